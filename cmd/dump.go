@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/leighmacdonald/mika/tracker"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// stateFile is the path the swarm state is dumped to or restored from
+var stateFile string
+
+// dumpCmd represents the dump command
+var dumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Dump the torrent and peer state to a file",
+	Long: `Dump the torrents and peers of the configured stores to a json file so they can be
+restored on another server with the restore command. Stop the tracker first for a fully
+consistent snapshot.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		tkr, err := tracker.New()
+		if err != nil {
+			log.Fatalf("Failed to initialize tracker: %s", err)
+		}
+		f, err := os.Create(stateFile)
+		if err != nil {
+			log.Fatalf("Failed to create state file: %s", err)
+		}
+		torrents, peers, err := tkr.DumpState(f)
+		if err != nil {
+			_ = f.Close()
+			log.Fatalf("Failed to dump state: %s", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Failed to write state file: %s", err)
+		}
+		log.Infof("Dumped %d torrents and %d peers to: %s", torrents, peers, stateFile)
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the torrent and peer state from a file",
+	Long: `Restore the torrents and peers written by the dump command into the configured stores.
+Peers which would already be reaped are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		tkr, err := tracker.New()
+		if err != nil {
+			log.Fatalf("Failed to initialize tracker: %s", err)
+		}
+		f, err := os.Open(stateFile)
+		if err != nil {
+			log.Fatalf("Failed to open state file: %s", err)
+		}
+		defer func() { _ = f.Close() }()
+		torrents, peers, skipped, err := tkr.RestoreState(f)
+		if err != nil {
+			log.Fatalf("Failed to restore state: %s", err)
+		}
+		log.Infof("Restored %d torrents and %d peers (%d stale peers skipped) from: %s",
+			torrents, peers, skipped, stateFile)
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{dumpCmd, restoreCmd} {
+		c.Flags().StringVarP(&stateFile, "file", "f", "mika_state.json", "Path of the state file")
+		rootCmd.AddCommand(c)
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"os"
 )
 
-var cfgFile string
+var (
+	cfgFile     string
+	checkConfig bool
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -31,6 +34,14 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(func() {
 		config.Read(cfgFile)
+		if checkConfig {
+			if err := config.Validate(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Configuration OK")
+			os.Exit(0)
+		}
 	})
 
 	// Here you will define your flags and configuration settings.
@@ -38,6 +49,8 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./mika.yaml)")
+	rootCmd.PersistentFlags().BoolVar(&checkConfig, "check-config", false,
+		"validate the config file and exit, exits non-zero when invalid")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
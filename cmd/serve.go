@@ -4,11 +4,15 @@ import (
 	"context"
 	"github.com/leighmacdonald/mika/config"
 	h "github.com/leighmacdonald/mika/http"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/tracker"
+	"github.com/leighmacdonald/mika/udp"
 	"github.com/leighmacdonald/mika/util"
+	"github.com/leighmacdonald/mika/ws"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"log"
 	"net/http"
 )
 
@@ -18,36 +22,169 @@ var serveCmd = &cobra.Command{
 	Short: "Start the tracker and serve requests",
 	Long:  `Start the tracker and serve requests`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := config.Validate(); err != nil {
+			log.Fatalf("%s", err)
+		}
 		ctx := context.Background()
+		// Used to stop the background workers on shutdown
+		workerCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		tkr, err := tracker.New()
 		if err != nil {
 			log.Fatalf("Failed to initialize tracker: %s", err)
 		}
+		go tkr.PeerReaper(workerCtx)
+		if tkr.ActivityInterval > 0 {
+			go tkr.ActivityFlusher(workerCtx)
+		}
+		if tkr.ProbePeers {
+			go tkr.PeerProber(workerCtx)
+		}
+		if tkr.MaxIPConcurrency > 0 {
+			go tkr.IPSlotCleaner(workerCtx)
+		}
+		var loader store.Loader
+		if lc := config.GetLoaderConfig(); lc.Type != "" {
+			loader, err = store.NewLoader(lc.Type, lc)
+			if err != nil {
+				log.Fatalf("Failed to initialize loader: %s", err)
+			}
+			go tkr.RegisteredLoader(workerCtx, loader, lc.Interval)
+			if writer, ok := loader.(store.StatWriter); ok && lc.StatFlushInterval > 0 {
+				go tkr.StatFlusher(workerCtx, writer, lc.StatFlushInterval)
+			}
+		}
+		tkr.StartHooks(workerCtx)
+		go util.ReloadOnSignal(workerCtx, tkr.ReloadWhitelist)
+		go util.ReloadOnSignal(workerCtx, tkr.ReloadBanList)
+		go util.ReloadOnSignal(workerCtx, tkr.ReopenAuditLog)
+		if tkr.HNRWebhook != nil {
+			go tkr.HNRWebhook.Start(workerCtx)
+		}
 		listenBT := viper.GetString(string(config.TrackerListen))
 		listenBTTLS := viper.GetBool(string(config.TrackerTLS))
 		btHandler := h.NewBitTorrentHandler(tkr)
 		btServer := h.CreateServer(btHandler, listenBT, listenBTTLS)
 
+		var btTLSServer *http.Server
+		listenBTHTTPS := viper.GetString(string(config.TrackerTLSListen))
+		if listenBTHTTPS != "" {
+			requireCert := viper.GetBool(string(config.TrackerTLSRequireClientCert))
+			btTLSHandler := btHandler
+			if requireCert {
+				btTLSHandler = h.NewBitTorrentCertHandler(tkr)
+			}
+			btTLSServer, err = h.CreateTLSServer(btTLSHandler, listenBTHTTPS, h.TLSOpts{
+				CertFile:          viper.GetString(string(config.TrackerTLSCert)),
+				KeyFile:           viper.GetString(string(config.TrackerTLSKey)),
+				ClientCAFile:      viper.GetString(string(config.TrackerTLSClientCA)),
+				RequireClientCert: requireCert,
+			})
+			if err != nil {
+				log.Fatalf("Failed to setup tls listener: %s", err)
+			}
+		}
+
 		listenAPI := viper.GetString(string(config.APIListen))
 		listenAPITLS := viper.GetBool(string(config.APITLS))
-		apiHandler := h.NewAPIHandler(tkr)
+		apiHandler := h.NewAPIHandler(tkr, viper.GetString(string(config.APIToken)))
 		apiServer := h.CreateServer(apiHandler, listenAPI, listenAPITLS)
 
+		var metricsServer *http.Server
+		if viper.GetBool(string(config.MetricsEnabled)) {
+			metricsServer = metrics.NewServer(viper.GetString(string(config.MetricsListen)))
+			go tkr.MetricsUpdater(workerCtx, viper.GetDuration(string(config.MetricsUpdateInterval)))
+			go func() {
+				if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("listen: %s\n", err)
+				}
+			}()
+		}
+		var udpServer *udp.Server
+		listenUDP := viper.GetString(string(config.TrackerUDPListen))
+		if listenUDP != "" {
+			udpServer = udp.NewServer(tkr, listenUDP)
+			go func() {
+				if err := udpServer.ListenAndServe(); err != nil && err != udp.ErrServerClosed {
+					log.Fatalf("listen: %s\n", err)
+				}
+			}()
+		}
+		var wsServer *ws.Server
+		listenWS := viper.GetString(string(config.TrackerWebSocketListen))
+		if listenWS != "" {
+			wsServer = ws.NewServer(tkr, listenWS)
+			go func() {
+				var err error
+				if viper.GetBool(string(config.TrackerWebSocketTLS)) {
+					err = wsServer.ListenAndServeTLS(viper.GetString(string(config.TrackerTLSCert)),
+						viper.GetString(string(config.TrackerTLSKey)))
+				} else {
+					err = wsServer.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
+					log.Fatalf("listen: %s\n", err)
+				}
+			}()
+		}
 		go func() {
 			if err := btServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("listen: %s\n", err)
 			}
 		}()
+		if btTLSServer != nil {
+			go func() {
+				if err := btTLSServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("listen: %s\n", err)
+				}
+			}()
+		}
 		go func() {
 			if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("listen: %s\n", err)
 			}
 		}()
 		util.WaitForSignal(ctx, func(ctx context.Context) error {
+			cancel()
+			if err := btServer.Shutdown(ctx); err != nil {
+				log.Fatalf("Error closing servers gracefully; %s", err)
+			}
 			if err := apiServer.Shutdown(ctx); err != nil {
 				log.Fatalf("Error closing servers gracefully; %s", err)
 			}
-			return nil
+			if btTLSServer != nil {
+				if err := btTLSServer.Shutdown(ctx); err != nil {
+					log.Fatalf("Error closing servers gracefully; %s", err)
+				}
+			}
+			if metricsServer != nil {
+				if err := metricsServer.Shutdown(ctx); err != nil {
+					log.Fatalf("Error closing servers gracefully; %s", err)
+				}
+			}
+			if udpServer != nil {
+				if err := udpServer.Shutdown(ctx); err != nil {
+					log.Fatalf("Error closing servers gracefully; %s", err)
+				}
+			}
+			if wsServer != nil {
+				if err := wsServer.Shutdown(ctx); err != nil {
+					log.Fatalf("Error closing servers gracefully; %s", err)
+				}
+			}
+			if loader != nil {
+				if writer, ok := loader.(store.StatWriter); ok {
+					if err := tkr.FlushStats(writer); err != nil {
+						log.Errorf("Failed to flush stats on shutdown: %s", err)
+					}
+				}
+				if err := loader.Close(); err != nil {
+					log.Errorf("Failed to close loader: %s", err)
+				}
+			}
+			// Servers are stopped first so no new announces arrive while waiting for the
+			// in-flight ones to finish
+			return tkr.Shutdown(ctx)
 		})
 	},
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/viper"
 	"net/url"
 	"os"
+	"time"
 )
 
 // StoreType is a mapping to the backing store types used
@@ -38,15 +39,57 @@ const (
 	// true|false
 	GeneralLogColour Key = "general_log_colour"
 
+	// GeneralLogFormat sets the output format of log messages. json is suitable for
+	// ingestion by log aggregators such as ELK
+	// text|json
+	GeneralLogFormat Key = "general_log_format"
+
+	// GeneralAuditLogPath is the file rejected announces and scrapes are written to as JSON
+	// lines, separate from the operational log. The file is reopened on SIGHUP so it can be
+	// rotated. Empty disables the audit log
+	// /var/log/mika/audit.log
+	GeneralAuditLogPath Key = "general_audit_log_path"
+
 	// TrackerPublic enables/disables auto registration of torrents and users
 	// true|false
 	TrackerPublic Key = "tracker_public"
+	// TrackerID is the "tracker id" returned in announce responses which clients echo back on
+	// their following announces. A random id is generated on startup when empty
+	// mika1
+	TrackerID Key = "tracker_id"
 	// TrackerListen sets the host and port to listen on
 	// hostname:port
 	TrackerListen Key = "tracker_listen"
+	// TrackerUDPListen sets the host and port for the UDP tracker to listen on. Leave empty
+	// to disable the UDP tracker
+	// hostname:port
+	TrackerUDPListen Key = "tracker_udp_listen"
+	// TrackerWebSocketListen sets the host and port for the WebTorrent websocket tracker to
+	// listen on. Leave empty to disable the websocket tracker
+	// hostname:port
+	TrackerWebSocketListen Key = "tracker_ws_listen"
+	// TrackerWebSocketTLS serves the websocket tracker over wss:// using the tracker_tls_cert
+	// and tracker_tls_key certificate
+	// true|false
+	TrackerWebSocketTLS Key = "tracker_ws_tls"
 	// TrackerTLS enables TLS for the tracker component
 	// true|false
 	TrackerTLS Key = "tracker_tls"
+	// TrackerTLSListen sets the host and port for a separate HTTPS tracker listener which can
+	// run alongside the plaintext one. Leave empty to disable it
+	// hostname:port
+	TrackerTLSListen Key = "tracker_tls_listen"
+	// TrackerTLSCert is the path to the PEM encoded certificate for the HTTPS listener
+	TrackerTLSCert Key = "tracker_tls_cert"
+	// TrackerTLSKey is the path to the PEM encoded private key for the HTTPS listener
+	TrackerTLSKey Key = "tracker_tls_key"
+	// TrackerTLSClientCA is the path to the PEM encoded CA bundle used to verify client certificates
+	TrackerTLSClientCA Key = "tracker_tls_client_ca"
+	// TrackerTLSRequireClientCert enables client certificate authentication on the HTTPS
+	// listener. The certificate CN or a DNS SAN must be the users numeric user id and the
+	// announce url becomes https://host:port/announce without a passkey
+	// true|false
+	TrackerTLSRequireClientCert Key = "tracker_tls_require_client_cert"
 	// TrackerIPv6 enables ipv6 peers
 	// true|false
 	TrackerIPv6 Key = "tracker_ipv6"
@@ -60,16 +103,329 @@ const (
 	// TrackerAnnounceIntervalMin is the minimum interval a client is allowed
 	// 60s|1m
 	TrackerAnnounceIntervalMin Key = "tracker_announce_interval_minimum"
+	// TrackerAnnounceIntervalJitter is the percentage of random jitter (+/-) applied to the
+	// interval returned to clients so announces are spread out over time. 0 disables jitter
+	// 10
+	TrackerAnnounceIntervalJitter Key = "tracker_announce_interval_jitter"
+	// TrackerEmptySwarmInterval is the announce interval returned to leechers which have no
+	// other peers to connect to, backing off until the swarm has someone to download from.
+	// 0 disables the backoff
+	// 0s|30m
+	TrackerEmptySwarmInterval Key = "tracker_empty_swarm_interval"
+	// TrackerSwarmIntervalSmall is the announce interval returned for swarms with at most
+	// TrackerSwarmSizeSmall peers. Intervals for swarms sized between the small and large sizes
+	// are interpolated. 0 disables scaling the interval by swarm size
+	// 0s|120s
+	TrackerSwarmIntervalSmall Key = "tracker_swarm_interval_small"
+	// TrackerSwarmIntervalLarge is the announce interval returned for swarms with at least
+	// TrackerSwarmSizeLarge peers
+	// 0s|900s
+	TrackerSwarmIntervalLarge Key = "tracker_swarm_interval_large"
+	// TrackerSwarmSizeSmall is the swarm size at or below which TrackerSwarmIntervalSmall is used
+	// 10
+	TrackerSwarmSizeSmall Key = "tracker_swarm_size_small"
+	// TrackerSwarmSizeLarge is the swarm size at or above which TrackerSwarmIntervalLarge is used
+	// 1000
+	TrackerSwarmSizeLarge Key = "tracker_swarm_size_large"
+	// TrackerRateLimitInterval is the minimum time required between regular announces from
+	// the same peer. 0 uses the minimum announce interval
+	// 0s|30s
+	TrackerRateLimitInterval Key = "tracker_rate_limit_interval"
+	// TrackerRateLimitGrace is subtracted from the rate limit interval so that clients
+	// announcing slightly early are not rejected
+	// 5s
+	TrackerRateLimitGrace Key = "tracker_rate_limit_grace"
+	// TrackerMinIntervalEnforce enables answering regular announces sent before the minimum
+	// announce interval without applying them
+	// true|false
+	TrackerMinIntervalEnforce Key = "tracker_min_interval_enforce"
+	// TrackerMinIntervalGrace is subtracted from the minimum announce interval when checking
+	// for early announces
+	// 5s
+	TrackerMinIntervalGrace Key = "tracker_min_interval_grace"
+	// TrackerMaxIPConcurrency is the maximum number of announces from a single ip which can be
+	// processed at the same time. 0 disables the limit
+	// 0|8
+	TrackerMaxIPConcurrency Key = "tracker_max_ip_concurrency"
+	// TrackerIPConcurrencyCleanup is how often the per ip counters of idle ips are removed
+	// 60s
+	TrackerIPConcurrencyCleanup Key = "tracker_ip_concurrency_cleanup"
+	// TrackerAnnounceDedupWindow is how long a announce is remembered so identical announces from
+	// the same peer are answered with the previous response instead of being processed again.
+	// 0 disables it
+	// 0s|2s
+	TrackerAnnounceDedupWindow Key = "tracker_announce_dedup_window"
+	// TrackerAnnounceDedupSize is the maximum number of announces remembered for deduplication
+	// 10000
+	TrackerAnnounceDedupSize Key = "tracker_announce_dedup_size"
+	// TrackerPeerCacheTTL is how long the encoded peer list of a large swarm is reused for
+	// announces to it before being rebuilt. 0 disables it
+	// 0s|5s
+	TrackerPeerCacheTTL Key = "tracker_peer_cache_ttl"
+	// TrackerPeerCacheMinPeers is the minimum number of peers in a swarm for its peer list to
+	// be cached
+	// 100
+	TrackerPeerCacheMinPeers Key = "tracker_peer_cache_min_peers"
+	// TrackerPeerCacheChurn is the fraction of a cached peer list which may join, leave or
+	// complete before the list is rebuilt ahead of its TTL
+	// 0.1
+	TrackerPeerCacheChurn Key = "tracker_peer_cache_churn"
+	// TrackerActivityInterval is how often the per torrent announce and scrape counts are written
+	// to the torrent store for ranking the most active torrents. 0 disables counting
+	// 0s|10s
+	TrackerActivityInterval Key = "tracker_activity_interval"
+	// TrackerActivityHalfLife is how long it takes the recent activity of a torrent to decay by half
+	// 1h
+	TrackerActivityHalfLife Key = "tracker_activity_half_life"
+	// TrackerPruneInactive is how long a torrent must go without announces before it is removed
+	// by the /torrents/prune admin endpoint when no period is given. 0 requires a period
+	// 720h
+	TrackerPruneInactive Key = "tracker_prune_inactive"
+	// TrackerProbePeers enables probing the reachability of announcing peers in the background
+	// so unreachable peers are returned last
+	// true|false
+	TrackerProbePeers Key = "tracker_probe_peers"
+	// TrackerProbeInterval is how long a probe result is kept before the peer is probed again
+	// 1h
+	TrackerProbeInterval Key = "tracker_probe_interval"
+	// TrackerProbeTimeout is how long to wait for a peer to accept the probe connection
+	// 3s
+	TrackerProbeTimeout Key = "tracker_probe_timeout"
+	// TrackerProbeRate is the maximum number of peers probed per second
+	// 10
+	TrackerProbeRate Key = "tracker_probe_rate"
+	// TrackerMaxBelievableSpeed is the highest upload speed in bytes/sec that is considered
+	// possible. Uploads reported faster than this are capped and a strike is recorded against
+	// the user. 0 disables the check
+	// 125000000
+	TrackerMaxBelievableSpeed Key = "tracker_max_believable_speed"
+	// TrackerResetThreshold is the number of times a peer may report lower transfer totals
+	// than its previous announce before it is flagged for review. 0 disables flagging
+	// 0|10
+	TrackerResetThreshold Key = "tracker_reset_threshold"
+	// TrackerPeerHistorySize is the number of recent announces retained per peer for review in
+	// the admin API. 0 disables the history
+	// 0|20
+	TrackerPeerHistorySize Key = "tracker_peer_history_size"
+	// TrackerLeftValidation sets how announces with a left value which is inconsistent with
+	// the torrent size are handled. warn only logs them, reject also fails the announce
+	// off|warn|reject
+	TrackerLeftValidation Key = "tracker_left_validation"
+	// TrackerLeftGrace is the percentage of the remaining data a leecher may be missing from
+	// its downloaded total when it reports having become a seeder
+	// 5
+	TrackerLeftGrace Key = "tracker_left_grace"
+	// TrackerCorruptMode sets how the corrupt bytes reported by clients are handled. track adds
+	// them to the users corrupt total and flags users exceeding TrackerCorruptRatio, penalize
+	// also refuses downloads to flagged users
+	// off|track|penalize
+	TrackerCorruptMode Key = "tracker_corrupt_mode"
+	// TrackerCorruptRatio is the fraction of a users downloads which may be reported corrupt
+	// before they are flagged
+	// 0.05
+	TrackerCorruptRatio Key = "tracker_corrupt_ratio"
+	// TrackerCorruptExclude subtracts the reported corrupt bytes from the downloads credited
+	// to users
+	// false
+	TrackerCorruptExclude Key = "tracker_corrupt_exclude"
+	// TrackerBonusRate is the number of bonus points credited to seeders per GB-hour seeded.
+	// 0 disables bonus points
+	// 1.0
+	TrackerBonusRate Key = "tracker_bonus_rate"
+	// TrackerBonusRequiresLeechers withholds bonus points from seeders of swarms without
+	// leechers, so seeding torrents nobody downloads can not be used to farm points
+	// false
+	TrackerBonusRequiresLeechers Key = "tracker_bonus_requires_leechers"
+	// TrackerRejectClientMsg is the failure reason sent to clients which are not whitelisted
+	// Client not allowed
+	TrackerRejectClientMsg Key = "tracker_reject_client_msg"
+	// TrackerUnregisteredMsg is the failure reason sent for announces to unknown or deleted torrents
+	// Unregistered torrent
+	TrackerUnregisteredMsg Key = "tracker_unregistered_msg"
+	// TrackerDeprecatedClients is a list of peer_id prefixes of clients which are still allowed
+	// but are sent a warning message asking the user to upgrade
+	// [-UT2210-, -qB3010-]
+	TrackerDeprecatedClients Key = "tracker_deprecated_clients"
+	// TrackerDeprecatedClientMsg is the warning message sent to deprecated clients
+	// Your client is outdated, please upgrade
+	TrackerDeprecatedClientMsg Key = "tracker_deprecated_client_msg"
+	// TrackerClientUserAgents maps peer_id prefixes to the regular expression the User-Agent header
+	// of the client must match. Each entry is the prefix and the pattern separated by a space
+	// ["-qB ^qBittorrent/", "-TR ^Transmission/"]
+	TrackerClientUserAgents Key = "tracker_client_user_agents"
+	// TrackerClientUserAgentStrict rejects announces with a User-Agent which does not match the
+	// pattern of their peer_id prefix instead of only logging and flagging them
+	// true|false
+	TrackerClientUserAgentStrict Key = "tracker_client_user_agent_strict"
+	// TrackerPortMin is the lowest port peers may announce, ports below 1024 are privileged
+	// and require root to bind to on unix
+	// 1024
+	TrackerPortMin Key = "tracker_port_min"
+	// TrackerPortMax is the highest port peers may announce
+	// 65535
+	TrackerPortMax Key = "tracker_port_max"
+	// TrackerShufflePeers randomizes the order of the peers returned to clients so that
+	// announces are spread across the whole swarm
+	// true|false
+	TrackerShufflePeers Key = "tracker_shuffle_peers"
+	// TrackerSeederBias is the proportion (0-1) of the peers returned to leechers which should
+	// be seeders when available. Seeders are handed leechers first. 0 disables the bias
+	// 0.5
+	TrackerSeederBias Key = "tracker_seeder_bias"
+	// TrackerCryptoMatching returns peers supporting protocol encryption first to peers which
+	// announce with requirecrypto=1
+	// true|false
+	TrackerCryptoMatching Key = "tracker_crypto_matching"
+	// TrackerSuperSeeding hands seeders announcing with superseed=1 a rotating subset of the
+	// leechers so each announce introduces them to different peers
+	// true|false
+	TrackerSuperSeeding Key = "tracker_super_seeding"
+	// TrackerSuperSeedingPeers is the max number of leechers handed to a super seeding peer per
+	// announce. 0 uses the numwant of the peer
+	// 5
+	TrackerSuperSeedingPeers Key = "tracker_super_seeding_peers"
+	// TrackerCryptoStrict only returns peers supporting protocol encryption to peers requiring
+	// it, even when there are not enough of them to fill the response
+	// true|false
+	TrackerCryptoStrict Key = "tracker_crypto_strict"
+	// TrackerHookWorkers is the number of workers delivering announces to registered hooks
+	// 4
+	TrackerHookWorkers Key = "tracker_hook_workers"
+	// TrackerUserCacheTTL is how long users looked up by passkey are cached, 0 disables the cache
+	// 30s
+	TrackerUserCacheTTL Key = "tracker_user_cache_ttl"
+	// TrackerHookQueueSize is the max number of announces queued for the hook workers
+	// before new ones are dropped
+	// 1000
+	TrackerHookQueueSize Key = "tracker_hook_queue_size"
 	// TrackerReapInterval defines how often we do a sweep of active swarms looking for stale
 	// peers that can be removed.
 	// 60s|1m
-	TrackerReapInterval Key = "tracker_reap_internal"
-	// TrackerHNRThreshold is how much time must pass before we mark a peer as Hit-N-Run
-	// 1d|12h|60m
+	TrackerReapInterval Key = "tracker_reap_interval"
+	// TrackerReapMultiplier is multiplied by the announce interval to determine how long a peer
+	// can go without announcing before it is considered stale and removed from the swarm
+	// 3
+	TrackerReapMultiplier Key = "tracker_reap_multiplier"
+	// TrackerHNRThreshold is how much time a peer which completed a torrent must participate in the
+	// swarm before leaving to not be marked as a Hit-N-Run
+	// 24h|12h|60m
 	TrackerHNRThreshold Key = "tracker_hnr_threshold"
 	// TrackerIndexInterval is the amount of time between updating the torrent stats
 	// 60s|1m
 	TrackerIndexInterval Key = "tracker_index_interval"
+	// TrackerMaxPeers is the maximum number of peers returned to a client in a announce
+	// 50
+	TrackerMaxPeers Key = "tracker_max_peers"
+	// TrackerMaxPeersPerTorrent caps the number of peers stored for a single swarm. When full
+	// the least recently announced peers are evicted, 0 disables the limit
+	// 0|10000
+	TrackerMaxPeersPerTorrent Key = "tracker_max_peers_per_torrent"
+	// TrackerMaxUserPeersPerTorrent caps the number of active peers a single user may have in a
+	// swarm. Announces from new peers over the limit are rejected, 0 disables the limit
+	// 0|3
+	TrackerMaxUserPeersPerTorrent Key = "tracker_max_user_peers_per_torrent"
+	// TrackerMaxLeechers caps the number of leechers in a swarm unless the torrent sets its own
+	// limit. New leechers over the limit are told to retry later, 0 disables the limit
+	// 0|500
+	TrackerMaxLeechers Key = "tracker_max_leechers"
+	// TrackerDownloadSlotsRetry is how long leechers rejected by the leecher limit are asked to
+	// wait before retrying
+	// 5m
+	TrackerDownloadSlotsRetry Key = "tracker_download_slots_retry"
+	// TrackerDefaultNumWant is the number of peers returned when the client does not
+	// specify a numwant value
+	// 30
+	TrackerDefaultNumWant Key = "tracker_default_numwant"
+	// TrackerFreeleech enables global freeleech, overriding the per-torrent setting. Downloads
+	// are not counted against users while enabled
+	// true|false
+	TrackerFreeleech Key = "tracker_freeleech"
+	// TrackerUploadMultiplier is a global multiplier applied to credited uploads. It stacks with
+	// the per-torrent upload multiplier
+	// 1.0|2.0
+	TrackerUploadMultiplier Key = "tracker_upload_multiplier"
+	// TrackerMaxUploadMultiplier caps the combined global and per-torrent upload multiplier
+	// 10.0
+	TrackerMaxUploadMultiplier Key = "tracker_max_upload_multiplier"
+	// TrackerTrustClientIP enables using the ip and ipv6 announce params supplied by the client
+	// instead of the address the request was received from
+	// true|false
+	TrackerTrustClientIP Key = "tracker_trust_client_ip"
+	// TrackerTrustedProxies is a list of CIDR ranges of reverse proxies which are trusted to supply
+	// client addresses via the X-Forwarded-For header. When set, client supplied ip params are also
+	// only used for requests originating from these ranges
+	// [127.0.0.1/32, 10.0.0.0/8]
+	TrackerTrustedProxies Key = "tracker_trusted_proxies"
+	// TrackerIPOverrideAllowlist is a list of CIDR ranges of clients, such as seedboxes, which may
+	// override their address with the ip and ipv6 announce params. When set, it replaces the
+	// tracker_trust_client_ip and tracker_trusted_proxies rules for the params.
+	// [203.0.113.0/24]
+	TrackerIPOverrideAllowlist Key = "tracker_ip_override_allowlist"
+	// TrackerIPOverrideReject rejects announces from clients outside of the override allowlist which
+	// try to override their address instead of silently using their real address
+	// true|false
+	TrackerIPOverrideReject Key = "tracker_ip_override_reject"
+	// TrackerAllowPrivateIP allows peers to use private and loopback addresses
+	// true|false
+	TrackerAllowPrivateIP Key = "tracker_allow_private_ip"
+	// TrackerBanList is a static list of IPs or CIDR ranges which are denied access to the tracker.
+	// These are merged with any bans loaded from the torrent store
+	// [10.0.0.0/8, 192.168.1.10]
+	TrackerBanList Key = "tracker_ban_list"
+	// TrackerAllowNonCompact allows clients sending compact=0 to receive the original non-compact
+	// peer list format. Compact responses are always used when disabled
+	// true|false
+	TrackerAllowNonCompact Key = "tracker_allow_non_compact"
+	// TrackerRequireCompact rejects announces from clients sending compact=0 with a failure
+	// response instead of ignoring the param. Takes precedence over TrackerAllowNonCompact
+	// true|false
+	TrackerRequireCompact Key = "tracker_require_compact"
+	// TrackerReturnExternalIP adds the non-standard "external ip" key to announce responses
+	// containing the address the tracker sees the client as
+	// true|false
+	TrackerReturnExternalIP Key = "tracker_return_external_ip"
+	// TrackerExternalIPString returns the external ip as a readable string instead of the
+	// compact 4 or 16 byte form
+	// true|false
+	TrackerExternalIPString Key = "tracker_external_ip_string"
+	// TrackerRequirePeerKey rejects announces where the key param does not match the key
+	// previously sent by the peer
+	// true|false
+	TrackerRequirePeerKey Key = "tracker_require_peer_key"
+	// TrackerMinRatio is the minimum global ratio a user must maintain to be able to
+	// announce as a leecher. 0 disables ratio enforcement
+	// 0.0|0.5
+	TrackerMinRatio Key = "tracker_min_ratio"
+	// TrackerMinRatioGrace is the amount of bytes a user can download before the minimum
+	// ratio is enforced
+	// 5368709120
+	TrackerMinRatioGrace Key = "tracker_min_ratio_grace"
+	// TrackerPublicAutoRegister registers unknown torrents as public torrents on their first
+	// announce instead of rejecting them
+	// true|false
+	TrackerPublicAutoRegister Key = "tracker_public_auto_register"
+	// TrackerScrapeAllowFull enables returning stats for all known torrents when a scrape
+	// request does not include any info_hash values.
+	// true|false
+	TrackerScrapeAllowFull Key = "tracker_scrape_allow_full"
+	// TrackerScrapeFullLimit caps the number of torrents returned for a full scrape
+	// 1000
+	TrackerScrapeFullLimit Key = "tracker_scrape_full_limit"
+	// TrackerMaxURILength is the longest request URI accepted for announces and scrapes. Longer
+	// requests are rejected before the query is parsed. 0 disables the limit
+	// 4096
+	TrackerMaxURILength Key = "tracker_max_uri_length"
+	// TrackerScrapeMaxHashes is the maximum number of info_hash values accepted in a single scrape request
+	// 64
+	TrackerScrapeMaxHashes Key = "tracker_scrape_max_hashes"
+	// TrackerScrapeTruncate will truncate the scrape request to TrackerScrapeMaxHashes instead of
+	// rejecting the request when too many info_hash values are supplied
+	// true|false
+	TrackerScrapeTruncate Key = "tracker_scrape_truncate"
+	// TrackerScrapeIncludeName adds the optional name key, the release name of the torrent, to
+	// each scrape entry
+	// true|false
+	TrackerScrapeIncludeName Key = "tracker_scrape_include_name"
 
 	// APIListen sets the host and port that the admin API should bind to
 	// localhost:34001
@@ -83,6 +439,34 @@ const (
 	// APIIPv6Only disabled ipv4 to the admin interface
 	// true|false
 	APIIPv6Only Key = "api_ipv6_only"
+	// APIToken is the shared secret which must be sent as a bearer token in the Authorization
+	// header of all admin API requests. Leaving this empty disables authentication
+	// abcdef1234567890
+	APIToken Key = "api_token"
+
+	// MetricsEnabled enables the prometheus /metrics endpoint
+	// true|false
+	MetricsEnabled Key = "metrics_enabled"
+	// MetricsListen sets the host and port that the metrics endpoint should bind to
+	// localhost:34002
+	MetricsListen Key = "metrics_listen"
+	// MetricsUpdateInterval is how often the swarm seeder/leecher gauges are recalculated
+	// 60s|1m
+	MetricsUpdateInterval Key = "metrics_update_interval"
+
+	// WebhookHNRURL is the url HNR events are POSTed to as JSON. Leave empty to disable
+	// https://example.com/hnr
+	WebhookHNRURL Key = "webhook_hnr_url"
+	// WebhookSecret is the shared secret used to sign the webhook body with HMAC-SHA256
+	// the signature is sent in the X-Mika-Signature header
+	WebhookSecret Key = "webhook_secret"
+	// WebhookRetries is the number of times a failed delivery is retried before being dropped
+	// 3
+	WebhookRetries Key = "webhook_retries"
+	// WebhookQueueSize is the number of pending webhook payloads buffered before new payloads
+	// are dropped
+	// 1000
+	WebhookQueueSize Key = "webhook_queue_size"
 
 	// StoreTorrentType sets the backing store type to be used for torrents
 	// memory|redis|postgres|mysql|http
@@ -105,6 +489,28 @@ const (
 	StoreTorrentPassword Key = "store_torrent_password"
 	// StoreTorrentProperties sets additional properties passed to the backing store configuration
 	StoreTorrentProperties Key = "store_torrent_properties"
+	// StoreTorrentMaxIdle is the number of idle connections kept open to the redis server
+	// 10
+	StoreTorrentMaxIdle Key = "store_torrent_max_idle"
+	// StoreTorrentMaxActive is the maximum number of connections open to the redis server
+	// 100
+	StoreTorrentMaxActive Key = "store_torrent_max_active"
+	// StoreTorrentIdleTimeout closes idle connections after this long
+	// 5m
+	StoreTorrentIdleTimeout Key = "store_torrent_idle_timeout"
+	// StoreTorrentDialTimeout is the timeout for establishing a new connection
+	// 5s
+	StoreTorrentDialTimeout Key = "store_torrent_dial_timeout"
+	// StoreTorrentReadTimeout is the timeout for reading a reply from the server
+	// 3s
+	StoreTorrentReadTimeout Key = "store_torrent_read_timeout"
+	// StoreTorrentWriteTimeout is the timeout for writing a command to the server
+	// 3s
+	StoreTorrentWriteTimeout Key = "store_torrent_write_timeout"
+	// StoreTorrentPoolWait is how long to wait for a free connection when every connection is
+	// in use before failing the request
+	// 4s
+	StoreTorrentPoolWait Key = "store_torrent_pool_wait"
 
 	// StoreUsersType sets the backing store type to be used for users
 	// memory|redis|postgres|mysql|http
@@ -127,6 +533,28 @@ const (
 	StoreUsersPassword Key = "store_users_password"
 	// StoreUsersProperties sets additional properties passed to the backing store configuration
 	StoreUsersProperties Key = "store_users_properties"
+	// StoreUsersMaxIdle is the number of idle connections kept open to the redis server
+	// 10
+	StoreUsersMaxIdle Key = "store_users_max_idle"
+	// StoreUsersMaxActive is the maximum number of connections open to the redis server
+	// 100
+	StoreUsersMaxActive Key = "store_users_max_active"
+	// StoreUsersIdleTimeout closes idle connections after this long
+	// 5m
+	StoreUsersIdleTimeout Key = "store_users_idle_timeout"
+	// StoreUsersDialTimeout is the timeout for establishing a new connection
+	// 5s
+	StoreUsersDialTimeout Key = "store_users_dial_timeout"
+	// StoreUsersReadTimeout is the timeout for reading a reply from the server
+	// 3s
+	StoreUsersReadTimeout Key = "store_users_read_timeout"
+	// StoreUsersWriteTimeout is the timeout for writing a command to the server
+	// 3s
+	StoreUsersWriteTimeout Key = "store_users_write_timeout"
+	// StoreUsersPoolWait is how long to wait for a free connection when every connection is
+	// in use before failing the request
+	// 4s
+	StoreUsersPoolWait Key = "store_users_pool_wait"
 
 	// StorePeersType sets the backing store type to be used for peers
 	// memory|redis|postgres|mysql|http
@@ -149,6 +577,40 @@ const (
 	StorePeersPassword Key = "store_peers_password"
 	// StorePeersProperties sets additional store specific properties passed to the backing store configuration
 	StorePeersProperties Key = "store_peers_properties"
+	// StorePeersSyncInterval batches peer updates and writes them to redis using a single
+	// pipeline on this interval. 0 writes every update immediately
+	// 0s|1s
+	StorePeersSyncInterval Key = "store_peers_sync_interval"
+	// StorePeersSyncBatchSize flushes the batched peer updates before the interval elapses
+	// once this many peers are queued. 0 only flushes on the interval
+	// 1000
+	StorePeersSyncBatchSize Key = "store_peers_sync_batch_size"
+	// StorePeersTTLMultiplier sets an expiry on the stored redis peers of this many times the
+	// longest announce interval, refreshed on every announce. 0 disables expiry
+	// 0|3
+	StorePeersTTLMultiplier Key = "store_peers_ttl_multiplier"
+	// StorePeersMaxIdle is the number of idle connections kept open to the redis server
+	// 10
+	StorePeersMaxIdle Key = "store_peers_max_idle"
+	// StorePeersMaxActive is the maximum number of connections open to the redis server
+	// 100
+	StorePeersMaxActive Key = "store_peers_max_active"
+	// StorePeersIdleTimeout closes idle connections after this long
+	// 5m
+	StorePeersIdleTimeout Key = "store_peers_idle_timeout"
+	// StorePeersDialTimeout is the timeout for establishing a new connection
+	// 5s
+	StorePeersDialTimeout Key = "store_peers_dial_timeout"
+	// StorePeersReadTimeout is the timeout for reading a reply from the server
+	// 3s
+	StorePeersReadTimeout Key = "store_peers_read_timeout"
+	// StorePeersWriteTimeout is the timeout for writing a command to the server
+	// 3s
+	StorePeersWriteTimeout Key = "store_peers_write_timeout"
+	// StorePeersPoolWait is how long to wait for a free connection when every connection is
+	// in use before failing the request
+	// 4s
+	StorePeersPoolWait Key = "store_peers_pool_wait"
 
 	// GeodbPath sets the path to use for downloading and loading the geo database. Relative to the binary's path.
 	// ./path/to/file.mmdb
@@ -159,8 +621,111 @@ const (
 	// GeodbEnabled toggles use of the geo database
 	// true|false
 	GeodbEnabled Key = "geodb_enabled"
+	// GeodbStatsEnabled enables the per-torrent peer country breakdown exposed by the admin API
+	// true|false
+	GeodbStatsEnabled Key = "geodb_stats_enabled"
+	// GeodbStatsTTL is how long a per-torrent country breakdown is cached before being recalculated
+	// 60s
+	GeodbStatsTTL Key = "geodb_stats_ttl"
+	// GeodbASNPath sets the path of the GeoLite2 ASN database used to identify datacenter peers.
+	// Leaving this empty disables ASN lookups.
+	// ./path/to/asn.mmdb
+	GeodbASNPath Key = "geodb_asn_path"
+	// GeodbASNCacheTTL is how long the ASN of an ip is cached before being looked up again
+	// 1h
+	GeodbASNCacheTTL Key = "geodb_asn_cache_ttl"
+	// GeodbASNBlockList is the list of datacenter/hosting ASNs which are denied from announcing
+	// to torrents which have block_datacenter enabled
+	// [16509, 14061, 24940]
+	GeodbASNBlockList Key = "geodb_asn_block_list"
+
+	// LoaderType is the driver used to load the registered torrents and users from an external
+	// source of truth into the stores. Empty disables loading.
+	// mysql
+	LoaderType Key = "loader_type"
+	// LoaderDSN is the connection string of the loaders database
+	// user:password@tcp(localhost:3306)/site
+	LoaderDSN Key = "loader_dsn"
+	// LoaderInterval is how often the registered torrents and users are reloaded
+	// 5m
+	LoaderInterval Key = "loader_interval"
+	// LoaderTorrentTable is the table containing the registered torrents
+	// torrents
+	LoaderTorrentTable Key = "loader_torrent_table"
+	// LoaderTorrentInfoHash is the column of the torrents raw 20 byte or 40 character hex info hash
+	// info_hash
+	LoaderTorrentInfoHash Key = "loader_torrent_info_hash"
+	// LoaderTorrentSize is the column of the torrents size in bytes
+	// size
+	LoaderTorrentSize Key = "loader_torrent_size"
+	// LoaderTorrentFreeleech is the column of the torrents freeleech flag
+	// freeleech
+	LoaderTorrentFreeleech Key = "loader_torrent_freeleech"
+	// LoaderUserTable is the table containing the registered users
+	// users
+	LoaderUserTable Key = "loader_user_table"
+	// LoaderUserID is the column of the users numeric id
+	// user_id
+	LoaderUserID Key = "loader_user_id"
+	// LoaderUserPasskey is the column of the users passkey
+	// passkey
+	LoaderUserPasskey Key = "loader_user_passkey"
+	// LoaderStatFlushInterval is how often the user transfer and torrent snatch deltas accumulated
+	// by the stores are written back to the loaders database. 0 disables flushing.
+	// 1m
+	LoaderStatFlushInterval Key = "loader_stat_flush_interval"
+	// LoaderUserUploaded is the column of the users total uploaded bytes
+	// uploaded
+	LoaderUserUploaded Key = "loader_user_uploaded"
+	// LoaderUserDownloaded is the column of the users total downloaded bytes
+	// downloaded
+	LoaderUserDownloaded Key = "loader_user_downloaded"
+	// LoaderTorrentSnatched is the column of the torrents snatch count
+	// snatched
+	LoaderTorrentSnatched Key = "loader_torrent_snatched"
 )
 
+// LoaderConfig defines where and how to load registered torrents and users from
+type LoaderConfig struct {
+	Type     string
+	DSN      string
+	Interval time.Duration
+	// Table and column names of the source tables
+	TorrentTable     string
+	TorrentInfoHash  string
+	TorrentSize      string
+	TorrentFreeleech string
+	UserTable        string
+	UserID           string
+	UserPasskey      string
+	// Stat flushing options
+	StatFlushInterval time.Duration
+	UserUploaded      string
+	UserDownloaded    string
+	TorrentSnatched   string
+}
+
+// GetLoaderConfig returns the config options of the registered entity loader
+func GetLoaderConfig() *LoaderConfig {
+	return &LoaderConfig{
+		Type:             viper.GetString(string(LoaderType)),
+		DSN:              viper.GetString(string(LoaderDSN)),
+		Interval:         viper.GetDuration(string(LoaderInterval)),
+		TorrentTable:     viper.GetString(string(LoaderTorrentTable)),
+		TorrentInfoHash:  viper.GetString(string(LoaderTorrentInfoHash)),
+		TorrentSize:      viper.GetString(string(LoaderTorrentSize)),
+		TorrentFreeleech: viper.GetString(string(LoaderTorrentFreeleech)),
+		UserTable:        viper.GetString(string(LoaderUserTable)),
+		UserID:           viper.GetString(string(LoaderUserID)),
+		UserPasskey:      viper.GetString(string(LoaderUserPasskey)),
+
+		StatFlushInterval: viper.GetDuration(string(LoaderStatFlushInterval)),
+		UserUploaded:      viper.GetString(string(LoaderUserUploaded)),
+		UserDownloaded:    viper.GetString(string(LoaderUserDownloaded)),
+		TorrentSnatched:   viper.GetString(string(LoaderTorrentSnatched)),
+	}
+}
+
 // StoreConfig provides a common config struct for backing stores
 type StoreConfig struct {
 	Type       string
@@ -170,6 +735,20 @@ type StoreConfig struct {
 	Password   string
 	Database   string
 	Properties string
+	// SyncInterval batches peer updates and writes them on this interval, 0 writes immediately
+	SyncInterval time.Duration
+	// SyncBatchSize flushes the batched updates early once this many peers are queued
+	SyncBatchSize int
+	// PeerTTL expires stored peers which have not been updated for this long, 0 disables it
+	PeerTTL time.Duration
+	// Connection pool settings, only used by the redis stores
+	MaxIdle      int
+	MaxActive    int
+	IdleTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolWait     time.Duration
 }
 
 // DSN constructs a URI for database connection strings
@@ -202,6 +781,14 @@ func GetStoreConfig(storeType StoreType) *StoreConfig {
 			Password:   viper.GetString(string(StoreUsersPassword)),
 			Database:   viper.GetString(string(StoreUsersDatabase)),
 			Properties: viper.GetString(string(StoreUsersProperties)),
+			// Only used by the redis stores
+			MaxIdle:      viper.GetInt(string(StoreUsersMaxIdle)),
+			MaxActive:    viper.GetInt(string(StoreUsersMaxActive)),
+			IdleTimeout:  viper.GetDuration(string(StoreUsersIdleTimeout)),
+			DialTimeout:  viper.GetDuration(string(StoreUsersDialTimeout)),
+			ReadTimeout:  viper.GetDuration(string(StoreUsersReadTimeout)),
+			WriteTimeout: viper.GetDuration(string(StoreUsersWriteTimeout)),
+			PoolWait:     viper.GetDuration(string(StoreUsersPoolWait)),
 		}
 	case Torrent:
 		return &StoreConfig{
@@ -212,6 +799,14 @@ func GetStoreConfig(storeType StoreType) *StoreConfig {
 			Password:   viper.GetString(string(StoreTorrentPassword)),
 			Database:   viper.GetString(string(StoreTorrentDatabase)),
 			Properties: viper.GetString(string(StoreTorrentProperties)),
+			// Only used by the redis stores
+			MaxIdle:      viper.GetInt(string(StoreTorrentMaxIdle)),
+			MaxActive:    viper.GetInt(string(StoreTorrentMaxActive)),
+			IdleTimeout:  viper.GetDuration(string(StoreTorrentIdleTimeout)),
+			DialTimeout:  viper.GetDuration(string(StoreTorrentDialTimeout)),
+			ReadTimeout:  viper.GetDuration(string(StoreTorrentReadTimeout)),
+			WriteTimeout: viper.GetDuration(string(StoreTorrentWriteTimeout)),
+			PoolWait:     viper.GetDuration(string(StoreTorrentPoolWait)),
 		}
 	case Peers:
 		return &StoreConfig{
@@ -222,11 +817,42 @@ func GetStoreConfig(storeType StoreType) *StoreConfig {
 			Password:   viper.GetString(string(StorePeersPassword)),
 			Database:   viper.GetString(string(StorePeersDatabase)),
 			Properties: viper.GetString(string(StorePeersProperties)),
+			// Only used by the redis stores
+			MaxIdle:      viper.GetInt(string(StorePeersMaxIdle)),
+			MaxActive:    viper.GetInt(string(StorePeersMaxActive)),
+			IdleTimeout:  viper.GetDuration(string(StorePeersIdleTimeout)),
+			DialTimeout:  viper.GetDuration(string(StorePeersDialTimeout)),
+			ReadTimeout:  viper.GetDuration(string(StorePeersReadTimeout)),
+			WriteTimeout: viper.GetDuration(string(StorePeersWriteTimeout)),
+			PoolWait:     viper.GetDuration(string(StorePeersPoolWait)),
+			// Only used by the redis peer store
+			SyncInterval:  viper.GetDuration(string(StorePeersSyncInterval)),
+			SyncBatchSize: viper.GetInt(string(StorePeersSyncBatchSize)),
+			PeerTTL:       peerTTL(),
 		}
 	}
 	return nil
 }
 
+// peerTTL returns the expiry of stored peers. It is based on the longest announce interval
+// which can be handed out including the jitter, so peers announcing on time never expire.
+func peerTTL() time.Duration {
+	multiplier := viper.GetInt(string(StorePeersTTLMultiplier))
+	if multiplier <= 0 {
+		return 0
+	}
+	interval := viper.GetDuration(string(TrackerAnnounceInterval))
+	for _, k := range []Key{TrackerSwarmIntervalSmall, TrackerSwarmIntervalLarge, TrackerEmptySwarmInterval} {
+		if d := viper.GetDuration(string(k)); d > interval {
+			interval = d
+		}
+	}
+	if jitter := viper.GetInt(string(TrackerAnnounceIntervalJitter)); jitter > 0 {
+		interval += interval * time.Duration(jitter) / 100
+	}
+	return interval * time.Duration(multiplier)
+}
+
 // Read reads in config file and ENV variables if set.
 func Read(cfgFile string) {
 	if cfgFile != "" {
@@ -249,6 +875,7 @@ func Read(cfgFile string) {
 		viper.SetConfigName("mika")
 	}
 
+	setDefaults()
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
@@ -256,17 +883,127 @@ func Read(cfgFile string) {
 		log.Debugf("Using config file: %s", viper.ConfigFileUsed())
 		level := viper.GetString(string(GeneralLogLevel))
 		colour := viper.GetBool(string(GeneralLogColour))
-		setupLogger(level, colour)
+		format := viper.GetString(string(GeneralLogFormat))
+		setupLogger(level, colour, format)
 
 		gin.SetMode(viper.GetString(string(GeneralRunMode)))
 	}
 }
 
-func setupLogger(levelStr string, colour bool) {
-	log.SetFormatter(&log.TextFormatter{
-		ForceColors:      colour,
-		DisableTimestamp: true,
-	})
+// setDefaults sets the default values for keys which must have a sane value even when
+// they are not defined in the config file
+func setDefaults() {
+	viper.SetDefault(string(GeneralLogFormat), "text")
+	viper.SetDefault(string(GeneralAuditLogPath), "")
+	viper.SetDefault(string(TrackerScrapeFullLimit), 1000)
+	viper.SetDefault(string(TrackerScrapeMaxHashes), 64)
+	viper.SetDefault(string(TrackerScrapeIncludeName), false)
+	viper.SetDefault(string(TrackerMaxURILength), 4096)
+	viper.SetDefault(string(TrackerMaxPeers), 50)
+	viper.SetDefault(string(TrackerMaxLeechers), 0)
+	viper.SetDefault(string(TrackerDownloadSlotsRetry), "5m")
+	viper.SetDefault(string(TrackerUploadMultiplier), 1.0)
+	viper.SetDefault(string(TrackerSeederBias), 0.0)
+	viper.SetDefault(string(TrackerCryptoMatching), false)
+	viper.SetDefault(string(TrackerSuperSeeding), false)
+	viper.SetDefault(string(TrackerSuperSeedingPeers), 5)
+	viper.SetDefault(string(TrackerCryptoStrict), false)
+	viper.SetDefault(string(TrackerMaxUploadMultiplier), 10.0)
+	viper.SetDefault(string(TrackerLeftValidation), "off")
+	viper.SetDefault(string(TrackerLeftGrace), 5)
+	viper.SetDefault(string(TrackerCorruptMode), "off")
+	viper.SetDefault(string(TrackerCorruptRatio), 0.05)
+	viper.SetDefault(string(TrackerCorruptExclude), false)
+	viper.SetDefault(string(TrackerBonusRequiresLeechers), false)
+	viper.SetDefault(string(TrackerDefaultNumWant), 30)
+	viper.SetDefault(string(TrackerReapInterval), "60s")
+	viper.SetDefault(string(TrackerRateLimitInterval), "0s")
+	viper.SetDefault(string(TrackerEmptySwarmInterval), "0s")
+	viper.SetDefault(string(TrackerSwarmIntervalSmall), "0s")
+	viper.SetDefault(string(TrackerSwarmIntervalLarge), "0s")
+	viper.SetDefault(string(TrackerSwarmSizeSmall), 10)
+	viper.SetDefault(string(TrackerSwarmSizeLarge), 1000)
+	viper.SetDefault(string(TrackerRateLimitGrace), "5s")
+	viper.SetDefault(string(TrackerMinIntervalEnforce), false)
+	viper.SetDefault(string(TrackerMinIntervalGrace), "5s")
+	viper.SetDefault(string(TrackerIPConcurrencyCleanup), "60s")
+	viper.SetDefault(string(TrackerAnnounceDedupWindow), "0s")
+	viper.SetDefault(string(TrackerAnnounceDedupSize), 10000)
+	viper.SetDefault(string(TrackerPeerCacheTTL), "0s")
+	viper.SetDefault(string(TrackerPeerCacheMinPeers), 100)
+	viper.SetDefault(string(TrackerPeerCacheChurn), 0.1)
+	viper.SetDefault(string(TrackerActivityInterval), "0s")
+	viper.SetDefault(string(TrackerActivityHalfLife), "1h")
+	viper.SetDefault(string(TrackerPruneInactive), "720h")
+	viper.SetDefault(string(TrackerProbePeers), false)
+	viper.SetDefault(string(TrackerProbeInterval), "1h")
+	viper.SetDefault(string(TrackerProbeTimeout), "3s")
+	viper.SetDefault(string(TrackerProbeRate), 10)
+	viper.SetDefault(string(TrackerRejectClientMsg), "Client not allowed")
+	viper.SetDefault(string(TrackerUnregisteredMsg), "Unregistered torrent")
+	viper.SetDefault(string(TrackerDeprecatedClientMsg), "Your client is outdated, please upgrade")
+	viper.SetDefault(string(TrackerPortMin), 1024)
+	viper.SetDefault(string(TrackerPortMax), 65535)
+	viper.SetDefault(string(TrackerHookWorkers), 4)
+	viper.SetDefault(string(TrackerHookQueueSize), 1000)
+	viper.SetDefault(string(TrackerUserCacheTTL), "30s")
+	viper.SetDefault(string(TrackerReapMultiplier), 3)
+	viper.SetDefault(string(TrackerMinRatioGrace), 5368709120)
+	viper.SetDefault(string(TrackerHNRThreshold), "24h")
+	viper.SetDefault(string(WebhookRetries), 3)
+	viper.SetDefault(string(WebhookQueueSize), 1000)
+	viper.SetDefault(string(MetricsListen), "localhost:34002")
+	viper.SetDefault(string(GeodbStatsTTL), "60s")
+	viper.SetDefault(string(GeodbASNCacheTTL), "1h")
+	viper.SetDefault(string(LoaderInterval), "5m")
+	viper.SetDefault(string(LoaderTorrentTable), "torrents")
+	viper.SetDefault(string(LoaderTorrentInfoHash), "info_hash")
+	viper.SetDefault(string(LoaderTorrentSize), "size")
+	viper.SetDefault(string(LoaderTorrentFreeleech), "freeleech")
+	viper.SetDefault(string(LoaderUserTable), "users")
+	viper.SetDefault(string(LoaderUserID), "user_id")
+	viper.SetDefault(string(LoaderUserPasskey), "passkey")
+	viper.SetDefault(string(LoaderStatFlushInterval), "1m")
+	viper.SetDefault(string(LoaderUserUploaded), "uploaded")
+	viper.SetDefault(string(LoaderUserDownloaded), "downloaded")
+	viper.SetDefault(string(LoaderTorrentSnatched), "snatched")
+	viper.SetDefault(string(MetricsUpdateInterval), "60s")
+	viper.SetDefault(string(StoreTorrentMaxIdle), 10)
+	viper.SetDefault(string(StoreTorrentMaxActive), 100)
+	viper.SetDefault(string(StoreTorrentIdleTimeout), "5m")
+	viper.SetDefault(string(StoreTorrentDialTimeout), "5s")
+	viper.SetDefault(string(StoreTorrentReadTimeout), "3s")
+	viper.SetDefault(string(StoreTorrentWriteTimeout), "3s")
+	viper.SetDefault(string(StoreTorrentPoolWait), "4s")
+	viper.SetDefault(string(StoreUsersMaxIdle), 10)
+	viper.SetDefault(string(StoreUsersMaxActive), 100)
+	viper.SetDefault(string(StoreUsersIdleTimeout), "5m")
+	viper.SetDefault(string(StoreUsersDialTimeout), "5s")
+	viper.SetDefault(string(StoreUsersReadTimeout), "3s")
+	viper.SetDefault(string(StoreUsersWriteTimeout), "3s")
+	viper.SetDefault(string(StoreUsersPoolWait), "4s")
+	viper.SetDefault(string(StorePeersMaxIdle), 10)
+	viper.SetDefault(string(StorePeersMaxActive), 100)
+	viper.SetDefault(string(StorePeersIdleTimeout), "5m")
+	viper.SetDefault(string(StorePeersDialTimeout), "5s")
+	viper.SetDefault(string(StorePeersReadTimeout), "3s")
+	viper.SetDefault(string(StorePeersWriteTimeout), "3s")
+	viper.SetDefault(string(StorePeersPoolWait), "4s")
+	viper.SetDefault(string(StorePeersTTLMultiplier), 0)
+}
+
+func setupLogger(levelStr string, colour bool, format string) {
+	switch format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text", "":
+		log.SetFormatter(&log.TextFormatter{
+			ForceColors:      colour,
+			DisableTimestamp: true,
+		})
+	default:
+		log.Panicln("Invalid log format defined")
+	}
 	log.SetOutput(os.Stdout)
 	level, err := log.ParseLevel(levelStr)
 	if err != nil {
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxUploadMultiplier is the upper bound accepted for the upload multiplier settings
+const maxUploadMultiplier = 100.0
+
+// Validate checks the loaded configuration for values which would make the tracker misbehave,
+// such as out of order intervals or multipliers outside of sane bounds, so the rest of the code
+// can assume valid inputs. All problems found are returned together in a single error.
+func Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	annInterval := viper.GetDuration(string(TrackerAnnounceInterval))
+	annIntervalMin := viper.GetDuration(string(TrackerAnnounceIntervalMin))
+	if annInterval <= 0 {
+		fail("%s must be greater than 0", TrackerAnnounceInterval)
+	}
+	if annIntervalMin < 0 || annIntervalMin > annInterval {
+		fail("%s must be between 0 and %s", TrackerAnnounceIntervalMin, TrackerAnnounceInterval)
+	}
+	if jitter := viper.GetInt(string(TrackerAnnounceIntervalJitter)); jitter < 0 || jitter > 100 {
+		fail("%s must be a percentage between 0 and 100", TrackerAnnounceIntervalJitter)
+	}
+	swarmSmall := viper.GetDuration(string(TrackerSwarmIntervalSmall))
+	swarmLarge := viper.GetDuration(string(TrackerSwarmIntervalLarge))
+	if swarmSmall < 0 || swarmLarge < 0 {
+		fail("%s and %s must not be negative", TrackerSwarmIntervalSmall, TrackerSwarmIntervalLarge)
+	}
+	if swarmSmall > 0 && swarmLarge > 0 &&
+		viper.GetInt(string(TrackerSwarmSizeSmall)) >= viper.GetInt(string(TrackerSwarmSizeLarge)) {
+		fail("%s must be less than %s", TrackerSwarmSizeSmall, TrackerSwarmSizeLarge)
+	}
+	if viper.GetDuration(string(TrackerActivityInterval)) < 0 {
+		fail("%s must not be negative", TrackerActivityInterval)
+	}
+	if viper.GetDuration(string(TrackerActivityHalfLife)) <= 0 {
+		fail("%s must be greater than 0", TrackerActivityHalfLife)
+	}
+	if viper.GetDuration(string(TrackerPruneInactive)) < 0 {
+		fail("%s must not be negative", TrackerPruneInactive)
+	}
+	if viper.GetDuration(string(TrackerPeerCacheTTL)) < 0 {
+		fail("%s must not be negative", TrackerPeerCacheTTL)
+	}
+	if viper.GetInt(string(TrackerPeerCacheMinPeers)) < 0 {
+		fail("%s must not be negative", TrackerPeerCacheMinPeers)
+	}
+	if viper.GetFloat64(string(TrackerPeerCacheChurn)) < 0 {
+		fail("%s must not be negative", TrackerPeerCacheChurn)
+	}
+	if viper.GetDuration(string(TrackerProbeInterval)) <= 0 {
+		fail("%s must be greater than 0", TrackerProbeInterval)
+	}
+	if viper.GetDuration(string(TrackerProbeTimeout)) <= 0 {
+		fail("%s must be greater than 0", TrackerProbeTimeout)
+	}
+	if viper.GetInt(string(TrackerProbeRate)) <= 0 {
+		fail("%s must be greater than 0", TrackerProbeRate)
+	}
+	if viper.GetDuration(string(TrackerReapInterval)) <= 0 {
+		fail("%s must be greater than 0", TrackerReapInterval)
+	}
+	if viper.GetInt(string(TrackerMaxURILength)) < 0 {
+		fail("%s must not be negative", TrackerMaxURILength)
+	}
+	if viper.GetInt(string(TrackerMaxLeechers)) < 0 {
+		fail("%s must not be negative", TrackerMaxLeechers)
+	}
+	if viper.GetDuration(string(TrackerDownloadSlotsRetry)) <= 0 {
+		fail("%s must be greater than 0", TrackerDownloadSlotsRetry)
+	}
+	if m := viper.GetInt(string(StorePeersTTLMultiplier)); m < 0 || m == 1 {
+		// A single late announce must never expire the peer
+		fail("%s must be 0 or at least 2", StorePeersTTLMultiplier)
+	}
+	if viper.GetInt(string(TrackerReapMultiplier)) < 1 {
+		fail("%s must be at least 1", TrackerReapMultiplier)
+	}
+	if viper.GetDuration(string(TrackerHNRThreshold)) <= 0 {
+		fail("%s must be greater than 0", TrackerHNRThreshold)
+	}
+
+	uploadMultiplier := viper.GetFloat64(string(TrackerUploadMultiplier))
+	maxMultiplier := viper.GetFloat64(string(TrackerMaxUploadMultiplier))
+	if maxMultiplier <= 0 || maxMultiplier > maxUploadMultiplier {
+		fail("%s must be greater than 0 and at most %.0f", TrackerMaxUploadMultiplier, maxUploadMultiplier)
+	}
+	if uploadMultiplier < 0 || uploadMultiplier > maxMultiplier {
+		fail("%s must be between 0 and %s", TrackerUploadMultiplier, TrackerMaxUploadMultiplier)
+	}
+	if bias := viper.GetFloat64(string(TrackerSeederBias)); bias < 0 || bias > 1 {
+		fail("%s must be between 0 and 1", TrackerSeederBias)
+	}
+	if viper.GetInt(string(TrackerSuperSeedingPeers)) < 0 {
+		fail("%s must not be negative", TrackerSuperSeedingPeers)
+	}
+	if viper.GetFloat64(string(TrackerCorruptRatio)) < 0 {
+		fail("%s must not be negative", TrackerCorruptRatio)
+	}
+
+	portMin := viper.GetInt(string(TrackerPortMin))
+	portMax := viper.GetInt(string(TrackerPortMax))
+	if portMin < 1 || portMax > 65535 || portMin > portMax {
+		fail("%s and %s must be an ordered port range within 1-65535", TrackerPortMin, TrackerPortMax)
+	}
+
+	for _, key := range []Key{TrackerHookWorkers, TrackerHookQueueSize, WebhookQueueSize} {
+		if viper.GetInt(string(key)) <= 0 {
+			fail("%s must be greater than 0", key)
+		}
+	}
+	for _, pool := range [][2]Key{
+		{StoreTorrentMaxIdle, StoreTorrentMaxActive},
+		{StoreUsersMaxIdle, StoreUsersMaxActive},
+		{StorePeersMaxIdle, StorePeersMaxActive},
+	} {
+		maxIdle := viper.GetInt(string(pool[0]))
+		maxActive := viper.GetInt(string(pool[1]))
+		if maxActive <= 0 {
+			fail("%s must be greater than 0", pool[1])
+		}
+		if maxIdle < 0 || maxIdle > maxActive {
+			fail("%s must be between 0 and %s", pool[0], pool[1])
+		}
+	}
+
+	listeners := []Key{TrackerTLSListen, TrackerUDPListen, TrackerWebSocketListen}
+	if viper.GetBool(string(MetricsEnabled)) {
+		listeners = append(listeners, MetricsListen)
+	}
+	for _, key := range []Key{TrackerListen, APIListen} {
+		if viper.GetString(string(key)) == "" {
+			fail("%s must be set", key)
+			continue
+		}
+		listeners = append(listeners, key)
+	}
+	for _, key := range listeners {
+		addr := viper.GetString(string(key))
+		if addr != "" && !validListenAddr(addr) {
+			fail("%s is not a valid host:port listen address: %s", key, addr)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("Invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validListenAddr checks the address is in the host:port form accepted by net.Listen
+func validListenAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.ContainsAny(host, " /") {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 0 && p <= 65535
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func validConfig() {
+	Read("")
+	viper.Set(string(TrackerListen), ":34000")
+	viper.Set(string(APIListen), "localhost:34001")
+	viper.Set(string(TrackerAnnounceInterval), "300s")
+	viper.Set(string(TrackerAnnounceIntervalMin), "10s")
+	viper.Set(string(TrackerAnnounceIntervalJitter), 10)
+	viper.Set(string(TrackerUploadMultiplier), 1.0)
+	viper.Set(string(TrackerMaxUploadMultiplier), 10.0)
+	viper.Set(string(TrackerSeederBias), 0.0)
+	viper.Set(string(TrackerHNRThreshold), "24h")
+	viper.Set(string(TrackerHookWorkers), 4)
+	viper.Set(string(TrackerUDPListen), "")
+	viper.Set(string(MetricsEnabled), false)
+}
+
+func TestValidate(t *testing.T) {
+	validConfig()
+	require.NoError(t, Validate())
+	invalid := []struct {
+		key   Key
+		value interface{}
+	}{
+		{TrackerAnnounceInterval, "0s"},
+		{TrackerAnnounceIntervalMin, "600s"},
+		{TrackerAnnounceIntervalMin, "-1s"},
+		{TrackerAnnounceIntervalJitter, 101},
+		{TrackerSwarmIntervalSmall, "-1s"},
+		{TrackerActivityInterval, "-1s"},
+		{TrackerPruneInactive, "-1h"},
+		{TrackerPeerCacheTTL, "-1s"},
+		{TrackerPeerCacheMinPeers, -1},
+		{TrackerPeerCacheChurn, -0.5},
+		{TrackerActivityHalfLife, "0s"},
+		{TrackerProbeInterval, "0s"},
+		{TrackerProbeTimeout, "-1s"},
+		{TrackerProbeRate, 0},
+		{TrackerReapInterval, "0s"},
+		{TrackerReapMultiplier, 0},
+		{StorePeersTTLMultiplier, 1},
+		{StorePeersTTLMultiplier, -1},
+		{TrackerMaxURILength, -1},
+		{TrackerMaxLeechers, -1},
+		{TrackerDownloadSlotsRetry, "0s"},
+		{TrackerHNRThreshold, "0s"},
+		{TrackerHNRThreshold, "-1h"},
+		{TrackerUploadMultiplier, -1.0},
+		{TrackerUploadMultiplier, 20.0},
+		{TrackerMaxUploadMultiplier, 0.0},
+		{TrackerMaxUploadMultiplier, 1000.0},
+		{TrackerSeederBias, 1.5},
+		{TrackerSeederBias, -0.1},
+		{TrackerSuperSeedingPeers, -1},
+		{TrackerCorruptRatio, -0.5},
+		{TrackerPortMin, 0},
+		{TrackerPortMin, 70000},
+		{TrackerPortMax, 70000},
+		{TrackerHookWorkers, 0},
+		{TrackerHookQueueSize, 0},
+		{WebhookQueueSize, -1},
+		{StoreTorrentMaxActive, 0},
+		{StoreUsersMaxIdle, -1},
+		{StorePeersMaxIdle, 1000},
+		{TrackerListen, ""},
+		{TrackerListen, "34000"},
+		{APIListen, "localhost:http-alt"},
+		{TrackerUDPListen, "bad host:6969"},
+	}
+	for _, tc := range invalid {
+		prev := viper.Get(string(tc.key))
+		viper.Set(string(tc.key), tc.value)
+		err := Validate()
+		require.Error(t, err, "%s: %v", tc.key, tc.value)
+		require.Contains(t, err.Error(), string(tc.key))
+		viper.Set(string(tc.key), prev)
+	}
+	require.NoError(t, Validate())
+	viper.Set(string(TrackerSwarmIntervalSmall), "60s")
+	viper.Set(string(TrackerSwarmIntervalLarge), "900s")
+	viper.Set(string(TrackerSwarmSizeSmall), 1000)
+	require.Error(t, Validate(), "Swarm sizes must be ordered when scaling")
+	viper.Set(string(TrackerSwarmSizeSmall), 10)
+	require.NoError(t, Validate())
+	viper.Set(string(TrackerSwarmIntervalSmall), "0s")
+	viper.Set(string(TrackerSwarmIntervalLarge), "0s")
+	prev := viper.Get(string(MetricsListen))
+	viper.Set(string(MetricsListen), "localhost")
+	require.NoError(t, Validate(), "Metrics listener is only checked when enabled")
+	viper.Set(string(MetricsEnabled), true)
+	require.Error(t, Validate())
+	viper.Set(string(MetricsEnabled), false)
+	viper.Set(string(MetricsListen), prev)
+}
+
+func TestGetStoreConfigPeerTTL(t *testing.T) {
+	validConfig()
+	require.Equal(t, time.Duration(0), GetStoreConfig(Peers).PeerTTL, "Disabled by default")
+	viper.Set(string(StorePeersTTLMultiplier), 3)
+	// 300s + 10% jitter
+	require.Equal(t, 990*time.Second, GetStoreConfig(Peers).PeerTTL)
+	viper.Set(string(TrackerSwarmIntervalLarge), "900s")
+	require.Equal(t, 2970*time.Second, GetStoreConfig(Peers).PeerTTL, "Longest interval is used")
+	viper.Set(string(TrackerSwarmIntervalLarge), "0s")
+	viper.Set(string(StorePeersTTLMultiplier), 0)
+}
@@ -1,36 +1,138 @@
 package consts
 
-import "github.com/pkg/errors"
+import "fmt"
+
+// ErrorKind classifies an Error so callers can react to a whole class of failures without
+// comparing against every individual sentinel
+type ErrorKind int
+
+const (
+	// KindUnknown is used for errors which are not a Error or have no better classification
+	KindUnknown ErrorKind = iota
+	// KindInvalid is used for malformed or otherwise unusable input or state
+	KindInvalid
+	// KindNotFound is used when the requested entity does not exist
+	KindNotFound
+	// KindDuplicate is used when an entity being added already exists
+	KindDuplicate
+	// KindUnauthorized is used when the requester is not allowed to perform the action
+	KindUnauthorized
+	// KindConfig is used for invalid configuration values or drivers
+	KindConfig
+)
+
+// String returns a short name for the kind
+func (k ErrorKind) String() string {
+	switch k {
+	case KindInvalid:
+		return "invalid"
+	case KindNotFound:
+		return "not found"
+	case KindDuplicate:
+		return "duplicate"
+	case KindUnauthorized:
+		return "unauthorized"
+	case KindConfig:
+		return "config"
+	default:
+		return "unknown"
+	}
+}
+
+// Error is the error type of the tracker sentinels. It carries a kind for the error class and
+// optionally the underlying cause. Errors created by Wrap compare equal to their sentinel
+// with errors.Is.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Cause   error
+}
+
+// newError creates a sentinel error with no cause
+func newError(kind ErrorKind, msg string) *Error {
+	return &Error{Kind: kind, Message: msg}
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.Cause.Error())
+}
+
+// Unwrap returns the underlying cause, if any
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is the same sentinel as e, ignoring the cause
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Kind == t.Kind && e.Message == t.Message
+}
+
+// Wrap returns a copy of the sentinel with cause attached as the underlying error
+func (e *Error) Wrap(cause error) error {
+	return &Error{Kind: e.Kind, Message: e.Message, Cause: cause}
+}
+
+// KindOf returns the kind of the first Error found in the chain of err. Both the standard
+// library Unwrap chain and github.com/pkg/errors Cause chain are followed.
+func KindOf(err error) ErrorKind {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e.Kind
+		}
+		if u, ok := err.(interface{ Unwrap() error }); ok {
+			err = u.Unwrap()
+			continue
+		}
+		if c, ok := err.(interface{ Cause() error }); ok {
+			err = c.Cause()
+			continue
+		}
+		return KindUnknown
+	}
+	return KindUnknown
+}
 
 var (
 	// ErrMalformedRequest is the general request error for invalid inputs that dont fall under other categories
-	ErrMalformedRequest = errors.New("Malformed request")
+	ErrMalformedRequest = newError(KindInvalid, "Malformed request")
 	// ErrInvalidMapKey is for general map key lookup failure
-	ErrInvalidMapKey = errors.New("Invalid map key specified")
+	ErrInvalidMapKey = newError(KindInvalid, "Invalid map key specified")
 	// ErrDuplicate duplicate entry error
-	ErrDuplicate = errors.New("Duplicate entry")
+	ErrDuplicate = newError(KindDuplicate, "Duplicate entry")
 	// ErrInvalidInfoHash returned to clients on unknown hash
-	ErrInvalidInfoHash = errors.New("Info hash not supplied")
+	ErrInvalidInfoHash = newError(KindNotFound, "Info hash not supplied")
 	// ErrInvalidTorrentID failure to find mapped torrent_id
-	ErrInvalidTorrentID = errors.New("Invalid torrent_id")
+	ErrInvalidTorrentID = newError(KindNotFound, "Invalid torrent_id")
 	// ErrInvalidPeerID failure to find a peer by peer_id
-	ErrInvalidPeerID = errors.New("Invalid peer_id")
+	ErrInvalidPeerID = newError(KindNotFound, "Invalid peer_id")
 	// ErrInvalidDriver is for when a unknown driver is used.
 	// Either misspelled or using driver that wasn't built into the binary
-	ErrInvalidDriver = errors.New("invalid driver")
+	ErrInvalidDriver = newError(KindConfig, "invalid driver")
 	// ErrInvalidConfig is issued when a invalid config value is used
-	ErrInvalidConfig = errors.New("invalid configuration")
+	ErrInvalidConfig = newError(KindConfig, "invalid configuration")
 	// ErrInvalidResponseCode is a generic error code representing a invalid response code
 	// was received from the server
-	ErrInvalidResponseCode = errors.New("invalid response code")
+	ErrInvalidResponseCode = newError(KindInvalid, "invalid response code")
 	// ErrUnauthorized is a general non-info disclosing auth error
-	ErrUnauthorized = errors.New("not authorized")
+	ErrUnauthorized = newError(KindUnauthorized, "not authorized")
 	// ErrInvalidState is used when the state of the data returned is not what we expect or invalid
 	// in any way.
-	ErrInvalidState = errors.New("invalid struct state")
+	ErrInvalidState = newError(KindInvalid, "invalid struct state")
 	// ErrInvalidUser is used when a user lookup fails
-	ErrInvalidUser = errors.New("invalid user")
+	ErrInvalidUser = newError(KindNotFound, "invalid user")
 
 	// ErrInvalidClient is used when an invalid client is requested/used
-	ErrInvalidClient = errors.New("invalid torrent client")
+	ErrInvalidClient = newError(KindNotFound, "invalid torrent client")
+	// ErrInvalidBan is used when an unknown or malformed ip ban is requested/used
+	ErrInvalidBan = newError(KindNotFound, "invalid ip ban")
+	// ErrIPOverrideDenied is used when a client not allowed to override its address tries to
+	ErrIPOverrideDenied = newError(KindUnauthorized, "ip override not allowed")
 )
@@ -0,0 +1,43 @@
+package consts
+
+import (
+	"errors"
+	"fmt"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestError_Is(t *testing.T) {
+	cause := errors.New("sql: no rows in result set")
+	wrapped := ErrInvalidInfoHash.Wrap(cause)
+	require.True(t, errors.Is(wrapped, ErrInvalidInfoHash))
+	require.True(t, errors.Is(wrapped, cause))
+	require.False(t, errors.Is(wrapped, ErrInvalidPeerID))
+	require.Equal(t, "Info hash not supplied: sql: no rows in result set", wrapped.Error())
+
+	require.True(t, errors.Is(fmt.Errorf("lookup failed: %w", ErrDuplicate), ErrDuplicate))
+	require.False(t, errors.Is(errors.New("Duplicate entry"), ErrDuplicate))
+
+	var e *Error
+	require.True(t, errors.As(fmt.Errorf("lookup failed: %w", wrapped), &e))
+	require.Equal(t, KindNotFound, e.Kind)
+	require.Equal(t, cause, e.Cause)
+}
+
+func TestKindOf(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{nil, KindUnknown},
+		{errors.New("other"), KindUnknown},
+		{ErrDuplicate, KindDuplicate},
+		{ErrUnauthorized.Wrap(errors.New("x")), KindUnauthorized},
+		{fmt.Errorf("x: %w", ErrMalformedRequest), KindInvalid},
+		{pkgerrors.Wrap(ErrInvalidConfig, "x"), KindConfig},
+		{pkgerrors.Wrap(fmt.Errorf("x: %w", ErrInvalidUser), "y"), KindNotFound},
+	} {
+		require.Equal(t, tc.kind, KindOf(tc.err), "%v", tc.err)
+	}
+}
@@ -244,3 +244,42 @@ func (db *DB) GetLocation(ip net.IP) City {
 	}
 	return record
 }
+
+// Lookup returns the geo location of the input IP addr. Unlike GetLocation, lookup
+// failures are returned to the caller so they can be handled in the request path.
+func (db *DB) Lookup(ip net.IP) (City, error) {
+	var record City
+	if err := db.db.Lookup(ip, &record); err != nil {
+		return record, errors.Wrapf(err, "Failed to lookup location of ip: %s", ip.String())
+	}
+	return record, nil
+}
+
+// ASN holds the autonomous system details of an IP as stored in the GeoLite2 ASN database
+type ASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// ASNDB handles opening and querying from the maxmind ASN memory mapped database (.mmdb) file.
+type ASNDB struct {
+	db *maxminddb.Reader
+}
+
+// NewASN opens the ASN .mmdb file for querying
+func NewASN(path string) (*ASNDB, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open asn database: %s", path)
+	}
+	return &ASNDB{db: db}, nil
+}
+
+// Lookup returns the autonomous system the input IP addr belongs to
+func (db *ASNDB) Lookup(ip net.IP) (ASN, error) {
+	var record ASN
+	if err := db.db.Lookup(ip, &record); err != nil {
+		return record, errors.Wrapf(err, "Failed to lookup asn of ip: %s", ip.String())
+	}
+	return record, nil
+}
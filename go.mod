@@ -16,6 +16,7 @@ require (
 	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/pelletier/go-toml v1.7.0 // indirect
 	github.com/pkg/errors v0.8.0
+	github.com/prometheus/client_golang v1.6.0
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/afero v1.2.2 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
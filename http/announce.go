@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,7 +26,12 @@ type BitTorrentHandler struct {
 //
 // TODO use gin binding func?
 type announceRequest struct {
-	Compact bool `form:"compact"` // Force compact always?
+	// Setting this to 1 indicates that the client accepts a compact response. Clients sending 0
+	// receive the original peer list of dictionaries when the tracker allows it.
+	Compact bool `form:"compact"`
+
+	// Indicates that the tracker can omit peer id field in the non-compact peers dictionary.
+	NoPeerID bool `form:"no_peer_id"`
 
 	// The total amount downloaded (since the client sent the 'started' event to the tracker) in
 	// base ten ASCII. While not explicitly stated in the official specification, the consensus is that
@@ -65,6 +74,9 @@ type announceRequest struct {
 	// it indicates only that client can communicate via IPv6.
 	IP net.IP `form:"ip" binding:"required"`
 
+	// Optional. The IPv6 address of the client, used alongside IP for dual-stack clients
+	IPv6 net.IP `form:"ipv6"`
+
 	// urlencoded 20-byte SHA1 hash of the value of the info key from the Metainfo file. Note that the
 	// value will be a bencoded dictionary, given the definition of the info key above.
 	InfoHash model.InfoHash `form:"info_hash" binding:"required"`
@@ -88,7 +100,17 @@ type announceRequest struct {
 	Port uint16 `binding:"required"`
 
 	// Optional. If a previous announce contained a tracker id, it should be set here.
-	TrackerID string `form:"tracker_id"`
+	TrackerID string `form:"trackerid"`
+
+	// Optional. An additional identification that is not shared with any other peers. It is intended
+	// to allow a client to prove their identity should their IP address change.
+	Key string `form:"key"`
+
+	// Optional. Protocol encryption support, set from the supportcrypto and requirecrypto params
+	Crypto model.CryptoLevel
+
+	// Optional, non-standard. Set by seeders which are super seeding
+	SuperSeed bool `form:"superseed"`
 }
 
 type announceResponse struct {
@@ -133,16 +155,29 @@ func getUint16Key(q *query, key announceParam, def uint16) uint16 {
 	return util.UMax16(0, left)
 }
 
-func getUintKey(q *query, key announceParam, def uint) uint {
-	left, err := q.Uint(key)
-	if err != nil {
-		return def
+// parseNumWant reads the number of peers wanted by the client from numwant, or one of its
+// aliases when numwant is not sent. Empty, negative or otherwise invalid values fall back to
+// def as clients send these when they have no preference. Values above max are clamped to max.
+func parseNumWant(q *query, def uint, max uint) uint {
+	numWant := def
+	for _, key := range []announceParam{paramNumWant, paramNumWantAlias, paramNumPeersWanted} {
+		str, exists := q.Params[key]
+		if !exists {
+			continue
+		}
+		if v, err := strconv.ParseUint(strings.TrimSpace(str), 10, 32); err == nil {
+			numWant = uint(v)
+		}
+		break
+	}
+	if numWant > max {
+		return max
 	}
-	return util.UMax(0, left)
+	return numWant
 }
 
 // Parse the query string into an announceRequest struct
-func newAnnounce(c *gin.Context) (*announceRequest, trackerErrCode) {
+func newAnnounce(c *gin.Context, t *tracker.Tracker) (*announceRequest, trackerErrCode) {
 	q, err := queryStringParser(c.Request.URL.RawQuery)
 	if err != nil {
 		return nil, msgMalformedRequest
@@ -151,146 +186,393 @@ func newAnnounce(c *gin.Context) (*announceRequest, trackerErrCode) {
 	if !exists {
 		return nil, msgInvalidInfoHash
 	}
+	// Short or long values would be silently padded or truncated into the fixed size arrays
+	if len(infoHash) != len(model.InfoHash{}) {
+		log.Debugf("Rejected info_hash with invalid length: %d", len(infoHash))
+		return nil, msgInvalidInfoHash
+	}
 	peerID, exists := q.Params[paramPeerID]
 	if !exists {
 		return nil, msgInvalidPeerID
 	}
-	ipv4, err := getIP(q, c)
+	if len(peerID) != len(model.PeerID{}) {
+		log.Debugf("Rejected peer_id with invalid length: %d", len(peerID))
+		return nil, msgInvalidPeerID
+	}
+	ip, ipv6, err := getIP(q, c, t)
+	if err == consts.ErrIPOverrideDenied {
+		return nil, msgIPOverrideDenied
+	}
 	if err != nil {
 		log.Warn("Could not get user IP from request")
 		return nil, msgMalformedRequest
 	}
-	if util.IsPrivateIP(ipv4) {
-		log.Warnf("Attempt to use non-routable IP value: %s", ipv4.String())
+	if !t.AllowPrivateIP && util.IsPrivateIP(ip) {
+		log.Warnf("Attempt to use non-routable IP value: %s", ip.String())
 		return nil, msgMalformedRequest
 	}
 	port := getUint16Key(q, paramPort, 0)
-	if port < 1024 || port > 65535 {
-		// Don't allow privileged ports which require root to bind to on unix
+	if !t.IsValidPort(port) {
 		return nil, msgInvalidPort
 	}
 	left := getUint32Key(q, paramLeft, 0)
 	downloaded := getUint32Key(q, paramDownloaded, 0)
 	uploaded := getUint32Key(q, paramUploaded, 0)
 	corrupt := getUint32Key(q, paramCorrupt, 0)
-	event := parseAnnounceType(q.Params[paramNumWant])
-	numWant := getUintKey(q, "numwant", 30)
+	event := parseAnnounceType(q.Params[paramEvent])
+	numWant := parseNumWant(q, uint(t.DefaultNumWant), uint(t.MaxPeers))
+	crypto := model.CryptoNone
+	if q.Params[paramRequireCrypto] == "1" {
+		crypto = model.CryptoRequired
+	} else if q.Params[paramSupportCrypto] == "1" {
+		crypto = model.CryptoSupported
+	}
 	return &announceRequest{
-		Compact:    true, // Ignored and always set to true
+		Compact:    q.Params[paramCompact] != "0",
+		Crypto:     crypto,
+		NoPeerID:   q.Params[paramNoPeerID] == "1",
 		Corrupt:    corrupt,
 		Downloaded: downloaded,
 		Event:      event,
-		IP:         ipv4,
+		IP:         ip,
+		IPv6:       ipv6,
 		InfoHash:   model.InfoHashFromString(infoHash),
+		Key:        q.Params[paramKey],
 		Left:       left,
 		NumWant:    numWant,
 		PeerID:     model.PeerIDFromString(peerID),
 		Port:       port,
+		SuperSeed:  q.Params[paramSuperSeed] == "1",
+		TrackerID:  q.Params[paramTrackerID],
 		Uploaded:   uploaded,
 	}, msgOk
 }
 
 // The meaty bits.
 func (h *BitTorrentHandler) announce(c *gin.Context) {
-	// Check that the user is valid before parsing anything
-	usr, valid := preFlightChecks(c, h.t)
-	if !valid {
+	defer observeRequest(c, "announce", time.Now())
+	defer func() {
+		if requestErrCode(c) != msgOk {
+			metrics.AnnounceRejectedTotal.Inc()
+		}
+	}()
+	if !h.t.StartAnnounce() {
+		oops(c, msgShuttingDown)
+		return
+	}
+	defer h.t.FinishAnnounce()
+	// Concurrent announces from the same ip are limited before anything touches the stores
+	ip := remoteIP(c, h.t)
+	entry := startAudit(c, h.t)
+	entry.IP = ip
+	if !h.t.AcquireIP(ip) {
+		oops(c, msgTooManyRequests)
+		return
+	}
+	defer h.t.ReleaseIP(ip)
+	if rejectBanned(c, h.t) || rejectLongURI(c, h.t) {
 		return
 	}
 	// Parse the announce into an announceRequest
-	req, code := newAnnounce(c)
+	req, code := newAnnounce(c, h.t)
 	if code != msgOk {
 		oops(c, code)
 		return
 	}
-	// Get & Validate the torrent associated with the info_hash supplies
-	tor, err := h.t.Torrents.Get(req.InfoHash)
-	if err != nil || tor.IsDeleted {
-		oops(c, msgInvalidInfoHash)
+	entry.PeerID = req.PeerID
+	entry.InfoHash = req.InfoHash
+	// The torrent is fetched before checking the user as public torrents do not require a valid
+	// passkey. Unknown torrents are only reported as such to valid users so the existence of a
+	// torrent is never revealed without one.
+	tor, err := h.t.TorrentForAnnounce(req.InfoHash)
+	if err != nil {
+		tor = nil
+	}
+	usr, valid := preFlightChecks(c, h.t, tor)
+	if !valid {
+		return
+	}
+	entry.UserID = usr.UserID
+	if tor == nil || tor.IsDeleted {
+		unregistered(c, h.t)
+		return
+	}
+	clientName, validClient := h.t.IsValidClient(req.PeerID)
+	if !validClient && !tor.IsPublic() {
+		// The rejection message is configurable so operators can point users to a list
+		// of allowed clients
+		if h.t.RejectClientMsg != "" {
+			failure(c, msgClientNotAllowed, h.t.RejectClientMsg, 0)
+		} else {
+			oops(c, msgClientNotAllowed)
+		}
+		return
+	}
+	// Legitimate peer_id prefixes sent with an inconsistent User-Agent are flagged, or rejected
+	// in strict mode
+	uaMismatch := !tor.IsPublic() && !h.t.UserAgentMatches(req.PeerID, c.Request.UserAgent())
+	if uaMismatch && h.t.ClientUserAgentStrict {
+		oops(c, msgUserAgentMismatch)
+		return
+	}
+	if !req.Compact && h.t.RequireCompact {
+		// Only the client prefix is logged, the remainder of the peer_id is random
+		log.Infof("Rejected non-compact announce from client prefix: %q", req.PeerID.RawString()[:8])
+		oops(c, msgCompactRequired)
+		return
+	}
+	// Seeders are always allowed to announce regardless of ratio
+	if req.Left > 0 && !usr.RatioAllowed(h.t.MinRatio, h.t.MinRatioGrace) {
+		oops(c, msgRatioTooLow)
+		return
+	}
+	if req.Left > 0 && !h.t.CorruptAllowed(usr) {
+		oops(c, msgCorruptTooHigh)
 		return
 	}
 	// If disabled and reason is set, the reason is returned to the client
 	// This is mostly useful for when a torrent has been "trumped" by another torrent so it
-	// should be downloaded instead
+	// should be downloaded instead. Failures never include peers so any peers already in the
+	// swarm will stop trading.
 	//
 	// TODO send this as a "warning message" field of a normal announce response instead?
-	if !tor.IsEnabled && tor.Reason != "" {
-		c.String(int(msgInvalidInfoHash), responseError(tor.Reason))
+	if !tor.IsEnabled {
+		if tor.Reason != "" {
+			failure(c, msgTorrentDisabled, tor.Reason, 0)
+		} else {
+			oops(c, msgTorrentDisabled)
+		}
+		return
+	}
+	if !h.t.DatacenterAllowed(tor, usr, req.IP) {
+		oops(c, msgDatacenterBlocked)
+		return
+	}
+	if !tor.AddressFamily.Allows(req.IP, req.IPv6) {
+		oops(c, msgAddressFamily)
+		return
+	}
+	// Rejected announces are not counted as activity of the torrent
+	h.t.CountAnnounce(tor.InfoHash)
+	h.t.TouchTorrent(tor)
+	// Identical announces sent in quick succession are answered without touching the swarm
+	// so they are not counted or applied twice
+	dedupKey := tracker.DedupKey(usr.UserID, tor.InfoHash, req.PeerID, string(req.Event),
+		uint64(req.Uploaded), uint64(req.Downloaded))
+	if resp, found := h.t.DuplicateAnnounce(dedupKey); found {
+		c.String(int(msgOk), string(resp))
 		return
 	}
 
 	// Peer / Swarm stuff
 	peer, err := h.t.Peers.Get(tor.InfoHash, req.PeerID)
+	if !h.t.ValidLeft(tor, peer, req.Downloaded, req.Left) {
+		oops(c, msgInvalidLeft)
+		return
+	}
 	if err != nil {
+		if !h.t.UserPeersAllowed(tor, usr.UserID) {
+			oops(c, msgTooManyPeers)
+			return
+		}
+		if !h.t.DownloadSlotAvailable(tor, req.Left) {
+			retryLater(c, msgDownloadSlotsFull, h.t.DownloadSlotsRetry)
+			return
+		}
 		// Create a new peer for the swarm
 		peer = model.NewPeer(usr.UserID, req.PeerID, req.IP, req.Port)
+		h.t.LocatePeer(peer)
+		peer.IPv6 = req.IPv6
+		peer.Key = req.Key
+		peer.Client = clientName
+		h.t.EvictPeers(tor)
 		if err := h.t.Peers.Add(tor.InfoHash, peer); err != nil {
 			log.Errorf("Failed to insert peer into swarm: %s", err.Error())
-			oops(c, msgGenericError)
+			oops(c, errCodeFor(err, msgGenericError))
 			return
 		}
+		h.t.PeerListChanged(tor.InfoHash)
+	} else if !h.t.VerifyPeerKey(peer, req.Key) {
+		oops(c, msgInvalidKey)
+		return
+	} else if (req.Event == ANNOUNCE || req.Event == PAUSED) && h.t.IsRateLimited(peer) {
+		// Only regular announces are limited, event announces are always accepted
+		retryLater(c, msgClientRequestTooFast, h.t.RateLimitWindow())
+		return
+	}
+	if err == nil && req.TrackerID != h.t.TrackerID {
+		// Returning peers should have received the tracker id in a previous response. This is
+		// only informational as the id changes on restart unless configured.
+		log.Debugf("Peer %s did not echo the tracker id", req.PeerID.String())
+	}
+	// Regular announces sent before the min interval are answered with the current swarm but
+	// not applied, so clients ignoring the min interval can not inflate their stats
+	early := err == nil && (req.Event == ANNOUNCE || req.Event == PAUSED) && h.t.IsEarlyAnnounce(peer)
+	if !early {
+		peer.UpdateAddr(req.IP, req.IPv6)
+		if uaMismatch {
+			h.t.FlagUserAgent(peer)
+		}
+		// TODO use a channel to send deltas instead of locking in-request?
+		// Maybe use sync/atomic, but needs testing?
+		if err := h.t.AccrueBonus(usr, tor, peer); err != nil {
+			log.Errorf("Failed to update user bonus points: %s", err.Error())
+		}
+		prevUp, prevDn := peer.Speed()
+		ulDiff, dlDiff := peer.Update(req.Uploaded, req.Downloaded, req.Left)
+		corrupt := peer.UpdateCorrupt(req.Corrupt)
+		peer.SetPaused(req.Event == PAUSED)
+		peer.SetCrypto(req.Crypto)
+		peer.SetSuperSeeding(req.SuperSeed)
+		peer.UpdateHNRExempt(h.t.HNRThresholdFor(tor))
+		h.t.FlagResets(peer)
+		h.t.RecordAnnounce(tor.InfoHash, peer)
+		ulDiff = h.t.LimitUpload(usr, peer, ulDiff)
+		dlDiff = h.t.ExcludeCorrupt(dlDiff, corrupt)
+		if err := h.t.AccountTransfer(usr, tor, ulDiff, dlDiff); err != nil {
+			log.Errorf("Failed to update user transfer totals: %s", err.Error())
+		}
+		if err := h.t.AccountCorrupt(usr, corrupt); err != nil {
+			log.Errorf("Failed to update user corrupt total: %s", err.Error())
+		}
+		h.t.RunHooks(peer, &tracker.AnnounceRequest{
+			InfoHash:   tor.InfoHash,
+			PeerID:     req.PeerID,
+			UserID:     usr.UserID,
+			Event:      string(req.Event),
+			Uploaded:   uint64(req.Uploaded),
+			Downloaded: uint64(req.Downloaded),
+			Left:       uint64(req.Left),
+			IP:         req.IP,
+			Port:       req.Port,
+		}, uint64(ulDiff), uint64(dlDiff))
+		switch req.Event {
+		case COMPLETED:
+			// TODO does a complete event get sent for a torrent when the user only downloads a specific file from the torrent
+			if err := h.t.PeerCompleted(tor, peer); err != nil {
+				log.Errorf("Failed to update torrent completed count: %s", err.Error())
+			}
+		case STOPPED:
+			if err := h.t.Peers.Delete(tor.InfoHash, peer); err != nil {
+				log.Errorf("Could not remove peer from swarm: %s", err.Error())
+				oops(c, errCodeFor(err, msgGenericError))
+				return
+			}
+			h.t.PeerListChanged(tor.InfoHash)
+			if peer.IsHNR(h.t.HNRThresholdFor(tor)) {
+				h.t.AddHNR(tor, peer)
+			}
+		}
+		up, dn := peer.Speed()
+		if req.Event == STOPPED {
+			up, dn = 0, 0
+		}
+		if err := h.t.AccountSpeed(usr.UserID, prevUp, prevDn, up, dn); err != nil {
+			log.Errorf("Failed to update user speed: %s", err.Error())
+		}
+		if req.Event != STOPPED {
+			if err := h.t.Peers.Update(tor.InfoHash, peer); err != nil {
+				log.Errorf("Failed to sync peer: %s", err.Error())
+			}
+			h.t.QueueProbe(tor.InfoHash, peer)
+		}
+	}
+	// Large swarms are answered from a shared compact peer list when the response does not
+	// depend on the announcing peer
+	compact := req.Compact || !h.t.AllowNonCompact
+	cacheable := compact && h.t.PeerCacheable(peer)
+	var (
+		peers             model.Swarm
+		cached            *model.CompactPeerList
+		seeders, leechers uint
+	)
+	if cacheable {
+		cached, seeders, leechers = h.t.CachedPeers(tor.InfoHash)
 	}
-	// TODO use a channel to send deltas instead of locking in-request?
-	// Maybe use sync/atomic, but needs testing?
-	peer.Lock()
-	peer.Uploaded = req.Uploaded
-	peer.Downloaded = req.Downloaded
-	peer.Announces++
-	peer.Left = req.Left
-	peer.UpdatedOn = time.Now()
-	peer.Unlock()
-	switch req.Event {
-	case COMPLETED:
-		// TODO does a complete event get sent for a torrent when the user only downloads a specific file from the torrent
-		// Do we force left=0 for this? Or trust the client?
-		tor.TotalCompleted++
-	case STOPPED:
-		if err := h.t.Peers.Delete(tor.InfoHash, peer); err != nil {
-			log.Errorf("Could not remove peer from swarm: %s", err.Error())
-			oops(c, msgGenericError)
+	if cached == nil {
+		peers, err = h.t.Peers.GetN(tor.InfoHash, h.t.MaxPeers)
+		if err != nil {
+			log.Errorf("Could not read peers from swarm: %s", err.Error())
+			oops(c, errCodeFor(err, msgGenericError))
 			return
 		}
+		seeders, leechers = peers.Counts()
+		if cacheable {
+			cached = h.t.CachePeers(tor.InfoHash, peers)
+		}
 	}
-	peers, err := h.t.Peers.GetN(tor.InfoHash, h.t.MaxPeers)
-	if err != nil {
-		log.Errorf("Could not read peers from swarm: %s", err.Error())
-		oops(c, msgGenericError)
-		return
+	var interval, minInterval int
+	if cached != nil {
+		others := cached.Len()
+		if cached.Contains(peer.PeerID) {
+			others--
+		}
+		interval, minInterval = h.t.SwarmIntervals(peer.Left, others)
+	} else {
+		interval, minInterval = h.t.SwarmIntervals(peer.Left, peers.Others(peer.PeerID))
+		if rotated, ok := h.t.SuperSeedPeers(peers, peer, int(req.NumWant)); ok {
+			peers = rotated
+			// Store the advanced cursor so the next announce continues with the following leechers
+			if !early && req.Event != STOPPED {
+				if err := h.t.Peers.Update(tor.InfoHash, peer); err != nil {
+					log.Errorf("Failed to sync peer: %s", err.Error())
+				}
+			}
+		} else {
+			// Prefer peers in the same country when the swarm is larger than what we return
+			peers = h.t.OrderPeers(peers, peer.CountryCode)
+			peers = h.t.BiasPeers(peers, peer.Seeding(), int(req.NumWant))
+		}
+		peers = h.t.MatchCrypto(peers, peer)
+		// The full swarm is fetched above so the counts are accurate, only numwant peers are returned
+		if len(peers) > int(req.NumWant) {
+			peers = peers[:req.NumWant]
+		}
 	}
-	seeders, leechers := peers.Counts()
 	dict := bencode.Dict{
-		"complete":     seeders,
-		"incomplete":   leechers,
-		"interval":     h.t.AnnInterval,
-		"min interval": h.t.AnnIntervalMin,
-	}
-	// NOTE we ONLY support compact response formats (binary format) by design even though its
-	// technically breaking the protocol specs.
-	// There is no reason to support the older less efficient model for private needs
-	if peers != nil {
-		dict["peers"] = makeCompactPeers(peers, peer.PeerID)
+		"complete":     int(seeders),
+		"incomplete":   int(leechers),
+		"interval":     interval,
+		"min interval": minInterval,
+	}
+	if h.t.TrackerID != "" {
+		dict["tracker id"] = h.t.TrackerID
+	}
+	if warning := h.t.ClientWarning(peer.PeerID); warning != "" {
+		dict["warning message"] = warning
+	}
+	if h.t.ReturnExternalIP {
+		dict["external ip"] = externalIP(ip, h.t.ExternalIPString)
+	}
+	// Compact responses are always used unless non-compact responses are explicitly enabled
+	// as there is no reason to support the older less efficient model for private needs
+	if cached != nil {
+		peers4, peers6 := tor.AddressFamily.Filter(cached.Peers(int(req.NumWant), peer.PeerID))
+		dict["peers"] = peers4
+		if len(peers6) > 0 {
+			dict["peers6"] = peers6
+		}
+	} else if !compact {
+		dictPeers := bencode.List{}
+		for _, dp := range model.MakeDictPeers(peers, peer.PeerID, req.NoPeerID, tor.AddressFamily) {
+			dictPeers = append(dictPeers, bencode.Dict(dp))
+		}
+		dict["peers"] = dictPeers
+	} else if peers != nil {
+		peers4, peers6 := tor.AddressFamily.Filter(model.MakeCompactPeers(peers, peer.PeerID))
+		dict["peers"] = peers4
+		if len(peers6) > 0 {
+			dict["peers6"] = peers6
+		}
 	} else {
 		dict["peers"] = []byte{}
 	}
 	var outBytes bytes.Buffer
-	if err := bencode.NewEncoder(&outBytes).Encode(dict); err != nil {
-		oops(c, msgGenericError)
+	if err := encodeResponse(&outBytes, dict); err != nil {
+		encodeFailed(c, "announce", err)
 		return
 	}
+	h.t.RememberAnnounce(dedupKey, outBytes.Bytes())
 	c.String(int(msgOk), outBytes.String())
-}
-
-// Generate a compact peer field array containing the byte representations
-// of a peers IP+Port appended to each other
-func makeCompactPeers(peers model.Swarm, skipID model.PeerID) []byte {
-	var buf bytes.Buffer
-	for _, peer := range peers {
-		if peer.PeerID == skipID {
-			// Skip the peers own peer_id
-			continue
-		}
-		buf.Write(peer.IP.To4())
-		buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
-	}
-	return buf.Bytes()
+	metrics.AnnounceTotal.WithLabelValues(req.Event.label()).Inc()
 }
@@ -1,23 +1,45 @@
 package http
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/chihaya/bencode"
 	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
 	req, _ := http.NewRequest(method, path, nil)
+	req.RemoteAddr = "1.2.3.4:51413"
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 	return w
 }
 
+// requireFailure checks the response is a bencoded failure with the reason, sent with a 200
+// status so clients read it, and returns the decoded response
+func requireFailure(t *testing.T, w *httptest.ResponseRecorder, reason string) bencode.Dict {
+	require.Equal(t, http.StatusOK, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	dict := resp.(bencode.Dict)
+	require.Equal(t, reason, dict["failure reason"])
+	return dict
+}
+
 func TestBitTorrentHandler_Announce(t *testing.T) {
 	config.Read("")
 	tkr, torrents, users, peers := tracker.NewTestTracker()
@@ -48,3 +70,863 @@ func TestBitTorrentHandler_Announce(t *testing.T) {
 		assert.EqualValues(t, w.Code, ann.resp)
 	}
 }
+
+func TestBitTorrentHandler_AnnounceNumWant(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := tracker.NewTestTracker()
+	// Repeated announces from the same peer would otherwise be rate limited
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	for _, tc := range []struct {
+		numWant  string
+		expected int
+	}{
+		{"0", 0},
+		{"2", 2},
+		{"1000", len(peers) / len(torrents)},
+		// Fall back to the default amount
+		{"", len(peers) / len(torrents)},
+		{"abc", len(peers) / len(torrents)},
+		{"-5", len(peers) / len(torrents)},
+	} {
+		v := url.Values{
+			"info_hash":  {torrents[1].InfoHash.RawString()},
+			"peer_id":    {"-XX0001-123456789012"},
+			"ip":         {"255.255.255.255"},
+			"port":       {"6881"},
+			"uploaded":   {"0"},
+			"downloaded": {"0"},
+			"left":       {"0"},
+			"numwant":    {tc.numWant},
+		}
+		u := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+		w := performRequest(rh, "GET", u)
+		require.Equal(t, 200, w.Code)
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		dict := resp.(bencode.Dict)
+		require.NotNil(t, dict["interval"])
+		require.Equal(t, tc.expected*6, len(dict["peers"].(string)), "numwant=%s", tc.numWant)
+	}
+}
+
+func TestParseNumWant(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected uint
+	}{
+		{"", 30},
+		{"numwant=10", 10},
+		{"numwant=", 30},
+		{"numwant=&left=0", 30},
+		{"numwant=abc", 30},
+		{"numwant=-5", 30},
+		{"numwant=9999", 50},
+		{"numwant=%2010", 10},
+		{"num_want=5", 5},
+		{"num_peers_wanted=7", 7},
+		{"num_peers_wanted=9999", 50},
+		{"numwant=3&num_want=5", 3},
+		{"numwant=abc&num_want=5", 30},
+	} {
+		q, err := queryStringParser(tc.query)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, parseNumWant(q, 30, 50), tc.query)
+	}
+}
+
+func TestQueryStringParserEmptyValues(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected map[announceParam]string
+	}{
+		{"event=&left=0", map[announceParam]string{paramEvent: "", paramLeft: "0"}},
+		{"event=&numwant=&left=0", map[announceParam]string{paramEvent: "", paramNumWant: "", paramLeft: "0"}},
+		{"ip=;port=6881", map[announceParam]string{paramIP: "", paramPort: "6881"}},
+		{"left=0&event=", map[announceParam]string{paramLeft: "0"}},
+	} {
+		q, err := queryStringParser(tc.query)
+		require.NoError(t, err, "Empty values are not malformed: %s", tc.query)
+		require.Equal(t, tc.expected, q.Params, tc.query)
+	}
+}
+
+func TestBitTorrentHandler_AnnounceBanned(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := tracker.NewTestTracker()
+	require.NoError(t, tkr.Torrents.BanListAdd("10.0.0.0/8"))
+	require.NoError(t, tkr.ReloadBanList())
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {peers[0].PeerID.RawString()},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()), nil)
+	req.RemoteAddr = "10.1.2.3:51413"
+	w := httptest.NewRecorder()
+	rh.ServeHTTP(w, req)
+	requireFailure(t, w, "Banned")
+}
+
+func TestBitTorrentHandler_LongURI(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.MaxURILength = 512
+	rh := NewBitTorrentHandler(tkr)
+	request := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RequestURI = path
+		req.RemoteAddr = "1.2.3.4:51413"
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		return w
+	}
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	announce := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+	require.NotContains(t, request(announce).Body.String(), "failure reason")
+	// Padding the query past the limit is rejected before it is parsed
+	requireFailure(t, request(announce+"&pad="+strings.Repeat("x", 512)), "Request URI too long")
+	scrape := fmt.Sprintf("/%s/scrape?", users[0].Passkey)
+	for _, tor := range torrents {
+		scrape += "info_hash=" + url.QueryEscape(tor.InfoHash.RawString()) + "&"
+	}
+	requireFailure(t, request(scrape), "Request URI too long")
+}
+
+func TestBitTorrentHandler_AnnounceNonCompact(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(extra url.Values) bencode.Dict {
+		v := url.Values{
+			"info_hash": {torrents[2].InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"ip":        {"255.255.255.255"},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		for k, val := range extra {
+			v[k] = val
+		}
+		w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+		require.Equal(t, 200, w.Code)
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		return resp.(bencode.Dict)
+	}
+	// Compact is used unless the tracker allows non-compact responses
+	_, isCompact := announce(url.Values{"compact": {"0"}})["peers"].(string)
+	require.True(t, isCompact)
+	tkr.AllowNonCompact = true
+	_, isCompact = announce(nil)["peers"].(string)
+	require.True(t, isCompact)
+	peerList := announce(url.Values{"compact": {"0"}})["peers"].(bencode.List)
+	require.NotEmpty(t, peerList)
+	require.Contains(t, peerList[0].(bencode.Dict), "peer id")
+	peerList = announce(url.Values{"compact": {"0"}, "no_peer_id": {"1"}})["peers"].(bencode.List)
+	require.NotContains(t, peerList[0].(bencode.Dict), "peer id")
+	require.Contains(t, peerList[0].(bencode.Dict), "ip")
+}
+
+func TestBitTorrentHandler_AnnounceDualStack(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {peerID.RawString()},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	before, err := tkr.Peers.GetN(tor.InfoHash, 1000)
+	require.NoError(t, err)
+	for _, remote := range []string{"[2600::1]:51413", "1.2.3.4:51413"} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()), nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+	}
+	// Announces over both families are merged into a single peer
+	after, err := tkr.Peers.GetN(tor.InfoHash, 1000)
+	require.NoError(t, err)
+	require.Equal(t, len(before)+1, len(after))
+	peer, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3.4", peer.IP.String())
+	require.Equal(t, "2600::1", peer.IPv6.String())
+	peers4, peers6 := model.MakeCompactPeers(model.Swarm{peer}, model.PeerID{})
+	require.Equal(t, 6, len(peers4))
+	require.Equal(t, 18, len(peers6))
+}
+
+func TestBitTorrentHandler_AnnounceTrackerID(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	require.NotEmpty(t, tkr.TrackerID, "A id is generated when not configured")
+	tkr.TrackerID = "mika1"
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, 200, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, "mika1", resp.(bencode.Dict)["tracker id"])
+}
+
+func TestBitTorrentHandler_AnnounceRequireCompact(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.AllowNonCompact = true
+	tkr.RequireCompact = true
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+		"compact":   {"0"},
+	}
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	requireFailure(t, w, "Compact announces required")
+	v.Set("compact", "1")
+	w = performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, 200, w.Code)
+	require.NotContains(t, w.Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceClientNotAllowed(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.Whitelist["-qB"] = model.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	requireFailure(t, w, "Client not allowed")
+	tkr.RejectClientMsg = "See the wiki for allowed clients"
+	w = performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	requireFailure(t, w, "See the wiki for allowed clients")
+}
+
+func TestBitTorrentHandler_AnnounceAudit(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	dir, err := ioutil.TempDir("", "mika-audit")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "audit.log")
+	tkr.AuditLog, err = tracker.NewAuditLog(path)
+	require.NoError(t, err)
+	tkr.Whitelist["-qB"] = model.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	requireFailure(t, w, "Client not allowed")
+	require.NoError(t, tkr.AuditLog.Close())
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &line))
+	require.Equal(t, "Client not allowed", line["reason"])
+	require.EqualValues(t, msgClientNotAllowed, line["code"])
+	require.Equal(t, "1.2.3.4", line["ip"])
+	require.Equal(t, "-XX0001-", line["peer_id"])
+	require.EqualValues(t, users[0].UserID, line["user_id"])
+	require.Equal(t, torrents[0].InfoHash.String(), line["info_hash"])
+}
+
+func TestBitTorrentHandler_AnnounceDeprecatedClient(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.DeprecatedClients = []string{"-XX0001-"}
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(peerID string) bencode.Dict {
+		v := url.Values{
+			"info_hash": {torrents[0].InfoHash.RawString()},
+			"peer_id":   {peerID},
+			"ip":        {"255.255.255.255"},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+		require.Equal(t, 200, w.Code)
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		return resp.(bencode.Dict)
+	}
+	resp := announce("-XX0001-123456789012")
+	require.Equal(t, "Your client is outdated, please upgrade", resp["warning message"])
+	require.Contains(t, resp, "peers", "Deprecated clients still receive peers")
+	require.Contains(t, resp, "interval")
+	require.NotContains(t, announce("-XX0002-123456789012"), "warning message")
+}
+
+func TestBitTorrentHandler_ScrapeCompletedPersists(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	completed := tor.TotalCompleted
+	for _, ann := range []struct {
+		event string
+		left  string
+	}{{"started", "1000"}, {"completed", "0"}, {"stopped", "0"}} {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"ip":        {"255.255.255.255"},
+			"port":      {"6881"},
+			"left":      {ann.left},
+			"event":     {ann.event},
+		}
+		w := performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+		require.Equal(t, 200, w.Code, ann.event)
+	}
+	_, err := tkr.Peers.Get(tor.InfoHash, model.PeerIDFromString("-XX0001-123456789012"))
+	require.Error(t, err, "Stopped peer should have left the swarm")
+	v := url.Values{"info_hash": {tor.InfoHash.RawString()}}
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/scrape?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, 200, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	stats := resp.(bencode.Dict)[tor.InfoHash.String()].(bencode.Dict)
+	require.EqualValues(t, completed+1, stats["downloaded"])
+}
+
+func TestBitTorrentHandler_AnnouncePublic(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.Whitelist["-QQ0001-"] = model.WhiteListClient{ClientPrefix: "-QQ0001-", ClientName: "Allowed"}
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(passkey string, ih model.InfoHash, peerID string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {ih.RawString()},
+			"peer_id":   {peerID},
+			"ip":        {"255.255.255.255"},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", passkey, v.Encode()))
+	}
+	private, public := torrents[0], torrents[1]
+	public.Visibility = model.Public
+	requireFailure(t, announce("anonymous", private.InfoHash, "-XX0001-123456789012"), "Invalid passkey")
+	require.NotContains(t, announce("anonymous", public.InfoHash, "-XX0001-123456789012").Body.String(), "failure reason",
+		"Passkey and client whitelist are not enforced for public torrents")
+	anon, err := tkr.Peers.Get(public.InfoHash, model.PeerIDFromString("-XX0001-123456789012"))
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), anon.UserID)
+	require.NotContains(t, announce(users[0].Passkey, public.InfoHash, "-QQ0001-123456789012").Body.String(), "failure reason")
+	known, err := tkr.Peers.Get(public.InfoHash, model.PeerIDFromString("-QQ0001-123456789012"))
+	require.NoError(t, err)
+	require.Equal(t, users[0].UserID, known.UserID, "Valid passkeys are still credited")
+
+	unknown := model.InfoHashFromString("unknown-public-hash!")
+	// Unknown torrents are not revealed without a valid passkey
+	requireFailure(t, announce("anonymous", unknown, "-XX0001-123456789012"), "Invalid passkey")
+	requireFailure(t, announce(users[0].Passkey, unknown, "-QQ0001-123456789012"), "Unregistered torrent")
+	tkr.PublicAutoRegister = true
+	require.NotContains(t, announce("anonymous", unknown, "-XX0001-123456789012").Body.String(), "failure reason")
+	registered, err := tkr.Torrents.Get(unknown)
+	require.NoError(t, err)
+	require.True(t, registered.IsPublic())
+}
+
+func TestBitTorrentHandler_AnnounceIPConcurrency(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.MaxIPConcurrency = 1
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"ip":        {"255.255.255.255"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	u := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+	// Simulate a announce from the same ip which is still being processed
+	ip := net.ParseIP("1.2.3.4")
+	require.True(t, tkr.AcquireIP(ip))
+	requireFailure(t, performRequest(rh, "GET", u), "Too many concurrent requests")
+	tkr.ReleaseIP(ip)
+	require.NotContains(t, performRequest(rh, "GET", u).Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceIPOverride(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.IPOverrideAllowlist = []*net.IPNet{{IP: net.ParseIP("1.2.3.4"), Mask: net.CIDRMask(32, 32)}}
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {peerID.RawString()},
+		"ip":        {"5.6.7.8"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	announce := func(remote string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()), nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		return w
+	}
+	require.NotContains(t, announce("9.9.9.9:51413").Body.String(), "failure reason")
+	peer, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.Equal(t, "9.9.9.9", peer.IP.String(), "Override ignored outside of the allowlist")
+	require.NotContains(t, announce("1.2.3.4:51413").Body.String(), "failure reason")
+	peer, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.Equal(t, "5.6.7.8", peer.IP.String())
+	tkr.IPOverrideReject = true
+	requireFailure(t, announce("9.9.9.9:51413"), "Not allowed to set the ip param")
+}
+
+func TestBitTorrentHandler_AnnounceDedup(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.AnnounceDedupWindow = time.Minute
+	tkr.AnnounceDedupSize = 100
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	announce := func(event string, uploaded string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {peerID.RawString()},
+			"port":      {"6881"},
+			"left":      {"0"},
+			"uploaded":  {uploaded},
+		}
+		if event != "" {
+			v.Set("event", event)
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	require.NotContains(t, announce("started", "0").Body.String(), "failure reason")
+	first := announce("", "1000")
+	require.NotContains(t, first.Body.String(), "failure reason")
+	// A processed duplicate would be rate limited
+	tkr.RateLimitInterval = time.Minute
+	dupe := announce("", "1000")
+	require.Equal(t, http.StatusOK, dupe.Code)
+	require.Equal(t, first.Body.String(), dupe.Body.String())
+	// Not a duplicate
+	requireFailure(t, announce("", "2000"), "Rate limited")
+	// A stop immediately followed by a start is processed normally
+	require.NotContains(t, announce("stopped", "2000").Body.String(), "failure reason")
+	_, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.Error(t, err)
+	require.NotContains(t, announce("started", "2000").Body.String(), "failure reason")
+	_, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+}
+
+func TestBitTorrentHandler_AnnounceExternalIP(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{
+		"info_hash": {torrents[0].InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	u := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+	externalIP := func(remote string, forwarded string) interface{} {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		return resp.(bencode.Dict)["external ip"]
+	}
+	require.Nil(t, externalIP("1.2.3.4:51413", ""), "Disabled by default")
+	tkr.ReturnExternalIP = true
+	require.Equal(t, string([]byte{1, 2, 3, 4}), externalIP("1.2.3.4:51413", ""))
+	require.Equal(t, string(net.ParseIP("2600::1").To16()), externalIP("[2600::1]:51413", ""))
+	tkr.TrustedProxies = []*net.IPNet{{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}}
+	require.Equal(t, string([]byte{5, 6, 7, 8}), externalIP("10.0.0.1:51413", "5.6.7.8"),
+		"Uses the client address forwarded by the proxy")
+	tkr.ExternalIPString = true
+	require.Equal(t, "1.2.3.4", externalIP("1.2.3.4:51413", ""))
+}
+
+func TestBitTorrentHandler_AnnounceUserAgent(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.ClientUserAgents = tracker.ParseUserAgentRules([]string{"-qB ^qBittorrent/"})
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-qB4500-123456789012")
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {peerID.RawString()},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	announce := func(userAgent string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()), nil)
+		req.RemoteAddr = "1.2.3.4:51413"
+		req.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		return w
+	}
+	require.NotContains(t, announce("qBittorrent/4.5.0").Body.String(), "failure reason")
+	peer, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.False(t, peer.Flagged)
+	require.NotContains(t, announce("FakeClient/1.0").Body.String(), "failure reason", "Only flagged by default")
+	peer, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.True(t, peer.Flagged)
+	tkr.ClientUserAgentStrict = true
+	requireFailure(t, announce("FakeClient/1.0"), "User-Agent does not match the client")
+	require.NotContains(t, announce("qBittorrent/4.5.0").Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceIDLength(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	ih := torrents[0].InfoHash.RawString()
+	announce := func(infoHash string, peerID string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {infoHash},
+			"peer_id":   {peerID},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		u := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+		req, _ := http.NewRequest("GET", u, nil)
+		req.RemoteAddr = "1.2.3.4:51413"
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		return w
+	}
+	for _, peerID := range []string{"-XX0001-12345678901", "-XX0001-1234567890123"} {
+		requireFailure(t, announce(ih, peerID), "Peer ID invalid")
+	}
+	for _, infoHash := range []string{ih[:19], ih + "x"} {
+		requireFailure(t, announce(infoHash, "-XX0001-123456789012"), "Invalid info hash")
+	}
+	require.NotContains(t, announce(ih, "-XX0001-123456789012").Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceDownloadSlots(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.DownloadSlotsRetry = time.Minute * 5
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	leecher := model.NewPeer(1, model.PeerIDFromString("-XX0001-000000000001"), net.ParseIP("1.2.3.4"), 6881)
+	leecher.Left = 1000
+	require.NoError(t, tkr.Peers.Add(tor.InfoHash, leecher))
+	_, leechers, err := tkr.Peers.CountsOnly(tor.InfoHash)
+	require.NoError(t, err)
+	tor.MaxLeechers = uint32(leechers)
+	announce := func(peerID string, left string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {peerID},
+			"ip":        {"255.255.255.255"},
+			"port":      {"6881"},
+			"left":      {left},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	resp := requireFailure(t, announce("-XX0001-123456789012", "1000"), "Download slots full, retry later")
+	require.EqualValues(t, 5, resp["retry in"])
+	require.NotContains(t, announce("-XX0001-210987654321", "0").Body.String(), "failure reason",
+		"Seeders are not limited")
+	tor.MaxLeechers = uint32(leechers + 1)
+	require.NotContains(t, announce("-XX0001-123456789012", "1000").Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceEarly(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 60
+	// Disable the hard rate limit so only the early announce enforcement applies
+	tkr.RateLimitGrace = time.Minute
+	tkr.MinIntervalEnforce = true
+	tkr.MinIntervalGrace = time.Second * 5
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	announce := func(event string, uploaded string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {peerID.RawString()},
+			"port":      {"6881"},
+			"left":      {"0"},
+			"uploaded":  {uploaded},
+		}
+		if event != "" {
+			v.Set("event", event)
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	require.NotContains(t, announce("started", "0").Body.String(), "failure reason")
+	peer, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	announces := peer.Announces
+	w := announce("", "1000")
+	require.Equal(t, http.StatusOK, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.NotNil(t, resp.(bencode.Dict)["peers"])
+	peer, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.Equal(t, announces, peer.Announces, "Early announces are not counted")
+	require.EqualValues(t, 0, peer.Uploaded, "Early announces are not applied")
+	// Event announces are always applied
+	require.NotContains(t, announce("completed", "1000").Body.String(), "failure reason")
+	peer, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, peer.Uploaded)
+	tkr.MinIntervalEnforce = false
+	require.NotContains(t, announce("", "2000").Body.String(), "failure reason")
+	peer, err = tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	require.EqualValues(t, 2000, peer.Uploaded)
+}
+
+func TestBitTorrentHandler_AnnounceStoppedInWindow(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 60
+	tkr.RateLimitInterval = time.Minute
+	tkr.MinIntervalEnforce = true
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	announce := func(event string, uploaded string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {peerID.RawString()},
+			"port":      {"6881"},
+			"left":      {"0"},
+			"uploaded":  {uploaded},
+		}
+		if event != "" {
+			v.Set("event", event)
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	require.NotContains(t, announce("started", "0").Body.String(), "failure reason")
+	requireFailure(t, announce("", "500"), "Rate limited")
+	// Stopping inside both windows is applied and removes the peer
+	require.NotContains(t, announce("stopped", "1000").Body.String(), "failure reason")
+	_, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.Error(t, err, "Stopped peer should have left the swarm")
+}
+
+func TestBitTorrentHandler_AnnounceAddressFamily(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	tor.AddressFamily = model.FamilyV6
+	tkr.IPOverrideAllowlist = []*net.IPNet{{IP: net.ParseIP("1.2.3.4"), Mask: net.CIDRMask(32, 32)}}
+	announce := func(remote string, ipv6 string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		if ipv6 != "" {
+			v.Set("ipv6", ipv6)
+		}
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()), nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		return w
+	}
+	requireFailure(t, announce("1.2.3.4:51413", ""), "Address family not allowed on this torrent")
+	w := announce("1.2.3.4:51413", "2600::1")
+	require.EqualValues(t, http.StatusOK, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Nil(t, resp.(bencode.Dict)["failure reason"])
+	require.Empty(t, resp.(bencode.Dict)["peers"], "Only v6 peers are returned")
+	tor.AddressFamily = model.FamilyV4
+	requireFailure(t, announce("[2600::1]:51413", ""), "Address family not allowed on this torrent")
+	require.NotContains(t, announce("1.2.3.4:51413", "").Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceKey(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.RequirePeerKey = true
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(key string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {torrents[0].InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"port":      {"6881"},
+			"left":      {"0"},
+			"key":       {key},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	require.NotContains(t, announce("abcd").Body.String(), "failure reason")
+	requireFailure(t, announce("efgh"), "Invalid key")
+	require.NotContains(t, announce("abcd").Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceUserPeers(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.MaxUserPeersPerTorrent = 1
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(peerID string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {torrents[0].InfoHash.RawString()},
+			"peer_id":   {peerID},
+			"port":      {"6881"},
+			"left":      {"0"},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	require.NotContains(t, announce("-XX0001-123456789012").Body.String(), "failure reason")
+	requireFailure(t, announce("-XX0001-210987654321"), "Too many active peers for this torrent")
+	require.NotContains(t, announce("-XX0001-123456789012").Body.String(), "failure reason",
+		"Existing peers of the user are unaffected")
+}
+
+func TestBitTorrentHandler_AnnounceDatacenter(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.ASNCacheTTL = time.Minute
+	tkr.ASNBlockList = map[uint]bool{16509: true}
+	tkr.CacheASN(net.ParseIP("1.2.3.4"), 16509)
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	tor.BlockDatacenter = true
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	path := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+	requireFailure(t, performRequest(rh, "GET", path), "Datacenter peers are not allowed on this torrent")
+	users[0].Seedbox = true
+	require.NotContains(t, performRequest(rh, "GET", path).Body.String(), "failure reason")
+}
+
+func TestBitTorrentHandler_AnnounceRejectedNotCounted(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	tor.IsEnabled = false
+	tor.Reason = "Trumped"
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	path := fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode())
+	requireFailure(t, performRequest(rh, "GET", path), "Trumped")
+	require.True(t, tor.LastActive.IsZero(), "Rejected announces are not activity")
+	tor.IsEnabled = true
+	require.NotContains(t, performRequest(rh, "GET", path).Body.String(), "failure reason")
+	require.Equal(t, time.Now().Truncate(time.Minute).Unix(), tor.LastActive.Unix())
+}
+
+func TestBitTorrentHandler_AnnounceCorrupt(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	tkr.CorruptMode = tracker.CorruptPenalize
+	tkr.CorruptRatio = 0.05
+	rh := NewBitTorrentHandler(tkr)
+	users[0].Downloaded = 1000
+	require.NoError(t, tkr.AccountCorrupt(users[0], 100))
+	announce := func(left string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {torrents[0].InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"port":      {"6881"},
+			"left":      {left},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	requireFailure(t, announce("1000"), "Too much corrupt data reported")
+	require.NotContains(t, announce("0").Body.String(), "failure reason", "Flagged users may still seed")
+}
+
+func TestBitTorrentHandler_AnnounceInvalidLeft(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.LeftValidation = tracker.LeftValidationReject
+	rh := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	tor.Size = 1000
+	announce := func(left string) *httptest.ResponseRecorder {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {"-XX0001-123456789012"},
+			"port":      {"6881"},
+			"left":      {left},
+		}
+		return performRequest(rh, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	}
+	requireFailure(t, announce("1001"), "Invalid left")
+	require.NotContains(t, announce("1000").Body.String(), "failure reason")
+}
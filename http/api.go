@@ -2,12 +2,22 @@
 package http
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/tracker"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // AdminAPI is the interface for administering a live server over HTTP
@@ -15,6 +25,22 @@ type AdminAPI struct {
 	t *tracker.Tracker
 }
 
+// tokenAuth rejects any request which does not include the shared secret as a bearer token
+func tokenAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "Unauthorized",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// infoHashFromCtx reads the info_hash url param. Both the 40 character hex encoded and
+// raw 20 byte forms are accepted.
 func infoHashFromCtx(c *gin.Context) (model.InfoHash, bool) {
 	ihStr := c.Param("info_hash")
 	if ihStr == "" {
@@ -23,26 +49,576 @@ func infoHashFromCtx(c *gin.Context) (model.InfoHash, bool) {
 		})
 		return model.InfoHash{}, false
 	}
+	if len(ihStr) == 40 {
+		ih, err := model.InfoHashFromHex(ihStr)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"message": "Invalid info hash",
+			})
+			return model.InfoHash{}, false
+		}
+		return ih, true
+	}
 	return model.InfoHashFromString(ihStr), true
 }
+
+// TorrentAddParams defines the parameters used to register a new torrent with the tracker
+type TorrentAddParams struct {
+	// Hex encoded info hash
+	InfoHash    string `json:"info_hash"`
+	TorrentID   uint32 `json:"torrent_id"`
+	ReleaseName string `json:"release_name"`
+	Freeleech   bool   `json:"freeleech"`
+	// BlockDatacenter denies announces from datacenter ASNs for non seedbox users
+	BlockDatacenter bool `json:"block_datacenter"`
+	// HNRThreshold overrides the global HNR threshold, in seconds
+	HNRThreshold uint32 `json:"hnr_threshold"`
+	// MaxLeechers caps the leechers in the swarm, overriding the global limit
+	MaxLeechers uint32 `json:"max_leechers"`
+	// Visibility is either public or private, defaulting to private
+	Visibility model.Visibility `json:"visibility"`
+	// AddressFamily restricts the swarm to v4 or v6 peers, defaulting to both
+	AddressFamily model.AddressFamily `json:"address_family"`
+	// Total size of the torrents contents in bytes
+	Size uint64 `json:"size"`
+}
+
+// validFamily checks the address family is one of the known values. Empty values are
+// treated as both.
+func validFamily(f model.AddressFamily) bool {
+	return f == "" || f == model.FamilyBoth || f == model.FamilyV4 || f == model.FamilyV6
+}
+
+// validVisibility checks the visibility is one of the known values. Empty values are
+// treated as private.
+func validVisibility(v model.Visibility) bool {
+	return v == "" || v == model.Private || v == model.Public
+}
+
+func (a *AdminAPI) torrentAdd(c *gin.Context) {
+	var tap TorrentAddParams
+	if err := c.BindJSON(&tap); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+	ih, err := model.InfoHashFromHex(tap.InfoHash)
+	if err != nil || tap.ReleaseName == "" || !validVisibility(tap.Visibility) ||
+		!validFamily(tap.AddressFamily) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid info hash or release name",
+		})
+		return
+	}
+	t := model.NewTorrent(ih, tap.ReleaseName, tap.TorrentID)
+	t.Freeleech = tap.Freeleech
+	t.BlockDatacenter = tap.BlockDatacenter
+	t.HNRThreshold = tap.HNRThreshold
+	t.MaxLeechers = tap.MaxLeechers
+	t.Visibility = tap.Visibility
+	t.AddressFamily = tap.AddressFamily
+	t.Size = tap.Size
+	if err := a.t.Torrents.Add(t); err != nil {
+		if errors.Is(err, consts.ErrDuplicate) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"message": "Torrent already exists",
+			})
+			return
+		}
+		c.AbortWithStatusJSON(apiStatus(err), gin.H{})
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+// apiStatus maps the kind of a store or tracker error to the http status returned by the admin api
+func apiStatus(err error) int {
+	switch consts.KindOf(err) {
+	case consts.KindInvalid:
+		return http.StatusBadRequest
+	case consts.KindNotFound:
+		return http.StatusNotFound
+	case consts.KindDuplicate:
+		return http.StatusConflict
+	case consts.KindUnauthorized:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (a *AdminAPI) torrentGeo(c *gin.Context) {
+	ih, ok := infoHashFromCtx(c)
+	if !ok {
+		return
+	}
+	if !a.t.GeoStatsEnabled {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "Geo stats are not enabled",
+		})
+		return
+	}
+	if _, err := a.t.Torrents.Get(ih); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	counts, err := a.t.GeoStats(ih)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, counts)
+}
+
+// SwarmPeer is the admin view of a single peer within a swarm. Addresses are redacted
+// to their network prefix unless the full details are requested.
+type SwarmPeer struct {
+	PeerID        model.PeerID `json:"peer_id"`
+	UserID        uint32       `json:"user_id"`
+	Client        string       `json:"client"`
+	IP            net.IP       `json:"addr_ip"`
+	IPv6          net.IP       `json:"addr_ipv6"`
+	Port          uint16       `json:"addr_port"`
+	CountryCode   string       `json:"country_code"`
+	Uploaded      uint32       `json:"total_uploaded"`
+	Downloaded    uint32       `json:"total_downloaded"`
+	Left          uint32       `json:"total_left"`
+	SpeedUP       uint32       `json:"speed_up"`
+	SpeedDN       uint32       `json:"speed_dn"`
+	Announces     uint32       `json:"total_announces"`
+	Completed     bool         `json:"completed"`
+	Flagged       bool         `json:"flagged"`
+	Paused        bool         `json:"paused"`
+	Partial       bool         `json:"partial"`
+	SuperSeeding  bool         `json:"super_seeding"`
+	AnnounceFirst time.Time    `json:"first_announce"`
+	AnnounceLast  time.Time    `json:"last_announce"`
+}
+
+// redactIP masks an address down to the network a peer is in, /24 for IPv4 and /48 for IPv6
+func redactIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// newSwarmPeer copies the peer while holding its read lock so an announce updating the peer
+// concurrently cannot produce a partially updated response
+func newSwarmPeer(peer *model.Peer, full bool) SwarmPeer {
+	peer.RLock()
+	defer peer.RUnlock()
+	sp := SwarmPeer{
+		PeerID:        peer.PeerID,
+		UserID:        peer.UserID,
+		Client:        peer.Client,
+		IP:            peer.IP,
+		IPv6:          peer.IPv6,
+		Port:          peer.Port,
+		CountryCode:   peer.CountryCode,
+		Uploaded:      peer.Uploaded,
+		Downloaded:    peer.Downloaded,
+		Left:          peer.Left,
+		SpeedUP:       peer.SpeedUP,
+		SpeedDN:       peer.SpeedDN,
+		Announces:     peer.Announces,
+		Completed:     peer.Completed,
+		Flagged:       peer.Flagged,
+		Paused:        peer.Paused,
+		Partial:       peer.Partial,
+		SuperSeeding:  peer.SuperSeeding,
+		AnnounceFirst: peer.AnnounceFirst,
+		AnnounceLast:  peer.AnnounceLast,
+	}
+	if !full {
+		sp.IP = redactIP(sp.IP)
+		sp.IPv6 = redactIP(sp.IPv6)
+	}
+	return sp
+}
+
+// torrentPeers lists the peers in a torrents swarm, including the name of the client used
+// by each peer. Peers are ordered by peer id and paginated using the limit (default 100) and
+// offset query params. Peers which have missed their last announce (nothing received for
+// twice the announce interval) are only included when inactive=true. Peer addresses are
+// redacted to their /24 (IPv4) or /48 (IPv6) network unless full=true.
+func (a *AdminAPI) torrentPeers(c *gin.Context) {
+	ih, ok := infoHashFromCtx(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid limit",
+		})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid offset",
+		})
+		return
+	}
+	inactive := c.Query("inactive") == "true"
+	full := c.Query("full") == "true"
+	peers, err := a.t.Peers.GetN(ih, math.MaxInt32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	// Without a valid interval there is no way to tell when a peer missed an announce
+	maxAge := time.Duration(a.t.AnnInterval*2) * time.Second
+	activeAfter := time.Now().Add(-maxAge)
+	swarm := make([]SwarmPeer, 0, len(peers))
+	for _, peer := range peers {
+		sp := newSwarmPeer(peer, full)
+		if !inactive && maxAge > 0 && sp.AnnounceLast.Before(activeAfter) {
+			continue
+		}
+		swarm = append(swarm, sp)
+	}
+	sort.Slice(swarm, func(i, j int) bool {
+		return bytes.Compare(swarm[i].PeerID[:], swarm[j].PeerID[:]) < 0
+	})
+	if offset > len(swarm) {
+		offset = len(swarm)
+	}
+	swarm = swarm[offset:]
+	if limit < len(swarm) {
+		swarm = swarm[:limit]
+	}
+	c.JSON(http.StatusOK, swarm)
+}
+
+// TopTorrent is a torrent ranked by its recent announce activity
+type TopTorrent struct {
+	InfoHash        string  `json:"info_hash"`
+	TorrentID       uint32  `json:"torrent_id"`
+	ReleaseName     string  `json:"release_name"`
+	Announces       int64   `json:"announces"`
+	Scrapes         int64   `json:"scrapes"`
+	RecentAnnounces float64 `json:"recent_announces"`
+	RecentScrapes   float64 `json:"recent_scrapes"`
+}
+
+// torrentsTop lists the torrents with the most recent announces, highest first. The number of
+// torrents returned is set with the limit query param (default 10, max 100). Requests are only
+// counted when tracker_activity_interval is set.
+func (a *AdminAPI) torrentsTop(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid limit",
+		})
+		return
+	}
+	activity, err := a.t.TopTorrents(limit)
+	if err != nil {
+		log.Errorf("Failed to fetch top torrents: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	hashes := make([]model.InfoHash, len(activity))
+	for i, act := range activity {
+		hashes[i] = act.InfoHash
+	}
+	torrents, err := a.t.Torrents.GetMulti(hashes)
+	if err != nil {
+		log.Errorf("Failed to fetch top torrents: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	known := make(map[model.InfoHash]*model.Torrent, len(torrents))
+	for _, tor := range torrents {
+		known[tor.InfoHash] = tor
+	}
+	top := make([]TopTorrent, 0, len(activity))
+	for _, act := range activity {
+		tt := TopTorrent{
+			InfoHash:        act.InfoHash.String(),
+			Announces:       act.Announces,
+			Scrapes:         act.Scrapes,
+			RecentAnnounces: act.RecentAnnounces,
+			RecentScrapes:   act.RecentScrapes,
+		}
+		// Torrents deleted since they were counted are still listed
+		if tor, found := known[act.InfoHash]; found {
+			tt.TorrentID = tor.TorrentID
+			tt.ReleaseName = tor.ReleaseName
+		}
+		top = append(top, tt)
+	}
+	c.JSON(http.StatusOK, top)
+}
+
+// PruneResult is the number of inactive torrents removed by a prune
+type PruneResult struct {
+	Pruned    int    `json:"pruned"`
+	OlderThan string `json:"older_than"`
+}
+
+// torrentsPrune removes the torrents without announces within the older_than query param, eg:
+// 720h, along with their swarms. tracker_prune_inactive is used when the param is not given.
+func (a *AdminAPI) torrentsPrune(c *gin.Context) {
+	olderThan := a.t.PruneInactive
+	if v := c.Query("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": "Invalid older_than duration",
+			})
+			return
+		}
+		olderThan = d
+	}
+	if olderThan <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Inactive period must be greater than 0",
+		})
+		return
+	}
+	pruned, err := a.t.PruneTorrents(olderThan)
+	if err != nil {
+		log.Errorf("Failed to prune torrents: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, PruneResult{Pruned: pruned, OlderThan: olderThan.String()})
+}
+
+// peerHistory returns the recent announces of a peer, oldest first. The peer_id param is
+// the hex encoded peer id.
+func (a *AdminAPI) peerHistory(c *gin.Context) {
+	ih, ok := infoHashFromCtx(c)
+	if !ok {
+		return
+	}
+	if a.t.PeerHistorySize <= 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "Announce history is disabled",
+		})
+		return
+	}
+	id, err := hex.DecodeString(c.Param("peer_id"))
+	if err != nil || len(id) != 20 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid peer id",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, a.t.PeerHistory(ih, model.PeerIDFromString(string(id))))
+}
+
+// UserStrikes is the number of impossible upload speeds a user has reported
+type UserStrikes struct {
+	UserID  uint32 `json:"user_id"`
+	Strikes uint   `json:"strikes"`
+}
+
+func (a *AdminAPI) userStrikes(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid user id",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, UserStrikes{
+		UserID:  uint32(userID),
+		Strikes: a.t.Strikes(uint32(userID)),
+	})
+}
+
+// UserPoints is the bonus points total of a user
+type UserPoints struct {
+	UserID uint32  `json:"user_id"`
+	Points float64 `json:"points"`
+}
+
+func (a *AdminAPI) userPoints(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid user id",
+		})
+		return
+	}
+	usr, err := a.t.Users.GetByID(uint32(userID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, UserPoints{
+		UserID: usr.UserID,
+		Points: usr.Points,
+	})
+}
+
+// UserSpeed is the total speed of all of a users active peers in bytes/sec
+type UserSpeed struct {
+	UserID  uint32 `json:"user_id"`
+	SpeedUP uint64 `json:"speed_up"`
+	SpeedDN uint64 `json:"speed_dn"`
+}
+
+func (a *AdminAPI) userSpeed(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid user id",
+		})
+		return
+	}
+	usr, err := a.t.Users.GetByID(uint32(userID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	up, dn, err := a.t.UserSpeed(usr.UserID)
+	if err != nil {
+		log.Errorf("Failed to fetch user speed: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, UserSpeed{
+		UserID:  usr.UserID,
+		SpeedUP: up,
+		SpeedDN: dn,
+	})
+}
+
+// UserCorrupt is the corrupt data total of a user. Flagged is set when the total exceeds
+// tracker_corrupt_ratio of their downloads.
+type UserCorrupt struct {
+	UserID     uint32 `json:"user_id"`
+	Corrupt    uint64 `json:"corrupt"`
+	Downloaded uint64 `json:"downloaded"`
+	Flagged    bool   `json:"flagged"`
+}
+
+func (a *AdminAPI) userCorrupt(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid user id",
+		})
+		return
+	}
+	usr, err := a.t.Users.GetByID(uint32(userID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, UserCorrupt{
+		UserID:     usr.UserID,
+		Corrupt:    usr.Corrupt,
+		Downloaded: usr.Downloaded,
+		Flagged:    a.t.CorruptFlagged(usr),
+	})
+}
+
+// UserSnatch is a torrent completed by a user
+type UserSnatch struct {
+	InfoHash  string    `json:"info_hash"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+func (a *AdminAPI) userSnatches(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid user id",
+		})
+		return
+	}
+	usr, err := a.t.Users.GetByID(uint32(userID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	snatches, err := a.t.Users.GetSnatches(usr.UserID)
+	if err != nil {
+		log.Errorf("Failed to fetch user snatches: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	results := make([]UserSnatch, len(snatches))
+	for i, s := range snatches {
+		results[i] = UserSnatch{
+			InfoHash:  s.InfoHash.String(),
+			CreatedOn: s.CreatedOn,
+		}
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// torrentGet returns the torrent, including when it was registered and last announced
+func (a *AdminAPI) torrentGet(c *gin.Context) {
+	ih, ok := infoHashFromCtx(c)
+	if !ok {
+		return
+	}
+	t, err := a.t.Torrents.Get(ih)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
 func (a *AdminAPI) torrentDelete(c *gin.Context) {
 	ih, ok := infoHashFromCtx(c)
 	if !ok {
 		return
 	}
+	t, err := a.t.Torrents.Get(ih)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{})
+		return
+	}
+	// Evict the swarm so the peers no longer exist in the store
+	peers, err := a.t.Peers.GetN(ih, math.MaxInt32)
+	if err == nil {
+		for _, p := range peers {
+			if err := a.t.Peers.Delete(ih, p); err != nil {
+				log.Errorf("Failed to remove peer from deleted torrent: %s", err.Error())
+			}
+		}
+	}
 	if err := a.t.Torrents.Delete(ih, true); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		c.AbortWithStatusJSON(apiStatus(err), gin.H{})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{})
+	a.t.DropPeerList(ih)
+	t.Lock()
+	t.IsDeleted = true
+	t.Unlock()
+	c.JSON(http.StatusOK, t)
 }
 
 // TorrentUpdatePrams defines what parameters we accept for updating a torrent. This is only
-// a subset of the fields as not all should be considered mutable
+// a subset of the fields as not all should be considered mutable. Fields which are not
+// supplied are left unchanged.
 type TorrentUpdatePrams struct {
-	IsDeleted bool   `json:"is_deleted"`
-	IsEnabled bool   `json:"is_enabled"`
-	Reason    string `json:"reason"`
+	IsDeleted *bool   `json:"is_deleted"`
+	IsEnabled *bool   `json:"is_enabled"`
+	Reason    *string `json:"reason"`
+	// MultiUp sets the upload multiplier of the torrent, eg: 2.0 for double upload
+	MultiUp *float64 `json:"multi_up"`
+	// BlockDatacenter toggles denying announces from datacenter ASNs
+	BlockDatacenter *bool `json:"block_datacenter"`
+	// HNRThreshold sets the HNR threshold of the torrent in seconds, 0 uses the global threshold
+	HNRThreshold *uint32 `json:"hnr_threshold"`
+	// MaxLeechers sets the leecher limit of the torrent, 0 uses the global limit
+	MaxLeechers *uint32 `json:"max_leechers"`
+	// Visibility sets the torrent to public or private
+	Visibility *model.Visibility `json:"visibility"`
+	// AddressFamily restricts the swarm to v4 or v6 peers
+	AddressFamily *model.AddressFamily `json:"address_family"`
 }
 
 func (a *AdminAPI) torrentUpdate(c *gin.Context) {
@@ -60,17 +636,48 @@ func (a *AdminAPI) torrentUpdate(c *gin.Context) {
 		return
 	}
 	var tup TorrentUpdatePrams
-	if err := c.BindJSON(&tup); err != nil {
+	if err := c.BindJSON(&tup); err != nil || (tup.MultiUp != nil && *tup.MultiUp < 0) ||
+		(tup.Visibility != nil && !validVisibility(*tup.Visibility)) ||
+		(tup.AddressFamily != nil && !validFamily(*tup.AddressFamily)) {
 		c.JSON(http.StatusBadRequest, gin.H{})
 		return
 	}
 	t.Lock()
-	t.Reason = tup.Reason
-	t.IsDeleted = tup.IsDeleted
-	t.IsEnabled = tup.IsEnabled
+	if tup.Reason != nil {
+		t.Reason = *tup.Reason
+	}
+	if tup.IsDeleted != nil {
+		t.IsDeleted = *tup.IsDeleted
+	}
+	if tup.IsEnabled != nil {
+		t.IsEnabled = *tup.IsEnabled
+	}
+	if tup.MultiUp != nil {
+		t.MultiUp = *tup.MultiUp
+	}
+	if tup.BlockDatacenter != nil {
+		t.BlockDatacenter = *tup.BlockDatacenter
+	}
+	if tup.HNRThreshold != nil {
+		t.HNRThreshold = *tup.HNRThreshold
+	}
+	if tup.MaxLeechers != nil {
+		t.MaxLeechers = *tup.MaxLeechers
+	}
+	if tup.Visibility != nil {
+		t.Visibility = *tup.Visibility
+	}
+	if tup.AddressFamily != nil {
+		t.AddressFamily = *tup.AddressFamily
+	}
+	t.UpdatedOn = time.Now()
 	t.Unlock()
-	c.JSON(http.StatusOK, tup)
-
+	if err := a.t.Torrents.Update(t); err != nil {
+		log.Errorf("Failed to persist torrent update: %s", err.Error())
+		c.AbortWithStatusJSON(apiStatus(err), gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, t)
 }
 
 func (a *AdminAPI) userUpdate(c *gin.Context) {
@@ -99,6 +706,52 @@ func (a *AdminAPI) configUpdate(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
+func (a *AdminAPI) whitelistReload(c *gin.Context) {
+	if err := a.t.ReloadWhitelist(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func (a *AdminAPI) banListReload(c *gin.Context) {
+	if err := a.t.ReloadBanList(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// HealthResponse is returned by the health check endpoint
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Reason the tracker is unhealthy, empty when healthy
+	Reason string `json:"reason,omitempty"`
+	// LastSync is when the peer store last wrote its queued updates, if it batches them
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	// LivePeers is the number of peers across all swarms as of the last reap
+	LivePeers int64 `json:"live_peers"`
+}
+
+// healthz responds with 200 when the backing stores can be reached and 503 otherwise
+func (a *AdminAPI) healthz(c *gin.Context) {
+	resp := HealthResponse{
+		Status:    "ok",
+		LivePeers: a.t.LivePeers(),
+	}
+	if lastSync := a.t.LastSync(); !lastSync.IsZero() {
+		resp.LastSync = &lastSync
+	}
+	if err := a.t.Ping(); err != nil {
+		log.Warnf("Health check failed: %s", err.Error())
+		resp.Status = "unavailable"
+		resp.Reason = err.Error()
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func (a *AdminAPI) stats(c *gin.Context) {
 
 }
@@ -0,0 +1,364 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chihaya/bencode"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func performAPIRequest(r http.Handler, method, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewReader(b))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAPI_Auth(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "secret")
+	require.Equal(t, http.StatusUnauthorized, performAPIRequest(rh, "POST", "/whitelist/reload", "", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, performAPIRequest(rh, "POST", "/whitelist/reload", "invalid", nil).Code)
+	require.Equal(t, http.StatusOK, performAPIRequest(rh, "POST", "/whitelist/reload", "secret", nil).Code)
+}
+
+func TestAdminAPI_TorrentAddDelete(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "secret")
+	tap := TorrentAddParams{
+		InfoHash:    "0123456789abcdef0123456789abcdef01234567",
+		TorrentID:   1234,
+		ReleaseName: "Show.Title.S01E01.720p.WEB.h264-GRP",
+	}
+	require.Equal(t, http.StatusCreated, performAPIRequest(rh, "POST", "/torrent", "secret", tap).Code)
+	require.Equal(t, http.StatusConflict, performAPIRequest(rh, "POST", "/torrent", "secret", tap).Code)
+	ih, _ := model.InfoHashFromHex(tap.InfoHash)
+	tor, err := tkr.Torrents.Get(ih)
+	require.NoError(t, err)
+	require.Equal(t, tap.TorrentID, tor.TorrentID)
+	tap.InfoHash = "invalid"
+	require.Equal(t, http.StatusBadRequest, performAPIRequest(rh, "POST", "/torrent", "secret", tap).Code)
+
+	ih = torrents[0].InfoHash
+	w := performAPIRequest(rh, "DELETE", "/torrent/"+ih.String(), "secret", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	_, err = tkr.Torrents.Get(ih)
+	require.Error(t, err)
+	peers, _ := tkr.Peers.GetN(ih, 100)
+	require.Empty(t, peers)
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "DELETE", "/torrent/"+ih.String(), "secret", nil).Code)
+}
+
+func TestAdminAPI_TorrentUpdate(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "")
+	bt := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	tor.Reason = "Trumped"
+	disabled := false
+	w := performAPIRequest(rh, "PATCH", "/torrent/"+tor.InfoHash.String(), "",
+		TorrentUpdatePrams{IsEnabled: &disabled})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.False(t, tor.IsEnabled)
+	// Fields not supplied are left unchanged
+	require.Equal(t, "Trumped", tor.Reason)
+
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {"-XX0001-123456789012"},
+		"ip":        {"255.255.255.255"},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	w = performRequest(bt, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	requireFailure(t, w, "Trumped")
+
+	sv := url.Values{"info_hash": {tor.InfoHash.RawString(), torrents[1].InfoHash.RawString()}}
+	w = performRequest(bt, "GET", fmt.Sprintf("/%s/scrape?%s", users[0].Passkey, sv.Encode()))
+	require.Equal(t, http.StatusOK, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.NotContains(t, resp.(bencode.Dict), tor.InfoHash.String())
+	require.Contains(t, resp.(bencode.Dict), torrents[1].InfoHash.String())
+}
+
+func TestAdminAPI_UserStrikes(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "")
+	require.Equal(t, http.StatusBadRequest, performAPIRequest(rh, "GET", "/user/abc/strikes", "", nil).Code)
+	w := performAPIRequest(rh, "GET", fmt.Sprintf("/user/%d/strikes", users[0].UserID), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var strikes UserStrikes
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &strikes))
+	require.Equal(t, users[0].UserID, strikes.UserID)
+	require.Equal(t, uint(0), strikes.Strikes)
+}
+
+func TestAdminAPI_TorrentPeers(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.Whitelist["-qB"] = model.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	tkr.AnnInterval = 300
+	rh := NewAPIHandler(tkr, "")
+	bt := NewBitTorrentHandler(tkr)
+	tor := torrents[3]
+	peerID := model.PeerIDFromString("-qB4220-123456789012")
+	v := url.Values{
+		"info_hash": {tor.InfoHash.RawString()},
+		"peer_id":   {peerID.RawString()},
+		"port":      {"6881"},
+		"left":      {"0"},
+	}
+	w := performRequest(bt, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, http.StatusOK, w.Code)
+	v.Set("peer_id", model.PeerIDFromString("-qB4220-210987654321").RawString())
+	v.Set("port", "6882")
+	w = performRequest(bt, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = performAPIRequest(rh, "GET", fmt.Sprintf("/torrent/%s/peers?limit=1000", tor.InfoHash.String()), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var peers []*model.Peer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &peers))
+	var found bool
+	for _, p := range peers {
+		if p.PeerID == peerID {
+			found = true
+			require.Equal(t, "qBittorrent", p.Client)
+		}
+	}
+	require.True(t, found)
+	require.Equal(t, http.StatusBadRequest, performAPIRequest(rh, "GET",
+		fmt.Sprintf("/torrent/%s/peers?limit=x", tor.InfoHash.String()), "", nil).Code)
+	require.Equal(t, http.StatusBadRequest, performAPIRequest(rh, "GET",
+		fmt.Sprintf("/torrent/%s/peers?offset=-1", tor.InfoHash.String()), "", nil).Code)
+
+	getSwarm := func(query string) []SwarmPeer {
+		w := performAPIRequest(rh, "GET", fmt.Sprintf("/torrent/%s/peers?%s", tor.InfoHash.String(), query), "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var swarm []SwarmPeer
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &swarm))
+		return swarm
+	}
+	findPeer := func(swarm []SwarmPeer) *SwarmPeer {
+		for i := range swarm {
+			if swarm[i].PeerID == peerID {
+				return &swarm[i]
+			}
+		}
+		return nil
+	}
+	redacted := findPeer(getSwarm("limit=1000"))
+	require.NotNil(t, redacted)
+	require.Equal(t, "1.2.3.0", redacted.IP.String())
+	full := findPeer(getSwarm("limit=1000&full=true"))
+	require.NotNil(t, full)
+	require.Equal(t, "1.2.3.4", full.IP.String())
+
+	all := getSwarm("limit=1000")
+	require.True(t, len(all) > 1)
+	page := getSwarm("limit=1&offset=1")
+	require.Equal(t, 1, len(page))
+	require.Equal(t, all[1].PeerID, page[0].PeerID)
+	require.Equal(t, 0, len(getSwarm(fmt.Sprintf("offset=%d", len(all)))))
+
+	// Peers which stopped announcing are hidden unless requested
+	stale, err := tkr.Peers.Get(tor.InfoHash, peerID)
+	require.NoError(t, err)
+	stale.Lock()
+	stale.AnnounceLast = time.Now().Add(-time.Duration(tkr.AnnInterval*3) * time.Second)
+	stale.Unlock()
+	require.Nil(t, findPeer(getSwarm("limit=1000")))
+	require.NotNil(t, findPeer(getSwarm("limit=1000&inactive=true")))
+}
+
+func TestAdminAPI_PeerHistory(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	rh := NewAPIHandler(tkr, "")
+	bt := NewBitTorrentHandler(tkr)
+	tor := torrents[0]
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	path := fmt.Sprintf("/torrent/%s/peers/%s/history", tor.InfoHash.String(), peerID.String())
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "GET", path, "", nil).Code)
+	tkr.PeerHistorySize = 10
+	for _, uploaded := range []string{"0", "1000"} {
+		v := url.Values{
+			"info_hash": {tor.InfoHash.RawString()},
+			"peer_id":   {peerID.RawString()},
+			"port":      {"6881"},
+			"left":      {"0"},
+			"uploaded":  {uploaded},
+		}
+		w := performRequest(bt, "GET", fmt.Sprintf("/%s/announce?%s", users[0].Passkey, v.Encode()))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w := performAPIRequest(rh, "GET", path, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []tracker.AnnounceSample
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Equal(t, 2, len(history))
+	require.Equal(t, uint32(1000), history[1].Uploaded)
+	require.Equal(t, http.StatusBadRequest, performAPIRequest(rh, "GET",
+		fmt.Sprintf("/torrent/%s/peers/xyz/history", tor.InfoHash.String()), "", nil).Code)
+}
+
+type unreachablePeerStore struct {
+	store.PeerStore
+}
+
+func (unreachablePeerStore) Ping() error {
+	return errors.New("connection refused")
+}
+
+func TestAdminAPI_Healthz(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := tracker.NewTestTracker()
+	// Probes do not need the admin token
+	rh := NewAPIHandler(tkr, "secret")
+	w := performAPIRequest(rh, "GET", "/healthz", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var health HealthResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	require.Equal(t, "ok", health.Status)
+	require.Nil(t, health.LastSync)
+	tkr.Peers = unreachablePeerStore{tkr.Peers}
+	w = performAPIRequest(rh, "GET", "/healthz", "", nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	require.Equal(t, "unavailable", health.Status)
+	require.Contains(t, health.Reason, "peer store unreachable")
+	require.Equal(t, http.StatusUnauthorized, performAPIRequest(rh, "GET", "/tracker/stats", "", nil).Code)
+}
+
+func TestAdminAPI_UserPoints(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "")
+	require.NoError(t, tkr.Users.AddPoints(users[0], 10))
+	w := performAPIRequest(rh, "GET", fmt.Sprintf("/user/%d/points", users[0].UserID), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var points UserPoints
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &points))
+	require.Equal(t, users[0].UserID, points.UserID)
+	require.Equal(t, 10.0, points.Points)
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "GET", "/user/999999/points", "", nil).Code)
+}
+
+func TestAdminAPI_UserSnatches(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "")
+	peers[0].UserID = users[0].UserID
+	require.NoError(t, tkr.PeerCompleted(torrents[0], peers[0]))
+	w := performAPIRequest(rh, "GET", fmt.Sprintf("/user/%d/snatches", users[0].UserID), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var snatches []UserSnatch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snatches))
+	require.Equal(t, 1, len(snatches))
+	require.Equal(t, torrents[0].InfoHash.String(), snatches[0].InfoHash)
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "GET", "/user/999999/snatches", "", nil).Code)
+}
+
+func TestAdminAPI_UserSpeed(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	tkr.AnnInterval = 60
+	tkr.ReapMultiplier = 2
+	rh := NewAPIHandler(tkr, "")
+	require.NoError(t, tkr.AccountSpeed(users[0].UserID, 0, 0, 1000, 500))
+	w := performAPIRequest(rh, "GET", fmt.Sprintf("/user/%d/speed", users[0].UserID), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var speed UserSpeed
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &speed))
+	require.Equal(t, UserSpeed{UserID: users[0].UserID, SpeedUP: 1000, SpeedDN: 500}, speed)
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "GET", "/user/999999/speed", "", nil).Code)
+}
+
+func TestAdminAPI_UserCorrupt(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	tkr.CorruptMode = tracker.CorruptTrack
+	tkr.CorruptRatio = 0.05
+	rh := NewAPIHandler(tkr, "")
+	users[0].Downloaded = 1000
+	require.NoError(t, tkr.AccountCorrupt(users[0], 100))
+	w := performAPIRequest(rh, "GET", fmt.Sprintf("/user/%d/corrupt", users[0].UserID), "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var corrupt UserCorrupt
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &corrupt))
+	require.Equal(t, UserCorrupt{UserID: users[0].UserID, Corrupt: 100, Downloaded: 1000, Flagged: true}, corrupt)
+	require.Equal(t, http.StatusNotFound, performAPIRequest(rh, "GET", "/user/999999/corrupt", "", nil).Code)
+}
+
+func TestAdminAPI_TorrentsPrune(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := tracker.NewTestTracker()
+	rh := NewAPIHandler(tkr, "")
+	peer := store.GenerateTestPeer(nil)
+	require.NoError(t, tkr.Peers.Add(torrents[0].InfoHash, peer))
+	require.NoError(t, tkr.Torrents.Touch(torrents[0].InfoHash, time.Now().Add(-48*time.Hour)))
+	tkr.TouchTorrent(torrents[1])
+	path := fmt.Sprintf("/torrent/%s", torrents[1].InfoHash.String())
+	w := performAPIRequest(rh, "GET", path, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tor model.Torrent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tor))
+	require.Equal(t, time.Now().Truncate(time.Minute).Unix(), tor.LastActive.Unix())
+	w = performAPIRequest(rh, "POST", "/torrents/prune?older_than=24h", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var result PruneResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, 1, result.Pruned)
+	_, err := tkr.Torrents.Get(torrents[0].InfoHash)
+	require.Error(t, err)
+	_, err = tkr.Peers.Get(torrents[0].InfoHash, peer.PeerID)
+	require.Error(t, err, "Peers of pruned torrents are removed")
+	_, err = tkr.Torrents.Get(torrents[1].InfoHash)
+	require.NoError(t, err)
+	w = performAPIRequest(rh, "POST", "/torrents/prune?older_than=0s", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAdminAPI_TorrentsTop(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := tracker.NewTestTracker()
+	tkr.ActivityInterval = time.Second
+	rh := NewAPIHandler(tkr, "")
+	tkr.CountAnnounce(torrents[4].InfoHash)
+	tkr.CountAnnounce(torrents[4].InfoHash)
+	tkr.CountAnnounce(torrents[5].InfoHash)
+	require.NoError(t, tkr.FlushActivity())
+	w := performAPIRequest(rh, "GET", "/torrents/top?limit=1", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var top []TopTorrent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &top))
+	require.Len(t, top, 1)
+	require.Equal(t, torrents[4].InfoHash.String(), top[0].InfoHash)
+	require.Equal(t, torrents[4].ReleaseName, top[0].ReleaseName)
+	require.Equal(t, int64(2), top[0].Announces)
+	w = performAPIRequest(rh, "GET", "/torrents/top?limit=1000", "", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -3,14 +3,21 @@ package http
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,22 +29,38 @@ const (
 	STARTED   announceType = "started"
 	STOPPED   announceType = "stopped"
 	COMPLETED announceType = "completed"
+	PAUSED    announceType = "paused"
 	ANNOUNCE  announceType = ""
 )
 
+// parseAnnounceType matches the event case-insensitively. Unknown events are treated as a
+// regular announce instead of failing since some clients send nonstandard values.
 func parseAnnounceType(t string) announceType {
-	switch t {
+	switch strings.ToLower(t) {
 	case "started":
 		return STARTED
 	case "stopped":
 		return STOPPED
 	case "completed":
 		return COMPLETED
+	case "paused":
+		return PAUSED
+	case "":
+		return ANNOUNCE
 	default:
+		log.Debugf("Unknown announce event, treating as regular announce: %q", t)
 		return ANNOUNCE
 	}
 }
 
+// label returns the name used for the announce type in metrics
+func (t announceType) label() string {
+	if t == ANNOUNCE {
+		return "regular"
+	}
+	return string(t)
+}
+
 type errorResponse struct {
 	FailReason string `bencode:"failure reason"`
 }
@@ -53,10 +76,27 @@ const (
 	msgInvalidInfoHash      trackerErrCode = 150
 	msgInvalidPeerID        trackerErrCode = 151
 	msgInvalidNumWant       trackerErrCode = 152
+	msgInvalidKey           trackerErrCode = 153
+	msgTorrentDisabled      trackerErrCode = 154
+	msgClientNotAllowed     trackerErrCode = 155
+	msgInvalidLeft          trackerErrCode = 156
+	msgCompactRequired      trackerErrCode = 157
+	msgTooManyPeers         trackerErrCode = 158
+	msgDatacenterBlocked    trackerErrCode = 159
+	msgIPOverrideDenied     trackerErrCode = 160
+	msgUserAgentMismatch    trackerErrCode = 161
+	msgDownloadSlotsFull    trackerErrCode = 162
+	msgAddressFamily        trackerErrCode = 163
+	msgCorruptTooHigh       trackerErrCode = 164
 	msgOk                   trackerErrCode = 200
+	msgURITooLong           trackerErrCode = 414
+	msgTooManyRequests      trackerErrCode = 429
 	msgInfoHashNotFound     trackerErrCode = 480
 	msgInvalidAuth          trackerErrCode = 490
+	msgRatioTooLow          trackerErrCode = 491
+	msgBanned               trackerErrCode = 492
 	msgClientRequestTooFast trackerErrCode = 500
+	msgShuttingDown         trackerErrCode = 503
 	msgGenericError         trackerErrCode = 900
 	msgMalformedRequest     trackerErrCode = 901
 	msgQueryParseFail       trackerErrCode = 902
@@ -71,11 +111,28 @@ var (
 		msgMissingPort:          errors.New("port missing from request"),
 		msgInvalidPort:          errors.New("Invalid port"),
 		msgInvalidAuth:          errors.New("Invalid passkey"),
+		msgRatioTooLow:          errors.New("Ratio too low"),
+		msgBanned:               errors.New("Banned"),
 		msgInvalidInfoHash:      errors.New("Invalid info hash"),
 		msgInvalidPeerID:        errors.New("Peer ID invalid"),
 		msgInvalidNumWant:       errors.New("num_want invalid"),
+		msgInvalidKey:           errors.New("Invalid key"),
+		msgTorrentDisabled:      errors.New("Torrent has been disabled"),
+		msgClientNotAllowed:     errors.New("Client not allowed"),
+		msgInvalidLeft:          errors.New("Invalid left"),
+		msgCompactRequired:      errors.New("Compact announces required"),
+		msgTooManyPeers:         errors.New("Too many active peers for this torrent"),
+		msgDatacenterBlocked:    errors.New("Datacenter peers are not allowed on this torrent"),
+		msgIPOverrideDenied:     errors.New("Not allowed to set the ip param"),
+		msgUserAgentMismatch:    errors.New("User-Agent does not match the client"),
+		msgDownloadSlotsFull:    errors.New("Download slots full, retry later"),
+		msgAddressFamily:        errors.New("Address family not allowed on this torrent"),
+		msgCorruptTooHigh:       errors.New("Too much corrupt data reported"),
+		msgURITooLong:           errors.New("Request URI too long"),
+		msgTooManyRequests:      errors.New("Too many concurrent requests"),
 		msgInfoHashNotFound:     errors.New("Unknown infohash"),
-		msgClientRequestTooFast: errors.New("Slow down there jimmy"),
+		msgClientRequestTooFast: errors.New("Rate limited"),
+		msgShuttingDown:         errors.New("Tracker shutting down"),
 		msgMalformedRequest:     errors.New("Malformed request"),
 		msgGenericError:         errors.New("Generic Error"),
 		msgQueryParseFail:       errors.New("Could not parse request"),
@@ -87,31 +144,88 @@ func TrackerErr(code trackerErrCode) error {
 	return responseStringMap[code]
 }
 
-// getIP Parses and returns a IP from a string
-func getIP(q *query, c *gin.Context) (net.IP, error) {
-	ipStr, found := q.Params[paramIP]
-	if found {
-		ip := net.ParseIP(ipStr)
-		if ip != nil {
-			return ip.To4(), nil
+// getIP determines the IPv4 and IPv6 addresses to use for the peer. The client address as
+// resolved by remoteIP is always used unless the tracker accepts the client declared ip and
+// ipv6 params. ipv6 is nil if the peer has no known IPv6 address. consts.ErrIPOverrideDenied
+// is returned when the client is not allowed to declare its address and should be rejected.
+func getIP(q *query, c *gin.Context, t *tracker.Tracker) (net.IP, net.IP, error) {
+	ip := remoteIP(c, t)
+	if ip == nil {
+		return nil, nil, consts.ErrMalformedRequest
+	}
+	conn := connIP(c)
+	source := ip
+	if declared := net.ParseIP(q.Params[paramIP]); declared != nil {
+		accept, err := t.AcceptIPOverride(conn, source, declared)
+		if err != nil {
+			return nil, nil, err
+		}
+		if accept {
+			ip = declared
 		}
 	}
-	// Look for forwarded ip in header then default to remote address
-	forwardedIP := c.Request.Header.Get("X-Forwarded-For")
-	if forwardedIP != "" {
-		ip := net.ParseIP(forwardedIP)
-		if ip != nil {
-			return ip.To4(), nil
+	var ipv6 net.IP
+	if ip.To4() == nil {
+		ipv6 = ip
+	}
+	if declared := net.ParseIP(q.Params[paramIPv6]); declared != nil && declared.To4() == nil {
+		accept, err := t.AcceptIPOverride(conn, source, declared)
+		if err != nil {
+			return nil, nil, err
 		}
-		return ip, nil
+		if accept {
+			ipv6 = declared
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, ipv6, nil
+}
+
+// externalIP formats the client address for the "external ip" response key, either as a
+// string or in the compact 4 byte IPv4 or 16 byte IPv6 form
+func externalIP(ip net.IP, readable bool) string {
+	if readable {
+		return ip.String()
 	}
-	s := strings.Split(c.Request.RemoteAddr, ":")
-	ipReq, _ := s[0], s[1]
-	ip := net.ParseIP(ipReq)
-	if ip != nil {
-		return ip.To4(), nil
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
 	}
-	return ip, nil
+	return string(ip.To16())
+}
+
+// connIP returns the address of the host connected to the tracker, which is the address
+// of the reverse proxy when running behind one
+func connIP(c *gin.Context) net.IP {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return net.ParseIP(c.Request.RemoteAddr)
+	}
+	return net.ParseIP(host)
+}
+
+// remoteIP returns the address of the client, ignoring any client supplied ip param.
+// The X-Forwarded-For header is only used when the connecting host is a trusted proxy. It
+// is walked right-to-left, skipping over trusted proxies, stopping at the first untrusted
+// hop as anything further left could have been supplied by the client.
+func remoteIP(c *gin.Context, t *tracker.Tracker) net.IP {
+	ip := connIP(c)
+	if ip == nil || !t.IsTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(c.Request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !t.IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
 }
 
 // oops will output a bencoded error code to the torrent client using
@@ -121,28 +235,142 @@ func oops(ctx *gin.Context, errCode trackerErrCode) {
 	if !exists {
 		msg = responseStringMap[msgGenericError]
 	}
-	ctx.String(int(errCode), responseError(msg.Error()))
+	failure(ctx, errCode, msg.Error(), 0)
 	log.Errorf("Error in request from: %s (%d)", ctx.Request.RequestURI, errCode)
 }
 
+// errCodeFor maps the kind of a store or tracker error to the error code returned to the client,
+// falling back to fallback for kinds without a more specific code
+func errCodeFor(err error, fallback trackerErrCode) trackerErrCode {
+	switch consts.KindOf(err) {
+	case consts.KindUnauthorized:
+		return msgInvalidAuth
+	case consts.KindInvalid:
+		return msgMalformedRequest
+	default:
+		return fallback
+	}
+}
+
+// encodeResponse bencodes the tracker response into w. Tests replace it to force a failure.
+var encodeResponse = func(w io.Writer, v interface{}) error {
+	return bencode.NewEncoder(w).Encode(v)
+}
+
+// encodeFailed responds with a generic failure when the response for the handler could not be
+// bencoded so the client always receives a well formed failure instead of nothing. Unlike other
+// failures this is a fault of the tracker, so it is sent with a 500 status.
+func encodeFailed(c *gin.Context, handler string, err error) {
+	log.Errorf("Failed to encode %s response: %s", handler, err.Error())
+	metrics.EncodeErrorsTotal.WithLabelValues(handler).Inc()
+	reason := responseStringMap[msgGenericError].Error()
+	c.Set(errCodeKey, msgGenericError)
+	c.String(http.StatusInternalServerError, responseError(reason, 0))
+	audit(c, msgGenericError, reason)
+}
+
+// observeRequest records how long handling the request took, labeled by the handler and the
+// outcome of the request. It should be deferred at the start of the handler.
+func observeRequest(c *gin.Context, handler string, start time.Time) {
+	outcome := "ok"
+	switch requestErrCode(c) {
+	case msgOk:
+	case msgGenericError:
+		outcome = "error"
+	default:
+		outcome = "rejected"
+	}
+	metrics.RequestDuration.WithLabelValues(handler, outcome).Observe(time.Since(start).Seconds())
+}
+
+// unregistered responds to announces for unknown or deleted torrents with the configured failure
+// reason so clients show a clear error for the torrent
+func unregistered(c *gin.Context, t *tracker.Tracker) {
+	if t.UnregisteredMsg == "" {
+		oops(c, msgInfoHashNotFound)
+		return
+	}
+	failure(c, msgInfoHashNotFound, t.UnregisteredMsg, 0)
+}
+
+// retryLater responds with the failure for the error code along with the BEP 31 "retry in"
+// key, telling the client how many minutes to wait before announcing again
+func retryLater(c *gin.Context, errCode trackerErrCode, after time.Duration) {
+	retryIn := int(math.Ceil(after.Minutes()))
+	if retryIn < 1 {
+		retryIn = 1
+	}
+	failure(c, errCode, responseStringMap[errCode].Error(), retryIn)
+}
+
+// rejectBanned responds with a failure and returns true when the client is banned. This should
+// be checked before anything else in the request is looked at.
+func rejectBanned(c *gin.Context, t *tracker.Tracker) bool {
+	// The resolved client address is checked so peers behind a trusted proxy can still be banned
+	if ip := remoteIP(c, t); ip != nil && t.IsBanned(ip) {
+		oops(c, msgBanned)
+		return true
+	}
+	return false
+}
+
+// rejectLongURI responds with a failure and returns true when the request URI is longer than
+// the tracker allows. This must be checked before the query is parsed so oversized requests
+// are cheap to reject.
+func rejectLongURI(c *gin.Context, t *tracker.Tracker) bool {
+	if t.MaxURILength > 0 && len(c.Request.RequestURI) > t.MaxURILength {
+		// oops is not used as it would log the whole URI
+		log.Warnf("Rejected request with a %d byte URI from: %s", len(c.Request.RequestURI), connIP(c))
+		failure(c, msgURITooLong, responseStringMap[msgURITooLong].Error(), 0)
+		return true
+	}
+	return false
+}
+
 // preFlightChecks ensures our user meets the requirements to make an authorized request
 // THis is used within the request handler itself and not as a middleware because of the
-// slightly higher cost of passing data in through the request context
-func preFlightChecks(c *gin.Context, t *tracker.Tracker) (*model.User, bool) {
-	// Check that the user is valid before parsing anything
-	pk := c.Param("passkey")
-	if pk == "" {
-		oops(c, msgInvalidAuth)
-		return nil, false
+// slightly higher cost of passing data in through the request context.
+// Requests for a public torrent are allowed without a valid passkey and are made as the
+// anonymous user. Passing a nil torrent always requires a valid passkey.
+func preFlightChecks(c *gin.Context, t *tracker.Tracker, tor *model.Torrent) (*model.User, bool) {
+	// Routes without a passkey are only served by the client certificate authenticated listener.
+	var usr *model.User
+	var err error
+	if pk := c.Param("passkey"); pk == "" {
+		usr, err = userFromCert(c.Request.TLS, t)
+	} else {
+		usr, err = t.UserByPasskey(pk)
 	}
-	usr, err := t.Users.GetByPasskey(pk)
-	if err != nil || !usr.Valid() {
-		oops(c, msgInvalidAuth)
+	if err != nil {
+		if tor != nil && !tor.IsDeleted && tor.IsPublic() {
+			return model.AnonymousUser(), true
+		}
+		oops(c, errCodeFor(err, msgInvalidAuth))
 		return nil, false
 	}
 	return usr, true
 }
 
+// userFromCert maps a verified client certificate to a user. The certificates common name
+// or one of its DNS SANs must contain the numeric user id.
+func userFromCert(state *tls.ConnectionState, t *tracker.Tracker) (*model.User, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, consts.ErrUnauthorized
+	}
+	cert := state.VerifiedChains[0][0]
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		userID, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			continue
+		}
+		usr, err := t.Users.GetByID(uint32(userID))
+		if err == nil && usr.Valid() {
+			return usr, nil
+		}
+	}
+	return nil, consts.ErrUnauthorized
+}
+
 // handleTrackerErrors is used as the default error handler for tracker requests
 // the error is returned to the client as a bencoded error string as defined in the
 // bittorrent specs.
@@ -163,17 +391,81 @@ func handleTrackerErrors(ctx *gin.Context) {
 	}
 }
 
+// errCodeKey is the gin context key of the error code of a failed request
+const errCodeKey = "err_code"
+
+// failure responds with the bencoded failure reason. Every rejection is sent through here so
+// failures are formatted the same everywhere. As BEP 3 expects the failure is sent with a 200
+// status, many of the error codes are not valid HTTP statuses and clients only read the body
+// of successful responses. The error code is only recorded for metrics and the audit log. A
+// retryIn above 0 tells the client how many minutes to wait before trying again.
+func failure(c *gin.Context, errCode trackerErrCode, reason string, retryIn int) {
+	c.Set(errCodeKey, errCode)
+	c.String(http.StatusOK, responseError(reason, retryIn))
+	audit(c, errCode, reason)
+}
+
+// requestErrCode returns the error code of the failure sent for the request, msgOk when the
+// request did not fail
+func requestErrCode(c *gin.Context) trackerErrCode {
+	if errCode, found := c.Get(errCodeKey); found {
+		return errCode.(trackerErrCode)
+	}
+	return msgOk
+}
+
+// auditKey is the gin context key of the audit record of the request being handled
+const auditKey = "audit"
+
+// auditRecord is the audit entry of a request along with the tracker it is written to
+type auditRecord struct {
+	t     *tracker.Tracker
+	entry tracker.AuditEntry
+}
+
+// startAudit attaches a audit entry to the request which is written by failure if the request
+// is rejected. The handler fills in the details of the request as they become known. Nothing
+// is attached when the audit log is disabled.
+func startAudit(c *gin.Context, t *tracker.Tracker) *tracker.AuditEntry {
+	rec := &auditRecord{t: t}
+	if t.AuditLog != nil {
+		c.Set(auditKey, rec)
+	}
+	return &rec.entry
+}
+
+// audit writes the rejected request to the audit log. Internal errors are not rejections of
+// the client, they are always reported with the generic error message and are not written.
+func audit(c *gin.Context, errCode trackerErrCode, reason string) {
+	if errCode == msgShuttingDown || reason == responseStringMap[msgGenericError].Error() {
+		return
+	}
+	v, found := c.Get(auditKey)
+	if !found {
+		return
+	}
+	rec := v.(*auditRecord)
+	rec.entry.Reason = reason
+	rec.entry.Code = int(errCode)
+	rec.t.Audit(rec.entry)
+}
+
 // responseError generates a bencoded error response for the torrent client to
-// parse and display to the user
+// parse and display to the user. When retryIn is above 0 the BEP 31 "retry in" key is
+// included with the number of minutes compliant clients should wait before retrying.
 //
 // Note that this function does not generate or support a warning reason, which are rarely if
 // ever used.
-func responseError(message string) string {
+func responseError(message string, retryIn int) string {
+	dict := bencode.Dict{
+		"failure reason": message,
+	}
+	if retryIn > 0 {
+		dict["retry in"] = retryIn
+	}
 	var buf bytes.Buffer
 	encoder := bencode.NewEncoder(&buf)
-	if err := encoder.Encode(bencode.Dict{
-		"failure reason": message,
-	}); err != nil {
+	if err := encoder.Encode(dict); err != nil {
 		log.Errorf("Failed to encode error response: %s", err)
 	}
 	return buf.String()
@@ -199,15 +491,51 @@ func NewBitTorrentHandler(tkr *tracker.Tracker) *gin.Engine {
 	return r
 }
 
-// NewAPIHandler configures a router to handle API requests
-func NewAPIHandler(tkr *tracker.Tracker) *gin.Engine {
+// NewBitTorrentCertHandler configures a router to handle tracker announce/scrape requests
+// authenticated with a client certificate instead of a passkey. It must only be served
+// by a server created with CreateTLSServer with RequireClientCert enabled.
+func NewBitTorrentCertHandler(tkr *tracker.Tracker) *gin.Engine {
+	r := newRouter()
+	r.Use(handleTrackerErrors)
+	h := BitTorrentHandler{
+		t: tkr,
+	}
+	r.GET("/announce", h.announce)
+	r.GET("/scrape", h.scrape)
+	return r
+}
+
+// NewAPIHandler configures a router to handle API requests. When token is not empty all
+// requests must include it as a bearer token.
+func NewAPIHandler(tkr *tracker.Tracker, token string) *gin.Engine {
 	r := newRouter()
 	h := AdminAPI{
 		t: tkr,
 	}
+	// Registered before the auth middleware so load balancers can probe without the token
+	r.GET("/healthz", h.healthz)
+	if token != "" {
+		r.Use(tokenAuth(token))
+	} else {
+		log.Warnf("Admin API token not set, authentication is disabled")
+	}
 	r.GET("/tracker/stats", h.stats)
+	r.POST("/torrent", h.torrentAdd)
+	r.GET("/torrent/:info_hash", h.torrentGet)
 	r.DELETE("/torrent/:info_hash", h.torrentDelete)
 	r.PATCH("/torrent/:info_hash", h.torrentUpdate)
+	r.GET("/torrent/:info_hash/geo", h.torrentGeo)
+	r.GET("/torrent/:info_hash/peers", h.torrentPeers)
+	r.GET("/torrent/:info_hash/peers/:peer_id/history", h.peerHistory)
+	r.GET("/torrents/top", h.torrentsTop)
+	r.POST("/torrents/prune", h.torrentsPrune)
+	r.GET("/user/:user_id/strikes", h.userStrikes)
+	r.GET("/user/:user_id/points", h.userPoints)
+	r.GET("/user/:user_id/snatches", h.userSnatches)
+	r.GET("/user/:user_id/speed", h.userSpeed)
+	r.GET("/user/:user_id/corrupt", h.userCorrupt)
+	r.POST("/whitelist/reload", h.whitelistReload)
+	r.POST("/banlist/reload", h.banListReload)
 	return r
 }
 
@@ -217,19 +545,7 @@ func NewAPIHandler(tkr *tracker.Tracker) *gin.Engine {
 func CreateServer(router http.Handler, addr string, useTLS bool) *http.Server {
 	var tlsCfg *tls.Config
 	if useTLS {
-		tlsCfg = &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
-		}
-	} else {
-		tlsCfg = nil
+		tlsCfg = newTLSConfig()
 	}
 	srv := &http.Server{
 		Addr:           addr,
@@ -241,3 +557,57 @@ func CreateServer(router http.Handler, addr string, useTLS bool) *http.Server {
 	}
 	return srv
 }
+
+// TLSOpts defines the certificates used by a server created with CreateTLSServer
+type TLSOpts struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of the CAs used to verify client certificates
+	ClientCAFile string
+	// RequireClientCert rejects connections without a valid client certificate
+	RequireClientCert bool
+}
+
+// CreateTLSServer will configure and return a *http.Server with its certificates loaded. The
+// server should be started with ListenAndServeTLS("", "").
+func CreateTLSServer(router http.Handler, addr string, opts TLSOpts) (*http.Server, error) {
+	srv := CreateServer(router, addr, true)
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load server certificate")
+	}
+	srv.TLSConfig.Certificates = []tls.Certificate{cert}
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read client CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No valid client CA certificates found")
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if opts.RequireClientCert {
+		if srv.TLSConfig.ClientCAs == nil {
+			return nil, errors.New("Client CA file is required to verify client certificates")
+		}
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return srv, nil
+}
+
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+	}
+}
@@ -0,0 +1,160 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/chihaya/bencode"
+	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRemoteIP(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := tracker.NewTestTracker()
+	_, proxies, _ := net.ParseCIDR("127.0.0.0/8")
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tc := range []struct {
+		trusted   []*net.IPNet
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		// The header is ignored entirely when no proxies are trusted
+		{nil, "127.0.0.1:8080", "1.2.3.4", "127.0.0.1"},
+		{[]*net.IPNet{proxies}, "127.0.0.1:8080", "1.2.3.4", "1.2.3.4"},
+		// The header is ignored when not sent from a trusted proxy
+		{[]*net.IPNet{proxies}, "5.6.7.8:8080", "1.2.3.4", "5.6.7.8"},
+		// Client supplied values to the left of the first untrusted hop are ignored
+		{[]*net.IPNet{proxies, lan}, "127.0.0.1:8080", "9.9.9.9, 1.2.3.4, 10.0.0.2", "1.2.3.4"},
+		{[]*net.IPNet{proxies}, "127.0.0.1:8080", "1.2.3.4, garbage", "127.0.0.1"},
+		{[]*net.IPNet{proxies}, "127.0.0.1:8080", "", "127.0.0.1"},
+	} {
+		tkr.TrustedProxies = tc.trusted
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		ip := remoteIP(&gin.Context{Request: req}, tkr)
+		require.Equal(t, tc.expected, ip.String(), "xff: %s", tc.forwarded)
+	}
+}
+
+func certState(commonName string, dnsNames ...string) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}, DNSNames: dnsNames}
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestUserFromCert(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	userID := fmt.Sprintf("%d", users[0].UserID)
+	usr, err := userFromCert(certState(userID), tkr)
+	require.NoError(t, err)
+	require.Equal(t, users[0].UserID, usr.UserID)
+	usr, err = userFromCert(certState("client.example.com", "client.example.com", userID), tkr)
+	require.NoError(t, err)
+	require.Equal(t, users[0].UserID, usr.UserID)
+	_, err = userFromCert(certState("999999999"), tkr)
+	require.Error(t, err, "Unknown users are rejected")
+	_, err = userFromCert(&tls.ConnectionState{}, tkr)
+	require.Error(t, err, "Unverified connections are rejected")
+	_, err = userFromCert(nil, tkr)
+	require.Error(t, err, "Plaintext connections are rejected")
+}
+
+func TestBitTorrentCertHandler_Announce(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := tracker.NewTestTracker()
+	rh := NewBitTorrentCertHandler(tkr)
+	v := url.Values{
+		"info_hash":  {torrents[0].InfoHash.RawString()},
+		"peer_id":    {peers[0].PeerID.RawString()},
+		"port":       {"6881"},
+		"uploaded":   {"5678"},
+		"downloaded": {"1234"},
+		"left":       {"9234"},
+		"event":      {""},
+	}
+	for _, tc := range []struct {
+		state  *tls.ConnectionState
+		reason string
+	}{
+		{certState(fmt.Sprintf("%d", users[0].UserID)), ""},
+		{certState("unknown"), "Invalid passkey"},
+		{nil, "Invalid passkey"},
+	} {
+		req, _ := http.NewRequest("GET", "/announce?"+v.Encode(), nil)
+		req.RemoteAddr = "1.2.3.4:51413"
+		req.TLS = tc.state
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, req)
+		if tc.reason == "" {
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NotContains(t, w.Body.String(), "failure reason")
+		} else {
+			requireFailure(t, w, tc.reason)
+		}
+	}
+}
+
+func TestParseAnnounceType(t *testing.T) {
+	for _, tc := range []struct {
+		event    string
+		expected announceType
+	}{
+		{"", ANNOUNCE},
+		{"started", STARTED},
+		{"Started", STARTED},
+		{"STARTED", STARTED},
+		{"stopped", STOPPED},
+		{"sToPpEd", STOPPED},
+		{"completed", COMPLETED},
+		{"Completed", COMPLETED},
+		{"paused", PAUSED},
+		{"PAUSED", PAUSED},
+		{"empty", ANNOUNCE},
+		{"start", ANNOUNCE},
+		{" started", ANNOUNCE},
+		{"\x00\xff", ANNOUNCE},
+	} {
+		require.Equal(t, tc.expected, parseAnnounceType(tc.event), "event: %q", tc.event)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	for _, tc := range []struct {
+		retryIn int
+		want    bencode.Dict
+	}{
+		{0, bencode.Dict{"failure reason": "Banned"}},
+		{-1, bencode.Dict{"failure reason": "Banned"}},
+		{5, bencode.Dict{"failure reason": "Banned", "retry in": int64(5)}},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		failure(c, msgBanned, "Banned", tc.retryIn)
+		require.Equal(t, http.StatusOK, w.Code, "Failures must be sent with a status clients read")
+		require.Equal(t, msgBanned, requestErrCode(c))
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, tc.want, resp, "retry in: %d", tc.retryIn)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	retryLater(c, msgClientRequestTooFast, time.Second*30)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, resp.(bencode.Dict)["retry in"], "Rounded up to a minute")
+	require.Equal(t, "Rate limited", resp.(bencode.Dict)["failure reason"])
+}
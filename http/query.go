@@ -13,13 +13,26 @@ const (
 	paramInfoHash   announceParam = "info_hash"
 	paramPeerID     announceParam = "peer_id"
 	paramIP         announceParam = "ip"
+	paramIPv6       announceParam = "ipv6"
 	paramPort       announceParam = "port"
 	paramLeft       announceParam = "left"
 	paramDownloaded announceParam = "downloaded"
 	paramUploaded   announceParam = "uploaded"
 	paramCorrupt    announceParam = "corrupt"
 	paramNumWant    announceParam = "numwant"
+	paramEvent      announceParam = "event"
 	paramCompact    announceParam = "compact"
+	paramKey        announceParam = "key"
+	paramNoPeerID   announceParam = "no_peer_id"
+	paramTrackerID  announceParam = "trackerid"
+	// Legacy params sent by clients which support protocol encryption
+	paramSupportCrypto announceParam = "supportcrypto"
+	paramRequireCrypto announceParam = "requirecrypto"
+	// Non-standard param sent by seeders wanting to be handed rotating leechers
+	paramSuperSeed announceParam = "superseed"
+	// Non-standard names some clients send numwant under
+	paramNumWantAlias   announceParam = "num_want"
+	paramNumPeersWanted announceParam = "num_peers_wanted"
 )
 
 type query struct {
@@ -60,15 +73,14 @@ func queryStringParser(qStr string) (*query, error) {
 			if err != nil {
 				return nil, err
 			}
-			// The start can be greater than the end when the query contains an invalid
-			// empty query value
-			if valStart > valEnd {
-				return nil, consts.ErrMalformedRequest
-			}
-
-			valStr, err := url.QueryUnescape(qStr[valStart : valEnd+1])
-			if err != nil {
-				return nil, err
+			// The start is greater than the end when the query contains an empty value such
+			// as "event=&", which some clients send for params they have no value for
+			var valStr string
+			if valStart <= valEnd {
+				valStr, err = url.QueryUnescape(qStr[valStart : valEnd+1])
+				if err != nil {
+					return nil, err
+				}
 			}
 			q.Params[announceParam(strings.ToLower(keyStr))] = valStr
 
@@ -96,7 +108,10 @@ func queryStringParser(qStr string) (*query, error) {
 			valEnd = i
 		}
 	}
-
+	if hasInfoHash && q.InfoHashes == nil {
+		// Single info hash
+		q.InfoHashes = []string{firstInfoHash}
+	}
 	return q, nil
 }
 
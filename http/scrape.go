@@ -4,59 +4,110 @@ import (
 	"bytes"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/model"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
+// scrapeEntry builds the scrape stats of a single torrent. Values are converted to plain ints so
+// the encoder never sees a type it does not support.
+func scrapeEntry(seeders uint, leechers uint, completed uint32) bencode.Dict {
+	return bencode.Dict{
+		"complete":   int(seeders),
+		"downloaded": int(completed),
+		"incomplete": int(leechers),
+	}
+}
+
 // scrape handles the bittorrent scrape protocol for
+//
+// Unlike announces, scrapes always require a valid passkey, including for public torrents, as a
+// single scrape can cover any number of torrents. Public torrents are otherwise scraped exactly
+// like private torrents.
 func (h *BitTorrentHandler) scrape(c *gin.Context) {
-	_, valid := preFlightChecks(c, h.t)
+	defer observeRequest(c, "scrape", time.Now())
+	entry := startAudit(c, h.t)
+	entry.IP = remoteIP(c, h.t)
+	if rejectBanned(c, h.t) || rejectLongURI(c, h.t) {
+		return
+	}
+	usr, valid := preFlightChecks(c, h.t, nil)
 	if !valid {
 		return
 	}
-	q, err := queryStringParser(c.Request.RequestURI)
+	entry.UserID = usr.UserID
+	q, err := queryStringParser(c.Request.URL.RawQuery)
 	if err != nil {
 		log.Errorf("Failed to parse request string")
 		oops(c, msgMalformedRequest)
 		return
 	}
-	// Technically no info hashes means we are supposed to send data for all known torrents.
-	// This is something we do NOT want to do in a private tracker scenario (or really public for that matter)
-	// TODO Add a config toggle for this?
-	// TODO Its not technically malformed, should we return a empty file set instead?
+	var torrents []*model.Torrent
 	if len(q.InfoHashes) == 0 {
-		log.Errorf("No infohash supplied")
-		oops(c, msgMalformedRequest)
-		return
-	}
-	// Todo limit scrape to N torrents
-	resp := make(bencode.Dict, len(q.InfoHashes))
-	for _, ihStr := range q.InfoHashes {
-		ih := model.InfoHashFromString(ihStr)
-		torrent, err := h.t.Torrents.Get(ih)
+		// Technically no info hashes means we are supposed to send data for all known torrents.
+		// This is something we do NOT want to do in a private tracker scenario so its disabled
+		// unless explicitly enabled in the config.
+		if !h.t.ScrapeAllowFull {
+			log.Errorf("No infohash supplied")
+			oops(c, msgMalformedRequest)
+			return
+		}
+		torrents, err = h.t.Torrents.GetN(h.t.ScrapeFullLimit)
 		if err != nil {
-			log.Debugf("Scrape request for invalid torrent: %s", ih)
+			log.Errorf("Failed to fetch torrents for full scrape: %s", err.Error())
+			oops(c, errCodeFor(err, msgGenericError))
+			return
+		}
+	} else {
+		log.Debugf("Scrape request with %d/%d info hashes", len(q.InfoHashes), h.t.ScrapeMaxHashes)
+		if len(q.InfoHashes) > h.t.ScrapeMaxHashes {
+			if !h.t.ScrapeTruncate {
+				oops(c, msgMalformedRequest)
+				return
+			}
+			q.InfoHashes = q.InfoHashes[0:h.t.ScrapeMaxHashes]
+		}
+		hashes := make([]model.InfoHash, len(q.InfoHashes))
+		for i, ihStr := range q.InfoHashes {
+			hashes[i] = model.InfoHashFromString(ihStr)
+		}
+		// Unknown torrents are skipped by the store
+		start := time.Now()
+		torrents, err = h.t.Torrents.GetMulti(hashes)
+		if err != nil {
+			log.Errorf("Failed to fetch torrents for scrape: %s", err.Error())
+			oops(c, errCodeFor(err, msgGenericError))
+			return
+		}
+		log.Debugf("Fetched %d/%d scrape torrents in %s", len(torrents), len(hashes), time.Since(start))
+	}
+	resp := make(bencode.Dict, len(torrents))
+	for _, torrent := range torrents {
+		if !torrent.IsEnabled {
+			// Disabled torrents are omitted entirely
 			continue
 		}
-		peers, err := h.t.Peers.GetN(ih, 100)
+		h.t.CountScrape(torrent.InfoHash)
+		seeders, leechers, err := h.t.Peers.CountsOnly(torrent.InfoHash)
 		if err != nil {
-			log.Debugf("Failed to get peers for scrape: %s", ih)
+			log.Debugf("Failed to get peer counts for scrape: %s", torrent.InfoHash)
 			continue
 		}
-		seeders, leechers := peers.Counts()
-		resp[ih.String()] = bencode.Dict{
-			"complete":   seeders,
-			"downloaded": torrent.TotalCompleted,
-			"incomplete": leechers,
+		stats := scrapeEntry(seeders, leechers, torrent.TotalCompleted)
+		if h.t.ScrapeIncludeName && torrent.ReleaseName != "" {
+			stats["name"] = torrent.ReleaseName
 		}
+		resp[torrent.InfoHash.String()] = stats
 	}
 	var buf bytes.Buffer
-	if err := bencode.NewEncoder(&buf).Encode(resp); err != nil {
-		log.Errorf("Failed to encode scrape response")
+	if err := encodeResponse(&buf, resp); err != nil {
+		encodeFailed(c, "scrape", err)
 		return
 	}
 	encoded := buf.String()
 	log.Debug(encoded)
 	c.String(http.StatusOK, encoded)
+	metrics.ScrapeTotal.Inc()
 }
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/chihaya/bencode"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestScrapeEncoding(t *testing.T) {
+	hashes := []model.InfoHash{
+		model.InfoHashFromString(strings.Repeat("\x00", 20)),
+		model.InfoHashFromString(strings.Repeat("\xff", 20)),
+		model.InfoHashFromString("%:e\x00ld4:\xfe\x01 &?=#/\\i0"),
+	}
+	entries := []bencode.Dict{
+		scrapeEntry(math.MaxUint32, math.MaxUint32, math.MaxUint32),
+		scrapeEntry(0, 0, 0),
+		scrapeEntry(1, 2, 3),
+	}
+	resp := bencode.Dict{}
+	for i, ih := range hashes {
+		resp[ih.String()] = entries[i]
+	}
+	var buf bytes.Buffer
+	require.NoError(t, bencode.NewEncoder(&buf).Encode(resp))
+	decoded, err := bencode.Unmarshal(buf.Bytes())
+	require.NoError(t, err)
+	stats := decoded.(bencode.Dict)[hashes[0].String()].(bencode.Dict)
+	require.EqualValues(t, math.MaxUint32, stats["complete"])
+	require.EqualValues(t, math.MaxUint32, stats["downloaded"])
+}
+
+func TestBitTorrentHandler_ScrapeName(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	rh := NewBitTorrentHandler(tkr)
+	scrape := func() bencode.Dict {
+		v := url.Values{"info_hash": {torrents[0].InfoHash.RawString()}}
+		w := performRequest(rh, "GET", fmt.Sprintf("/%s/scrape?%s", users[0].Passkey, v.Encode()))
+		require.Equal(t, 200, w.Code)
+		resp, err := bencode.Unmarshal(w.Body.Bytes())
+		require.NoError(t, err)
+		return resp.(bencode.Dict)[torrents[0].InfoHash.String()].(bencode.Dict)
+	}
+	_, found := scrape()["name"]
+	require.False(t, found, "Name is opt-in")
+	tkr.ScrapeIncludeName = true
+	require.Equal(t, torrents[0].ReleaseName, scrape()["name"])
+}
+
+func TestBitTorrentHandler_ScrapeFull(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := tracker.NewTestTracker()
+	tkr.ScrapeAllowFull = false
+	rh := NewBitTorrentHandler(tkr)
+	path := fmt.Sprintf("/%s/scrape", users[0].Passkey)
+	requireFailure(t, performRequest(rh, "GET", path), "Malformed request")
+	tkr.ScrapeAllowFull = true
+	tkr.ScrapeFullLimit = 5
+	w := performRequest(rh, "GET", path)
+	require.Equal(t, 200, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, resp.(bencode.Dict), 5, "Full scrapes are capped")
+}
+
+func TestBitTorrentHandler_ScrapeMaxHashes(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.ScrapeMaxHashes = 2
+	rh := NewBitTorrentHandler(tkr)
+	v := url.Values{}
+	for _, tor := range torrents[0:3] {
+		v.Add("info_hash", tor.InfoHash.RawString())
+	}
+	path := fmt.Sprintf("/%s/scrape?%s", users[0].Passkey, v.Encode())
+	tkr.ScrapeTruncate = false
+	requireFailure(t, performRequest(rh, "GET", path), "Malformed request")
+	tkr.ScrapeTruncate = true
+	w := performRequest(rh, "GET", path)
+	require.Equal(t, 200, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err)
+	files := resp.(bencode.Dict)
+	require.Len(t, files, 2)
+	for _, tor := range torrents[0:2] {
+		require.Contains(t, files, tor.InfoHash.String(), "The first hashes are kept")
+	}
+}
+
+func TestBitTorrentHandler_ScrapeEncodeFailed(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	rh := NewBitTorrentHandler(tkr)
+	encode := encodeResponse
+	defer func() { encodeResponse = encode }()
+	encodeResponse = func(w io.Writer, v interface{}) error {
+		return errors.New("unsupported type")
+	}
+	errorsBefore := testutil.ToFloat64(metrics.EncodeErrorsTotal.WithLabelValues("scrape"))
+	v := url.Values{}
+	v.Add("info_hash", torrents[0].InfoHash.RawString())
+	w := performRequest(rh, "GET", fmt.Sprintf("/%s/scrape?%s", users[0].Passkey, v.Encode()))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	resp, err := bencode.Unmarshal(w.Body.Bytes())
+	require.NoError(t, err, "Encode failures still send a well formed response")
+	require.Equal(t, responseStringMap[msgGenericError].Error(), resp.(bencode.Dict)["failure reason"])
+	require.Equal(t, errorsBefore+1, testutil.ToFloat64(metrics.EncodeErrorsTotal.WithLabelValues("scrape")))
+}
@@ -0,0 +1,237 @@
+// Package metrics defines the prometheus metrics exported by the tracker
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "mika"
+
+// LatencyBuckets are the histogram buckets used for request and store latencies, from 1ms to 1s
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+var (
+	// AnnounceTotal counts successful announces labeled by their event type
+	// started|stopped|completed|regular
+	AnnounceTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_total",
+		Help:      "Total number of announces handled",
+	}, []string{"event"})
+
+	// AnnounceRejectedTotal counts announces which were rejected for any reason
+	AnnounceRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_rejected_total",
+		Help:      "Total number of rejected announces",
+	})
+
+	// AnnounceRateLimitedTotal counts announces rejected for arriving before the minimum interval
+	AnnounceRateLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_rate_limited_total",
+		Help:      "Total number of announces rejected for announcing too often",
+	})
+
+	// AnnounceEarlyTotal counts announces answered without being applied for arriving before the
+	// minimum interval
+	AnnounceEarlyTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_early_total",
+		Help:      "Total number of announces ignored for arriving before the minimum interval",
+	})
+
+	// PeerProbesTotal counts the reachability probes of peers by their result
+	PeerProbesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_probes_total",
+		Help:      "Total number of peer reachability probes",
+	}, []string{"result"})
+
+	// PeerCacheRequestsTotal counts the lookups of cached peer lists by result, hit or miss
+	PeerCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_cache_requests_total",
+		Help:      "Total number of cached peer list lookups",
+	}, []string{"result"})
+
+	// AnnounceSpeedCappedTotal counts announces where the reported upload speed was impossible
+	AnnounceSpeedCappedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_speed_capped_total",
+		Help:      "Total number of announces with uploads capped for exceeding the max believable speed",
+	})
+
+	// AnnounceInvalidLeftTotal counts announces failing the left validation
+	AnnounceInvalidLeftTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_invalid_left_total",
+		Help:      "Total number of announces with a left value inconsistent with the torrent size",
+	})
+
+	// AnnounceEmptySwarmTotal counts announces answered with the empty swarm backoff interval
+	AnnounceEmptySwarmTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_empty_swarm_total",
+		Help:      "Total number of leecher announces told to back off because the swarm was empty",
+	})
+
+	// PeersEvictedTotal counts peers removed to keep swarms under the max peers per torrent
+	PeersEvictedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peers_evicted_total",
+		Help:      "Total number of peers evicted from swarms which reached the max peers per torrent",
+	})
+
+	// PeersFlaggedTotal counts peers flagged for review after repeatedly resetting their totals
+	PeersFlaggedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peers_flagged_total",
+		Help:      "Total number of peers flagged for review for repeatedly reporting decreasing totals",
+	})
+
+	// UsersCorruptFlaggedTotal counts users flagged for review after reporting too much corrupt data
+	UsersCorruptFlaggedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "users_corrupt_flagged_total",
+		Help:      "Total number of users flagged for review for reporting too much corrupt data",
+	})
+
+	// PeerSyncDuration measures how long writing a batch of peer updates takes
+	PeerSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "peer_sync_duration_seconds",
+		Help:      "Time taken to write a batch of queued peer updates",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// RequestDuration measures how long handling a tracker request takes
+	// handler: announce|scrape, outcome: ok|rejected|error
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle a tracker request",
+		Buckets:   LatencyBuckets,
+	}, []string{"handler", "outcome"})
+
+	// StoreDuration measures the round trip time of calls to the backing stores
+	// store: torrent|peer|user, op: the store method called
+	StoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_duration_seconds",
+		Help:      "Round trip time of calls to the backing stores",
+		Buckets:   LatencyBuckets,
+	}, []string{"store", "op"})
+
+	// PeerSyncBatchSize is the number of peers written per batch
+	PeerSyncBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "peer_sync_batch_size",
+		Help:      "Number of peers written per batch of queued peer updates",
+		Buckets:   []float64{1, 10, 50, 100, 500, 1000, 5000, 10000},
+	})
+
+	// ScrapeTotal counts scrape requests
+	ScrapeTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_total",
+		Help:      "Total number of scrapes handled",
+	})
+
+	// EncodeErrorsTotal counts responses which could not be bencoded
+	// handler: announce|scrape
+	EncodeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "encode_errors_total",
+		Help:      "Total number of tracker responses which failed to encode",
+	}, []string{"handler"})
+
+	// AnnounceSlotsFullTotal counts new leechers rejected for exceeding the leecher limit
+	AnnounceSlotsFullTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_slots_full_total",
+		Help:      "Total number of new leechers rejected because the swarm has no free download slots",
+	})
+	// AnnounceUserPeerLimitTotal counts new peers rejected for exceeding the per user peer limit
+	AnnounceUserPeerLimitTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_user_peer_limit_total",
+		Help:      "Total number of new peers rejected because the user has too many peers in the swarm",
+	})
+
+	// AnnounceDatacenterBlockedTotal counts announces rejected for originating from a blocked datacenter ASN
+	AnnounceDatacenterBlockedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_datacenter_blocked_total",
+		Help:      "Total number of announces rejected because they originated from a blocked datacenter ASN",
+	})
+
+	// AnnounceConcurrencyLimitedTotal counts announces rejected for exceeding the per ip concurrency limit
+	AnnounceConcurrencyLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_concurrency_limited_total",
+		Help:      "Total number of announces rejected because too many announces from the same ip were in flight",
+	})
+
+	// AnnounceDedupedTotal counts duplicate announces answered with a previous response
+	AnnounceDedupedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "announce_deduped_total",
+		Help:      "Total number of duplicate announces answered with the response of the original announce",
+	})
+
+	// ClientUserAgentMismatchTotal counts announces with a User-Agent not matching their peer_id
+	ClientUserAgentMismatchTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_user_agent_mismatch_total",
+		Help:      "Total number of announces with a User-Agent inconsistent with their peer_id prefix",
+	})
+
+	// ClientRejectedTotal counts peers rejected by the client whitelist
+	ClientRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_rejected_total",
+		Help:      "Total number of announces rejected due to a non-whitelisted client",
+	})
+
+	// Seeders is the current number of seeding peers across all swarms
+	Seeders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seeders",
+		Help:      "Current number of seeders across all swarms",
+	})
+
+	// Leechers is the current number of leeching peers across all swarms
+	Leechers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leechers",
+		Help:      "Current number of leechers across all swarms",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(AnnounceTotal, AnnounceRejectedTotal, AnnounceRateLimitedTotal,
+		AnnounceEarlyTotal, AnnounceSpeedCappedTotal, AnnounceInvalidLeftTotal, AnnounceEmptySwarmTotal,
+		AnnounceUserPeerLimitTotal, AnnounceSlotsFullTotal, AnnounceDatacenterBlockedTotal,
+		AnnounceConcurrencyLimitedTotal, AnnounceDedupedTotal, PeersEvictedTotal, PeersFlaggedTotal, UsersCorruptFlaggedTotal, PeerSyncDuration, PeerSyncBatchSize,
+		PeerProbesTotal, PeerCacheRequestsTotal, RequestDuration, StoreDuration,
+		ScrapeTotal, EncodeErrorsTotal, ClientRejectedTotal, ClientUserAgentMismatchTotal,
+		Seeders, Leechers)
+}
+
+// NewServer creates a http server exposing the default prometheus registry
+// under /metrics
+func NewServer(listenAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:           listenAddr,
+		Handler:        mux,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+}
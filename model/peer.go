@@ -1,10 +1,14 @@
 package model
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/leighmacdonald/mika/geo"
 	"github.com/leighmacdonald/mika/util"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -29,6 +33,18 @@ func (p PeerID) RawString() string {
 	return string(p[:])
 }
 
+// CryptoLevel is the support for protocol encryption announced by a peer
+type CryptoLevel uint8
+
+const (
+	// CryptoNone is used for peers which did not announce encryption support
+	CryptoNone CryptoLevel = iota
+	// CryptoSupported is used for peers which accept encrypted connections
+	CryptoSupported
+	// CryptoRequired is used for peers which only accept encrypted connections
+	CryptoRequired
+)
+
 // Peer represents a single unique peer in a swarm
 type Peer struct {
 	sync.RWMutex
@@ -46,12 +62,44 @@ type Peer struct {
 	Downloaded uint32 `db:"total_downloaded" redis:"total_downloaded" json:"total_downloaded"`
 	// Clients reported bytes left of the download
 	Left uint32 `db:"total_left" redis:"total_left" json:"total_left"`
+	// Total amount of corrupt data discarded as reported by client
+	Corrupt uint32 `db:"total_corrupt" redis:"total_corrupt" json:"total_corrupt"`
 	// Total number of announces the peer has made
 	Announces uint32 `db:"total_announces" redis:"total_announces" json:"total_announces"`
 	// Total active swarm participation time
 	TotalTime uint32 `db:"total_time" redis:"total_time" json:"total_time"`
+	// Set once the peer has sent a completed event, used to prevent counting a snatch twice
+	Completed bool `db:"completed" redis:"completed" json:"completed"`
+	// Number of announces reporting lower totals than the previous announce
+	Resets uint32 `db:"resets" redis:"resets" json:"resets"`
+	// Set once the peer has reset its totals too many times and should be reviewed
+	Flagged bool `db:"flagged" redis:"flagged" json:"flagged"`
+	// Set while the peer reports itself as paused (BEP 21), paused time does not count
+	// towards TotalTime
+	Paused bool `db:"paused" redis:"paused" json:"paused"`
+	// Set while the peer is a partial seed (BEP 21), paused with data left. Partial seeds are
+	// not downloading more so they are served to leechers like seeders, but never count as
+	// having completed the torrent.
+	Partial bool `db:"partial" redis:"partial" json:"partial"`
+	// Set while the seeder announces with the superseed param, it is then handed a rotating
+	// subset of the leechers instead of the same peers each announce
+	SuperSeeding bool `db:"super_seeding" redis:"super_seeding" json:"super_seeding"`
+	// Position in the sorted leechers of the next peer handed to a super seeding peer
+	SuperSeedCursor uint32 `db:"super_seed_cursor" redis:"super_seed_cursor" json:"super_seed_cursor"`
+	// Set once the peer has participated in the swarm for the HNR threshold, the peer is never
+	// counted as a HNR after that even when it leaves the swarm before completing again
+	HNRExempt bool `db:"hnr_exempt" redis:"hnr_exempt" json:"hnr_exempt"`
+	// Protocol encryption support announced with the supportcrypto and requirecrypto params
+	Crypto CryptoLevel `db:"crypto" redis:"crypto" json:"crypto"`
+	// Result of the last reachability probe of the peers address, only meaningful once ProbedOn
+	// is set. Probe results are not stored by the mysql peer store.
+	Connectable bool `db:"-" redis:"connectable" json:"connectable"`
+	// Time of the last reachability probe, zero when the peer has never been probed
+	ProbedOn time.Time `db:"-" redis:"probed_on" json:"probed_on"`
 	// Clients IPv4 Address detected automatically, does not use client supplied value
 	IP net.IP `db:"addr_ip" redis:"addr_ip" json:"addr_ip"`
+	// Clients IPv6 address, used for dual-stack peers which also have a IPv4 address
+	IPv6 net.IP `db:"addr_ipv6" redis:"addr_ipv6" json:"addr_ipv6"`
 	// Clients reported port
 	Port uint16 `db:"addr_port" redis:"addr_port" json:"addr_port"`
 	// Last announce timestamp
@@ -62,6 +110,12 @@ type Peer struct {
 	PeerID   PeerID      `db:"peer_id" redis:"peer_id" json:"peer_id"`
 	Location geo.LatLong `db:"location" redis:"location" json:"location"`
 	UserID   uint32      `db:"user_id" redis:"user_id" json:"user_id"`
+	// Key sent by the client used to verify the identity of the peer across announces
+	Key string `db:"peer_key" redis:"key" json:"key"`
+	// ISO country code of the peers IP, resolved once when the peer joins the swarm
+	CountryCode string `db:"country_code" redis:"country_code" json:"country_code"`
+	// Name of the whitelisted client matching the peer_id prefix
+	Client string `db:"client" redis:"client" json:"client"`
 	// TODO Do we actually care about these times? Announce times likely enough
 	CreatedOn time.Time `db:"created_on" redis:"created_on" json:"created_on"`
 	UpdatedOn time.Time `db:"updated_on" redis:"updated_on" json:"updated_on"`
@@ -69,6 +123,18 @@ type Peer struct {
 	User *User
 }
 
+// Unreachable checks if the peer has been probed and its address was not connectable
+func (peer *Peer) Unreachable() bool {
+	return !peer.ProbedOn.IsZero() && !peer.Connectable
+}
+
+// Speed returns the peers upload and download speeds measured at its last announce
+func (peer *Peer) Speed() (up uint32, dn uint32) {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.SpeedUP, peer.SpeedDN
+}
+
 // IsNew checks if the peer is making its first announce request
 func (peer *Peer) IsNew() bool {
 	return peer.Announces == 0
@@ -79,6 +145,148 @@ func (peer *Peer) Valid() bool {
 	return peer.UserID > 0 && peer.Port >= 1024 && util.IsPrivateIP(peer.IP)
 }
 
+// UpdateAddr records the addresses the peer announced from. A IPv4 address always replaces
+// the primary IP while IPv6 addresses are stored separately so dual-stack peers can be
+// returned to clients of both families. Peers without a known IPv4 address use their
+// latest IPv6 address as the primary IP.
+func (peer *Peer) UpdateAddr(ip net.IP, ipv6 net.IP) {
+	peer.Lock()
+	defer peer.Unlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		peer.IP = ip4
+	} else if ip != nil && peer.IP.To4() == nil {
+		peer.IP = ip
+	}
+	if ipv6 != nil && ipv6.To4() == nil {
+		peer.IPv6 = ipv6
+	}
+}
+
+// Update applies the values from a announce to the peer, returning the amount uploaded and
+// downloaded since the previous announce. The current and max speeds are also recalculated
+// using the time since the last announce.
+//
+// The event is intentionally not considered. Clients send started again after a restart, so
+// only a peer which is new to the swarm takes the reported totals as is, returning peers
+// always go through the same delta calculation as a regular announce.
+func (peer *Peer) Update(uploaded uint32, downloaded uint32, left uint32) (ulDiff uint32, dlDiff uint32) {
+	peer.Lock()
+	defer peer.Unlock()
+	// Clients reset their counters on restart, so we don't count decreasing values. The
+	// lower values become the new baseline for the deltas of the following announces.
+	if uploaded < peer.Uploaded || downloaded < peer.Downloaded {
+		peer.Resets++
+		log.Warnf("Peer %s of user %d reported decreasing totals (resets: %d)",
+			peer.PeerID.String(), peer.UserID, peer.Resets)
+	}
+	if uploaded > peer.Uploaded {
+		ulDiff = uploaded - peer.Uploaded
+	}
+	if downloaded > peer.Downloaded {
+		dlDiff = downloaded - peer.Downloaded
+	}
+	now := time.Now()
+	elapsed := uint32(now.Sub(peer.AnnounceLast).Seconds())
+	// Transfers reported within the same second are measured over a full second so that
+	// rapid announces can not hide their speed
+	interval := elapsed
+	if interval == 0 {
+		interval = 1
+	}
+	peer.SpeedUP = ulDiff / interval
+	peer.SpeedDN = dlDiff / interval
+	if peer.SpeedUP > peer.SpeedUPMax {
+		peer.SpeedUPMax = peer.SpeedUP
+	}
+	if peer.SpeedDN > peer.SpeedDNMax {
+		peer.SpeedDNMax = peer.SpeedDN
+	}
+	peer.Uploaded = uploaded
+	peer.Downloaded = downloaded
+	peer.Left = left
+	peer.Announces++
+	// Time spent paused since the previous announce is not active participation
+	if !peer.Paused {
+		peer.TotalTime += elapsed
+	}
+	peer.AnnounceLast = now
+	peer.UpdatedOn = now
+	return ulDiff, dlDiff
+}
+
+// UpdateCorrupt records the corrupt total reported by the client and returns the corrupt bytes
+// reported since the previous announce. Like the transfer totals, lower values become the new
+// baseline of a restarted client.
+func (peer *Peer) UpdateCorrupt(corrupt uint32) uint32 {
+	peer.Lock()
+	defer peer.Unlock()
+	var diff uint32
+	if corrupt > peer.Corrupt {
+		diff = corrupt - peer.Corrupt
+	}
+	peer.Corrupt = corrupt
+	return diff
+}
+
+// SetPaused records whether the peer announced itself as paused (BEP 21). This should be
+// set after Update so the state applies to the time until the peers next announce, and so
+// paused peers with data left are recorded as partial seeds. A partial seed stops being one
+// as soon as it resumes downloading or reports having nothing left.
+func (peer *Peer) SetPaused(paused bool) {
+	peer.Lock()
+	peer.Paused = paused
+	peer.Partial = paused && peer.Left > 0
+	peer.Unlock()
+}
+
+// SetSuperSeeding records whether the peer announced itself as super seeding
+func (peer *Peer) SetSuperSeeding(superSeeding bool) {
+	peer.Lock()
+	peer.SuperSeeding = superSeeding
+	peer.Unlock()
+}
+
+// Seeding returns true for seeders and partial seeds, the peers which are not downloading
+func (peer *Peer) Seeding() bool {
+	return peer.Left == 0 || peer.Partial
+}
+
+// SetCrypto records the protocol encryption support announced by the peer
+func (peer *Peer) SetCrypto(level CryptoLevel) {
+	peer.Lock()
+	peer.Crypto = level
+	peer.Unlock()
+}
+
+// IsHNR returns true when a peer which completed the torrent has participated in the swarm
+// for less time than the threshold. This should be checked as the peer leaves the swarm.
+// Peers which are HNR exempt are never a HNR.
+func (peer *Peer) IsHNR(threshold time.Duration) bool {
+	peer.RLock()
+	defer peer.RUnlock()
+	return !peer.HNRExempt && peer.Completed && time.Duration(peer.TotalTime)*time.Second < threshold
+}
+
+// UpdateHNRExempt marks the peer as HNR exempt once it has participated in the swarm for at
+// least the threshold. This should be called after Update so the latest time is counted.
+func (peer *Peer) UpdateHNRExempt(threshold time.Duration) {
+	peer.Lock()
+	if time.Duration(peer.TotalTime)*time.Second >= threshold {
+		peer.HNRExempt = true
+	}
+	peer.Unlock()
+}
+
+// HNR is a Hit-N-Run record created when a user leaves a swarm before meeting
+// the minimum participation time
+type HNR struct {
+	UserID     uint32    `json:"user_id"`
+	TorrentID  uint32    `json:"torrent_id"`
+	Downloaded uint32    `json:"downloaded"`
+	TotalTime  uint32    `json:"total_time"`
+	CreatedOn  time.Time `json:"created_on"`
+}
+
 // Swarm is a set of users participating in a torrent
 type Swarm []*Peer
 
@@ -105,6 +313,319 @@ func (peers Swarm) Counts() (seeders uint, leechers uint) {
 	return
 }
 
+// Others returns the number of peers in the swarm excluding the peer with the id provided
+func (peers Swarm) Others(peerID PeerID) int {
+	others := len(peers)
+	for _, p := range peers {
+		if p.PeerID == peerID {
+			others--
+		}
+	}
+	return others
+}
+
+// PreferCountry returns the swarm reordered so that peers located in the country provided
+// come first. The relative order of peers is otherwise preserved.
+func (peers Swarm) PreferCountry(countryCode string) Swarm {
+	if countryCode == "" {
+		return peers
+	}
+	sorted := make(Swarm, 0, len(peers))
+	var others Swarm
+	for _, p := range peers {
+		if p.CountryCode == countryCode {
+			sorted = append(sorted, p)
+		} else {
+			others = append(others, p)
+		}
+	}
+	return append(sorted, others...)
+}
+
+// PausedLast returns the swarm reordered so that paused peers come after the active ones.
+// Partial seeds keep their place as they still have data for leechers. The relative order of
+// peers is otherwise preserved.
+func (peers Swarm) PausedLast() Swarm {
+	sorted := make(Swarm, 0, len(peers))
+	var paused Swarm
+	for _, p := range peers {
+		if p.Paused && !p.Partial {
+			paused = append(paused, p)
+		} else {
+			sorted = append(sorted, p)
+		}
+	}
+	return append(sorted, paused...)
+}
+
+// UnreachableLast returns the swarm reordered so that peers which failed their last
+// reachability probe come after the others. Peers which were never probed are treated as
+// reachable. The relative order of peers is otherwise preserved.
+func (peers Swarm) UnreachableLast() Swarm {
+	sorted := make(Swarm, 0, len(peers))
+	var unreachable Swarm
+	for _, p := range peers {
+		if p.Unreachable() {
+			unreachable = append(unreachable, p)
+		} else {
+			sorted = append(sorted, p)
+		}
+	}
+	return append(sorted, unreachable...)
+}
+
+// CryptoFirst returns the swarm reordered so that peers supporting protocol encryption come
+// first. When strict is set peers without encryption support are dropped instead. The relative
+// order of peers is otherwise preserved.
+func (peers Swarm) CryptoFirst(strict bool) Swarm {
+	sorted := make(Swarm, 0, len(peers))
+	var plain Swarm
+	for _, p := range peers {
+		if p.Crypto != CryptoNone {
+			sorted = append(sorted, p)
+		} else if !strict {
+			plain = append(plain, p)
+		}
+	}
+	return append(sorted, plain...)
+}
+
+// Mix returns the swarm reordered so that the first n peers contain up to the number of
+// seeders requested followed by leechers. When there are not enough leechers to fill n the
+// remainder is filled with more seeders, and when there are not enough seeders with more
+// leechers. Partial seeds are counted as seeders. The relative order of seeders and of
+// leechers is otherwise preserved.
+func (peers Swarm) Mix(n int, seeders int) Swarm {
+	if n <= 0 {
+		return peers
+	}
+	var seeding, leeching Swarm
+	for _, p := range peers {
+		if p.Seeding() {
+			seeding = append(seeding, p)
+		} else {
+			leeching = append(leeching, p)
+		}
+	}
+	if seeders > n {
+		seeders = n
+	}
+	takeSeeders := seeders
+	if takeSeeders > len(seeding) {
+		takeSeeders = len(seeding)
+	}
+	takeLeechers := n - takeSeeders
+	if takeLeechers > len(leeching) {
+		takeLeechers = len(leeching)
+	}
+	// When there are not enough leechers the remaining seeders follow them and fill the
+	// remainder of the first n
+	mixed := make(Swarm, 0, len(peers))
+	mixed = append(mixed, seeding[:takeSeeders]...)
+	mixed = append(mixed, leeching[:takeLeechers]...)
+	mixed = append(mixed, seeding[takeSeeders:]...)
+	return append(mixed, leeching[takeLeechers:]...)
+}
+
+// RotateLeechers returns up to n leechers starting at the cursor position and the cursor to
+// use for the next call. Leechers are sorted by peer id so successive calls walk through the
+// whole set, wrapping around at the end. Peers joining or leaving the swarm shift the positions,
+// so a leecher may occasionally be skipped or repeated.
+func (peers Swarm) RotateLeechers(cursor uint32, n int) (Swarm, uint32) {
+	var leeching Swarm
+	for _, p := range peers {
+		if !p.Seeding() {
+			leeching = append(leeching, p)
+		}
+	}
+	if len(leeching) == 0 || n <= 0 {
+		return Swarm{}, 0
+	}
+	sort.Slice(leeching, func(i, j int) bool {
+		return bytes.Compare(leeching[i].PeerID[:], leeching[j].PeerID[:]) < 0
+	})
+	if n > len(leeching) {
+		n = len(leeching)
+	}
+	start := int(cursor % uint32(len(leeching)))
+	rotated := make(Swarm, 0, n)
+	for i := 0; i < n; i++ {
+		rotated = append(rotated, leeching[(start+i)%len(leeching)])
+	}
+	return rotated, uint32((start + n) % len(leeching))
+}
+
+// Shuffle returns a copy of the swarm in a random order
+func (peers Swarm) Shuffle(rng *rand.Rand) Swarm {
+	shuffled := make(Swarm, len(peers))
+	copy(shuffled, peers)
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// MakeCompactPeers generates the compact peer field arrays containing the byte representations
+// of a peers IP+Port appended to each other. IPv4 peers are written as 6 byte
+// records into the first slice and IPv6 peers as 18 byte records into the second
+// slice which is used for the BEP 7 "peers6" key.
+func MakeCompactPeers(peers Swarm, skipID PeerID) ([]byte, []byte) {
+	var buf4, buf6 bytes.Buffer
+	for _, peer := range peers {
+		if peer.PeerID == skipID {
+			// Skip the peers own peer_id
+			continue
+		}
+		writeCompactPeer(&buf4, &buf6, peer)
+	}
+	return buf4.Bytes(), buf6.Bytes()
+}
+
+// writeCompactPeer writes the compact records of the peer into the IPv4 and IPv6 buffers
+func writeCompactPeer(buf4 *bytes.Buffer, buf6 *bytes.Buffer, peer *Peer) {
+	if peer.Port == 0 {
+		// Announces with invalid ports are rejected so this should never happen
+		log.Warnf("Skipping peer with invalid port 0: %s", peer.PeerID.String())
+		return
+	}
+	port := []byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)}
+	ip6 := peer.IPv6.To16()
+	if ip4 := peer.IP.To4(); ip4 != nil {
+		buf4.Write(ip4)
+		buf4.Write(port)
+	} else if ip6 == nil {
+		ip6 = peer.IP.To16()
+	}
+	if ip6 != nil {
+		buf6.Write(ip6)
+		buf6.Write(port)
+	}
+	// Peers without a parsable address are skipped entirely
+}
+
+// CompactPeerList is a swarm encoded once with the records of MakeCompactPeers, remembering
+// which peer each record belongs to so it can be truncated and the requesting peer skipped
+// without encoding the swarm again
+type CompactPeerList struct {
+	ids    []PeerID
+	peers4 []byte
+	peers6 []byte
+	// Offset of the end of the records of each peer within peers4 and peers6
+	end4 []int
+	end6 []int
+}
+
+// NewCompactPeerList encodes the swarm, keeping the order of the peers
+func NewCompactPeerList(peers Swarm) *CompactPeerList {
+	var buf4, buf6 bytes.Buffer
+	l := &CompactPeerList{
+		ids:  make([]PeerID, 0, len(peers)),
+		end4: make([]int, 0, len(peers)),
+		end6: make([]int, 0, len(peers)),
+	}
+	for _, peer := range peers {
+		writeCompactPeer(&buf4, &buf6, peer)
+		l.ids = append(l.ids, peer.PeerID)
+		l.end4 = append(l.end4, buf4.Len())
+		l.end6 = append(l.end6, buf6.Len())
+	}
+	l.peers4 = buf4.Bytes()
+	l.peers6 = buf6.Bytes()
+	return l
+}
+
+// Len returns the number of peers in the list
+func (l *CompactPeerList) Len() int {
+	return len(l.ids)
+}
+
+// Contains checks if the peer is in the list
+func (l *CompactPeerList) Contains(peerID PeerID) bool {
+	for _, id := range l.ids {
+		if id == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers returns the compact records of the first n peers in the list, excluding the peer with
+// skipID, in the same form as MakeCompactPeers. The returned slices share the memory of the
+// list and must not be modified.
+func (l *CompactPeerList) Peers(n int, skipID PeerID) ([]byte, []byte) {
+	if n > len(l.ids) {
+		n = len(l.ids)
+	}
+	skip := -1
+	for i := 0; i < n; i++ {
+		if l.ids[i] == skipID {
+			skip = i
+			break
+		}
+	}
+	// Take one more peer to make up for the skipped one
+	if skip >= 0 && n < len(l.ids) {
+		n++
+	}
+	return sliceRecords(l.peers4, l.end4, n, skip), sliceRecords(l.peers6, l.end6, n, skip)
+}
+
+// sliceRecords returns the records of the first n peers, leaving out the records of the peer at
+// index skip when skip is not negative
+func sliceRecords(buf []byte, ends []int, n int, skip int) []byte {
+	if n == 0 {
+		return nil
+	}
+	end := ends[n-1]
+	if skip < 0 {
+		return buf[:end]
+	}
+	start := 0
+	if skip > 0 {
+		start = ends[skip-1]
+	}
+	records := make([]byte, 0, end-(ends[skip]-start))
+	records = append(records, buf[:start]...)
+	return append(records, buf[ends[skip]:end]...)
+}
+
+// MakeDictPeers generates the original non-compact peer list where each peer is represented
+// by a dictionary with "ip", "port" and optionally "peer id" keys. When noPeerID is set the
+// "peer id" key is omitted as requested by the client. Only the addresses of the family are
+// returned, peers without an address of the family are skipped.
+func MakeDictPeers(peers Swarm, skipID PeerID, noPeerID bool, family AddressFamily) []map[string]interface{} {
+	var dictPeers []map[string]interface{}
+	for _, peer := range peers {
+		if peer.PeerID == skipID {
+			// Skip the peers own peer_id
+			continue
+		}
+		ip := peer.IP
+		switch family {
+		case FamilyV4:
+			ip = peer.IP.To4()
+		case FamilyV6:
+			if peer.IPv6 != nil {
+				ip = peer.IPv6
+			} else if peer.IP.To4() != nil {
+				ip = nil
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		dp := map[string]interface{}{
+			"ip":   ip.String(),
+			"port": int(peer.Port),
+		}
+		if !noPeerID {
+			dp["peer id"] = peer.PeerID.RawString()
+		}
+		dictPeers = append(dictPeers, dp)
+	}
+	return dictPeers
+}
+
 // NewPeer create a new peer instance for inserting into a swarm
 func NewPeer(userID uint32, peerID PeerID, ip net.IP, port uint16) *Peer {
 	return &Peer{
@@ -0,0 +1,307 @@
+package model
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMakeCompactPeers(t *testing.T) {
+	p4 := NewPeer(1, PeerIDFromString("-DE13F0-000000000001"), net.ParseIP("12.34.56.78"), 6881)
+	p6 := NewPeer(2, PeerIDFromString("-DE13F0-000000000002"), net.ParseIP("2600::1"), 6882)
+	pNil := NewPeer(3, PeerIDFromString("-DE13F0-000000000003"), nil, 6883)
+	self := NewPeer(4, PeerIDFromString("-DE13F0-000000000004"), net.ParseIP("12.34.56.79"), 6884)
+	pZero := NewPeer(5, PeerIDFromString("-DE13F0-000000000005"), net.ParseIP("12.34.56.80"), 0)
+	peers4, peers6 := MakeCompactPeers(Swarm{p4, p6, pNil, pZero, self}, self.PeerID)
+	assert.Equal(t, []byte{12, 34, 56, 78, 0x1a, 0xe1}, peers4)
+	assert.Equal(t, 18, len(peers6))
+	assert.Equal(t, []byte(net.ParseIP("2600::1").To16()), peers6[0:16])
+	assert.Equal(t, []byte{0x1a, 0xe2}, peers6[16:])
+}
+
+func TestMakeCompactPeersDualStack(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-DE13F0-000000000001"), net.ParseIP("12.34.56.78"), 6881)
+	p.UpdateAddr(nil, net.ParseIP("2600::1"))
+	peers4, peers6 := MakeCompactPeers(Swarm{p}, PeerIDFromString("-DE13F0-000000000004"))
+	assert.Equal(t, []byte{12, 34, 56, 78, 0x1a, 0xe1}, peers4)
+	assert.Equal(t, []byte(net.ParseIP("2600::1").To16()), peers6[0:16])
+	assert.Equal(t, []byte{0x1a, 0xe1}, peers6[16:])
+}
+
+func TestCompactPeerList(t *testing.T) {
+	p1 := NewPeer(1, PeerIDFromString("-DE13F0-000000000001"), net.ParseIP("12.34.56.78"), 6881)
+	p6 := NewPeer(2, PeerIDFromString("-DE13F0-000000000002"), net.ParseIP("2600::1"), 6882)
+	p2 := NewPeer(3, PeerIDFromString("-DE13F0-000000000003"), net.ParseIP("12.34.56.80"), 6883)
+	p3 := NewPeer(4, PeerIDFromString("-DE13F0-000000000004"), net.ParseIP("12.34.56.81"), 6884)
+	swarm := Swarm{p1, p6, p2, p3}
+	l := NewCompactPeerList(swarm)
+	assert.Equal(t, 4, l.Len())
+	assert.True(t, l.Contains(p2.PeerID))
+	assert.False(t, l.Contains(PeerIDFromString("-DE13F0-000000000009")))
+	peers4, peers6 := l.Peers(10, PeerID{})
+	exp4, exp6 := MakeCompactPeers(swarm, PeerID{})
+	assert.Equal(t, exp4, peers4)
+	assert.Equal(t, exp6, peers6)
+	// The skipped peer is made up for with the next one
+	peers4, peers6 = l.Peers(3, p2.PeerID)
+	exp4, exp6 = MakeCompactPeers(Swarm{p1, p6, p3}, PeerID{})
+	assert.Equal(t, exp4, peers4)
+	assert.Equal(t, exp6, peers6)
+	peers4, _ = l.Peers(1, p1.PeerID)
+	assert.Empty(t, peers4)
+	peers4, peers6 = l.Peers(4, p3.PeerID)
+	exp4, exp6 = MakeCompactPeers(Swarm{p1, p6, p2}, PeerID{})
+	assert.Equal(t, exp4, peers4)
+	assert.Equal(t, exp6, peers6)
+	peers4, peers6 = l.Peers(0, PeerID{})
+	assert.Empty(t, peers4)
+	assert.Empty(t, peers6)
+}
+
+func TestPeer_UpdateAddr(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-DE13F0-000000000001"), net.ParseIP("2600::1"), 6881)
+	// A IPv6 only peer follows its address changes
+	p.UpdateAddr(net.ParseIP("2600::2"), net.ParseIP("2600::2"))
+	assert.Equal(t, "2600::2", p.IP.String())
+	assert.Equal(t, "2600::2", p.IPv6.String())
+	// Once a IPv4 address is known it is kept as the primary IP
+	p.UpdateAddr(net.ParseIP("12.34.56.78"), nil)
+	assert.Equal(t, "12.34.56.78", p.IP.String())
+	assert.Equal(t, "2600::2", p.IPv6.String())
+	p.UpdateAddr(net.ParseIP("2600::3"), net.ParseIP("2600::3"))
+	assert.Equal(t, "12.34.56.78", p.IP.String())
+	assert.Equal(t, "2600::3", p.IPv6.String())
+}
+
+func TestMakeDictPeers(t *testing.T) {
+	p4 := NewPeer(1, PeerIDFromString("-DE13F0-000000000001"), net.ParseIP("12.34.56.78"), 6881)
+	p6 := NewPeer(2, PeerIDFromString("-DE13F0-000000000002"), net.ParseIP("2600::1"), 6882)
+	pNil := NewPeer(3, PeerIDFromString("-DE13F0-000000000003"), nil, 6883)
+	self := NewPeer(4, PeerIDFromString("-DE13F0-000000000004"), net.ParseIP("12.34.56.79"), 6884)
+	dictPeers := MakeDictPeers(Swarm{p4, p6, pNil, self}, self.PeerID, false, FamilyBoth)
+	assert.Equal(t, 2, len(dictPeers))
+	assert.Equal(t, "12.34.56.78", dictPeers[0]["ip"])
+	assert.Equal(t, 6881, dictPeers[0]["port"])
+	assert.Equal(t, p4.PeerID.RawString(), dictPeers[0]["peer id"])
+	assert.Equal(t, "2600::1", dictPeers[1]["ip"])
+	dictPeers = MakeDictPeers(Swarm{p4}, self.PeerID, true, FamilyBoth)
+	assert.NotContains(t, dictPeers[0], "peer id")
+	dual := NewPeer(5, PeerIDFromString("-DE13F0-000000000005"), net.ParseIP("12.34.56.80"), 6885)
+	dual.IPv6 = net.ParseIP("2600::5")
+	dictPeers = MakeDictPeers(Swarm{p4, p6, dual}, self.PeerID, false, FamilyV6)
+	assert.Equal(t, 2, len(dictPeers))
+	assert.Equal(t, "2600::1", dictPeers[0]["ip"])
+	assert.Equal(t, "2600::5", dictPeers[1]["ip"])
+	dictPeers = MakeDictPeers(Swarm{p4, p6, dual}, self.PeerID, false, FamilyV4)
+	assert.Equal(t, 2, len(dictPeers))
+	assert.Equal(t, "12.34.56.78", dictPeers[0]["ip"])
+	assert.Equal(t, "12.34.56.80", dictPeers[1]["ip"])
+}
+
+func TestPeer_IsHNR(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	p.TotalTime = 3600
+	assert.False(t, p.IsHNR(time.Hour*24), "Incomplete peers are never HNR")
+	p.Completed = true
+	assert.True(t, p.IsHNR(time.Hour*24))
+	assert.False(t, p.IsHNR(time.Minute*30))
+}
+
+func TestPeer_UpdateHNRExempt(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	p.Completed = true
+	p.TotalTime = 3600
+	p.UpdateHNRExempt(time.Hour * 2)
+	assert.False(t, p.HNRExempt)
+	p.UpdateHNRExempt(time.Hour)
+	assert.True(t, p.HNRExempt)
+	// Exempt peers stay exempt when checked against a longer threshold
+	p.UpdateHNRExempt(time.Hour * 24)
+	assert.True(t, p.HNRExempt)
+	assert.False(t, p.IsHNR(time.Hour*24))
+}
+
+func TestPeer_Update(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	p.AnnounceLast = time.Now().Add(-time.Second * 10)
+	ul, dl := p.Update(1000, 5000, 100)
+	assert.Equal(t, uint32(1000), ul)
+	assert.Equal(t, uint32(5000), dl)
+	assert.Equal(t, uint32(100), p.SpeedUP)
+	assert.Equal(t, uint32(500), p.SpeedDN)
+	assert.Equal(t, uint32(500), p.SpeedDNMax)
+	assert.Equal(t, uint32(1), p.Announces)
+	assert.Equal(t, uint32(100), p.Left)
+	// Counters reset by a client restart are not counted
+	ul, dl = p.Update(10, 10, 100)
+	assert.Equal(t, uint32(0), ul)
+	assert.Equal(t, uint32(0), dl)
+}
+
+func TestPeer_UpdateRestart(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	assert.True(t, p.IsNew())
+	// A new peer takes the reported totals as is
+	ul, dl := p.Update(5000, 8000, 0)
+	assert.Equal(t, uint32(5000), ul)
+	assert.Equal(t, uint32(8000), dl)
+	assert.False(t, p.IsNew())
+	ul, dl = p.Update(6000, 8000, 0)
+	assert.Equal(t, uint32(1000), ul)
+	assert.Equal(t, uint32(0), dl)
+	// The client restarts and sends started with its counters reset. Nothing is credited
+	// for the lower totals.
+	ul, dl = p.Update(200, 0, 0)
+	assert.Equal(t, uint32(0), ul)
+	assert.Equal(t, uint32(0), dl)
+	assert.Equal(t, uint32(3), p.Announces)
+	assert.Equal(t, uint32(1), p.Resets)
+	// Following announces are measured from the restarted counters rather than the
+	// previous session, so nothing is counted twice
+	ul, dl = p.Update(700, 100, 0)
+	assert.Equal(t, uint32(500), ul)
+	assert.Equal(t, uint32(100), dl)
+	// Repeating the started announce with unchanged totals is a no-op
+	ul, dl = p.Update(700, 100, 0)
+	assert.Equal(t, uint32(0), ul)
+	assert.Equal(t, uint32(0), dl)
+}
+
+func TestPeer_UpdatePaused(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	p.AnnounceLast = time.Now().Add(-time.Second * 10)
+	p.Update(0, 0, 100)
+	assert.Equal(t, uint32(10), p.TotalTime)
+	p.SetPaused(true)
+	// Time since a paused announce is not counted
+	p.AnnounceLast = time.Now().Add(-time.Second * 10)
+	p.Update(0, 0, 100)
+	assert.Equal(t, uint32(10), p.TotalTime)
+	p.SetPaused(false)
+	p.AnnounceLast = time.Now().Add(-time.Second * 10)
+	p.Update(0, 0, 100)
+	assert.Equal(t, uint32(20), p.TotalTime)
+}
+
+func TestSwarm_PreferCountry(t *testing.T) {
+	a := &Peer{CountryCode: "US"}
+	b := &Peer{CountryCode: "CA"}
+	c := &Peer{CountryCode: "US"}
+	d := &Peer{}
+	swarm := Swarm{a, b, c, d}
+	assert.Equal(t, Swarm{a, c, b, d}, swarm.PreferCountry("US"))
+	assert.Equal(t, Swarm{b, a, c, d}, swarm.PreferCountry("CA"))
+	assert.Equal(t, swarm, swarm.PreferCountry(""))
+}
+
+func TestSwarm_PausedLast(t *testing.T) {
+	a := &Peer{Paused: true}
+	b := &Peer{}
+	c := &Peer{Paused: true}
+	d := &Peer{}
+	assert.Equal(t, Swarm{b, d, a, c}, Swarm{a, b, c, d}.PausedLast())
+	// Partial seeds are still useful to leechers
+	p := &Peer{Paused: true, Partial: true, Left: 1}
+	assert.Equal(t, Swarm{b, p, a}, Swarm{a, b, p}.PausedLast())
+}
+
+func TestPeer_SetPaused(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	p.Update(0, 500, 500)
+	assert.False(t, p.Seeding())
+	p.SetPaused(true)
+	assert.True(t, p.Partial)
+	assert.True(t, p.Seeding())
+	// Resuming the download ends the partial seed
+	p.SetPaused(false)
+	assert.False(t, p.Partial)
+	assert.False(t, p.Seeding())
+	// A partial seed which finishes the download becomes a regular seeder
+	p.SetPaused(true)
+	p.Update(0, 1000, 0)
+	p.SetPaused(true)
+	assert.False(t, p.Partial)
+	assert.True(t, p.Seeding())
+}
+
+func TestSwarm_RotateLeechers(t *testing.T) {
+	a := &Peer{PeerID: PeerIDFromString("-XX0001-000000000001"), Left: 1}
+	b := &Peer{PeerID: PeerIDFromString("-XX0001-000000000002"), Left: 1}
+	c := &Peer{PeerID: PeerIDFromString("-XX0001-000000000003"), Left: 1}
+	s := &Peer{PeerID: PeerIDFromString("-XX0001-000000000000")}
+	swarm := Swarm{c, s, a, b}
+	rotated, cursor := swarm.RotateLeechers(0, 2)
+	assert.Equal(t, Swarm{a, b}, rotated)
+	assert.Equal(t, uint32(2), cursor)
+	rotated, cursor = swarm.RotateLeechers(cursor, 2)
+	assert.Equal(t, Swarm{c, a}, rotated)
+	assert.Equal(t, uint32(1), cursor)
+	// Cursors past the end of a shrunken swarm wrap around
+	rotated, _ = swarm.RotateLeechers(7, 5)
+	assert.Equal(t, Swarm{b, c, a}, rotated)
+	rotated, cursor = Swarm{s}.RotateLeechers(3, 2)
+	assert.Empty(t, rotated)
+	assert.Equal(t, uint32(0), cursor)
+}
+
+func TestSwarm_CryptoFirst(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{Crypto: CryptoSupported}
+	c := &Peer{}
+	d := &Peer{Crypto: CryptoRequired}
+	assert.Equal(t, Swarm{b, d, a, c}, Swarm{a, b, c, d}.CryptoFirst(false))
+	assert.Equal(t, Swarm{b, d}, Swarm{a, b, c, d}.CryptoFirst(true))
+}
+
+func TestSwarm_UnreachableLast(t *testing.T) {
+	a := &Peer{ProbedOn: time.Now()}
+	b := &Peer{ProbedOn: time.Now(), Connectable: true}
+	c := &Peer{}
+	d := &Peer{ProbedOn: time.Now()}
+	assert.Equal(t, Swarm{b, c, a, d}, Swarm{a, b, c, d}.UnreachableLast())
+}
+
+func TestSwarm_Mix(t *testing.T) {
+	s1 := &Peer{}
+	s2 := &Peer{}
+	s3 := &Peer{}
+	l1 := &Peer{Left: 1}
+	l2 := &Peer{Left: 1}
+	l3 := &Peer{Left: 1}
+	swarm := Swarm{l1, s1, l2, s2, l3, s3}
+	assert.Equal(t, Swarm{s1, s2, l1, l2, s3, l3}, swarm.Mix(4, 2))
+	// Seeders are wanted least, leechers come first
+	assert.Equal(t, Swarm{l1, l2, l3, s1, s2, s3}, swarm.Mix(4, 0))
+	// Not enough seeders, leechers fill the rest
+	assert.Equal(t, Swarm{s1, s2, s3, l1, l2, l3}, Swarm{l1, l2, l3, s1, s2, s3}.Mix(5, 5))
+	assert.Equal(t, Swarm{s1, l1, l2}, Swarm{l1, s1, l2}.Mix(3, 3))
+	// Not enough leechers, seeders fill the rest
+	assert.Equal(t, Swarm{s1, l1, s2, s3}, Swarm{s1, s2, s3, l1}.Mix(4, 1))
+	assert.Equal(t, swarm, swarm.Mix(0, 0))
+	// Partial seeds are mixed in as seeders
+	p1 := &Peer{Left: 1, Paused: true, Partial: true}
+	assert.Equal(t, Swarm{p1, l1, l2}, Swarm{l1, l2, p1}.Mix(3, 1))
+}
+
+func TestSwarm_Shuffle(t *testing.T) {
+	var swarm Swarm
+	for i := 0; i < 50; i++ {
+		swarm = append(swarm, &Peer{Port: uint16(i)})
+	}
+	shuffled := swarm.Shuffle(rand.New(rand.NewSource(1)))
+	assert.Equal(t, len(swarm), len(shuffled))
+	assert.NotEqual(t, swarm, shuffled)
+	assert.ElementsMatch(t, swarm, shuffled)
+	assert.Equal(t, uint16(0), swarm[0].Port, "The original swarm is unchanged")
+}
+
+func TestPeer_UpdateCorrupt(t *testing.T) {
+	p := NewPeer(1, PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	assert.Equal(t, uint32(100), p.UpdateCorrupt(100))
+	assert.Equal(t, uint32(50), p.UpdateCorrupt(150))
+	// A restarted client reports a lower total which becomes the new baseline
+	assert.Equal(t, uint32(0), p.UpdateCorrupt(20))
+	assert.Equal(t, uint32(10), p.UpdateCorrupt(30))
+}
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"encoding/hex"
 	"fmt"
+	"github.com/leighmacdonald/mika/consts"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +20,17 @@ func InfoHashFromString(s string) InfoHash {
 	return buf
 }
 
+// InfoHashFromHex returns a binary infohash from the 40 character base16 encoded string
+func InfoHashFromHex(s string) (InfoHash, error) {
+	var buf InfoHash
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(buf) {
+		return buf, consts.ErrInvalidInfoHash
+	}
+	copy(buf[:], b)
+	return buf, nil
+}
+
 // String implements fmt.Stringer, returning the base16 encoded PeerID.
 func (ih *InfoHash) String() string {
 	return fmt.Sprintf("%x", ih[:])
@@ -27,30 +41,116 @@ func (ih *InfoHash) RawString() string {
 	return string(ih[:])
 }
 
+// Visibility controls who is able to participate in the swarm of a torrent
+type Visibility string
+
+const (
+	// Private torrents require a valid passkey and a whitelisted client. Torrents without a
+	// visibility set are private.
+	Private Visibility = "private"
+	// Public torrents accept announces from anyone, with or without a valid passkey
+	Public Visibility = "public"
+)
+
+// AddressFamily restricts the ip address families which may participate in the swarm of a
+// torrent. Every announce must carry an address of the allowed family, either as the address
+// the announce was sent from or the ip/ipv6 params. Clients without connectivity in the family,
+// or dual stack clients which announce over the other family without sending the ipv6 param,
+// have their announces rejected and are unable to join the swarm.
+type AddressFamily string
+
+const (
+	// FamilyBoth allows both IPv4 and IPv6 peers. Torrents without a family set allow both.
+	FamilyBoth AddressFamily = "both"
+	// FamilyV4 only allows peers with an IPv4 address and only returns IPv4 peers
+	FamilyV4 AddressFamily = "v4"
+	// FamilyV6 only allows peers with an IPv6 address and only returns IPv6 peers
+	FamilyV6 AddressFamily = "v6"
+)
+
+// Allows checks if a peer announcing with the addresses may join a swarm restricted to the
+// family. ipv6 is the optional additional IPv6 address the peer reported.
+func (f AddressFamily) Allows(ip net.IP, ipv6 net.IP) bool {
+	switch f {
+	case FamilyV4:
+		return ip.To4() != nil
+	case FamilyV6:
+		return ipv6 != nil || (ip != nil && ip.To4() == nil)
+	default:
+		return true
+	}
+}
+
+// Filter drops the compact peer list of the family not allowed
+func (f AddressFamily) Filter(peers4 []byte, peers6 []byte) ([]byte, []byte) {
+	switch f {
+	case FamilyV4:
+		return peers4, nil
+	case FamilyV6:
+		return nil, peers6
+	default:
+		return peers4, peers6
+	}
+}
+
 // Torrent is the core struct for our torrent being tracked
 type Torrent struct {
 	sync.RWMutex
 	TorrentID      uint32   `db:"torrent_id" redis:"torrent_id" json:"torrent_id"`
 	ReleaseName    string   `db:"release_name" redis:"release_name" json:"release_name"`
 	InfoHash       InfoHash `db:"info_hash" redis:"info_hash" json:"info_hash"`
-	TotalCompleted int16    `db:"total_completed" redis:"total_completed" json:"total_completed"`
+	TotalCompleted uint32   `db:"total_completed" redis:"total_completed" json:"total_completed"`
 	// This is stored as MB to reduce storage costs
 	TotalUploaded uint32 `db:"total_uploaded" redis:"total_uploaded" json:"total_uploaded"`
 	// This is stored as MB to reduce storage costs
 	TotalDownloaded uint32 `db:"total_downloaded" redis:"total_downloaded" json:"total_downloaded"`
 	IsDeleted       bool   `db:"is_deleted" redis:"is_deleted" json:"is_deleted"`
+	// Total size of the torrents contents in bytes, used to calculate seeding bonus points
+	Size uint64 `db:"size" redis:"size" json:"size"`
 	// When you have a message to pass to a client set enabled = false and set the reason message.
 	// If IsDeleted is true, then nothing will be returned to the client
 	IsEnabled bool `db:"is_enabled" redis:"is_enabled" json:"is_enabled"`
 	// Reason when set will return a message to the torrent client
 	Reason string `db:"reason" redis:"reason" json:"reason"`
+	// Freeleech torrents do not count downloaded bytes towards the users totals
+	Freeleech bool `db:"freeleech" redis:"freeleech" json:"freeleech"`
+	// BlockDatacenter denies announces from datacenter ASNs for users not flagged as seedbox users
+	BlockDatacenter bool `db:"block_datacenter" redis:"block_datacenter" json:"block_datacenter"`
+	// HNRThreshold overrides the global HNR threshold for the torrent, in seconds. 0 uses the
+	// global threshold
+	HNRThreshold uint32 `db:"hnr_threshold" redis:"hnr_threshold" json:"hnr_threshold"`
+	// MaxLeechers caps the number of leechers in the swarm, overriding the global limit. 0 uses
+	// the global limit
+	MaxLeechers uint32 `db:"max_leechers" redis:"max_leechers" json:"max_leechers"`
+	// Visibility is either public or private, defaulting to private when empty
+	Visibility Visibility `db:"visibility" redis:"visibility" json:"visibility"`
+	// AddressFamily restricts the swarm to IPv4 or IPv6 peers, defaulting to both when empty
+	AddressFamily AddressFamily `db:"address_family" redis:"address_family" json:"address_family"`
 	// Upload multiplier added to the users totals
 	MultiUp float64 `db:"multi_up" redis:"multi_up" json:"multi_up"`
 	// Download multiplier added to the users totals
 	// 0 denotes freeleech status
-	MultiDn   float64   `db:"multi_dn"  redis:"multi_dn" json:"multi_dn"`
+	MultiDn float64 `db:"multi_dn"  redis:"multi_dn" json:"multi_dn"`
+	// Time the torrent was registered with the tracker
 	CreatedOn time.Time `db:"created_on" redis:"created_on" json:"created_on"`
 	UpdatedOn time.Time `db:"updated_on" redis:"updated_on" json:"updated_on"`
+	// Time of the last announce, rounded down to the minute. Torrents which have never been
+	// announced have it unset, or set to the time they were registered by the mysql store.
+	LastActive time.Time `db:"last_active" redis:"last_active" json:"last_active"`
+}
+
+// ActiveOn returns the time of the last announce for the torrent, or the time it was
+// registered when it has never been announced
+func (t *Torrent) ActiveOn() time.Time {
+	if t.LastActive.IsZero() {
+		return t.CreatedOn
+	}
+	return t.LastActive
+}
+
+// IsPublic returns true when the torrent accepts announces without a valid passkey
+func (t *Torrent) IsPublic() bool {
+	return t.Visibility == Public
 }
 
 // TorrentStats is used to relay info stats for a torrent around. It contains rolled up stats
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestAddressFamily_Allows(t *testing.T) {
+	ip4 := net.ParseIP("12.34.56.78")
+	ip6 := net.ParseIP("2600::1")
+	for _, f := range []AddressFamily{"", FamilyBoth} {
+		assert.True(t, f.Allows(ip4, nil))
+		assert.True(t, f.Allows(ip6, nil))
+	}
+	assert.True(t, FamilyV4.Allows(ip4, nil))
+	assert.True(t, FamilyV4.Allows(ip4, ip6))
+	assert.False(t, FamilyV4.Allows(ip6, nil))
+	assert.False(t, FamilyV6.Allows(ip4, nil))
+	assert.True(t, FamilyV6.Allows(ip4, ip6), "Dual stack peers reporting their v6 address")
+	assert.True(t, FamilyV6.Allows(ip6, nil))
+}
+
+func TestAddressFamily_Filter(t *testing.T) {
+	peers4, peers6 := []byte{1}, []byte{2}
+	p4, p6 := FamilyBoth.Filter(peers4, peers6)
+	assert.Equal(t, peers4, p4)
+	assert.Equal(t, peers6, p6)
+	p4, p6 = FamilyV4.Filter(peers4, peers6)
+	assert.Equal(t, peers4, p4)
+	assert.Nil(t, p6)
+	p4, p6 = FamilyV6.Filter(peers4, peers6)
+	assert.Nil(t, p4)
+	assert.Equal(t, peers6, p6)
+}
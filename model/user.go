@@ -1,13 +1,45 @@
 package model
 
+import "time"
+
 // User defines a basic user known to the tracker
 // All users are considered enabled if they exist. You must remove them from the
 // backing store to ensure they cannot access any resources
 type User struct {
-	UserID          uint32 `json:"user_id"`
-	Passkey         string `json:"passkey"`
-	IsDeleted       bool   `json:"is_deleted"`
-	DownloadEnabled bool   `json:"download_enabled"`
+	UserID          uint32 `db:"user_id" json:"user_id"`
+	Passkey         string `db:"passkey" json:"passkey"`
+	IsDeleted       bool   `db:"is_deleted" json:"is_deleted"`
+	DownloadEnabled bool   `db:"download_enabled" json:"download_enabled"`
+	// Total bytes uploaded across all torrents
+	Uploaded uint64 `db:"uploaded" json:"uploaded"`
+	// Total bytes downloaded across all torrents
+	Downloaded uint64 `db:"downloaded" json:"downloaded"`
+	// MinRatio overrides the tracker wide minimum ratio when non-zero. A negative value
+	// exempts the user from ratio enforcement entirely.
+	MinRatio float64 `db:"min_ratio" json:"min_ratio"`
+	// Bonus points accrued by seeding
+	Points float64 `db:"points" json:"points"`
+	// Seedbox exempts the user from datacenter ASN blocking
+	Seedbox bool `db:"seedbox" json:"seedbox"`
+	// Total bytes reported as corrupt across all torrents
+	Corrupt uint64 `db:"corrupt" json:"corrupt"`
+}
+
+// AnonymousUser returns the user that announces to public torrents without a valid passkey
+// are made as. It has no user id and is never persisted.
+func AnonymousUser() *User {
+	return &User{}
+}
+
+// IsAnonymous returns true for the user of announces made without a valid passkey
+func (u User) IsAnonymous() bool {
+	return u.UserID == 0
+}
+
+// CorruptExceeds returns true when the corrupt bytes reported by the user are more than ratio
+// of their downloads
+func (u User) CorruptExceeds(ratio float64) bool {
+	return u.Corrupt > 0 && float64(u.Corrupt) > float64(u.Downloaded)*ratio
 }
 
 // Valid performs basic validation of the user info ensuring we have the minimum required
@@ -16,6 +48,27 @@ func (u User) Valid() bool {
 	return u.UserID > 0 && len(u.Passkey) == 20
 }
 
+// Ratio returns the users global upload/download ratio. Users who have not
+// downloaded anything yet will have a ratio of 0.
+func (u User) Ratio() float64 {
+	if u.Downloaded == 0 {
+		return 0
+	}
+	return float64(u.Uploaded) / float64(u.Downloaded)
+}
+
+// RatioAllowed checks the users ratio against the minimum ratio, taking into account any
+// per-user override. Users who have downloaded less than the grace amount are always allowed.
+func (u User) RatioAllowed(minRatio float64, graceBytes uint64) bool {
+	if u.MinRatio != 0 {
+		minRatio = u.MinRatio
+	}
+	if minRatio <= 0 || u.Downloaded < graceBytes {
+		return true
+	}
+	return u.Ratio() >= minRatio
+}
+
 // Users is a slice of known users
 type Users []*User
 
@@ -28,3 +81,10 @@ func (users Users) Remove(p *User) []*User {
 	}
 	return users
 }
+
+// Snatch records a user completing a torrent
+type Snatch struct {
+	UserID    uint32
+	InfoHash  InfoHash
+	CreatedOn time.Time
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUser_RatioAllowed(t *testing.T) {
+	gb := uint64(1 << 30)
+	for i, tc := range []struct {
+		user     User
+		minRatio float64
+		expected bool
+	}{
+		{User{Uploaded: gb, Downloaded: 10 * gb}, 0, true},
+		{User{Uploaded: gb, Downloaded: 10 * gb}, 0.5, false},
+		{User{Uploaded: 5 * gb, Downloaded: 10 * gb}, 0.5, true},
+		// Under the grace amount
+		{User{Uploaded: 0, Downloaded: gb / 2}, 0.5, true},
+		// Per-user overrides
+		{User{Uploaded: gb, Downloaded: 10 * gb, MinRatio: 0.1}, 0.5, true},
+		{User{Uploaded: gb, Downloaded: 10 * gb, MinRatio: -1}, 0.5, true},
+		{User{Uploaded: 5 * gb, Downloaded: 10 * gb, MinRatio: 1.0}, 0.5, false},
+	} {
+		assert.Equal(t, tc.expected, tc.user.RatioAllowed(tc.minRatio, gb), "Test %d", i)
+	}
+}
+
+func TestUser_CorruptExceeds(t *testing.T) {
+	assert.False(t, User{Downloaded: 1000}.CorruptExceeds(0.05))
+	assert.False(t, User{Downloaded: 1000, Corrupt: 50}.CorruptExceeds(0.05))
+	assert.True(t, User{Downloaded: 1000, Corrupt: 51}.CorruptExceeds(0.05))
+	assert.True(t, User{Corrupt: 1}.CorruptExceeds(0.05))
+}
@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -85,6 +86,46 @@ func (ts TorrentStore) WhiteListGetAll() ([]model.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanListDelete removes a single IP or CIDR range from the global ban list
+func (ts TorrentStore) BanListDelete(cidr string) error {
+	u := fmt.Sprintf(ts.baseURL, fmt.Sprintf("/banlist/%s", url.PathEscape(cidr)))
+	resp, err := doRequest(ts.client, "DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusOK)
+}
+
+// BanListAdd will insert a new IP or CIDR range into the global ban list
+func (ts TorrentStore) BanListAdd(cidr string) error {
+	resp, err := doRequest(ts.client, "POST", fmt.Sprintf(ts.baseURL, "/banlist"), cidr)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusCreated)
+}
+
+// BanListGetAll fetches all banned IPs and CIDR ranges
+func (ts TorrentStore) BanListGetAll() ([]string, error) {
+	resp, err := doRequest(ts.client, "GET", fmt.Sprintf(ts.baseURL, "/banlist"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var bl []string
+	if err := json.Unmarshal(b, &bl); err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal ban list")
+	}
+	return bl, nil
+}
+
 func checkResponse(resp *http.Response, code int) error {
 	switch resp.StatusCode {
 	case code:
@@ -116,6 +157,36 @@ func (ts TorrentStore) Add(t *model.Torrent) error {
 	return checkResponse(resp, http.StatusCreated)
 }
 
+// Update will sync any new torrent data with the backing store
+func (ts TorrentStore) Update(t *model.Torrent) error {
+	url := fmt.Sprintf("%s/torrent/%s", ts.baseURL, t.InfoHash.String())
+	resp, err := doRequest(ts.client, "PATCH", url, t)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusOK)
+}
+
+// IncrementCompleted increments the completed count of the torrent, returning the new total
+func (ts TorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	url := fmt.Sprintf("%s/torrent/%s/completed", ts.baseURL, ih.String())
+	resp, err := doRequest(ts.client, "POST", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return 0, err
+	}
+	var total uint32
+	if err := json.NewDecoder(resp.Body).Decode(&total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
 // Delete will mark a torrent as deleted in the backing store.
 // If dropRow is true, it will permanently remove the torrent from the store
 func (ts TorrentStore) Delete(ih model.InfoHash, dropRow bool) error {
@@ -159,6 +230,99 @@ func (ts TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	return t, nil
 }
 
+// GetN returns up to N known torrents which are not marked as deleted
+func (ts TorrentStore) GetN(limit int) ([]*model.Torrent, error) {
+	url := fmt.Sprintf("%s/torrents?limit=%d", ts.baseURL, limit)
+	resp, err := doRequest(ts.client, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var torrents []*model.Torrent
+	if err := json.Unmarshal(b, &torrents); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// Touch records the time of the last announce for the torrent
+func (ts TorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	url := fmt.Sprintf("%s/torrent/%s/active", ts.baseURL, ih.String())
+	resp, err := doRequest(ts.client, "POST", url, map[string]interface{}{
+		"last_active": lastActive,
+	})
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusOK)
+}
+
+// PruneInactive removes the torrents which have not been announced within olderThan
+func (ts TorrentStore) PruneInactive(olderThan time.Duration) ([]model.InfoHash, error) {
+	url := fmt.Sprintf("%s/torrents/prune", ts.baseURL)
+	resp, err := doRequest(ts.client, "POST", url, map[string]interface{}{
+		"older_than": int64(olderThan.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var hexHashes []string
+	if err := json.Unmarshal(b, &hexHashes); err != nil {
+		return nil, err
+	}
+	pruned := make([]model.InfoHash, 0, len(hexHashes))
+	for _, h := range hexHashes {
+		ih, err := model.InfoHashFromHex(h)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, ih)
+	}
+	return pruned, nil
+}
+
+// GetMulti returns the known torrents matching the info hashes using a single request
+func (ts TorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	hexHashes := make([]string, len(hashes))
+	for i, ih := range hashes {
+		hexHashes[i] = ih.String()
+	}
+	resp, err := doRequest(ts.client, "POST", fmt.Sprintf("%s/torrents", ts.baseURL), hexHashes)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	var torrents []*model.Torrent
+	if err := json.NewDecoder(resp.Body).Decode(&torrents); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
 // Close will close all the remaining http connections
 func (ts TorrentStore) Close() error {
 	ts.client.CloseIdleConnections()
@@ -186,8 +350,13 @@ func (ps PeerStore) Get(_ model.InfoHash, _ model.PeerID) (*model.Peer, error) {
 }
 
 // Update will sync any new peer data with the backing store
-func (ps PeerStore) Update(_ model.InfoHash, _ *model.Peer) error {
-	panic("implement me")
+func (ps PeerStore) Update(ih model.InfoHash, p *model.Peer) error {
+	reqURL := fmt.Sprintf("%s/torrent/%s/peer/%s", ps.baseURL, ih.String(), p.PeerID.String())
+	resp, err := doRequest(ps.client, "PATCH", reqURL, p)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusOK)
 }
 
 // Delete will remove a user from a torrents swarm
@@ -228,9 +397,50 @@ func (ps PeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
 	return peers, nil
 }
 
-// GetScrape returns scrape data for the torrent provided
-func (ps PeerStore) GetScrape(_ model.InfoHash) {
-	panic("implement me")
+// CountsOnly returns the number of seeders and leechers in the swarm
+func (ps PeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	var counts struct {
+		Seeders  uint `json:"seeders"`
+		Leechers uint `json:"leechers"`
+	}
+	reqURL := fmt.Sprintf("%s/torrent/%s/counts", ps.baseURL, ih.String())
+	resp, err := doRequest(ps.client, "GET", reqURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return 0, 0, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&counts); err != nil {
+		return 0, 0, err
+	}
+	return counts.Seeders, counts.Leechers, nil
+}
+
+// UserPeers returns the number of peers the user has in the swarm which have announced since
+// the time provided
+func (ps PeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	var count struct {
+		Peers int `json:"peers"`
+	}
+	reqURL := fmt.Sprintf("%s/torrent/%s/user/%d/peers?since=%d", ps.baseURL, ih.String(), userID, since.Unix())
+	resp, err := doRequest(ps.client, "GET", reqURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return 0, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&count); err != nil {
+		return 0, err
+	}
+	return count.Peers, nil
 }
 
 // Close will close all the remaining http connections
@@ -318,6 +528,87 @@ func (u *UserStore) GetByID(_ uint32) (*model.User, error) {
 	panic("implement me")
 }
 
+// AddTransfer sends the users transfer amounts to the backing http api
+func (u *UserStore) AddTransfer(usr *model.User, uploaded uint64, downloaded uint64) error {
+	path := fmt.Sprintf("%s/api/user/pk/%s/transfer", u.baseURL, usr.Passkey)
+	resp, err := doRequest(u.client, "POST", path, map[string]uint64{
+		"uploaded":   uploaded,
+		"downloaded": downloaded,
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+	usr.Uploaded += uploaded
+	usr.Downloaded += downloaded
+	return nil
+}
+
+// AddPoints sends the users accrued bonus points to the backing http api
+func (u *UserStore) AddPoints(usr *model.User, points float64) error {
+	path := fmt.Sprintf("%s/api/user/pk/%s/points", u.baseURL, usr.Passkey)
+	resp, err := doRequest(u.client, "POST", path, map[string]float64{
+		"points": points,
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+	usr.Points += points
+	return nil
+}
+
+// snatch is the json representation of a model.Snatch used by the backing http api
+type snatch struct {
+	InfoHash  string    `json:"info_hash"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+// AddSnatch sends the completed torrent to the backing http api
+func (u *UserStore) AddSnatch(s model.Snatch) error {
+	path := fmt.Sprintf("%s/api/user/%d/snatches", u.baseURL, s.UserID)
+	resp, err := doRequest(u.client, "POST", path, snatch{
+		InfoHash:  s.InfoHash.String(),
+		CreatedOn: s.CreatedOn,
+	})
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, http.StatusOK)
+}
+
+// GetSnatches fetches the torrents completed by the user from the backing http api
+func (u *UserStore) GetSnatches(userID uint32) ([]model.Snatch, error) {
+	path := fmt.Sprintf("%s/api/user/%d/snatches", u.baseURL, userID)
+	resp, err := doRequest(u.client, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var results []snatch
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode user snatches")
+	}
+	snatches := make([]model.Snatch, 0, len(results))
+	for _, r := range results {
+		ih, err := model.InfoHashFromHex(r.InfoHash)
+		if err != nil {
+			return nil, err
+		}
+		snatches = append(snatches, model.Snatch{UserID: userID, InfoHash: ih, CreatedOn: r.CreatedOn})
+	}
+	return snatches, nil
+}
+
 // Delete removes a user from the backing store
 func (u *UserStore) Delete(_ *model.User) error {
 	panic("implement me")
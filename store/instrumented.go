@@ -0,0 +1,276 @@
+package store
+
+import (
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"time"
+)
+
+// observe records the round trip time of a store call started at start
+func observe(store string, op string, start time.Time) {
+	metrics.StoreDuration.WithLabelValues(store, op).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedTorrentStore records the latency of the TorrentStore calls made while
+// handling requests
+type instrumentedTorrentStore struct {
+	TorrentStore
+}
+
+// NewInstrumentedTorrentStore wraps the store so the latency of its request path calls are
+// recorded in the store duration histogram
+func NewInstrumentedTorrentStore(s TorrentStore) TorrentStore {
+	return instrumentedTorrentStore{s}
+}
+
+func (s instrumentedTorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
+	start := time.Now()
+	t, err := s.TorrentStore.Get(hash)
+	observe("torrent", "get", start)
+	return t, err
+}
+
+func (s instrumentedTorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	start := time.Now()
+	t, err := s.TorrentStore.GetMulti(hashes)
+	observe("torrent", "get_multi", start)
+	return t, err
+}
+
+func (s instrumentedTorrentStore) Update(t *model.Torrent) error {
+	start := time.Now()
+	err := s.TorrentStore.Update(t)
+	observe("torrent", "update", start)
+	return err
+}
+
+func (s instrumentedTorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	start := time.Now()
+	total, err := s.TorrentStore.IncrementCompleted(ih)
+	observe("torrent", "increment_completed", start)
+	return total, err
+}
+
+func (s instrumentedTorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	start := time.Now()
+	err := s.TorrentStore.Touch(ih, lastActive)
+	observe("torrent", "touch", start)
+	return err
+}
+
+// Ping forwards to the wrapped store when it implements Pinger
+func (s instrumentedTorrentStore) Ping() error {
+	if pinger, ok := s.TorrentStore.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// TakeStats forwards to the wrapped store when it implements StatSource
+func (s instrumentedTorrentStore) TakeStats() (*StatDeltas, error) {
+	if source, ok := s.TorrentStore.(StatSource); ok {
+		return source.TakeStats()
+	}
+	return nil, nil
+}
+
+// CommitStats forwards to the wrapped store when it implements StatSource
+func (s instrumentedTorrentStore) CommitStats() error {
+	if source, ok := s.TorrentStore.(StatSource); ok {
+		return source.CommitStats()
+	}
+	return nil
+}
+
+// AddActivity forwards to the wrapped store when it implements ActivityStore
+func (s instrumentedTorrentStore) AddActivity(counts map[model.InfoHash]RequestCounts, decay float64) error {
+	if as, ok := s.TorrentStore.(ActivityStore); ok {
+		return as.AddActivity(counts, decay)
+	}
+	return nil
+}
+
+// TopActivity forwards to the wrapped store when it implements ActivityStore
+func (s instrumentedTorrentStore) TopActivity(n int) ([]TorrentActivity, error) {
+	if as, ok := s.TorrentStore.(ActivityStore); ok {
+		return as.TopActivity(n)
+	}
+	return nil, nil
+}
+
+// instrumentedPeerStore records the latency of the PeerStore calls made while handling requests
+type instrumentedPeerStore struct {
+	PeerStore
+}
+
+// NewInstrumentedPeerStore wraps the store so the latency of its request path calls are
+// recorded in the store duration histogram
+func NewInstrumentedPeerStore(s PeerStore) PeerStore {
+	return instrumentedPeerStore{s}
+}
+
+func (s instrumentedPeerStore) Add(ih model.InfoHash, p *model.Peer) error {
+	start := time.Now()
+	err := s.PeerStore.Add(ih, p)
+	observe("peer", "add", start)
+	return err
+}
+
+func (s instrumentedPeerStore) Update(ih model.InfoHash, p *model.Peer) error {
+	start := time.Now()
+	err := s.PeerStore.Update(ih, p)
+	observe("peer", "update", start)
+	return err
+}
+
+func (s instrumentedPeerStore) Delete(ih model.InfoHash, p *model.Peer) error {
+	start := time.Now()
+	err := s.PeerStore.Delete(ih, p)
+	observe("peer", "delete", start)
+	return err
+}
+
+func (s instrumentedPeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
+	start := time.Now()
+	swarm, err := s.PeerStore.GetN(ih, limit)
+	observe("peer", "get_n", start)
+	return swarm, err
+}
+
+func (s instrumentedPeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	start := time.Now()
+	seeders, leechers, err := s.PeerStore.CountsOnly(ih)
+	observe("peer", "counts_only", start)
+	return seeders, leechers, err
+}
+
+func (s instrumentedPeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	start := time.Now()
+	count, err := s.PeerStore.UserPeers(ih, userID, since)
+	observe("peer", "user_peers", start)
+	return count, err
+}
+
+func (s instrumentedPeerStore) Get(ih model.InfoHash, id model.PeerID) (*model.Peer, error) {
+	start := time.Now()
+	p, err := s.PeerStore.Get(ih, id)
+	observe("peer", "get", start)
+	return p, err
+}
+
+// Ping forwards to the wrapped store when it implements Pinger
+func (s instrumentedPeerStore) Ping() error {
+	if pinger, ok := s.PeerStore.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// LastSync forwards to the wrapped store when it implements Syncer
+func (s instrumentedPeerStore) LastSync() time.Time {
+	if syncer, ok := s.PeerStore.(Syncer); ok {
+		return syncer.LastSync()
+	}
+	return time.Time{}
+}
+
+// Flush forwards to the wrapped store when it implements Syncer
+func (s instrumentedPeerStore) Flush() (int, error) {
+	if syncer, ok := s.PeerStore.(Syncer); ok {
+		return syncer.Flush()
+	}
+	return 0, nil
+}
+
+// instrumentedUserStore records the latency of the UserStore calls made while handling requests
+type instrumentedUserStore struct {
+	UserStore
+}
+
+// NewInstrumentedUserStore wraps the store so the latency of its request path calls are
+// recorded in the store duration histogram
+func NewInstrumentedUserStore(s UserStore) UserStore {
+	return instrumentedUserStore{s}
+}
+
+func (s instrumentedUserStore) GetByPasskey(passkey string) (*model.User, error) {
+	start := time.Now()
+	u, err := s.UserStore.GetByPasskey(passkey)
+	observe("user", "get_by_passkey", start)
+	return u, err
+}
+
+func (s instrumentedUserStore) AddTransfer(u *model.User, uploaded uint64, downloaded uint64) error {
+	start := time.Now()
+	err := s.UserStore.AddTransfer(u, uploaded, downloaded)
+	observe("user", "add_transfer", start)
+	return err
+}
+
+func (s instrumentedUserStore) AddPoints(u *model.User, points float64) error {
+	start := time.Now()
+	err := s.UserStore.AddPoints(u, points)
+	observe("user", "add_points", start)
+	return err
+}
+
+func (s instrumentedUserStore) AddSnatch(snatch model.Snatch) error {
+	start := time.Now()
+	err := s.UserStore.AddSnatch(snatch)
+	observe("user", "add_snatch", start)
+	return err
+}
+
+// Ping forwards to the wrapped store when it implements Pinger
+func (s instrumentedUserStore) Ping() error {
+	if pinger, ok := s.UserStore.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// TakeStats forwards to the wrapped store when it implements StatSource
+func (s instrumentedUserStore) TakeStats() (*StatDeltas, error) {
+	if source, ok := s.UserStore.(StatSource); ok {
+		return source.TakeStats()
+	}
+	return nil, nil
+}
+
+// CommitStats forwards to the wrapped store when it implements StatSource
+func (s instrumentedUserStore) CommitStats() error {
+	if source, ok := s.UserStore.(StatSource); ok {
+		return source.CommitStats()
+	}
+	return nil
+}
+
+// AddSpeed forwards to the wrapped store when it implements SpeedStore
+func (s instrumentedUserStore) AddSpeed(userID uint32, up int64, dn int64, ttl time.Duration) error {
+	if ss, ok := s.UserStore.(SpeedStore); ok {
+		start := time.Now()
+		err := ss.AddSpeed(userID, up, dn, ttl)
+		observe("user", "add_speed", start)
+		return err
+	}
+	return nil
+}
+
+// GetSpeed forwards to the wrapped store when it implements SpeedStore
+func (s instrumentedUserStore) GetSpeed(userID uint32) (uint64, uint64, error) {
+	if ss, ok := s.UserStore.(SpeedStore); ok {
+		return ss.GetSpeed(userID)
+	}
+	return 0, 0, nil
+}
+
+// AddCorrupt forwards to the wrapped store when it implements CorruptStore
+func (s instrumentedUserStore) AddCorrupt(u *model.User, corrupt uint64) error {
+	if cs, ok := s.UserStore.(CorruptStore); ok {
+		start := time.Now()
+		err := cs.AddCorrupt(u, corrupt)
+		observe("user", "add_corrupt", start)
+		return err
+	}
+	return nil
+}
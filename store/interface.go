@@ -14,15 +14,18 @@ import (
 	"github.com/leighmacdonald/mika/model"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 var (
 	userDriverMutex     = sync.RWMutex{}
 	peerDriversMutex    = sync.RWMutex{}
 	torrentDriversMutex = sync.RWMutex{}
+	loaderDriversMutex  = sync.RWMutex{}
 	userDrivers         = make(map[string]UserDriver)
 	peerDrivers         = make(map[string]PeerDriver)
 	torrentDrivers      = make(map[string]TorrentDriver)
+	loaderDrivers       = make(map[string]LoaderDriver)
 )
 
 // TorrentDriver provides a interface to enable registration of TorrentStore drivers
@@ -43,6 +46,20 @@ type UserDriver interface {
 	NewUserStore(config interface{}) (UserStore, error)
 }
 
+// LoaderDriver provides a interface to enable registration of Loader drivers
+type LoaderDriver interface {
+	// NewLoader instantiates a new Loader
+	NewLoader(config interface{}) (Loader, error)
+}
+
+// AddLoaderDriver will register a new driver able to instantiate a Loader
+func AddLoaderDriver(name string, driver LoaderDriver) {
+	loaderDriversMutex.Lock()
+	defer loaderDriversMutex.Unlock()
+	loaderDrivers[name] = driver
+	log.Debugf("Registered loader driver: %s", name)
+}
+
 // AddPeerDriver will register a new driver able to instantiate a PeerStore
 func AddPeerDriver(name string, driver PeerDriver) {
 	peerDriversMutex.Lock()
@@ -77,6 +94,15 @@ type UserStore interface {
 	GetByPasskey(passkey string) (*model.User, error)
 	// GetByID returns a user matching the userId
 	GetByID(userID uint32) (*model.User, error)
+	// AddTransfer atomically adds the uploaded and downloaded amounts to the users totals
+	AddTransfer(u *model.User, uploaded uint64, downloaded uint64) error
+	// AddPoints atomically adds the bonus points to the users total
+	AddPoints(u *model.User, points float64) error
+	// AddSnatch records the user completing a torrent. Completing the same torrent again
+	// updates the existing records timestamp.
+	AddSnatch(snatch model.Snatch) error
+	// GetSnatches returns the torrents completed by the user, most recent first
+	GetSnatches(userID uint32) ([]model.Snatch, error)
 	// Delete removes a user from the backing store
 	Delete(user *model.User) error
 	// Close will cleanup and close the underlying storage driver if necessary
@@ -88,11 +114,27 @@ type UserStore interface {
 type TorrentStore interface {
 	// Add adds a new torrent to the backing store
 	Add(t *model.Torrent) error
+	// Update will sync any new torrent data with the backing store
+	Update(t *model.Torrent) error
+	// IncrementCompleted atomically increments the completed count of the torrent, returning
+	// the new total. The total is never derived from or reset by the current swarm.
+	IncrementCompleted(ih model.InfoHash) (uint32, error)
 	// Delete will mark a torrent as deleted in the backing store.
 	// If dropRow is true, it will permanently remove the torrent from the store
 	Delete(ih model.InfoHash, dropRow bool) error
 	// Get returns the Torrent matching the infohash
 	Get(hash model.InfoHash) (*model.Torrent, error)
+	// GetN returns up to N known torrents which are not marked as deleted
+	GetN(limit int) ([]*model.Torrent, error)
+	// GetMulti returns the known torrents matching the info hashes in as few requests to the
+	// backing store as possible. Unknown and deleted torrents are skipped.
+	GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error)
+	// Touch records the time of the last announce for the torrent
+	Touch(ih model.InfoHash, lastActive time.Time) error
+	// PruneInactive permanently removes the torrents which have not been announced, or were
+	// registered and never announced, within olderThan. The info hashes of the removed
+	// torrents are returned so their swarms can be removed.
+	PruneInactive(olderThan time.Duration) ([]model.InfoHash, error)
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
 	// WhiteListDelete removes a client from the global whitelist
@@ -101,6 +143,12 @@ type TorrentStore interface {
 	WhiteListAdd(client model.WhiteListClient) error
 	// WhiteListGetAll fetches all known whitelisted clients
 	WhiteListGetAll() ([]model.WhiteListClient, error)
+	// BanListDelete removes a single IP or CIDR range from the global ban list
+	BanListDelete(cidr string) error
+	// BanListAdd will insert a new IP or CIDR range into the global ban list
+	BanListAdd(cidr string) error
+	// BanListGetAll fetches all banned IPs and CIDR ranges
+	BanListGetAll() ([]string, error)
 }
 
 // PeerStore defines our interface for storing peer data
@@ -115,12 +163,145 @@ type PeerStore interface {
 	Delete(ih model.InfoHash, p *model.Peer) error
 	// GetN will fetch peers for a torrents active swarm up to N users
 	GetN(ih model.InfoHash, limit int) (model.Swarm, error)
+	// CountsOnly returns the number of seeders and leechers in a torrents swarm without
+	// fetching the peers themselves
+	CountsOnly(ih model.InfoHash) (seeders uint, leechers uint, err error)
+	// UserPeers returns the number of peers the user has in a torrents swarm which have
+	// announced since the time provided, using a per-user index of the swarm
+	UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error)
 	// Get will fetch the peer from the swarm if it exists
 	Get(ih model.InfoHash, id model.PeerID) (*model.Peer, error)
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
 }
 
+// Loader reads the registered torrents and users from an external source of truth, such as the
+// database of the site, so they can be loaded into the torrent and user stores
+type Loader interface {
+	// Torrents returns all registered torrents. Only the info hash, size and freeleech status
+	// are populated.
+	Torrents() ([]*model.Torrent, error)
+	// Users returns all registered users. Only the user id and passkey are populated.
+	Users() ([]*model.User, error)
+	// Close will cleanup and close the underlying connection if necessary
+	Close() error
+}
+
+// StatDeltas holds the user transfer and torrent snatch amounts accumulated by a store since
+// they were last flushed
+type StatDeltas struct {
+	// Uploaded and Downloaded are keyed by user id
+	Uploaded   map[uint32]uint64
+	Downloaded map[uint32]uint64
+	// Completed is keyed by info hash
+	Completed map[model.InfoHash]uint64
+}
+
+// NewStatDeltas returns a empty StatDeltas
+func NewStatDeltas() *StatDeltas {
+	return &StatDeltas{
+		Uploaded:   make(map[uint32]uint64),
+		Downloaded: make(map[uint32]uint64),
+		Completed:  make(map[model.InfoHash]uint64),
+	}
+}
+
+// Merge adds the amounts of other to the deltas
+func (d *StatDeltas) Merge(other *StatDeltas) {
+	if other == nil {
+		return
+	}
+	for userID, v := range other.Uploaded {
+		d.Uploaded[userID] += v
+	}
+	for userID, v := range other.Downloaded {
+		d.Downloaded[userID] += v
+	}
+	for ih, v := range other.Completed {
+		d.Completed[ih] += v
+	}
+}
+
+// Empty returns true when there is nothing to flush
+func (d *StatDeltas) Empty() bool {
+	return len(d.Uploaded) == 0 && len(d.Downloaded) == 0 && len(d.Completed) == 0
+}
+
+// StatSource is implemented by stores which accumulate stat deltas that are periodically
+// flushed to a external database
+type StatSource interface {
+	// TakeStats snapshots and resets the accumulated deltas. Deltas recorded while a snapshot is
+	// being flushed are kept for the next snapshot. The same snapshot is returned again until
+	// CommitStats is called so a failed flush is retried without losing the deltas.
+	TakeStats() (*StatDeltas, error)
+	// CommitStats discards the snapshot returned by TakeStats once it has been persisted
+	CommitStats() error
+}
+
+// StatWriter persists stat deltas to a external database
+type StatWriter interface {
+	// WriteStats adds the deltas to the stored totals, returning the number of rows written
+	WriteStats(d *StatDeltas) (int64, error)
+}
+
+// RequestCounts holds the number of announce and scrape requests made for a torrent
+type RequestCounts struct {
+	Announces int64
+	Scrapes   int64
+}
+
+// TorrentActivity holds the request counts of a torrent. The totals count every request while
+// the recent counts decay over time so they rank the torrents which are currently active.
+type TorrentActivity struct {
+	InfoHash        model.InfoHash
+	Announces       int64
+	Scrapes         int64
+	RecentAnnounces float64
+	RecentScrapes   float64
+}
+
+// ActivityStore is implemented by torrent stores which count the requests made for each torrent
+// so the most active torrents can be ranked
+type ActivityStore interface {
+	// AddActivity multiplies the recent counts of all torrents by decay (0-1) before adding
+	// the counts provided to both the totals and the recent counts
+	AddActivity(counts map[model.InfoHash]RequestCounts, decay float64) error
+	// TopActivity returns up to n torrents ordered by their recent announce count, highest first
+	TopActivity(n int) ([]TorrentActivity, error)
+}
+
+// SpeedStore is implemented by user stores which keep a running total of the current speeds of
+// all of a users active peers
+type SpeedStore interface {
+	// AddSpeed adds the deltas (bytes/sec) to the users speed totals. The totals are dropped
+	// when they are not updated again within ttl.
+	AddSpeed(userID uint32, up int64, dn int64, ttl time.Duration) error
+	// GetSpeed returns the users current total upload and download speeds in bytes/sec
+	GetSpeed(userID uint32) (up uint64, dn uint64, err error)
+}
+
+// CorruptStore is implemented by user stores which keep a total of the corrupt data reported
+// by each user
+type CorruptStore interface {
+	// AddCorrupt adds the corrupt bytes to the users total
+	AddCorrupt(u *model.User, corrupt uint64) error
+}
+
+// Pinger is implemented by stores able to cheaply verify they can reach their backend
+type Pinger interface {
+	// Ping returns an error when the backend can not be reached
+	Ping() error
+}
+
+// Syncer is implemented by peer stores which write queued peer updates in batches
+type Syncer interface {
+	// LastSync returns when the queued peer updates were last written successfully. The
+	// zero time is returned when nothing has been written yet.
+	LastSync() time.Time
+	// Flush writes the queued peer updates immediately, returning the number of peers written
+	Flush() (int, error)
+}
+
 // NewTorrentStore will attempt to initialize a TorrentStore using the driver name provided
 func NewTorrentStore(storeType string, config interface{}) (TorrentStore, error) {
 	torrentDriversMutex.RLock()
@@ -156,3 +337,14 @@ func NewUserStore(storeType string, config interface{}) (UserStore, error) {
 	}
 	return driver.NewUserStore(config)
 }
+
+// NewLoader will attempt to initialize a Loader using the driver name provided
+func NewLoader(loaderType string, config interface{}) (Loader, error) {
+	loaderDriversMutex.RLock()
+	defer loaderDriversMutex.RUnlock()
+	driver, found := loaderDrivers[loaderType]
+	if !found {
+		return nil, consts.ErrInvalidDriver
+	}
+	return driver.NewLoader(config)
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
+	"sort"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,11 +18,44 @@ type TorrentStore struct {
 	sync.RWMutex
 	torrents  map[model.InfoHash]*model.Torrent
 	whitelist []model.WhiteListClient
+	banlist   []string
+	activity  map[model.InfoHash]*store.TorrentActivity
+}
+
+// BanListDelete removes a single IP or CIDR range from the global ban list
+func (ts *TorrentStore) BanListDelete(cidr string) error {
+	ts.Lock()
+	defer ts.Unlock()
+	for i := len(ts.banlist) - 1; i >= 0; i-- {
+		if ts.banlist[i] == cidr {
+			ts.banlist = append(ts.banlist[:i], ts.banlist[i+1:]...)
+			return nil
+		}
+	}
+	return consts.ErrInvalidBan
+}
+
+// BanListAdd will insert a new IP or CIDR range into the global ban list
+func (ts *TorrentStore) BanListAdd(cidr string) error {
+	ts.Lock()
+	ts.banlist = append(ts.banlist, cidr)
+	ts.Unlock()
+	return nil
+}
+
+// BanListGetAll fetches all banned IPs and CIDR ranges
+func (ts *TorrentStore) BanListGetAll() ([]string, error) {
+	ts.RLock()
+	bl := make([]string, len(ts.banlist))
+	copy(bl, ts.banlist)
+	ts.RUnlock()
+	return bl, nil
 }
 
 // WhiteListDelete removes a client from the global whitelist
 func (ts *TorrentStore) WhiteListDelete(client model.WhiteListClient) error {
 	ts.Lock()
+	defer ts.Unlock()
 	// Remove removes a peer from a slice
 	for i := len(ts.whitelist) - 1; i >= 0; i-- {
 		if ts.whitelist[i].ClientPrefix == client.ClientPrefix {
@@ -66,11 +101,52 @@ func (ts *TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	return t, nil
 }
 
+// GetN returns up to N known torrents which are not marked as deleted
+func (ts *TorrentStore) GetN(limit int) ([]*model.Torrent, error) {
+	var torrents []*model.Torrent
+	ts.RLock()
+	for _, t := range ts.torrents {
+		if len(torrents) == limit {
+			break
+		}
+		if t.IsDeleted {
+			continue
+		}
+		torrents = append(torrents, t)
+	}
+	ts.RUnlock()
+	return torrents, nil
+}
+
+// GetMulti returns the known torrents matching the info hashes, skipping unknown and
+// deleted torrents
+func (ts *TorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	var torrents []*model.Torrent
+	ts.RLock()
+	for _, ih := range hashes {
+		t, found := ts.torrents[ih]
+		if !found || t.IsDeleted {
+			continue
+		}
+		torrents = append(torrents, t)
+	}
+	ts.RUnlock()
+	return torrents, nil
+}
+
 // PeerStore is a memory backed store.PeerStore implementation
 // TODO shard peer storage
 type PeerStore struct {
 	sync.RWMutex
 	peers map[model.InfoHash]model.Swarm
+	// users indexes the peers of each user in a swarm
+	users map[userSwarm]model.Swarm
+}
+
+// userSwarm is the key of the per-user peer index
+type userSwarm struct {
+	ih     model.InfoHash
+	userID uint32
 }
 
 // Get will fetch the peer from the swarm if it exists
@@ -90,6 +166,7 @@ func (ps *PeerStore) Get(ih model.InfoHash, p model.PeerID) (*model.Peer, error)
 func (ps *PeerStore) Close() error {
 	ps.Lock()
 	ps.peers = make(map[model.InfoHash]model.Swarm)
+	ps.users = make(map[userSwarm]model.Swarm)
 	ps.Unlock()
 	return nil
 }
@@ -98,6 +175,8 @@ func (ps *PeerStore) Close() error {
 func (ps *PeerStore) Add(ih model.InfoHash, p *model.Peer) error {
 	ps.Lock()
 	ps.peers[ih] = append(ps.peers[ih], p)
+	key := userSwarm{ih, p.UserID}
+	ps.users[key] = append(ps.users[key], p)
 	ps.Unlock()
 	return nil
 }
@@ -111,20 +190,61 @@ func (ps *PeerStore) Update(_ model.InfoHash, _ *model.Peer) error {
 // Delete will remove a user from a torrents swarm
 func (ps *PeerStore) Delete(ih model.InfoHash, p *model.Peer) error {
 	ps.Lock()
-	ps.peers[ih].Remove(p)
+	ps.peers[ih] = ps.peers[ih].Remove(p)
+	key := userSwarm{ih, p.UserID}
+	if peers := ps.users[key].Remove(p); len(peers) > 0 {
+		ps.users[key] = peers
+	} else {
+		delete(ps.users, key)
+	}
 	ps.Unlock()
 	return nil
 }
 
 // GetN will fetch peers for a torrents active swarm up to N users
+// A copy of the swarm is returned so callers are not affected by concurrent
+// Add/Delete calls modifying the underlying slice
 func (ps *PeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
 	ps.RLock()
+	defer ps.RUnlock()
 	p, found := ps.peers[ih]
-	ps.RUnlock()
 	if !found {
 		return nil, consts.ErrInvalidTorrentID
 	}
-	return p[0:limit], nil
+	if limit > len(p) {
+		limit = len(p)
+	}
+	swarm := make(model.Swarm, limit)
+	copy(swarm, p[0:limit])
+	return swarm, nil
+}
+
+// CountsOnly returns the number of seeders and leechers in the swarm
+func (ps *PeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	ps.RLock()
+	defer ps.RUnlock()
+	p, found := ps.peers[ih]
+	if !found {
+		return 0, 0, consts.ErrInvalidTorrentID
+	}
+	seeders, leechers := p.Counts()
+	return seeders, leechers, nil
+}
+
+// UserPeers returns the number of peers the user has in the swarm which have announced since
+// the time provided
+func (ps *PeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	ps.RLock()
+	defer ps.RUnlock()
+	count := 0
+	for _, peer := range ps.users[userSwarm{ih, userID}] {
+		peer.RLock()
+		if !peer.AnnounceLast.Before(since) {
+			count++
+		}
+		peer.RUnlock()
+	}
+	return count, nil
 }
 
 // Add adds a new torrent to the memory store
@@ -141,6 +261,60 @@ func (ts *TorrentStore) Add(t *model.Torrent) error {
 	return nil
 }
 
+// Update is a no-op for memory backed store
+func (ts *TorrentStore) Update(_ *model.Torrent) error {
+	// no-op for in-memory store
+	return nil
+}
+
+// IncrementCompleted increments the completed count of the torrent
+func (ts *TorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	ts.RLock()
+	t, found := ts.torrents[ih]
+	ts.RUnlock()
+	if !found {
+		return 0, consts.ErrInvalidInfoHash
+	}
+	t.Lock()
+	t.TotalCompleted++
+	total := t.TotalCompleted
+	t.Unlock()
+	return total, nil
+}
+
+// Touch records the time of the last announce for the torrent
+func (ts *TorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	ts.RLock()
+	t, found := ts.torrents[ih]
+	ts.RUnlock()
+	if !found {
+		return consts.ErrInvalidInfoHash
+	}
+	t.Lock()
+	t.LastActive = lastActive
+	t.Unlock()
+	return nil
+}
+
+// PruneInactive removes the torrents which have not been announced within olderThan
+func (ts *TorrentStore) PruneInactive(olderThan time.Duration) ([]model.InfoHash, error) {
+	cutoff := time.Now().Add(-olderThan)
+	var pruned []model.InfoHash
+	ts.Lock()
+	defer ts.Unlock()
+	for ih, t := range ts.torrents {
+		t.RLock()
+		inactive := t.ActiveOn().Before(cutoff)
+		t.RUnlock()
+		if inactive {
+			delete(ts.torrents, ih)
+			delete(ts.activity, ih)
+			pruned = append(pruned, ih)
+		}
+	}
+	return pruned, nil
+}
+
 // Delete will mark a torrent as deleted in the backing store.
 // NOTE the memory store always permanently deletes the torrent
 func (ts *TorrentStore) Delete(ih model.InfoHash, _ bool) error {
@@ -150,6 +324,45 @@ func (ts *TorrentStore) Delete(ih model.InfoHash, _ bool) error {
 	return nil
 }
 
+// AddActivity decays the recent request counts and adds the new counts
+func (ts *TorrentStore) AddActivity(counts map[model.InfoHash]store.RequestCounts, decay float64) error {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, a := range ts.activity {
+		a.RecentAnnounces *= decay
+		a.RecentScrapes *= decay
+	}
+	for ih, c := range counts {
+		a, found := ts.activity[ih]
+		if !found {
+			a = &store.TorrentActivity{InfoHash: ih}
+			ts.activity[ih] = a
+		}
+		a.Announces += c.Announces
+		a.Scrapes += c.Scrapes
+		a.RecentAnnounces += float64(c.Announces)
+		a.RecentScrapes += float64(c.Scrapes)
+	}
+	return nil
+}
+
+// TopActivity returns up to n torrents with the highest recent announce count
+func (ts *TorrentStore) TopActivity(n int) ([]store.TorrentActivity, error) {
+	ts.RLock()
+	top := make([]store.TorrentActivity, 0, len(ts.activity))
+	for _, a := range ts.activity {
+		top = append(top, *a)
+	}
+	ts.RUnlock()
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].RecentAnnounces > top[j].RecentAnnounces
+	})
+	if n < len(top) {
+		top = top[:n]
+	}
+	return top, nil
+}
+
 type torrentDriver struct{}
 
 // NewTorrentStore initialize a TorrentStore implementation using the memory backing store
@@ -158,6 +371,8 @@ func (td torrentDriver) NewTorrentStore(_ interface{}) (store.TorrentStore, erro
 		sync.RWMutex{},
 		make(map[model.InfoHash]*model.Torrent),
 		[]model.WhiteListClient{},
+		[]string{},
+		make(map[model.InfoHash]*store.TorrentActivity),
 	}, nil
 }
 
@@ -168,13 +383,23 @@ func (pd peerDriver) NewPeerStore(_ interface{}) (store.PeerStore, error) {
 	return &PeerStore{
 		sync.RWMutex{},
 		make(map[model.InfoHash]model.Swarm),
+		make(map[userSwarm]model.Swarm),
 	}, nil
 }
 
 // UserStore is the memory backed store.UserStore implementation
 type UserStore struct {
 	sync.RWMutex
-	users map[string]*model.User
+	users    map[string]*model.User
+	snatches map[uint32][]model.Snatch
+	speeds   map[uint32]userSpeed
+}
+
+// userSpeed is the running total of a users peer speeds
+type userSpeed struct {
+	up      int64
+	dn      int64
+	expires time.Time
 }
 
 // Add will add a new user to the backing store
@@ -211,6 +436,94 @@ func (u *UserStore) GetByID(userID uint32) (*model.User, error) {
 	return nil, consts.ErrUnauthorized
 }
 
+// AddTransfer adds the uploaded and downloaded amounts to the users totals
+func (u *UserStore) AddTransfer(usr *model.User, uploaded uint64, downloaded uint64) error {
+	u.Lock()
+	usr.Uploaded += uploaded
+	usr.Downloaded += downloaded
+	u.Unlock()
+	return nil
+}
+
+// AddPoints adds the bonus points to the users total
+func (u *UserStore) AddPoints(usr *model.User, points float64) error {
+	u.Lock()
+	usr.Points += points
+	u.Unlock()
+	return nil
+}
+
+// AddCorrupt adds the corrupt bytes to the users total
+func (u *UserStore) AddCorrupt(usr *model.User, corrupt uint64) error {
+	u.Lock()
+	usr.Corrupt += corrupt
+	u.Unlock()
+	return nil
+}
+
+// AddSnatch records the user completing a torrent
+func (u *UserStore) AddSnatch(snatch model.Snatch) error {
+	u.Lock()
+	defer u.Unlock()
+	snatches := u.snatches[snatch.UserID]
+	for i := len(snatches) - 1; i >= 0; i-- {
+		if snatches[i].InfoHash == snatch.InfoHash {
+			snatches = append(snatches[:i], snatches[i+1:]...)
+		}
+	}
+	u.snatches[snatch.UserID] = append(snatches, snatch)
+	return nil
+}
+
+// GetSnatches returns the torrents completed by the user, most recent first
+func (u *UserStore) GetSnatches(userID uint32) ([]model.Snatch, error) {
+	u.RLock()
+	defer u.RUnlock()
+	snatches := u.snatches[userID]
+	s := make([]model.Snatch, len(snatches))
+	for i, snatch := range snatches {
+		s[len(snatches)-1-i] = snatch
+	}
+	return s, nil
+}
+
+// AddSpeed adds the deltas to the users speed totals, starting again from zero when the
+// totals were not updated within the previous ttl
+func (u *UserStore) AddSpeed(userID uint32, up int64, dn int64, ttl time.Duration) error {
+	u.Lock()
+	defer u.Unlock()
+	now := time.Now()
+	speed, found := u.speeds[userID]
+	if !found || now.After(speed.expires) {
+		speed = userSpeed{}
+	}
+	speed.up += up
+	speed.dn += dn
+	speed.expires = now.Add(ttl)
+	u.speeds[userID] = speed
+	return nil
+}
+
+// GetSpeed returns the users current total upload and download speeds
+func (u *UserStore) GetSpeed(userID uint32) (uint64, uint64, error) {
+	u.RLock()
+	defer u.RUnlock()
+	speed, found := u.speeds[userID]
+	if !found || time.Now().After(speed.expires) {
+		return 0, 0, nil
+	}
+	return clampSpeed(speed.up), clampSpeed(speed.dn), nil
+}
+
+// clampSpeed converts a speed total to its unsigned value. Totals can briefly be negative when
+// the speeds of peers added before a restart are removed.
+func clampSpeed(speed int64) uint64 {
+	if speed < 0 {
+		return 0
+	}
+	return uint64(speed)
+}
+
 // Delete removes a user from the backing store
 func (u *UserStore) Delete(user *model.User) error {
 	u.Lock()
@@ -223,6 +536,8 @@ func (u *UserStore) Delete(user *model.User) error {
 func (u *UserStore) Close() error {
 	u.Lock()
 	u.users = make(map[string]*model.User)
+	u.snatches = make(map[uint32][]model.Snatch)
+	u.speeds = make(map[uint32]userSpeed)
 	u.Unlock()
 	return nil
 }
@@ -234,6 +549,8 @@ func (pd userDriver) NewUserStore(_ interface{}) (store.UserStore, error) {
 	return &UserStore{
 		sync.RWMutex{},
 		make(map[string]*model.User),
+		make(map[uint32][]model.Snatch),
+		make(map[uint32]userSpeed),
 	}, nil
 }
 
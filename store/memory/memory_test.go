@@ -1,8 +1,11 @@
 package memory
 
 import (
+	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestMemoryTorrentStore(t *testing.T) {
@@ -18,3 +21,61 @@ func TestMemoryPeerStore(t *testing.T) {
 	ps, _ := pd.NewPeerStore(nil)
 	store.TestPeerStore(t, ps, ts)
 }
+
+func TestMemoryUserStore(t *testing.T) {
+	ud := userDriver{}
+	us, _ := ud.NewUserStore(nil)
+	store.TestUserStore(t, us)
+}
+
+func TestMemoryPeerStore_GetNCopy(t *testing.T) {
+	pd := peerDriver{}
+	ps, _ := pd.NewPeerStore(nil)
+	tor := store.GenerateTestTorrent()
+	var peers []*model.Peer
+	for i := 0; i < 3; i++ {
+		p := store.GenerateTestPeer(store.GenerateTestUser())
+		require.NoError(t, ps.Add(tor.InfoHash, p))
+		peers = append(peers, p)
+	}
+	swarm, err := ps.GetN(tor.InfoHash, 10)
+	require.NoError(t, err)
+	require.NoError(t, ps.Delete(tor.InfoHash, peers[0]))
+	// Previously fetched swarms must not be modified by later deletes
+	require.Equal(t, model.Swarm(peers), swarm)
+}
+
+func TestMemoryUserStore_Speed(t *testing.T) {
+	ud := userDriver{}
+	us, _ := ud.NewUserStore(nil)
+	ss := us.(store.SpeedStore)
+	require.NoError(t, ss.AddSpeed(1, 100, 200, time.Minute))
+	require.NoError(t, ss.AddSpeed(1, 50, -250, time.Minute))
+	up, dn, err := ss.GetSpeed(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(150), up)
+	require.Equal(t, uint64(0), dn)
+	// Totals which are not updated within the ttl decay to zero
+	require.NoError(t, ss.AddSpeed(2, 100, 100, time.Millisecond))
+	time.Sleep(time.Millisecond * 5)
+	up, dn, err = ss.GetSpeed(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), up)
+	require.Equal(t, uint64(0), dn)
+}
+
+func TestInstrumentedStores(t *testing.T) {
+	td := torrentDriver{}
+	ts, _ := td.NewTorrentStore(nil)
+	store.TestTorrentStore(t, store.NewInstrumentedTorrentStore(ts))
+	pd := peerDriver{}
+	ps, _ := pd.NewPeerStore(nil)
+	ips := store.NewInstrumentedPeerStore(ps)
+	store.TestPeerStore(t, ips, ts)
+	ud := userDriver{}
+	us, _ := ud.NewUserStore(nil)
+	store.TestUserStore(t, store.NewInstrumentedUserStore(us))
+	// Wrapping a store without a backend to ping or batched writes must not change its health
+	require.NoError(t, ips.(store.Pinger).Ping())
+	require.True(t, ips.(store.Syncer).LastSync().IsZero())
+}
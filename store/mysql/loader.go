@@ -0,0 +1,178 @@
+package mysql
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Loader reads the registered torrents and users from the tables of a sites mysql database
+// using the table and column names from the loader config
+type Loader struct {
+	db  *sqlx.DB
+	cfg *config.LoaderConfig
+}
+
+// quoteIdent quotes a configured table or column name for use in a query
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Torrents returns all torrents in the configured torrent table
+func (l *Loader) Torrents() ([]*model.Torrent, error) {
+	q := fmt.Sprintf("SELECT %s, %s, %s FROM %s", quoteIdent(l.cfg.TorrentInfoHash),
+		quoteIdent(l.cfg.TorrentSize), quoteIdent(l.cfg.TorrentFreeleech), quoteIdent(l.cfg.TorrentTable))
+	rows, err := l.db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query source torrents")
+	}
+	var torrents []*model.Torrent
+	for rows.Next() {
+		var (
+			rawHash   []byte
+			size      uint64
+			freeleech bool
+		)
+		if err := rows.Scan(&rawHash, &size, &freeleech); err != nil {
+			_ = rows.Close()
+			return nil, errors.Wrap(err, "Failed to read source torrent")
+		}
+		ih, err := parseSourceHash(rawHash)
+		if err != nil {
+			log.Warnf("Skipping source torrent with invalid info hash: %x", rawHash)
+			continue
+		}
+		t := model.NewTorrent(ih, ih.String(), 0)
+		t.Size = size
+		t.Freeleech = freeleech
+		torrents = append(torrents, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read source torrents")
+	}
+	return torrents, nil
+}
+
+// parseSourceHash accepts info hashes stored as either the raw 20 bytes or the 40 character
+// hex encoded string
+func parseSourceHash(b []byte) (model.InfoHash, error) {
+	switch len(b) {
+	case 20:
+		return model.InfoHashFromString(string(b)), nil
+	case 40:
+		return model.InfoHashFromHex(string(b))
+	default:
+		return model.InfoHash{}, consts.ErrInvalidInfoHash
+	}
+}
+
+// Users returns all users in the configured user table
+func (l *Loader) Users() ([]*model.User, error) {
+	q := fmt.Sprintf("SELECT %s, %s FROM %s", quoteIdent(l.cfg.UserID),
+		quoteIdent(l.cfg.UserPasskey), quoteIdent(l.cfg.UserTable))
+	rows, err := l.db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query source users")
+	}
+	var users []*model.User
+	for rows.Next() {
+		usr := &model.User{DownloadEnabled: true}
+		if err := rows.Scan(&usr.UserID, &usr.Passkey); err != nil {
+			_ = rows.Close()
+			return nil, errors.Wrap(err, "Failed to read source user")
+		}
+		if !usr.Valid() {
+			log.Warnf("Skipping invalid source user: %d", usr.UserID)
+			continue
+		}
+		users = append(users, usr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read source users")
+	}
+	return users, nil
+}
+
+// WriteStats adds the deltas to the configured user transfer and torrent snatch columns in a
+// single transaction. Torrents are matched by either their raw or hex encoded info hash.
+func (l *Loader) WriteStats(d *store.StatDeltas) (int64, error) {
+	tx, err := l.db.Beginx()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to begin stat flush")
+	}
+	userQ := fmt.Sprintf("UPDATE %s SET %s = %s + ?, %s = %s + ? WHERE %s = ?", quoteIdent(l.cfg.UserTable),
+		quoteIdent(l.cfg.UserUploaded), quoteIdent(l.cfg.UserUploaded),
+		quoteIdent(l.cfg.UserDownloaded), quoteIdent(l.cfg.UserDownloaded), quoteIdent(l.cfg.UserID))
+	torrentQ := fmt.Sprintf("UPDATE %s SET %s = %s + ? WHERE %s IN (?, ?)", quoteIdent(l.cfg.TorrentTable),
+		quoteIdent(l.cfg.TorrentSnatched), quoteIdent(l.cfg.TorrentSnatched), quoteIdent(l.cfg.TorrentInfoHash))
+	var rows int64
+	exec := func(q string, args ...interface{}) error {
+		res, err := tx.Exec(q, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err == nil {
+			rows += n
+		}
+		return nil
+	}
+	for userID := range userIDs(d) {
+		if err := exec(userQ, d.Uploaded[userID], d.Downloaded[userID], userID); err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrapf(err, "Failed to flush user stats: %d", userID)
+		}
+	}
+	for ih, completed := range d.Completed {
+		if err := exec(torrentQ, completed, ih.RawString(), ih.String()); err != nil {
+			_ = tx.Rollback()
+			return 0, errors.Wrapf(err, "Failed to flush torrent stats: %s", ih.String())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "Failed to commit stat flush")
+	}
+	return rows, nil
+}
+
+// userIDs returns the set of users with either a upload or download delta
+func userIDs(d *store.StatDeltas) map[uint32]struct{} {
+	ids := make(map[uint32]struct{}, len(d.Uploaded))
+	for userID := range d.Uploaded {
+		ids[userID] = struct{}{}
+	}
+	for userID := range d.Downloaded {
+		ids[userID] = struct{}{}
+	}
+	return ids
+}
+
+// Close will close the underlying mysql database connection
+func (l *Loader) Close() error {
+	return l.db.Close()
+}
+
+type loaderDriver struct{}
+
+// NewLoader initialize a Loader reading from the mysql database of the config
+func (ld loaderDriver) NewLoader(cfg interface{}) (store.Loader, error) {
+	c, ok := cfg.(*config.LoaderConfig)
+	if !ok {
+		return nil, consts.ErrInvalidConfig
+	}
+	db, err := sqlx.Connect(driverName, c.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to loader database")
+	}
+	return &Loader{db: db, cfg: c}, nil
+}
+
+func init() {
+	store.AddLoaderDriver(driverName, loaderDriver{})
+}
@@ -1 +1,24 @@
 package mysql
+
+import (
+	"github.com/leighmacdonald/mika/model"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseSourceHash(t *testing.T) {
+	raw := []byte("01234567890123456789")
+	ih, err := parseSourceHash(raw)
+	require.NoError(t, err)
+	require.Equal(t, model.InfoHashFromString(string(raw)), ih)
+	hexIH, err := parseSourceHash([]byte(ih.String()))
+	require.NoError(t, err)
+	require.Equal(t, ih, hexIH)
+	_, err = parseSourceHash([]byte("short"))
+	require.Error(t, err)
+}
+
+func TestQuoteIdent(t *testing.T) {
+	require.Equal(t, "`torrents`", quoteIdent("torrents"))
+	require.Equal(t, "`bad``name`", quoteIdent("bad`name"))
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
+	"time"
 )
 
 // PeerStore is the mysql backed implementation of store.PeerStore
@@ -20,19 +21,33 @@ func (ps *PeerStore) Close() error {
 }
 
 // Update will sync the new peer data with the backing store
-func (ps *PeerStore) Update(_ model.InfoHash, _ *model.Peer) error {
-	panic("implement me")
+func (ps *PeerStore) Update(ih model.InfoHash, p *model.Peer) error {
+	const q = `
+	UPDATE peers 
+	SET total_downloaded = ?, total_uploaded = ?, total_left = ?, total_corrupt = ?, total_time = ?, total_announces = ?,
+	    speed_up = ?, speed_dn = ?, speed_up_max = ?, speed_dn_max = ?, completed = ?, resets = ?, flagged = ?,
+	    paused = ?, partial = ?, super_seeding = ?, super_seed_cursor = ?, crypto = ?, hnr_exempt = ?, peer_key = ?,
+	    addr_ip = ?, addr_ipv6 = ?, updated_on = ?
+	WHERE info_hash = ? AND peer_id = ?`
+	_, err := ps.db.Exec(q, p.Downloaded, p.Uploaded, p.Left, p.Corrupt, p.TotalTime, p.Announces,
+		p.SpeedUP, p.SpeedDN, p.SpeedUPMax, p.SpeedDNMax, p.Completed, p.Resets, p.Flagged,
+		p.Paused, p.Partial, p.SuperSeeding, p.SuperSeedCursor, p.Crypto, p.HNRExempt, p.Key,
+		p.IP, p.IPv6, p.UpdatedOn, ih, p.PeerID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update peer")
+	}
+	return nil
 }
 
 // Add insets the peer into the swarm of the torrent provided
 func (ps *PeerStore) Add(ih model.InfoHash, p *model.Peer) error {
 	const q = `
 	INSERT INTO peers 
-	    (peer_id, info_hash, addr_ip, addr_port, location, user_id, created_on, updated_on)
+	    (peer_id, info_hash, addr_ip, addr_ipv6, addr_port, location, country_code, peer_key, client, user_id, created_on, updated_on)
 	VALUES 
-	    (:peer_id, :info_hash, :addr_ip, :addr_port, :location, :user_id, now(), :updated_on)
+	    (:peer_id, :info_hash, :addr_ip, :addr_ipv6, :addr_port, :location, :country_code, :peer_key, :client, :user_id, now(), :updated_on)
 	`
-	_, err := ps.db.Exec(q, p.PeerID, ih, p.IP, p.Port, p.Location, p.UserID)
+	_, err := ps.db.Exec(q, p.PeerID, ih, p.IP, p.IPv6, p.Port, p.Location, p.CountryCode, p.Key, p.Client, p.UserID)
 	if err != nil {
 		return err
 	}
@@ -66,6 +81,32 @@ func (ps *PeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
 	return peers, nil
 }
 
+// CountsOnly returns the number of seeders and leechers in the swarm
+func (ps *PeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	const q = `
+		SELECT COALESCE(SUM(total_left = 0), 0) AS seeders, COALESCE(SUM(total_left > 0), 0) AS leechers
+		FROM peers WHERE info_hash = ?`
+	var counts struct {
+		Seeders  uint `db:"seeders"`
+		Leechers uint `db:"leechers"`
+	}
+	if err := ps.db.Get(&counts, q, ih); err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to fetch swarm counts")
+	}
+	return counts.Seeders, counts.Leechers, nil
+}
+
+// UserPeers returns the number of peers the user has in the swarm which have been updated
+// since the time provided
+func (ps *PeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	const q = `SELECT COUNT(*) FROM peers WHERE info_hash = ? AND user_id = ? AND updated_on >= ?`
+	var count int
+	if err := ps.db.Get(&count, q, ih, userID, since); err != nil {
+		return 0, errors.Wrap(err, "Failed to fetch user peers")
+	}
+	return count, nil
+}
+
 type peerDriver struct{}
 
 // NewPeerStore returns a mysql backed store.PeerStore driver
@@ -10,14 +10,22 @@ create table torrent
     release_name varchar(255) not null,
     total_uploaded int unsigned default 0 not null,
     total_downloaded int unsigned default 0 not null,
-    total_completed smallint unsigned default 0 not null,
+    total_completed int unsigned default 0 not null,
+    size bigint unsigned default 0 not null,
     is_deleted tinyint(1) default 0 not null,
     is_enabled tinyint(1) default 1 not null,
     reason varchar(255) default '' not null,
+    freeleech tinyint(1) default 0 not null,
+    block_datacenter tinyint(1) default 0 not null,
+    hnr_threshold int unsigned default 0 not null,
+    max_leechers int unsigned default 0 not null,
+    visibility enum('private', 'public') default 'private' not null,
+    address_family enum('both', 'v4', 'v6') default 'both' not null,
     multi_up decimal(5,2) default 1.00 not null,
     multi_dn decimal(5,2) default 1.00 not null,
     created_on datetime not null,
     updated_on datetime not null,
+    last_active datetime default current_timestamp not null,
     constraint pk_torrent  primary key (info_hash),
     constraint uq_release_name  unique (release_name)
 );
@@ -30,10 +38,34 @@ create table user
 	passkey varchar(20) not null,
 	download_enabled tinyint(1) default 1 not null,
 	is_deleted tinyint(1) default 0 not null,
+	uploaded bigint unsigned default 0 not null,
+	downloaded bigint unsigned default 0 not null,
+	min_ratio decimal(5,2) default 0.00 not null,
+	points double default 0 not null,
+	seedbox tinyint(1) default 0 not null,
+	corrupt bigint unsigned default 0 not null,
 	constraint user_passkey_uindex
 		unique (passkey)
 );
 
+create table user_snatch
+(
+	user_id int unsigned not null,
+	info_hash binary(20) not null,
+	created_on datetime not null,
+	constraint pk_user_snatch primary key (user_id, info_hash),
+	constraint user_snatch_user_user_id_fk
+		foreign key (user_id) references user (user_id)
+			on update cascade on delete cascade
+);
+
+create table ban_list
+(
+	cidr varchar(43) not null,
+	created_on datetime not null,
+	constraint pk_ban_list primary key (cidr)
+);
+
 create table peers
 (
 	peer_id binary(20) not null,
@@ -41,17 +73,31 @@ create table peers
 	user_id int unsigned not null,
 	torrent_id int unsigned not null,
 	addr_ip int unsigned not null,
+	addr_ipv6 varbinary(16) null,
 	addr_port smallint unsigned not null,
 	total_downloaded int unsigned default 0 not null,
 	total_uploaded int unsigned default 0 not null,
 	total_left int unsigned default 0 not null,
+	total_corrupt int unsigned default 0 not null,
 	total_time int unsigned default 0 not null,
 	total_announces int unsigned default 0 not null,
 	speed_up int unsigned default 0 not null,
 	speed_dn int unsigned default 0 not null,
 	speed_up_max int unsigned default 0 not null,
 	speed_dn_max int unsigned default 0 not null,
+	completed tinyint(1) default 0 not null,
+	resets int unsigned default 0 not null,
+	flagged tinyint(1) default 0 not null,
+	paused tinyint(1) default 0 not null,
+	partial tinyint(1) default 0 not null,
+	super_seeding tinyint(1) default 0 not null,
+	super_seed_cursor int unsigned default 0 not null,
+	crypto tinyint unsigned default 0 not null,
+	hnr_exempt tinyint(1) default 0 not null,
+	peer_key varchar(64) default '' not null,
 	location point not null,
+	country_code char(2) default '' not null,
+	client varchar(64) default '' not null,
 	created_on datetime not null,
 	updated_on datetime not null,
 	constraint peers_pk primary key (info_hash, peer_id)
@@ -59,4 +105,7 @@ create table peers
 		foreign key (user_id) references user (user_id)
 			on update cascade on delete cascade,
 );
+
+create index peers_info_hash_user_id_index
+	on peers (info_hash, user_id);
 `
@@ -4,6 +4,7 @@
 package mysql
 
 import (
+	"database/sql"
 	// imported for side-effects
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -12,6 +13,7 @@ import (
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
+	"time"
 )
 
 const (
@@ -38,6 +40,42 @@ func (s *TorrentStore) WhiteListGetAll() ([]model.WhiteListClient, error) {
 	panic("implement me")
 }
 
+// BanListDelete removes a single IP or CIDR range from the global ban list
+func (s *TorrentStore) BanListDelete(cidr string) error {
+	const q = `DELETE FROM ban_list WHERE cidr = ?`
+	res, err := s.db.Exec(q, cidr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove banned ip")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove banned ip")
+	}
+	if rows != 1 {
+		return consts.ErrInvalidBan
+	}
+	return nil
+}
+
+// BanListAdd will insert a new IP or CIDR range into the global ban list
+func (s *TorrentStore) BanListAdd(cidr string) error {
+	const q = `INSERT INTO ban_list (cidr, created_on) VALUES (?, NOW())`
+	if _, err := s.db.Exec(q, cidr); err != nil {
+		return errors.Wrapf(err, "Failed to add new banned ip: %s", cidr)
+	}
+	return nil
+}
+
+// BanListGetAll fetches all banned IPs and CIDR ranges
+func (s *TorrentStore) BanListGetAll() ([]string, error) {
+	const q = `SELECT cidr FROM ban_list`
+	var bl []string
+	if err := s.db.Select(&bl, q); err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch ban list")
+	}
+	return bl, nil
+}
+
 // Close will close the underlying mysql database connection
 func (s *TorrentStore) Close() error {
 	return s.db.Close()
@@ -48,17 +86,142 @@ func (s *TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	const q = `SELECT * FROM torrent WHERE info_hash = ? AND is_deleted = false`
 	var t *model.Torrent
 	if err := s.db.Get(t, q, hash.String()); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, consts.ErrInvalidInfoHash.Wrap(err)
+		}
 		return nil, err
 	}
 	return t, nil
 }
 
+// GetN returns up to N known torrents which are not marked as deleted
+func (s *TorrentStore) GetN(limit int) ([]*model.Torrent, error) {
+	const q = `SELECT * FROM torrent WHERE is_deleted = false LIMIT ?`
+	var torrents []*model.Torrent
+	if err := s.db.Select(&torrents, q, limit); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// GetMulti returns the torrents matching the info hashes which are not marked as deleted
+func (s *TorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	rawHashes := make([][]byte, len(hashes))
+	for i := range hashes {
+		rawHashes[i] = hashes[i][:]
+	}
+	q, args, err := sqlx.In(`SELECT * FROM torrent WHERE info_hash IN (?) AND is_deleted = false`, rawHashes)
+	if err != nil {
+		return nil, err
+	}
+	var torrents []*model.Torrent
+	if err := s.db.Select(&torrents, s.db.Rebind(q), args...); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// Update will sync any new torrent data with the backing store
+func (s *TorrentStore) Update(t *model.Torrent) error {
+	const q = `
+		UPDATE torrent 
+		SET total_uploaded = ?, total_downloaded = ?, is_deleted = ?, 
+		    is_enabled = ?, reason = ?, freeleech = ?, multi_up = ?, multi_dn = ?, block_datacenter = ?,
+		    hnr_threshold = ?, max_leechers = ?, visibility = ?, address_family = ?, updated_on = ?
+		WHERE info_hash = ?`
+	_, err := s.db.Exec(q, t.TotalUploaded, t.TotalDownloaded, t.IsDeleted,
+		t.IsEnabled, t.Reason, t.Freeleech, t.MultiUp, t.MultiDn, t.BlockDatacenter,
+		t.HNRThreshold, t.MaxLeechers, visibilityOrDefault(t.Visibility), familyOrDefault(t.AddressFamily),
+		t.UpdatedOn, t.InfoHash)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update torrent")
+	}
+	return nil
+}
+
+// Touch records the time of the last announce for the torrent
+func (s *TorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	const q = `UPDATE torrent SET last_active = ? WHERE info_hash = ?`
+	if _, err := s.db.Exec(q, lastActive, ih); err != nil {
+		return errors.Wrap(err, "Failed to update last active time")
+	}
+	return nil
+}
+
+// PruneInactive removes the torrents which have not been announced within olderThan. The
+// last active time is set to the time the torrent was registered on insert.
+func (s *TorrentStore) PruneInactive(olderThan time.Duration) ([]model.InfoHash, error) {
+	cutoff := time.Now().Add(-olderThan)
+	const selectQ = `SELECT info_hash FROM torrent WHERE last_active < ?`
+	rows, err := s.db.Query(selectQ, cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch inactive torrents")
+	}
+	defer func() { _ = rows.Close() }()
+	var pruned []model.InfoHash
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, errors.Wrap(err, "Failed to read inactive torrent")
+		}
+		var ih model.InfoHash
+		copy(ih[:], raw)
+		pruned = append(pruned, ih)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	const deleteQ = `DELETE FROM torrent WHERE last_active < ?`
+	if _, err := s.db.Exec(deleteQ, cutoff); err != nil {
+		return nil, errors.Wrap(err, "Failed to remove inactive torrents")
+	}
+	return pruned, nil
+}
+
+// visibilityOrDefault maps the unset visibility to private as the column does not accept
+// empty values
+func visibilityOrDefault(v model.Visibility) model.Visibility {
+	if v == "" {
+		return model.Private
+	}
+	return v
+}
+
+// familyOrDefault maps the unset address family to both as the column does not accept
+// empty values
+func familyOrDefault(f model.AddressFamily) model.AddressFamily {
+	if f == "" {
+		return model.FamilyBoth
+	}
+	return f
+}
+
+// IncrementCompleted atomically increments the completed count of the torrent
+func (s *TorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	const q = `UPDATE torrent SET total_completed = total_completed + 1 WHERE info_hash = ?`
+	if _, err := s.db.Exec(q, ih); err != nil {
+		return 0, errors.Wrap(err, "Failed to increment completed count")
+	}
+	var total uint32
+	const sq = `SELECT total_completed FROM torrent WHERE info_hash = ?`
+	if err := s.db.Get(&total, sq, ih); err != nil {
+		return 0, errors.Wrap(err, "Failed to fetch completed count")
+	}
+	return total, nil
+}
+
 // Add inserts a new torrent into the backing store
 func (s *TorrentStore) Add(t *model.Torrent) error {
 	if t.TorrentID > 0 {
 		return errors.New("Torrent ID already attached")
 	}
-	const q = `INSERT INTO torrent (info_hash, release_name, created_on, updated_on) VALUES( ?, ?, ?, ?)`
+	const q = `INSERT INTO torrent (info_hash, release_name, size, created_on, updated_on) VALUES( ?, ?, ?, ?, ?)`
 	res, err := s.db.NamedExec(q, t)
 	if err != nil {
 		return err
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"database/sql"
 	"github.com/jmoiron/sqlx"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
@@ -47,6 +48,9 @@ func (u *UserStore) GetByPasskey(passkey string) (*model.User, error) {
 	var user model.User
 	const q = `SELECT * FROM user WHERE passkey = ?`
 	if err := u.db.Get(&user, q, passkey); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, consts.ErrUnauthorized.Wrap(err)
+		}
 		return nil, errors.Wrap(err, "Failed to fetch user by passkey")
 	}
 	return &user, nil
@@ -62,6 +66,69 @@ func (u *UserStore) GetByID(userID uint32) (*model.User, error) {
 	return &user, nil
 }
 
+// AddTransfer atomically adds the uploaded and downloaded amounts to the users totals
+func (u *UserStore) AddTransfer(user *model.User, uploaded uint64, downloaded uint64) error {
+	const q = `UPDATE user SET uploaded = uploaded + ?, downloaded = downloaded + ? WHERE user_id = ?`
+	if _, err := u.db.Exec(q, uploaded, downloaded, user.UserID); err != nil {
+		return errors.Wrap(err, "Failed to update user transfer totals")
+	}
+	user.Uploaded += uploaded
+	user.Downloaded += downloaded
+	return nil
+}
+
+// AddPoints atomically adds the bonus points to the users total
+func (u *UserStore) AddPoints(user *model.User, points float64) error {
+	const q = `UPDATE user SET points = points + ? WHERE user_id = ?`
+	if _, err := u.db.Exec(q, points, user.UserID); err != nil {
+		return errors.Wrap(err, "Failed to update user points")
+	}
+	user.Points += points
+	return nil
+}
+
+// AddCorrupt atomically adds the corrupt bytes to the users total
+func (u *UserStore) AddCorrupt(user *model.User, corrupt uint64) error {
+	const q = `UPDATE user SET corrupt = corrupt + ? WHERE user_id = ?`
+	if _, err := u.db.Exec(q, corrupt, user.UserID); err != nil {
+		return errors.Wrap(err, "Failed to update user corrupt total")
+	}
+	user.Corrupt += corrupt
+	return nil
+}
+
+// AddSnatch records the user completing a torrent
+func (u *UserStore) AddSnatch(snatch model.Snatch) error {
+	const q = `
+		INSERT INTO user_snatch (user_id, info_hash, created_on) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE created_on = VALUES(created_on)`
+	if _, err := u.db.Exec(q, snatch.UserID, snatch.InfoHash[:], snatch.CreatedOn); err != nil {
+		return errors.Wrap(err, "Failed to add user snatch")
+	}
+	return nil
+}
+
+// GetSnatches returns the torrents completed by the user, most recent first
+func (u *UserStore) GetSnatches(userID uint32) ([]model.Snatch, error) {
+	const q = `SELECT info_hash, created_on FROM user_snatch WHERE user_id = ? ORDER BY created_on DESC`
+	rows, err := u.db.Query(q, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch user snatches")
+	}
+	defer func() { _ = rows.Close() }()
+	var snatches []model.Snatch
+	for rows.Next() {
+		var ih []byte
+		snatch := model.Snatch{UserID: userID}
+		if err := rows.Scan(&ih, &snatch.CreatedOn); err != nil {
+			return nil, errors.Wrap(err, "Failed to read user snatch")
+		}
+		copy(snatch.InfoHash[:], ih)
+		snatches = append(snatches, snatch)
+	}
+	return snatches, rows.Err()
+}
+
 // Delete removes a user from the backing store
 func (u *UserStore) Delete(user *model.User) error {
 	if user.UserID <= 0 {
@@ -6,6 +6,7 @@ import (
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
+	"time"
 )
 
 const (
@@ -35,6 +36,26 @@ func (us UserStore) GetByID(userID uint32) (*model.User, error) {
 	panic("implement me")
 }
 
+// AddTransfer atomically adds the uploaded and downloaded amounts to the users totals
+func (us UserStore) AddTransfer(u *model.User, uploaded uint64, downloaded uint64) error {
+	panic("implement me")
+}
+
+// AddPoints atomically adds the bonus points to the users total
+func (us UserStore) AddPoints(u *model.User, points float64) error {
+	panic("implement me")
+}
+
+// AddSnatch records the user completing a torrent
+func (us UserStore) AddSnatch(snatch model.Snatch) error {
+	panic("implement me")
+}
+
+// GetSnatches returns the torrents completed by the user, most recent first
+func (us UserStore) GetSnatches(userID uint32) ([]model.Snatch, error) {
+	panic("implement me")
+}
+
 // Delete removes a user from the backing store
 func (us UserStore) Delete(user *model.User) error {
 	panic("implement me")
@@ -55,6 +76,16 @@ func (ts TorrentStore) Add(t *model.Torrent) error {
 	panic("implement me")
 }
 
+// Update will sync any new torrent data with the backing store
+func (ts TorrentStore) Update(t *model.Torrent) error {
+	panic("implement me")
+}
+
+// IncrementCompleted atomically increments the completed count of the torrent
+func (ts TorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	panic("implement me")
+}
+
 // Delete will mark a torrent as deleted in the backing store.
 // If dropRow is true, it will permanently remove the torrent from the store
 func (ts TorrentStore) Delete(ih model.InfoHash, dropRow bool) error {
@@ -66,6 +97,26 @@ func (ts TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	panic("implement me")
 }
 
+// GetN returns up to N known torrents which are not marked as deleted
+func (ts TorrentStore) GetN(limit int) ([]*model.Torrent, error) {
+	panic("implement me")
+}
+
+// GetMulti returns the known torrents matching the info hashes
+func (ts TorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	panic("implement me")
+}
+
+// Touch records the time of the last announce for the torrent
+func (ts TorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	panic("implement me")
+}
+
+// PruneInactive removes the torrents which have not been announced within olderThan
+func (ts TorrentStore) PruneInactive(olderThan time.Duration) ([]model.InfoHash, error) {
+	panic("implement me")
+}
+
 // Close will close the underlying postgres database connection
 func (ts TorrentStore) Close() error {
 	panic("implement me")
@@ -86,6 +137,21 @@ func (ts TorrentStore) WhiteListGetAll() ([]model.WhiteListClient, error) {
 	panic("implement me")
 }
 
+// BanListDelete removes a single IP or CIDR range from the global ban list
+func (ts TorrentStore) BanListDelete(cidr string) error {
+	panic("implement me")
+}
+
+// BanListAdd will insert a new IP or CIDR range into the global ban list
+func (ts TorrentStore) BanListAdd(cidr string) error {
+	panic("implement me")
+}
+
+// BanListGetAll fetches all banned IPs and CIDR ranges
+func (ts TorrentStore) BanListGetAll() ([]string, error) {
+	panic("implement me")
+}
+
 // PeerStore is the postgres backed implementation of store.PeerStore
 type PeerStore struct {
 	db *sqlx.DB
@@ -111,6 +177,16 @@ func (ps PeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
 	panic("implement me")
 }
 
+// CountsOnly returns the number of seeders and leechers in the swarm
+func (ps PeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	panic("implement me")
+}
+
+// UserPeers returns the number of peers the user has in the swarm
+func (ps PeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	panic("implement me")
+}
+
 // Get will fetch the peer from the swarm if it exists
 func (ps PeerStore) Get(ih model.InfoHash, id model.PeerID) (*model.Peer, error) {
 	panic("implement me")
@@ -6,6 +6,7 @@ import (
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/util"
@@ -13,7 +14,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -23,11 +27,25 @@ const (
 
 const (
 	prefixWhitelist    = "whitelist:"
+	keyBanList         = "banlist"
 	prefixTorrent      = "t:"
-	prefixTorrentPeers = "tp:"
+	prefixCompleted    = "tc:"
 	prefixPeer         = "p:"
+	prefixSeeders      = "tsz:"
+	prefixLeechers     = "tlz:"
 	prefixUser         = "u:"
 	prefixUserID       = "user_id_pk:"
+	prefixUserSnatched = "t:u:snatched:"
+	prefixUserPeers    = "t:u:peers:"
+	prefixUserSpeed    = "user_speed:"
+	keyStatsUsers      = "stats:users"
+	keyStatsTorrents   = "stats:torrents"
+	suffixStatsPending = ":pending"
+	keyAnnounces       = "activity:announces"
+	keyScrapes         = "activity:scrapes"
+	suffixRecent       = ":recent"
+	// Torrents whose recent counts decayed below this are dropped from the recent rankings
+	minRecentActivity = "0.01"
 )
 
 func whiteListKey(prefix string) string {
@@ -38,14 +56,46 @@ func torrentKey(t model.InfoHash) string {
 	return fmt.Sprintf("%s%s", prefixTorrent, t.String())
 }
 
+// torrentCompletedKey is kept separate from the torrent hash so it can be atomically
+// incremented without being overwritten by Update
+func torrentCompletedKey(t model.InfoHash) string {
+	return fmt.Sprintf("%s%s", prefixCompleted, t.String())
+}
+
 func torrentPeersKey(t model.InfoHash) string {
-	return fmt.Sprintf("%s:%s:*", prefixTorrentPeers, t.String())
+	return fmt.Sprintf("%s%s:*", prefixPeer, t.String())
 }
 
 func peerKey(t model.InfoHash, p model.PeerID) string {
 	return fmt.Sprintf("%s%s:%s", prefixPeer, t.String(), p.String())
 }
 
+func seedersKey(t model.InfoHash) string {
+	return fmt.Sprintf("%s%s", prefixSeeders, t.String())
+}
+
+func leechersKey(t model.InfoHash) string {
+	return fmt.Sprintf("%s%s", prefixLeechers, t.String())
+}
+
+// countPeer adds the peer to the seeder or leecher set matching its current state, scored by
+// its last announce, and removes it from the other so the counts stay consistent as peers
+// complete
+func countPeer(pipe redis.Pipeliner, ih model.InfoHash, peerID model.PeerID, seeder bool, announced time.Time) {
+	member := peerID.String()
+	z := &redis.Z{
+		Score:  float64(announced.Unix()),
+		Member: member,
+	}
+	if seeder {
+		pipe.ZRem(leechersKey(ih), member)
+		pipe.ZAdd(seedersKey(ih), z)
+	} else {
+		pipe.ZRem(seedersKey(ih), member)
+		pipe.ZAdd(leechersKey(ih), z)
+	}
+}
+
 func userKey(passkey string) string {
 	return fmt.Sprintf("%s%s", prefixUser, passkey)
 }
@@ -54,6 +104,25 @@ func userIDKey(userID uint32) string {
 	return fmt.Sprintf("%s%d", prefixUserID, userID)
 }
 
+func userSnatchedKey(userID uint32) string {
+	return fmt.Sprintf("%s%d", prefixUserSnatched, userID)
+}
+
+// userPeersKey is the sorted set of the peers of a user in a swarm, scored by the unix time of
+// their last announce
+func userPeersKey(userID uint32, ih model.InfoHash) string {
+	return fmt.Sprintf("%s%d:%s", prefixUserPeers, userID, ih.String())
+}
+
+// isUserTorrentKey checks if the key is one of the per-user sets sharing the torrent prefix
+func isUserTorrentKey(key string) bool {
+	return strings.HasPrefix(key, prefixUserSnatched) || strings.HasPrefix(key, prefixUserPeers)
+}
+
+func userSpeedKey(userID uint32) string {
+	return fmt.Sprintf("%s%d", prefixUserSpeed, userID)
+}
+
 // UserStore is the redis backed store.TorrentStore implementation
 type UserStore struct {
 	client *redis.Client
@@ -68,6 +137,12 @@ func (us UserStore) Add(u *model.User) error {
 		"passkey":          u.Passkey,
 		"download_enabled": true,
 		"is_deleted":       false,
+		"uploaded":         u.Uploaded,
+		"downloaded":       u.Downloaded,
+		"min_ratio":        u.MinRatio,
+		"points":           u.Points,
+		"seedbox":          u.Seedbox,
+		"corrupt":          u.Corrupt,
 	})
 	pipe.Set(userIDKey(u.UserID), u.Passkey, 0)
 	if _, err := pipe.Exec(); err != nil {
@@ -85,6 +160,12 @@ func (us UserStore) GetByPasskey(passkey string) (*model.User, error) {
 	var user model.User
 	user.Passkey = v["passkey"]
 	user.UserID = util.StringToUInt32(v["user_id"], 0)
+	user.Uploaded = util.StringToUInt64(v["uploaded"], 0)
+	user.Downloaded = util.StringToUInt64(v["downloaded"], 0)
+	user.MinRatio = util.StringToFloat64(v["min_ratio"], 0)
+	user.Points = util.StringToFloat64(v["points"], 0)
+	user.Seedbox = util.StringToBool(v["seedbox"], false)
+	user.Corrupt = util.StringToUInt64(v["corrupt"], 0)
 	if !user.Valid() {
 		return nil, consts.ErrInvalidState
 	}
@@ -104,6 +185,111 @@ func (us UserStore) GetByID(userID uint32) (*model.User, error) {
 	return us.GetByPasskey(passkey)
 }
 
+// AddTransfer atomically increments the users transfer totals
+func (us UserStore) AddTransfer(u *model.User, uploaded uint64, downloaded uint64) error {
+	pipe := us.client.TxPipeline()
+	pipe.HIncrBy(userKey(u.Passkey), "uploaded", int64(uploaded))
+	pipe.HIncrBy(userKey(u.Passkey), "downloaded", int64(downloaded))
+	if uploaded > 0 {
+		pipe.HIncrBy(keyStatsUsers, fmt.Sprintf("%d:uploaded", u.UserID), int64(uploaded))
+	}
+	if downloaded > 0 {
+		pipe.HIncrBy(keyStatsUsers, fmt.Sprintf("%d:downloaded", u.UserID), int64(downloaded))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return errors.Wrap(err, "Failed to update user transfer totals")
+	}
+	u.Uploaded += uploaded
+	u.Downloaded += downloaded
+	return nil
+}
+
+// AddPoints atomically increments the users bonus points
+func (us UserStore) AddPoints(u *model.User, points float64) error {
+	if err := us.client.HIncrByFloat(userKey(u.Passkey), "points", points).Err(); err != nil {
+		return errors.Wrap(err, "Failed to update user points")
+	}
+	u.Points += points
+	return nil
+}
+
+// AddCorrupt atomically increments the users corrupt total
+func (us UserStore) AddCorrupt(u *model.User, corrupt uint64) error {
+	if err := us.client.HIncrBy(userKey(u.Passkey), "corrupt", int64(corrupt)).Err(); err != nil {
+		return errors.Wrap(err, "Failed to update user corrupt total")
+	}
+	u.Corrupt += corrupt
+	return nil
+}
+
+// AddSnatch records the torrent in the users snatched set scored by the completion time
+func (us UserStore) AddSnatch(snatch model.Snatch) error {
+	err := us.client.ZAdd(userSnatchedKey(snatch.UserID), &redis.Z{
+		Score:  float64(snatch.CreatedOn.Unix()),
+		Member: snatch.InfoHash.String(),
+	}).Err()
+	if err != nil {
+		return errors.Wrap(err, "Failed to add user snatch")
+	}
+	return nil
+}
+
+// GetSnatches returns the torrents completed by the user, most recent first
+func (us UserStore) GetSnatches(userID uint32) ([]model.Snatch, error) {
+	members, err := us.client.ZRevRangeWithScores(userSnatchedKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch user snatches")
+	}
+	snatches := make([]model.Snatch, 0, len(members))
+	for _, m := range members {
+		member, _ := m.Member.(string)
+		ih, err := model.InfoHashFromHex(member)
+		if err != nil {
+			log.Warnf("Invalid info hash in user snatches: %v", m.Member)
+			continue
+		}
+		snatches = append(snatches, model.Snatch{
+			UserID:    userID,
+			InfoHash:  ih,
+			CreatedOn: time.Unix(int64(m.Score), 0),
+		})
+	}
+	return snatches, nil
+}
+
+// AddSpeed atomically adds the deltas to the users speed totals. The key expires once no
+// peer of the user announces within ttl, dropping the totals back to zero.
+func (us UserStore) AddSpeed(userID uint32, up int64, dn int64, ttl time.Duration) error {
+	key := userSpeedKey(userID)
+	pipe := us.client.TxPipeline()
+	pipe.HIncrBy(key, "up", up)
+	pipe.HIncrBy(key, "dn", dn)
+	pipe.Expire(key, ttl)
+	if _, err := pipe.Exec(); err != nil {
+		return errors.Wrap(err, "Failed to update user speed")
+	}
+	return nil
+}
+
+// GetSpeed returns the users current total upload and download speeds. Negative totals, left
+// behind when the speeds of peers added before the key expired are removed, count as zero.
+func (us UserStore) GetSpeed(userID uint32) (uint64, uint64, error) {
+	v, err := us.client.HGetAll(userSpeedKey(userID)).Result()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to fetch user speed")
+	}
+	// Missing fields parse as zero, the key does not exist while the user has no active peers
+	up, _ := strconv.ParseInt(v["up"], 10, 64)
+	dn, _ := strconv.ParseInt(v["dn"], 10, 64)
+	if up < 0 {
+		up = 0
+	}
+	if dn < 0 {
+		dn = 0
+	}
+	return uint64(up), uint64(dn), nil
+}
+
 // Delete drops a user from redis.
 func (us UserStore) Delete(user *model.User) error {
 	if err := us.client.Del(userKey(user.Passkey)).Err(); err != nil {
@@ -115,6 +301,11 @@ func (us UserStore) Delete(user *model.User) error {
 	return nil
 }
 
+// Ping checks that the redis server can be reached
+func (us UserStore) Ping() error {
+	return us.client.Ping().Err()
+}
+
 // Close will shutdown the underlying redis connection
 func (us UserStore) Close() error {
 	return us.client.Close()
@@ -174,6 +365,35 @@ func (ts *TorrentStore) WhiteListGetAll() ([]model.WhiteListClient, error) {
 	return wl, nil
 }
 
+// BanListDelete removes a single IP or CIDR range from the global ban list
+func (ts *TorrentStore) BanListDelete(cidr string) error {
+	res, err := ts.client.SRem(keyBanList, cidr).Result()
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove banned ip")
+	}
+	if res != 1 {
+		return consts.ErrInvalidBan
+	}
+	return nil
+}
+
+// BanListAdd will insert a new IP or CIDR range into the global ban list
+func (ts *TorrentStore) BanListAdd(cidr string) error {
+	if err := ts.client.SAdd(keyBanList, cidr).Err(); err != nil {
+		return errors.Wrapf(err, "failed to add new banned ip: %s", cidr)
+	}
+	return nil
+}
+
+// BanListGetAll fetches all banned IPs and CIDR ranges
+func (ts *TorrentStore) BanListGetAll() ([]string, error) {
+	bl, err := ts.client.SMembers(keyBanList).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch ban list")
+	}
+	return bl, nil
+}
+
 // Add adds a new torrent to the redis backing store
 func (ts *TorrentStore) Add(t *model.Torrent) error {
 	err := ts.client.HSet(torrentKey(t.InfoHash), map[string]interface{}{
@@ -182,7 +402,14 @@ func (ts *TorrentStore) Add(t *model.Torrent) error {
 		"total_completed":  t.TotalCompleted,
 		"total_downloaded": t.TotalDownloaded,
 		"total_uploaded":   t.TotalUploaded,
+		"size":             t.Size,
 		"reason":           t.Reason,
+		"freeleech":        t.Freeleech,
+		"block_datacenter": t.BlockDatacenter,
+		"hnr_threshold":    t.HNRThreshold,
+		"max_leechers":     t.MaxLeechers,
+		"visibility":       string(t.Visibility),
+		"address_family":   string(t.AddressFamily),
 		"multi_up":         t.MultiUp,
 		"multi_dn":         t.MultiDn,
 		"info_hash":        t.InfoHash.RawString(),
@@ -197,11 +424,155 @@ func (ts *TorrentStore) Add(t *model.Torrent) error {
 	return nil
 }
 
+// Update will sync any new torrent data with the backing store
+func (ts *TorrentStore) Update(t *model.Torrent) error {
+	err := ts.client.HSet(torrentKey(t.InfoHash), map[string]interface{}{
+		"total_downloaded": t.TotalDownloaded,
+		"total_uploaded":   t.TotalUploaded,
+		"reason":           t.Reason,
+		"freeleech":        t.Freeleech,
+		"block_datacenter": t.BlockDatacenter,
+		"hnr_threshold":    t.HNRThreshold,
+		"max_leechers":     t.MaxLeechers,
+		"visibility":       string(t.Visibility),
+		"address_family":   string(t.AddressFamily),
+		"multi_up":         t.MultiUp,
+		"multi_dn":         t.MultiDn,
+		"is_deleted":       t.IsDeleted,
+		"is_enabled":       t.IsEnabled,
+		"updated_on":       util.TimeToString(t.UpdatedOn),
+	}).Err()
+	if err != nil {
+		return errors.Wrap(err, "Failed to Update")
+	}
+	return nil
+}
+
+// IncrementCompleted atomically increments the completed counter of the torrent. Torrents added
+// before the counter existed have it seeded from the total_completed value of the torrent hash.
+func (ts *TorrentStore) IncrementCompleted(ih model.InfoHash) (uint32, error) {
+	key := torrentCompletedKey(ih)
+	exists, err := ts.client.Exists(key).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to check completed counter")
+	}
+	if exists == 0 {
+		current, err := ts.client.HGet(torrentKey(ih), "total_completed").Result()
+		if err != nil && err != redis.Nil {
+			return 0, errors.Wrap(err, "Failed to fetch completed count")
+		}
+		if err := ts.client.SetNX(key, util.StringToUInt32(current, 0), 0).Err(); err != nil {
+			return 0, errors.Wrap(err, "Failed to seed completed counter")
+		}
+	}
+	pipe := ts.client.TxPipeline()
+	total := pipe.Incr(key)
+	pipe.HIncrBy(keyStatsTorrents, ih.String(), 1)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, errors.Wrap(err, "Failed to increment completed counter")
+	}
+	return uint32(total.Val()), nil
+}
+
+// AddActivity adds the request counts to the total and recent activity rankings of the torrents.
+// The recent rankings are decayed first, all within a single transaction.
+func (ts *TorrentStore) AddActivity(counts map[model.InfoHash]store.RequestCounts, decay float64) error {
+	pipe := ts.client.TxPipeline()
+	if decay < 1 {
+		for _, key := range []string{keyAnnounces + suffixRecent, keyScrapes + suffixRecent} {
+			pipe.ZUnionStore(key, &redis.ZStore{Keys: []string{key}, Weights: []float64{decay}})
+			pipe.ZRemRangeByScore(key, "-inf", minRecentActivity)
+		}
+	}
+	for ih, c := range counts {
+		member := ih.String()
+		if c.Announces > 0 {
+			pipe.ZIncrBy(keyAnnounces, float64(c.Announces), member)
+			pipe.ZIncrBy(keyAnnounces+suffixRecent, float64(c.Announces), member)
+		}
+		if c.Scrapes > 0 {
+			pipe.ZIncrBy(keyScrapes, float64(c.Scrapes), member)
+			pipe.ZIncrBy(keyScrapes+suffixRecent, float64(c.Scrapes), member)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return errors.Wrap(err, "Failed to add activity")
+	}
+	return nil
+}
+
+// TopActivity returns up to n torrents with the highest recent announce count
+func (ts *TorrentStore) TopActivity(n int) ([]store.TorrentActivity, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	ranked, err := ts.client.ZRevRangeWithScores(keyAnnounces+suffixRecent, 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch recent activity")
+	}
+	pipe := ts.client.Pipeline()
+	type scores struct {
+		announces, scrapes, recentScrapes *redis.FloatCmd
+	}
+	fetched := make([]scores, len(ranked))
+	for i, z := range ranked {
+		member, _ := z.Member.(string)
+		fetched[i] = scores{
+			announces:     pipe.ZScore(keyAnnounces, member),
+			scrapes:       pipe.ZScore(keyScrapes, member),
+			recentScrapes: pipe.ZScore(keyScrapes+suffixRecent, member),
+		}
+	}
+	// Torrents which were never scraped have no score, leaving their counts at 0
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Failed to fetch activity")
+	}
+	top := make([]store.TorrentActivity, 0, len(ranked))
+	for i, z := range ranked {
+		member, _ := z.Member.(string)
+		ih, err := model.InfoHashFromHex(member)
+		if err != nil {
+			continue
+		}
+		top = append(top, store.TorrentActivity{
+			InfoHash:        ih,
+			Announces:       int64(fetched[i].announces.Val()),
+			Scrapes:         int64(fetched[i].scrapes.Val()),
+			RecentAnnounces: z.Score,
+			RecentScrapes:   fetched[i].recentScrapes.Val(),
+		})
+	}
+	return top, nil
+}
+
+// loadCompleted replaces the completed counts of the torrents with the values of their
+// completed counters. Torrents without a counter keep the value of their torrent hash.
+func (ts *TorrentStore) loadCompleted(torrents []*model.Torrent) error {
+	if len(torrents) == 0 {
+		return nil
+	}
+	pipe := ts.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(torrents))
+	for i, t := range torrents {
+		cmds[i] = pipe.Get(torrentCompletedKey(t.InfoHash))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Failed to fetch completed counters")
+	}
+	for i, cmd := range cmds {
+		if cmd.Err() != nil {
+			continue
+		}
+		torrents[i].TotalCompleted = util.StringToUInt32(cmd.Val(), torrents[i].TotalCompleted)
+	}
+	return nil
+}
+
 // Delete will mark a torrent as deleted in the backing store.
 // If dropRow is true, it will permanently remove the torrent from the store
 func (ts *TorrentStore) Delete(ih model.InfoHash, dropRow bool) error {
 	if dropRow {
-		if err := ts.client.Del(torrentKey(ih)).Err(); err != nil {
+		if err := ts.client.Del(torrentKey(ih), torrentCompletedKey(ih)).Err(); err != nil {
 			return errors.Wrap(err, "Could not remove torrent from store")
 		}
 		return nil
@@ -212,6 +583,50 @@ func (ts *TorrentStore) Delete(ih model.InfoHash, dropRow bool) error {
 	return nil
 }
 
+// Touch records the time of the last announce for the torrent
+func (ts *TorrentStore) Touch(ih model.InfoHash, lastActive time.Time) error {
+	if err := ts.client.HSet(torrentKey(ih), "last_active", util.TimeToString(lastActive)).Err(); err != nil {
+		return errors.Wrap(err, "Failed to update last active time")
+	}
+	return nil
+}
+
+// PruneInactive removes the torrents which have not been announced within olderThan, along
+// with their completed counters and activity rankings
+func (ts *TorrentStore) PruneInactive(olderThan time.Duration) ([]model.InfoHash, error) {
+	keys, err := ts.client.Keys(fmt.Sprintf("%s*", prefixTorrent)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrent keys")
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var pruned []model.InfoHash
+	for _, key := range keys {
+		// The snatch and peer sets of users share the torrent prefix
+		if isUserTorrentKey(key) {
+			continue
+		}
+		v, err := ts.client.HGetAll(key).Result()
+		if err != nil {
+			return pruned, errors.Wrap(err, "Failed to fetch torrent")
+		}
+		t := mapTorrentValues(v)
+		if !t.ActiveOn().Before(cutoff) {
+			continue
+		}
+		member := t.InfoHash.String()
+		pipe := ts.client.TxPipeline()
+		pipe.Del(key, torrentCompletedKey(t.InfoHash))
+		for _, rank := range []string{keyAnnounces, keyAnnounces + suffixRecent, keyScrapes, keyScrapes + suffixRecent} {
+			pipe.ZRem(rank, member)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return pruned, errors.Wrap(err, "Failed to remove torrent")
+		}
+		pruned = append(pruned, t.InfoHash)
+	}
+	return pruned, nil
+}
+
 // Get returns the Torrent matching the infohash
 func (ts *TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	v, err := ts.client.HGetAll(torrentKey(hash)).Result()
@@ -222,22 +637,106 @@ func (ts *TorrentStore) Get(hash model.InfoHash) (*model.Torrent, error) {
 	if !found {
 		return nil, consts.ErrInvalidInfoHash
 	}
-	t := model.Torrent{
+	t := mapTorrentValues(v)
+	if err := ts.loadCompleted([]*model.Torrent{&t}); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetN returns up to N known torrents which are not marked as deleted
+func (ts *TorrentStore) GetN(limit int) ([]*model.Torrent, error) {
+	keys, err := ts.client.Keys(fmt.Sprintf("%s*", prefixTorrent)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrent keys")
+	}
+	var torrents []*model.Torrent
+	for _, key := range keys {
+		if len(torrents) == limit {
+			break
+		}
+		if isUserTorrentKey(key) {
+			continue
+		}
+		v, err := ts.client.HGetAll(key).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error trying to GetN")
+		}
+		t := mapTorrentValues(v)
+		if t.IsDeleted {
+			continue
+		}
+		torrents = append(torrents, &t)
+	}
+	if err := ts.loadCompleted(torrents); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// GetMulti fetches the torrents matching the info hashes using a single pipelined request.
+// Unknown and deleted torrents are skipped.
+func (ts *TorrentStore) GetMulti(hashes []model.InfoHash) ([]*model.Torrent, error) {
+	pipe := ts.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(hashes))
+	for i, ih := range hashes {
+		cmds[i] = pipe.HGetAll(torrentKey(ih))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, errors.Wrap(err, "Error trying to GetMulti")
+	}
+	var torrents []*model.Torrent
+	for _, cmd := range cmds {
+		v := cmd.Val()
+		if _, found := v["info_hash"]; !found {
+			continue
+		}
+		t := mapTorrentValues(v)
+		if t.IsDeleted {
+			continue
+		}
+		torrents = append(torrents, &t)
+	}
+	if err := ts.loadCompleted(torrents); err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+func mapTorrentValues(v map[string]string) model.Torrent {
+	// Torrents which have not been announced yet have no last active time
+	var lastActive time.Time
+	if s := v["last_active"]; s != "" {
+		lastActive = util.StringToTime(s)
+	}
+	return model.Torrent{
 		RWMutex:         sync.RWMutex{},
 		ReleaseName:     v["release_name"],
 		InfoHash:        model.InfoHashFromString(v["info_hash"]),
-		TotalCompleted:  util.StringToInt16(v["total_completed"], 0),
+		TotalCompleted:  util.StringToUInt32(v["total_completed"], 0),
 		TotalUploaded:   util.StringToUInt32(v["total_uploaded"], 0),
 		TotalDownloaded: util.StringToUInt32(v["total_downloaded"], 0),
+		Size:            util.StringToUInt64(v["size"], 0),
 		IsDeleted:       util.StringToBool(v["is_deleted"], false),
 		IsEnabled:       util.StringToBool(v["is_enabled"], false),
 		Reason:          v["reason"],
+		Freeleech:       util.StringToBool(v["freeleech"], false),
+		BlockDatacenter: util.StringToBool(v["block_datacenter"], false),
+		HNRThreshold:    util.StringToUInt32(v["hnr_threshold"], 0),
+		MaxLeechers:     util.StringToUInt32(v["max_leechers"], 0),
+		Visibility:      model.Visibility(v["visibility"]),
+		AddressFamily:   model.AddressFamily(v["address_family"]),
 		MultiUp:         util.StringToFloat64(v["multi_up"], 1.0),
 		MultiDn:         util.StringToFloat64(v["multi_dn"], 1.0),
 		CreatedOn:       util.StringToTime(v["created_on"]),
 		UpdatedOn:       util.StringToTime(v["updated_on"]),
+		LastActive:      lastActive,
 	}
-	return &t, nil
+}
+
+// Ping checks that the redis server can be reached
+func (ts *TorrentStore) Ping() error {
+	return ts.client.Ping().Err()
 }
 
 // Close will close the underlying redis client and clear the caches
@@ -248,36 +747,66 @@ func (ts *TorrentStore) Close() error {
 // PeerStore is the redis backed store.PeerStore implementation
 type PeerStore struct {
 	client *redis.Client
+	// Peer updates are queued and written in batches when syncInterval is set
+	syncInterval  time.Duration
+	syncBatchSize int
+	// peerTTL expires peers which have not been written for this long, 0 disables it
+	peerTTL   time.Duration
+	pendingMu sync.Mutex
+	pending   map[string]pendingPeer
+	// flushMu serializes flushes with deletes so a flush can not recreate a deleted peer
+	flushMu  sync.Mutex
+	flushNow chan struct{}
+	syncStop chan struct{}
+	syncDone chan struct{}
+	// lastSync is the unix nano timestamp of the last successful flush
+	lastSync int64
 }
 
 // Add inserts a peer into the active swarm for the torrent provided
 func (ps *PeerStore) Add(ih model.InfoHash, p *model.Peer) error {
-	err := ps.client.HSet(peerKey(ih, p.PeerID), map[string]interface{}{
-		"speed_up":         p.SpeedUP,
-		"speed_dn":         p.SpeedDN,
-		"speed_up_max":     p.SpeedUPMax,
-		"speed_dn_max":     p.SpeedDNMax,
-		"total_uploaded":   p.Uploaded,
-		"total_downloaded": p.Downloaded,
-		"total_left":       p.Left,
-		"total_announces":  p.Announces,
-		"total_time":       p.TotalTime,
-		"addr_ip":          p.IP.String(),
-		"addr_port":        p.Port,
-		"last_announce":    util.TimeToString(p.AnnounceLast),
-		"first_announce":   util.TimeToString(p.AnnounceFirst),
-		"peer_id":          p.PeerID.RawString(),
-		"location":         p.Location.String(),
-		"user_id":          p.UserID,
-		"created_on":       util.TimeToString(p.CreatedOn),
-		"updated_on":       util.TimeToString(p.UpdatedOn),
-	}).Err()
-	if err != nil {
+	pipe := ps.client.TxPipeline()
+	pipe.HSet(peerKey(ih, p.PeerID), peerValues(p))
+	countPeer(pipe, ih, p.PeerID, p.Left == 0, p.AnnounceLast)
+	indexUserPeer(pipe, ih, p.UserID, p.PeerID, p.AnnounceLast)
+	ps.expire(pipe, ih, p.PeerID)
+	ps.expireUserPeers(pipe, ih, p.UserID)
+	if _, err := pipe.Exec(); err != nil {
 		return errors.Wrap(err, "Failed to Add")
 	}
 	return nil
 }
 
+// expire refreshes the expiry of the peer and the swarm count sets when a peer TTL is set. The
+// count sets are only removed once the whole swarm has been idle, peers in them which expired
+// on their own are dropped by CountsOnly.
+func (ps *PeerStore) expire(pipe redis.Pipeliner, ih model.InfoHash, peerID model.PeerID) {
+	if ps.peerTTL <= 0 {
+		return
+	}
+	pipe.Expire(peerKey(ih, peerID), ps.peerTTL)
+	pipe.Expire(seedersKey(ih), ps.peerTTL)
+	pipe.Expire(leechersKey(ih), ps.peerTTL)
+}
+
+// expireUserPeers refreshes the expiry of the user peer index of the swarm when a peer TTL
+// is set
+func (ps *PeerStore) expireUserPeers(pipe redis.Pipeliner, ih model.InfoHash, userID uint32) {
+	if ps.peerTTL <= 0 {
+		return
+	}
+	pipe.Expire(userPeersKey(userID, ih), ps.peerTTL)
+}
+
+// indexUserPeer adds the peer to the user peer index of the swarm, or refreshes its last
+// announce time when already indexed
+func indexUserPeer(pipe redis.Pipeliner, ih model.InfoHash, userID uint32, peerID model.PeerID, announced time.Time) {
+	pipe.ZAdd(userPeersKey(userID, ih), &redis.Z{
+		Score:  float64(announced.Unix()),
+		Member: peerID.String(),
+	})
+}
+
 func (ps *PeerStore) findKeys(prefix string) []string {
 	v, err := ps.client.Keys(prefix).Result()
 	if err != nil {
@@ -286,39 +815,248 @@ func (ps *PeerStore) findKeys(prefix string) []string {
 	return v
 }
 
-// Update will sync any new peer data with the backing store
+// pendingPeer is a peer update waiting to be written by the next flush
+type pendingPeer struct {
+	ih        model.InfoHash
+	peerID    model.PeerID
+	userID    uint32
+	seeder    bool
+	announced time.Time
+	values    map[string]interface{}
+}
+
+// Update will sync any new peer data with the backing store. When a sync interval is
+// configured the update is queued and written by the next flush instead.
 func (ps *PeerStore) Update(ih model.InfoHash, p *model.Peer) error {
-	err := ps.client.HSet(peerKey(ih, p.PeerID), map[string]interface{}{
-		"speed_up":         p.SpeedUP,
-		"speed_dn":         p.SpeedDN,
-		"speed_up_max":     p.SpeedUPMax,
-		"speed_dn_max":     p.SpeedDNMax,
-		"total_uploaded":   p.Uploaded,
-		"total_downloaded": p.Downloaded,
-		"total_left":       p.Left,
-		"total_announces":  p.Announces,
-		"total_time":       p.TotalTime,
-		"last_announce":    util.TimeToString(p.AnnounceLast),
-		"first_announce":   util.TimeToString(p.AnnounceFirst),
-		"updated_on":       util.TimeToString(p.UpdatedOn),
-	}).Err()
-	if err != nil {
-		return errors.Wrap(err, "Failed to Update")
+	values := peerUpdateValues(p)
+	if ps.syncInterval <= 0 {
+		pipe := ps.client.TxPipeline()
+		pipe.HSet(peerKey(ih, p.PeerID), values)
+		countPeer(pipe, ih, p.PeerID, p.Left == 0, p.AnnounceLast)
+		indexUserPeer(pipe, ih, p.UserID, p.PeerID, p.AnnounceLast)
+		ps.expire(pipe, ih, p.PeerID)
+		ps.expireUserPeers(pipe, ih, p.UserID)
+		if _, err := pipe.Exec(); err != nil {
+			return errors.Wrap(err, "Failed to Update")
+		}
+		return nil
+	}
+	ps.pendingMu.Lock()
+	// Only the latest state of the peer needs to be written
+	ps.pending[peerKey(ih, p.PeerID)] = pendingPeer{ih, p.PeerID, p.UserID, p.Left == 0, p.AnnounceLast, values}
+	queued := len(ps.pending)
+	ps.pendingMu.Unlock()
+	if ps.syncBatchSize > 0 && queued >= ps.syncBatchSize {
+		select {
+		case ps.flushNow <- struct{}{}:
+		default:
+		}
 	}
 	return nil
 }
 
+// syncer periodically writes the queued peer updates until the store is closed
+func (ps *PeerStore) syncer() {
+	defer close(ps.syncDone)
+	ticker := time.NewTicker(ps.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ps.flushNow:
+		case <-ps.syncStop:
+			_, _ = ps.flush()
+			return
+		}
+		_, _ = ps.flush()
+	}
+}
+
+// Flush writes the queued peer updates immediately, returning the number of peers written
+func (ps *PeerStore) Flush() (int, error) {
+	return ps.flush()
+}
+
+// flush writes all queued peer updates using a single pipeline, returning the number of peers
+// written. The queue is swapped for an empty one before writing so peers updated during the
+// flush are kept for the next one.
+func (ps *PeerStore) flush() (int, error) {
+	ps.flushMu.Lock()
+	defer ps.flushMu.Unlock()
+	ps.pendingMu.Lock()
+	batch := ps.pending
+	ps.pending = make(map[string]pendingPeer, len(batch))
+	ps.pendingMu.Unlock()
+	if len(batch) == 0 {
+		atomic.StoreInt64(&ps.lastSync, time.Now().UnixNano())
+		return 0, nil
+	}
+	start := time.Now()
+	pipe := ps.client.Pipeline()
+	for key, p := range batch {
+		pipe.HSet(key, p.values)
+		countPeer(pipe, p.ih, p.peerID, p.seeder, p.announced)
+		indexUserPeer(pipe, p.ih, p.userID, p.peerID, p.announced)
+		ps.expire(pipe, p.ih, p.peerID)
+		ps.expireUserPeers(pipe, p.ih, p.userID)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		log.Errorf("Failed to flush %d peer updates: %s", len(batch), err.Error())
+		// Requeue the failed updates unless a newer update has been queued since
+		ps.pendingMu.Lock()
+		for key, p := range batch {
+			if _, found := ps.pending[key]; !found {
+				ps.pending[key] = p
+			}
+		}
+		ps.pendingMu.Unlock()
+		return 0, errors.Wrap(err, "Failed to flush peer updates")
+	}
+	atomic.StoreInt64(&ps.lastSync, time.Now().UnixNano())
+	metrics.PeerSyncDuration.Observe(time.Since(start).Seconds())
+	metrics.PeerSyncBatchSize.Observe(float64(len(batch)))
+	return len(batch), nil
+}
+
+// LastSync returns when the queued peer updates were last flushed successfully
+func (ps *PeerStore) LastSync() time.Time {
+	ts := atomic.LoadInt64(&ps.lastSync)
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ts)
+}
+
+// peerValues returns all the fields stored for a peer, as written when it joins the swarm
+func peerValues(p *model.Peer) map[string]interface{} {
+	return map[string]interface{}{
+		"speed_up":          p.SpeedUP,
+		"speed_dn":          p.SpeedDN,
+		"speed_up_max":      p.SpeedUPMax,
+		"speed_dn_max":      p.SpeedDNMax,
+		"total_uploaded":    p.Uploaded,
+		"total_downloaded":  p.Downloaded,
+		"total_left":        p.Left,
+		"total_corrupt":     p.Corrupt,
+		"total_announces":   p.Announces,
+		"total_time":        p.TotalTime,
+		"completed":         p.Completed,
+		"resets":            p.Resets,
+		"flagged":           p.Flagged,
+		"paused":            p.Paused,
+		"partial":           p.Partial,
+		"super_seeding":     p.SuperSeeding,
+		"super_seed_cursor": p.SuperSeedCursor,
+		"crypto":            uint8(p.Crypto),
+		"hnr_exempt":        p.HNRExempt,
+		"connectable":       p.Connectable,
+		"probed_on":         util.TimeToString(p.ProbedOn),
+		"key":               p.Key,
+		"addr_ip":           p.IP.String(),
+		"addr_ipv6":         p.IPv6.String(),
+		"addr_port":         p.Port,
+		"last_announce":     util.TimeToString(p.AnnounceLast),
+		"first_announce":    util.TimeToString(p.AnnounceFirst),
+		"peer_id":           p.PeerID.RawString(),
+		"location":          p.Location.String(),
+		"country_code":      p.CountryCode,
+		"client":            p.Client,
+		"user_id":           p.UserID,
+		"created_on":        util.TimeToString(p.CreatedOn),
+		"updated_on":        util.TimeToString(p.UpdatedOn),
+	}
+}
+
+// peerUpdateValues returns the subset of fields which can change after the peer has
+// joined the swarm
+func peerUpdateValues(p *model.Peer) map[string]interface{} {
+	return map[string]interface{}{
+		"speed_up":          p.SpeedUP,
+		"speed_dn":          p.SpeedDN,
+		"speed_up_max":      p.SpeedUPMax,
+		"speed_dn_max":      p.SpeedDNMax,
+		"total_uploaded":    p.Uploaded,
+		"total_downloaded":  p.Downloaded,
+		"total_left":        p.Left,
+		"total_corrupt":     p.Corrupt,
+		"total_announces":   p.Announces,
+		"total_time":        p.TotalTime,
+		"completed":         p.Completed,
+		"resets":            p.Resets,
+		"flagged":           p.Flagged,
+		"paused":            p.Paused,
+		"partial":           p.Partial,
+		"super_seeding":     p.SuperSeeding,
+		"super_seed_cursor": p.SuperSeedCursor,
+		"crypto":            uint8(p.Crypto),
+		"hnr_exempt":        p.HNRExempt,
+		"connectable":       p.Connectable,
+		"probed_on":         util.TimeToString(p.ProbedOn),
+		"key":               p.Key,
+		"addr_ip":           p.IP.String(),
+		"addr_ipv6":         p.IPv6.String(),
+		"last_announce":     util.TimeToString(p.AnnounceLast),
+		"updated_on":        util.TimeToString(p.UpdatedOn),
+	}
+}
+
 // Delete will remove a user from a torrents swarm
 func (ps *PeerStore) Delete(ih model.InfoHash, p *model.Peer) error {
-	return ps.client.Del(peerKey(ih, p.PeerID)).Err()
+	ps.flushMu.Lock()
+	defer ps.flushMu.Unlock()
+	ps.pendingMu.Lock()
+	delete(ps.pending, peerKey(ih, p.PeerID))
+	ps.pendingMu.Unlock()
+	pipe := ps.client.TxPipeline()
+	pipe.Del(peerKey(ih, p.PeerID))
+	pipe.ZRem(seedersKey(ih), p.PeerID.String())
+	pipe.ZRem(leechersKey(ih), p.PeerID.String())
+	pipe.ZRem(userPeersKey(p.UserID, ih), p.PeerID.String())
+	if _, err := pipe.Exec(); err != nil {
+		return errors.Wrap(err, "Failed to Delete")
+	}
+	return nil
+}
+
+// UserPeers returns the number of peers the user has in the swarm which have announced since
+// the time provided. Peers which expired without being deleted are dropped from the index first.
+func (ps *PeerStore) UserPeers(ih model.InfoHash, userID uint32, since time.Time) (int, error) {
+	key := userPeersKey(userID, ih)
+	pipe := ps.client.Pipeline()
+	pipe.ZRemRangeByScore(key, "-inf", fmt.Sprintf("(%d", since.Unix()))
+	count := pipe.ZCard(key)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, errors.Wrap(err, "Failed to fetch user peers")
+	}
+	return int(count.Val()), nil
+}
+
+// CountsOnly returns the seeder and leecher counts using the cardinality of the per-torrent
+// seeder and leecher sets, avoiding fetching every peer in the swarm. When a peer TTL is set,
+// peers which have not announced within it have expired and are dropped from the sets first.
+func (ps *PeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	pipe := ps.client.Pipeline()
+	if ps.peerTTL > 0 {
+		expired := fmt.Sprintf("(%d", time.Now().Add(-ps.peerTTL).Unix())
+		pipe.ZRemRangeByScore(seedersKey(ih), "-inf", expired)
+		pipe.ZRemRangeByScore(leechersKey(ih), "-inf", expired)
+	}
+	seeders := pipe.ZCard(seedersKey(ih))
+	leechers := pipe.ZCard(leechersKey(ih))
+	if _, err := pipe.Exec(); err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to fetch swarm counts")
+	}
+	return uint(seeders.Val()), uint(leechers.Val()), nil
 }
 
 // Get will fetch the peer from the swarm if it exists
 func (ps *PeerStore) Get(ih model.InfoHash, peerID model.PeerID) (*model.Peer, error) {
-	v, err := ps.client.HGetAll(peerKey(ih, peerID)).Result()
+	key := peerKey(ih, peerID)
+	v, err := ps.client.HGetAll(key).Result()
 	if err != nil {
 		return nil, err
 	}
+	ps.overlayPending(key, v)
 	p := mapPeerValues(v)
 	if !p.Valid() {
 		return nil, consts.ErrInvalidState
@@ -326,26 +1064,75 @@ func (ps *PeerStore) Get(ih model.InfoHash, peerID model.PeerID) (*model.Peer, e
 	return &p, nil
 }
 
+// overlayPending replaces the stored values of the peer with those of its queued update, if
+// any, so peers read before the next flush never return stale totals
+func (ps *PeerStore) overlayPending(key string, v map[string]string) {
+	if len(v) == 0 {
+		return
+	}
+	ps.pendingMu.Lock()
+	p, found := ps.pending[key]
+	ps.pendingMu.Unlock()
+	if !found {
+		return
+	}
+	for field, value := range p.values {
+		v[field] = redisString(value)
+	}
+}
+
+// redisString formats the value the same way it is stored by redis
+func redisString(value interface{}) string {
+	if b, ok := value.(bool); ok {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(value)
+}
+
 func mapPeerValues(v map[string]string) model.Peer {
+	// Peers stored before probing was enabled have no probe time and were never probed
+	var probedOn time.Time
+	if s := v["probed_on"]; s != "" {
+		probedOn = util.StringToTime(s)
+	}
 	return model.Peer{
-		SpeedUP:       util.StringToUInt32(v["speed_up"], 0),
-		SpeedDN:       util.StringToUInt32(v["speed_dn"], 0),
-		SpeedUPMax:    util.StringToUInt32(v["speed_dn_max"], 0),
-		SpeedDNMax:    util.StringToUInt32(v["speed_up_max"], 0),
-		Uploaded:      util.StringToUInt32(v["total_uploaded"], 0),
-		Downloaded:    util.StringToUInt32(v["total_downloaded"], 0),
-		Left:          util.StringToUInt32(v["total_left"], 0),
-		Announces:     util.StringToUInt32(v["total_announces"], 0),
-		TotalTime:     util.StringToUInt32(v["total_time"], 0),
-		IP:            net.ParseIP(v["addr_ip"]),
-		Port:          util.StringToUInt16(v["addr_port"], 0),
-		AnnounceLast:  util.StringToTime(v["last_announce"]),
-		AnnounceFirst: util.StringToTime(v["first_announce"]),
-		PeerID:        model.PeerIDFromString(v["peer_id"]),
-		Location:      geo.LatLongFromString(v["location"]),
-		UserID:        util.StringToUInt32(v["user_id"], 0),
-		CreatedOn:     util.StringToTime(v["created_on"]),
-		UpdatedOn:     util.StringToTime(v["updated_on"]),
+		SpeedUP:         util.StringToUInt32(v["speed_up"], 0),
+		SpeedDN:         util.StringToUInt32(v["speed_dn"], 0),
+		SpeedUPMax:      util.StringToUInt32(v["speed_up_max"], 0),
+		SpeedDNMax:      util.StringToUInt32(v["speed_dn_max"], 0),
+		Uploaded:        util.StringToUInt32(v["total_uploaded"], 0),
+		Downloaded:      util.StringToUInt32(v["total_downloaded"], 0),
+		Left:            util.StringToUInt32(v["total_left"], 0),
+		Corrupt:         util.StringToUInt32(v["total_corrupt"], 0),
+		Announces:       util.StringToUInt32(v["total_announces"], 0),
+		TotalTime:       util.StringToUInt32(v["total_time"], 0),
+		Completed:       util.StringToBool(v["completed"], false),
+		Resets:          util.StringToUInt32(v["resets"], 0),
+		Flagged:         util.StringToBool(v["flagged"], false),
+		Paused:          util.StringToBool(v["paused"], false),
+		Partial:         util.StringToBool(v["partial"], false),
+		SuperSeeding:    util.StringToBool(v["super_seeding"], false),
+		SuperSeedCursor: util.StringToUInt32(v["super_seed_cursor"], 0),
+		Crypto:          model.CryptoLevel(util.StringToUInt16(v["crypto"], 0)),
+		HNRExempt:       util.StringToBool(v["hnr_exempt"], false),
+		Connectable:     util.StringToBool(v["connectable"], false),
+		ProbedOn:        probedOn,
+		IP:              net.ParseIP(v["addr_ip"]),
+		IPv6:            net.ParseIP(v["addr_ipv6"]),
+		Port:            util.StringToUInt16(v["addr_port"], 0),
+		AnnounceLast:    util.StringToTime(v["last_announce"]),
+		AnnounceFirst:   util.StringToTime(v["first_announce"]),
+		PeerID:          model.PeerIDFromString(v["peer_id"]),
+		Location:        geo.LatLongFromString(v["location"]),
+		CountryCode:     v["country_code"],
+		Client:          v["client"],
+		Key:             v["key"],
+		UserID:          util.StringToUInt32(v["user_id"], 0),
+		CreatedOn:       util.StringToTime(v["created_on"]),
+		UpdatedOn:       util.StringToTime(v["updated_on"]),
 	}
 }
 
@@ -360,26 +1147,123 @@ func (ps *PeerStore) GetN(ih model.InfoHash, limit int) (model.Swarm, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "Error trying to GetN")
 		}
+		ps.overlayPending(key, v)
 		p := mapPeerValues(v)
 		peers = append(peers, &p)
 	}
 	return peers, nil
 }
 
+// Ping checks that the redis server can be reached
+func (ps *PeerStore) Ping() error {
+	return ps.client.Ping().Err()
+}
+
 // Close will close the underlying redis client and clear in-memory caches
 func (ps *PeerStore) Close() error {
+	if ps.syncInterval > 0 {
+		// Write any queued updates before closing the connection
+		close(ps.syncStop)
+		<-ps.syncDone
+	}
 	return ps.client.Close()
 }
 
+// takeStats moves the live stats hash to its pending key so new deltas accumulate in a fresh
+// hash and returns the pending values. RENAME is atomic so no concurrent increment is lost. A
+// pending hash left over by a failed flush is returned as is instead.
+func takeStats(client *redis.Client, key string) (map[string]string, error) {
+	pending := key + suffixStatsPending
+	exists, err := client.Exists(pending).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to check pending stats")
+	}
+	if exists == 0 {
+		if err := client.Rename(key, pending).Err(); err != nil {
+			if strings.Contains(err.Error(), "no such key") {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "Failed to snapshot stats")
+		}
+	}
+	values, err := client.HGetAll(pending).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch pending stats")
+	}
+	return values, nil
+}
+
+// TakeStats snapshots and resets the transfer amounts accumulated by AddTransfer
+func (us UserStore) TakeStats() (*store.StatDeltas, error) {
+	values, err := takeStats(us.client, keyStatsUsers)
+	if err != nil {
+		return nil, err
+	}
+	deltas := store.NewStatDeltas()
+	for field, value := range values {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		userID, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		amount := util.StringToUInt64(value, 0)
+		switch parts[1] {
+		case "uploaded":
+			deltas.Uploaded[uint32(userID)] += amount
+		case "downloaded":
+			deltas.Downloaded[uint32(userID)] += amount
+		}
+	}
+	return deltas, nil
+}
+
+// CommitStats removes the snapshot returned by TakeStats
+func (us UserStore) CommitStats() error {
+	return us.client.Del(keyStatsUsers + suffixStatsPending).Err()
+}
+
+// TakeStats snapshots and resets the snatch counts accumulated by IncrementCompleted
+func (ts *TorrentStore) TakeStats() (*store.StatDeltas, error) {
+	values, err := takeStats(ts.client, keyStatsTorrents)
+	if err != nil {
+		return nil, err
+	}
+	deltas := store.NewStatDeltas()
+	for field, value := range values {
+		ih, err := model.InfoHashFromHex(field)
+		if err != nil {
+			continue
+		}
+		deltas.Completed[ih] += util.StringToUInt64(value, 0)
+	}
+	return deltas, nil
+}
+
+// CommitStats removes the snapshot returned by TakeStats
+func (ts *TorrentStore) CommitStats() error {
+	return ts.client.Del(keyStatsTorrents + suffixStatsPending).Err()
+}
+
 func newRedisConfig(c *config.StoreConfig) *redis.Options {
 	database, err := strconv.ParseInt(c.Database, 10, 32)
 	if err != nil {
 		log.Panicf("Failed to parse redis database integer: %s", c.Database)
 	}
+	// Zero values fall back to the go-redis defaults
 	return &redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", c.Host, c.Port),
-		Password: c.Password,
-		DB:       int(database),
+		Addr:         fmt.Sprintf("%s:%d", c.Host, c.Port),
+		Password:     c.Password,
+		DB:           int(database),
+		PoolSize:     c.MaxActive,
+		MinIdleConns: c.MaxIdle,
+		IdleTimeout:  c.IdleTimeout,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		PoolTimeout:  c.PoolWait,
 		OnConnect: func(conn *redis.Conn) error {
 			if err := conn.ClientSetName(clientName).Err(); err != nil {
 				log.Fatalf("Could not setname, bailing: %s", err)
@@ -412,9 +1296,20 @@ func (pd peerDriver) NewPeerStore(cfg interface{}) (store.PeerStore, error) {
 		return nil, consts.ErrInvalidConfig
 	}
 	client := redis.NewClient(newRedisConfig(c))
-	return &PeerStore{
-		client: client,
-	}, nil
+	ps := &PeerStore{
+		client:        client,
+		syncInterval:  c.SyncInterval,
+		syncBatchSize: c.SyncBatchSize,
+		peerTTL:       c.PeerTTL,
+		pending:       make(map[string]pendingPeer),
+		flushNow:      make(chan struct{}, 1),
+		syncStop:      make(chan struct{}),
+		syncDone:      make(chan struct{}),
+	}
+	if ps.syncInterval > 0 {
+		go ps.syncer()
+	}
+	return ps, nil
 }
 
 type userDriver struct{}
@@ -1,11 +1,16 @@
 package redis
 
 import (
+	"context"
 	"github.com/go-redis/redis/v7"
 	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/leighmacdonald/mika/util"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestRedisTorrentStore(t *testing.T) {
@@ -24,8 +29,182 @@ func TestRedisPeerStore(t *testing.T) {
 	store.TestPeerStore(t, ps, ts)
 }
 
+func TestRedisPeerStoreBatched(t *testing.T) {
+	config.Read("")
+	ts, err := store.NewTorrentStore("redis", config.GetStoreConfig(config.Torrent))
+	require.NoError(t, err)
+	cfg := config.GetStoreConfig(config.Peers)
+	cfg.SyncInterval = time.Hour
+	cfg.SyncBatchSize = 2
+	ps, err := store.NewPeerStore("redis", cfg)
+	require.NoError(t, err)
+	tor := store.GenerateTestTorrent()
+	require.NoError(t, ts.Add(tor))
+	defer func() { _ = ts.Delete(tor.InfoHash, true) }()
+	peers := []*model.Peer{store.GenerateTestPeer(nil), store.GenerateTestPeer(nil)}
+	for _, p := range peers {
+		require.NoError(t, ps.Add(tor.InfoHash, p))
+	}
+	client := ps.(*PeerStore).client
+	peers[0].Uploaded = 4000
+	require.NoError(t, ps.Update(tor.InfoHash, peers[0]))
+	peers[0].Uploaded = 5000
+	require.NoError(t, ps.Update(tor.InfoHash, peers[0]))
+	stored, err := client.HGet(peerKey(tor.InfoHash, peers[0].PeerID), "total_uploaded").Result()
+	require.NoError(t, err)
+	require.Equal(t, "0", stored, "Updates are queued until flushed")
+	fetched, err := ps.Get(tor.InfoHash, peers[0].PeerID)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5000), fetched.Uploaded, "Reads include the queued update")
+	swarm, err := ps.GetN(tor.InfoHash, 10)
+	require.NoError(t, err)
+	var swarmPeer *model.Peer
+	for _, p := range swarm {
+		if p.PeerID == peers[0].PeerID {
+			swarmPeer = p
+		}
+	}
+	require.NotNil(t, swarmPeer)
+	require.Equal(t, uint32(5000), swarmPeer.Uploaded, "Swarm reads include the queued update")
+	// Reaching the batch size triggers a flush without waiting for the interval
+	peers[1].Uploaded = 6000
+	require.NoError(t, ps.Update(tor.InfoHash, peers[1]))
+	for i := 0; i < 100 && stored == "0"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stored, err = client.HGet(peerKey(tor.InfoHash, peers[0].PeerID), "total_uploaded").Result()
+		require.NoError(t, err)
+	}
+	require.Equal(t, "5000", stored)
+	// Deleted peers with queued updates are not recreated by the final flush on close
+	peers[1].Uploaded = 7000
+	require.NoError(t, ps.Update(tor.InfoHash, peers[1]))
+	require.NoError(t, ps.Delete(tor.InfoHash, peers[1]))
+	peers[0].Uploaded = 8000
+	require.NoError(t, ps.Update(tor.InfoHash, peers[0]))
+	require.NoError(t, ps.Close())
+	ps, err = store.NewPeerStore("redis", config.GetStoreConfig(config.Peers))
+	require.NoError(t, err)
+	_, err = ps.Get(tor.InfoHash, peers[1].PeerID)
+	require.Error(t, err)
+	fetched, err = ps.Get(tor.InfoHash, peers[0].PeerID)
+	require.NoError(t, err)
+	require.Equal(t, uint32(8000), fetched.Uploaded, "Queued updates are written on close")
+	require.NoError(t, ps.Delete(tor.InfoHash, peers[0]))
+}
+
+func TestRedisPeerStoreShutdown(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := tracker.NewTestTracker()
+	cfg := config.GetStoreConfig(config.Peers)
+	cfg.SyncInterval = time.Hour
+	ps, err := store.NewPeerStore("redis", cfg)
+	require.NoError(t, err)
+	tkr.Peers = ps
+	tor := torrents[0]
+	peer := store.GenerateTestPeer(nil)
+	require.NoError(t, ps.Add(tor.InfoHash, peer))
+	peer.Uploaded = 5000
+	require.NoError(t, ps.Update(tor.InfoHash, peer))
+	require.NoError(t, tkr.Shutdown(context.Background()))
+	ps, err = store.NewPeerStore("redis", config.GetStoreConfig(config.Peers))
+	require.NoError(t, err)
+	fetched, err := ps.Get(tor.InfoHash, peer.PeerID)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5000), fetched.Uploaded, "Queued updates are written on shutdown")
+	require.NoError(t, ps.Delete(tor.InfoHash, peer))
+}
+
+func TestRedisPeerStoreExpiredCounts(t *testing.T) {
+	config.Read("")
+	cfg := config.GetStoreConfig(config.Peers)
+	cfg.PeerTTL = time.Minute
+	ps, err := store.NewPeerStore("redis", cfg)
+	require.NoError(t, err)
+	defer func() { _ = ps.Close() }()
+	ih := store.GenerateTestTorrent().InfoHash
+	seeder := store.GenerateTestPeer(nil)
+	seeder.Left = 0
+	leecher := store.GenerateTestPeer(nil)
+	leecher.Left = 1000
+	expired := store.GenerateTestPeer(nil)
+	expired.Left = 1000
+	expired.AnnounceLast = time.Now().Add(-2 * time.Minute)
+	for _, p := range []*model.Peer{seeder, leecher, expired} {
+		require.NoError(t, ps.Add(ih, p))
+	}
+	// The peer expiring on its own leaves its member in the count set
+	require.NoError(t, ps.(*PeerStore).client.Del(peerKey(ih, expired.PeerID)).Err())
+	seeders, leechers, err := ps.CountsOnly(ih)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), seeders)
+	require.Equal(t, uint(1), leechers, "Expired peers are not counted")
+	for _, p := range []*model.Peer{seeder, leecher} {
+		require.NoError(t, ps.Delete(ih, p))
+	}
+}
+
+// redisStrings converts the values to the strings redis returns for them
+func redisStrings(values map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(values))
+	for k, v := range values {
+		s[k] = redisString(v)
+	}
+	return s
+}
+
+func TestMapPeerValues(t *testing.T) {
+	p := store.GenerateTestPeer(nil)
+	p.SpeedUP = 100
+	p.SpeedDN = 200
+	p.SpeedUPMax = 1000
+	p.SpeedDNMax = 2000
+	p.Completed = true
+	p.Resets = 2
+	p.Paused = true
+	// Above the int16 range
+	p.Port = 51413
+	loaded := mapPeerValues(redisStrings(peerValues(p)))
+	require.Equal(t, p.SpeedUP, loaded.SpeedUP)
+	require.Equal(t, p.SpeedDN, loaded.SpeedDN)
+	require.Equal(t, p.SpeedUPMax, loaded.SpeedUPMax)
+	require.Equal(t, p.SpeedDNMax, loaded.SpeedDNMax)
+	require.Equal(t, p.PeerID, loaded.PeerID)
+	require.Equal(t, p.UserID, loaded.UserID)
+	require.Equal(t, p.Port, loaded.Port)
+	require.Equal(t, p.Completed, loaded.Completed)
+	require.Equal(t, p.Resets, loaded.Resets)
+	require.Equal(t, p.Paused, loaded.Paused)
+	require.Equal(t, util.TimeToString(p.AnnounceFirst), util.TimeToString(loaded.AnnounceFirst))
+
+	// Updates only write the changing fields but must not clobber the others
+	p.SpeedUPMax = 3000
+	v := redisStrings(peerValues(p))
+	for k, val := range redisStrings(peerUpdateValues(p)) {
+		v[k] = val
+	}
+	loaded = mapPeerValues(v)
+	require.Equal(t, uint32(3000), loaded.SpeedUPMax)
+	require.Equal(t, uint32(2000), loaded.SpeedDNMax)
+	require.Equal(t, uint32(100), loaded.SpeedUP)
+}
+
 func clearDB(c *redis.Client) {
 	for _, k := range c.Keys("*").Val() {
 		c.Del(k)
 	}
 }
+
+func TestNewRedisConfig(t *testing.T) {
+	config.Read("")
+	c := config.GetStoreConfig(config.Peers)
+	c.Database = "1"
+	c.MaxActive = 200
+	c.PoolWait = time.Second
+	opts := newRedisConfig(c)
+	require.Equal(t, 1, opts.DB)
+	require.Equal(t, 200, opts.PoolSize)
+	require.Equal(t, time.Second, opts.PoolTimeout)
+	require.Equal(t, 10, opts.MinIdleConns)
+	require.Equal(t, time.Minute*5, opts.IdleTimeout)
+	require.Equal(t, time.Second*3, opts.ReadTimeout)
+}
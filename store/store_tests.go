@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 )
 
 // GenerateTestUser creates a peer using fake data. Used for testing.
@@ -49,6 +50,41 @@ func findPeer(peers []*model.Peer, p1 *model.Peer) *model.Peer {
 	return nil
 }
 
+// TestUserStore tests the interface implementation
+func TestUserStore(t *testing.T, us UserStore) {
+	userA := GenerateTestUser()
+	require.NoError(t, us.Add(userA))
+	fetchedUser, err := us.GetByPasskey(userA.Passkey)
+	require.NoError(t, err)
+	require.Equal(t, userA.UserID, fetchedUser.UserID)
+	fetchedUser, err = us.GetByID(userA.UserID)
+	require.NoError(t, err)
+	require.Equal(t, userA.Passkey, fetchedUser.Passkey)
+	require.NoError(t, us.AddTransfer(userA, 1000, 2000))
+	fetchedUser, err = us.GetByPasskey(userA.Passkey)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), fetchedUser.Uploaded)
+	require.Equal(t, uint64(2000), fetchedUser.Downloaded)
+	require.NoError(t, us.AddPoints(userA, 1.5))
+	fetchedUser, err = us.GetByPasskey(userA.Passkey)
+	require.NoError(t, err)
+	require.Equal(t, 1.5, fetchedUser.Points)
+	ihA, ihB := GenerateTestTorrent().InfoHash, GenerateTestTorrent().InfoHash
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, us.AddSnatch(model.Snatch{UserID: userA.UserID, InfoHash: ihA, CreatedOn: now.Add(-time.Hour)}))
+	require.NoError(t, us.AddSnatch(model.Snatch{UserID: userA.UserID, InfoHash: ihB, CreatedOn: now.Add(-time.Minute)}))
+	require.NoError(t, us.AddSnatch(model.Snatch{UserID: userA.UserID, InfoHash: ihA, CreatedOn: now}))
+	snatches, err := us.GetSnatches(userA.UserID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(snatches), "Snatching again only updates the timestamp")
+	require.Equal(t, ihA, snatches[0].InfoHash)
+	require.True(t, now.Equal(snatches[0].CreatedOn))
+	require.Equal(t, ihB, snatches[1].InfoHash)
+	require.NoError(t, us.Delete(userA))
+	_, err = us.GetByPasskey(userA.Passkey)
+	require.Error(t, err)
+}
+
 // TestPeerStore tests the interface implementation
 func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore) {
 	//clearDB(ps.client)
@@ -90,9 +126,36 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore) {
 	require.Equal(t, p1.TotalTime, p1Updated.TotalTime)
 	require.Equal(t, p1.Downloaded, p1Updated.Downloaded)
 	require.Equal(t, p1.Uploaded, p1Updated.Uploaded)
+	seeders, leechers := updatedPeers.Counts()
+	countSeeders, countLeechers, err := ps.CountsOnly(torrentA.InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, seeders, countSeeders)
+	require.Equal(t, leechers, countLeechers)
+	// Counts must follow peers transitioning from leeching to seeding
+	p1.Left = 0
+	require.NoError(t, ps.Update(torrentA.InfoHash, p1))
+	seeders, leechers = model.Swarm(peers).Counts()
+	countSeeders, countLeechers, err = ps.CountsOnly(torrentA.InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, seeders, countSeeders)
+	require.Equal(t, leechers, countLeechers)
+	// The user peer index must follow peers joining and leaving the swarm
+	p2 := GenerateTestPeer(nil)
+	p2.UserID = p1.UserID
+	require.NoError(t, ps.Add(torrentA.InfoHash, p2))
+	userPeers, err := ps.UserPeers(torrentA.InfoHash, p1.UserID, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, userPeers)
+	require.NoError(t, ps.Delete(torrentA.InfoHash, p2))
+	userPeers, err = ps.UserPeers(torrentA.InfoHash, p1.UserID, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, userPeers)
 	for _, peer := range peers {
 		require.NoError(t, ps.Delete(torrentA.InfoHash, peer))
 	}
+	userPeers, err = ps.UserPeers(torrentA.InfoHash, p1.UserID, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, 0, userPeers)
 }
 
 // TestTorrentStore tests the interface implementation
@@ -106,8 +169,46 @@ func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	require.Equal(t, torrentA.IsDeleted, fetchedTorrent.IsDeleted)
 	require.Equal(t, torrentA.IsEnabled, fetchedTorrent.IsEnabled)
 	require.Equal(t, util.TimeToString(torrentA.CreatedOn), util.TimeToString(fetchedTorrent.CreatedOn))
+	torrents, err := ts.GetN(10)
+	require.NoError(t, err)
+	require.True(t, len(torrents) > 0)
+	unknown := GenerateTestTorrent()
+	multi, err := ts.GetMulti([]model.InfoHash{unknown.InfoHash, torrentA.InfoHash})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(multi), "Unknown torrents are skipped")
+	require.Equal(t, torrentA.InfoHash, multi[0].InfoHash)
+	completed := fetchedTorrent.TotalCompleted
+	for i := uint32(1); i <= 2; i++ {
+		total, err := ts.IncrementCompleted(torrentA.InfoHash)
+		require.NoError(t, err)
+		require.Equal(t, completed+i, total)
+	}
+	completedTorrent, err := ts.Get(torrentA.InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, completed+2, completedTorrent.TotalCompleted)
+	lastActive := time.Now().Truncate(time.Minute)
+	require.NoError(t, ts.Touch(torrentA.InfoHash, lastActive))
+	touchedTorrent, err := ts.Get(torrentA.InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, util.TimeToString(lastActive), util.TimeToString(touchedTorrent.LastActive))
+	inactive := GenerateTestTorrent()
+	require.NoError(t, ts.Add(inactive))
+	require.NoError(t, ts.Touch(inactive.InfoHash, time.Now().Add(-48*time.Hour)))
+	pruned, err := ts.PruneInactive(24 * time.Hour)
+	require.NoError(t, err)
+	require.Contains(t, pruned, inactive.InfoHash)
+	require.NotContains(t, pruned, torrentA.InfoHash)
+	_, err = ts.Get(inactive.InfoHash)
+	require.Equal(t, consts.ErrInvalidInfoHash, err)
 	require.NoError(t, ts.Delete(torrentA.InfoHash, true))
 	deletedTorrent, err := ts.Get(torrentA.InfoHash)
 	require.Nil(t, deletedTorrent)
 	require.Equal(t, consts.ErrInvalidInfoHash, err)
+
+	require.NoError(t, ts.BanListAdd("10.0.0.0/8"))
+	bans, err := ts.BanListGetAll()
+	require.NoError(t, err)
+	require.Contains(t, bans, "10.0.0.0/8")
+	require.NoError(t, ts.BanListDelete("10.0.0.0/8"))
+	require.Equal(t, consts.ErrInvalidBan, ts.BanListDelete("10.0.0.0/8"))
 }
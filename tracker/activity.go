@@ -0,0 +1,152 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+// CountAnnounce records a announce for the torrent in the activity rankings
+func (t *Tracker) CountAnnounce(ih model.InfoHash) {
+	t.countRequest(ih, store.RequestCounts{Announces: 1})
+}
+
+// CountScrape records a scrape of the torrent in the activity rankings
+func (t *Tracker) CountScrape(ih model.InfoHash) {
+	t.countRequest(ih, store.RequestCounts{Scrapes: 1})
+}
+
+// countRequest adds the counts to those waiting for the next activity flush. Requests are only
+// counted in memory so counting does not add a store round trip to the request.
+func (t *Tracker) countRequest(ih model.InfoHash, c store.RequestCounts) {
+	if t.ActivityInterval <= 0 {
+		return
+	}
+	t.activityMu.Lock()
+	if t.activity == nil {
+		t.activity = make(map[model.InfoHash]store.RequestCounts)
+	}
+	counts := t.activity[ih]
+	counts.Announces += c.Announces
+	counts.Scrapes += c.Scrapes
+	t.activity[ih] = counts
+	t.activityMu.Unlock()
+}
+
+// activityDecay returns the factor the recent activity counts are multiplied by after elapsed
+// so they are halved every ActivityHalfLife
+func (t *Tracker) activityDecay(elapsed time.Duration) float64 {
+	if t.ActivityHalfLife <= 0 || elapsed <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(elapsed)/float64(t.ActivityHalfLife))
+}
+
+// FlushActivity writes the counted requests to the torrent store in a single call, decaying
+// the recent counts by the time passed since the previous flush. Counts which fail to be
+// written are kept for the next flush.
+func (t *Tracker) FlushActivity() error {
+	as, ok := t.Torrents.(store.ActivityStore)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	t.activityMu.Lock()
+	counts := t.activity
+	t.activity = make(map[model.InfoHash]store.RequestCounts, len(counts))
+	var elapsed time.Duration
+	if !t.activityFlushed.IsZero() {
+		elapsed = now.Sub(t.activityFlushed)
+	}
+	t.activityMu.Unlock()
+	if err := as.AddActivity(counts, t.activityDecay(elapsed)); err != nil {
+		t.activityMu.Lock()
+		for ih, c := range counts {
+			merged := t.activity[ih]
+			merged.Announces += c.Announces
+			merged.Scrapes += c.Scrapes
+			t.activity[ih] = merged
+		}
+		t.activityMu.Unlock()
+		return errors.Wrap(err, "Failed to write activity")
+	}
+	t.activityMu.Lock()
+	t.activityFlushed = now
+	t.activityMu.Unlock()
+	return nil
+}
+
+// ActivityFlusher flushes the counted requests every ActivityInterval until the context is
+// cancelled, flushing a final time before returning
+func (t *Tracker) ActivityFlusher(ctx context.Context) {
+	ticker := time.NewTicker(t.ActivityInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.FlushActivity(); err != nil {
+				log.Errorf("Failed to flush torrent activity: %s", err.Error())
+			}
+		case <-ctx.Done():
+			if err := t.FlushActivity(); err != nil {
+				log.Errorf("Failed to flush torrent activity: %s", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// TouchTorrent records the announce as the last activity of the torrent. The time is rounded
+// down to the minute so the store is written at most once a minute for each torrent.
+func (t *Tracker) TouchTorrent(tor *model.Torrent) {
+	now := time.Now().Truncate(time.Minute)
+	tor.Lock()
+	if !tor.LastActive.Before(now) {
+		tor.Unlock()
+		return
+	}
+	tor.LastActive = now
+	tor.Unlock()
+	if err := t.Torrents.Touch(tor.InfoHash, now); err != nil {
+		log.Errorf("Failed to update torrent last active time: %s", err.Error())
+	}
+}
+
+// PruneTorrents removes the torrents without announces within olderThan along with the peers
+// remaining in their swarms, returning the number of torrents removed
+func (t *Tracker) PruneTorrents(olderThan time.Duration) (int, error) {
+	pruned, err := t.Torrents.PruneInactive(olderThan)
+	for _, ih := range pruned {
+		t.DropPeerList(ih)
+		peers, err := t.Peers.GetN(ih, math.MaxInt32)
+		if err != nil {
+			log.Errorf("Failed to fetch swarm of pruned torrent: %s", err.Error())
+			continue
+		}
+		for _, p := range peers {
+			if err := t.Peers.Delete(ih, p); err != nil {
+				log.Errorf("Failed to remove peer of pruned torrent: %s", err.Error())
+			}
+		}
+	}
+	if err != nil {
+		return len(pruned), errors.Wrap(err, "Failed to prune torrents")
+	}
+	if len(pruned) > 0 {
+		log.Infof("Pruned %d torrents inactive for %s", len(pruned), olderThan)
+	}
+	return len(pruned), nil
+}
+
+// TopTorrents returns up to n torrents with the most recent announces
+func (t *Tracker) TopTorrents(n int) ([]store.TorrentActivity, error) {
+	as, ok := t.Torrents.(store.ActivityStore)
+	if !ok {
+		return nil, nil
+	}
+	return as.TopActivity(n)
+}
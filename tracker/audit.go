@@ -0,0 +1,123 @@
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry holds the details of a rejected request. Details which were not known yet when
+// the request was rejected are left empty.
+type AuditEntry struct {
+	Reason   string
+	Code     int
+	IP       net.IP
+	PeerID   model.PeerID
+	UserID   uint32
+	InfoHash model.InfoHash
+}
+
+// auditLine is a single line of the audit log
+type auditLine struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Code     int       `json:"code"`
+	IP       string    `json:"ip,omitempty"`
+	PeerID   string    `json:"peer_id,omitempty"`
+	UserID   uint32    `json:"user_id,omitempty"`
+	InfoHash string    `json:"info_hash,omitempty"`
+}
+
+// AuditLog writes rejected requests as JSON lines to a file kept separate from the operational
+// log, so the rejection history of a user or address can be searched during abuse
+// investigations
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewAuditLog opens the audit log at path for appending, creating it if required
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen closes and reopens the log file so logs moved away by a log rotation tool are
+// released and writing continues in a new file at the same path
+func (a *AuditLog) Reopen() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open audit log")
+	}
+	a.mu.Lock()
+	prev := a.file
+	a.file = f
+	a.mu.Unlock()
+	if prev != nil {
+		return prev.Close()
+	}
+	return nil
+}
+
+// Write appends the entry to the log. Only the client prefix of the peer id is written as the
+// remainder is random.
+func (a *AuditLog) Write(e AuditEntry) {
+	line := auditLine{
+		Time:   time.Now(),
+		Reason: e.Reason,
+		Code:   e.Code,
+		UserID: e.UserID,
+	}
+	if e.IP != nil {
+		line.IP = e.IP.String()
+	}
+	if e.PeerID != (model.PeerID{}) {
+		line.PeerID = e.PeerID.RawString()[:8]
+	}
+	if e.InfoHash != (model.InfoHash{}) {
+		line.InfoHash = e.InfoHash.String()
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		log.Errorf("Failed to encode audit entry: %s", err.Error())
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write audit log: %s", err.Error())
+	}
+}
+
+// Close closes the log file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// Audit writes the rejected request to the audit log when one is configured
+func (t *Tracker) Audit(e AuditEntry) {
+	if t.AuditLog == nil {
+		return
+	}
+	t.AuditLog.Write(e)
+}
+
+// ReopenAuditLog reopens the audit log file, this should be called on SIGHUP after the log
+// has been rotated
+func (t *Tracker) ReopenAuditLog() error {
+	if t.AuditLog == nil {
+		return nil
+	}
+	return t.AuditLog.Reopen()
+}
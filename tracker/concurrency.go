@@ -0,0 +1,70 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/metrics"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+// AcquireIP reserves one of the MaxIPConcurrency announce slots of the ip. Returns false when
+// all of the slots are in use, in which case the announce should be rejected without doing
+// any further work. Every successful call must be followed by a call to ReleaseIP.
+func (t *Tracker) AcquireIP(ip net.IP) bool {
+	if t.MaxIPConcurrency <= 0 || ip == nil {
+		return true
+	}
+	key := ip.String()
+	t.ipSlotsMu.Lock()
+	defer t.ipSlotsMu.Unlock()
+	if t.ipSlots == nil {
+		t.ipSlots = make(map[string]int)
+	}
+	if t.ipSlots[key] >= t.MaxIPConcurrency {
+		metrics.AnnounceConcurrencyLimitedTotal.Inc()
+		log.Debugf("Too many concurrent announces from: %s", key)
+		return false
+	}
+	t.ipSlots[key]++
+	return true
+}
+
+// ReleaseIP frees a announce slot of the ip reserved by AcquireIP
+func (t *Tracker) ReleaseIP(ip net.IP) {
+	if t.MaxIPConcurrency <= 0 || ip == nil {
+		return
+	}
+	key := ip.String()
+	t.ipSlotsMu.Lock()
+	if t.ipSlots[key] > 0 {
+		t.ipSlots[key]--
+	}
+	t.ipSlotsMu.Unlock()
+}
+
+// IPSlotCleaner periodically removes the counters of ips without any in-flight announces
+// until the context is cancelled. Idle counters are kept between cleanups so busy ips do not
+// constantly reallocate them.
+func (t *Tracker) IPSlotCleaner(ctx context.Context) {
+	ticker := time.NewTicker(t.IPConcurrencyCleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.cleanupIPSlots()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) cleanupIPSlots() {
+	t.ipSlotsMu.Lock()
+	for ip, inFlight := range t.ipSlots {
+		if inFlight == 0 {
+			delete(t.ipSlots, ip)
+		}
+	}
+	t.ipSlotsMu.Unlock()
+}
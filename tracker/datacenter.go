@@ -0,0 +1,94 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+type asnCacheEntry struct {
+	asn     uint
+	expires time.Time
+}
+
+// parseASNs converts the configured list of ASNs into a set for fast lookups
+func parseASNs(values []int) map[uint]bool {
+	asns := make(map[uint]bool, len(values))
+	for _, v := range values {
+		if v <= 0 {
+			log.Warnf("Ignoring invalid asn: %d", v)
+			continue
+		}
+		asns[uint(v)] = true
+	}
+	return asns
+}
+
+// LookupASN returns the autonomous system number of the ip, caching the result for
+// ASNCacheTTL. Lookup failures are treated as an unknown ASN (0).
+func (t *Tracker) LookupASN(ip net.IP) uint {
+	key := ip.String()
+	now := time.Now()
+	t.asnCacheMu.RLock()
+	entry, found := t.asnCache[key]
+	t.asnCacheMu.RUnlock()
+	if found && now.Before(entry.expires) {
+		return entry.asn
+	}
+	if t.ASNdb == nil {
+		return 0
+	}
+	asn, err := t.ASNdb.Lookup(ip)
+	if err != nil {
+		log.Debugf("Failed to lookup asn: %s", err.Error())
+		return 0
+	}
+	t.CacheASN(ip, asn.Number)
+	return asn.Number
+}
+
+// CacheASN stores the autonomous system number of the ip in the lookup cache for ASNCacheTTL
+func (t *Tracker) CacheASN(ip net.IP, asn uint) {
+	t.asnCacheMu.Lock()
+	if t.asnCache == nil {
+		t.asnCache = make(map[string]asnCacheEntry)
+	}
+	t.asnCache[ip.String()] = asnCacheEntry{asn: asn, expires: time.Now().Add(t.ASNCacheTTL)}
+	t.asnCacheMu.Unlock()
+}
+
+// DatacenterAllowed checks if the user may announce to the torrent from the ip. Torrents
+// with BlockDatacenter set deny peers whose ASN is in the ASNBlockList unless the user
+// is flagged as a seedbox user.
+func (t *Tracker) DatacenterAllowed(tor *model.Torrent, usr *model.User, ip net.IP) bool {
+	if len(t.ASNBlockList) == 0 || usr.Seedbox {
+		return true
+	}
+	tor.RLock()
+	block := tor.BlockDatacenter
+	tor.RUnlock()
+	if !block {
+		return true
+	}
+	asn := t.LookupASN(ip)
+	if !t.ASNBlockList[asn] {
+		return true
+	}
+	log.Debugf("Rejected announce from datacenter asn %d: %s", asn, ip.String())
+	metrics.AnnounceDatacenterBlockedTotal.Inc()
+	return false
+}
+
+// expireASNCache removes any expired ASN lookups
+func (t *Tracker) expireASNCache() {
+	now := time.Now()
+	t.asnCacheMu.Lock()
+	for ip, entry := range t.asnCache {
+		if now.After(entry.expires) {
+			delete(t.asnCache, ip)
+		}
+	}
+	t.asnCacheMu.Unlock()
+}
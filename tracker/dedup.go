@@ -0,0 +1,74 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"time"
+)
+
+type dedupEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+// DedupKey identifies a announce for deduplication. The event is part of the key so a stop
+// immediately followed by a start is never mistaken for a duplicate.
+func DedupKey(userID uint32, ih model.InfoHash, peerID model.PeerID, event string,
+	uploaded uint64, downloaded uint64) string {
+	return fmt.Sprintf("%d:%s:%s:%s:%d:%d", userID, ih.String(), peerID.String(), event, uploaded, downloaded)
+}
+
+// DuplicateAnnounce returns the response of a identical announce seen within
+// AnnounceDedupWindow, if any
+func (t *Tracker) DuplicateAnnounce(key string) ([]byte, bool) {
+	if t.AnnounceDedupWindow <= 0 {
+		return nil, false
+	}
+	t.dedupMu.Lock()
+	entry, found := t.dedup[key]
+	t.dedupMu.Unlock()
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	metrics.AnnounceDedupedTotal.Inc()
+	return entry.response, true
+}
+
+// RememberAnnounce stores the response of the announce so identical announces arriving within
+// AnnounceDedupWindow can reuse it. Once AnnounceDedupSize responses are stored expired
+// entries are removed, and new responses are not remembered if that does not free any space.
+func (t *Tracker) RememberAnnounce(key string, response []byte) {
+	if t.AnnounceDedupWindow <= 0 {
+		return
+	}
+	now := time.Now()
+	t.dedupMu.Lock()
+	defer t.dedupMu.Unlock()
+	if t.dedup == nil {
+		t.dedup = make(map[string]dedupEntry)
+	}
+	if len(t.dedup) >= t.AnnounceDedupSize {
+		for k, entry := range t.dedup {
+			if now.After(entry.expires) {
+				delete(t.dedup, k)
+			}
+		}
+		if len(t.dedup) >= t.AnnounceDedupSize {
+			return
+		}
+	}
+	t.dedup[key] = dedupEntry{response: response, expires: now.Add(t.AnnounceDedupWindow)}
+}
+
+// expireDedup removes any expired announce responses
+func (t *Tracker) expireDedup() {
+	now := time.Now()
+	t.dedupMu.Lock()
+	for key, entry := range t.dedup {
+		if now.After(entry.expires) {
+			delete(t.dedup, key)
+		}
+	}
+	t.dedupMu.Unlock()
+}
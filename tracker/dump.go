@@ -0,0 +1,84 @@
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"time"
+)
+
+// SwarmState holds a torrent and the peers of its swarm as written by DumpState
+type SwarmState struct {
+	Torrent *model.Torrent `json:"torrent"`
+	Peers   model.Swarm    `json:"peers"`
+}
+
+// State is a snapshot of all torrents and swarms known to the tracker, used to move the
+// tracker state between servers
+type State struct {
+	CreatedOn time.Time    `json:"created_on"`
+	Swarms    []SwarmState `json:"swarms"`
+}
+
+// DumpState writes the torrents and peers of the torrent and peer stores to w as json. Every
+// torrent is read once along with its swarm so each swarm is consistent with itself, the tracker
+// should not be serving announces while dumping if a fully consistent snapshot is required.
+func (t *Tracker) DumpState(w io.Writer) (torrents int, peers int, err error) {
+	tors, err := t.Torrents.GetN(math.MaxInt32)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to fetch torrents")
+	}
+	state := State{
+		CreatedOn: time.Now(),
+		Swarms:    make([]SwarmState, 0, len(tors)),
+	}
+	for _, tor := range tors {
+		swarm, err := t.Peers.GetN(tor.InfoHash, math.MaxInt32)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "Failed to fetch swarm: %s", tor.InfoHash.String())
+		}
+		state.Swarms = append(state.Swarms, SwarmState{Torrent: tor, Peers: swarm})
+		peers += len(swarm)
+	}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		return 0, 0, errors.Wrap(err, "Failed to encode state")
+	}
+	return len(state.Swarms), peers, nil
+}
+
+// RestoreState reads a snapshot written by DumpState and adds its torrents and peers to the
+// torrent and peer stores. Torrents which already exist are kept as is. Peers which have not
+// announced within AnnInterval * ReapMultiplier would be reaped straight away so they are skipped
+// and counted separately.
+func (t *Tracker) RestoreState(r io.Reader) (torrents int, peers int, skipped int, err error) {
+	var state State
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "Failed to decode state")
+	}
+	maxAge := time.Duration(t.AnnInterval*t.ReapMultiplier) * time.Second
+	expired := time.Now().Add(-maxAge)
+	for _, swarm := range state.Swarms {
+		if swarm.Torrent == nil {
+			continue
+		}
+		ih := swarm.Torrent.InfoHash
+		if err := t.Torrents.Add(swarm.Torrent); err != nil && err != consts.ErrDuplicate {
+			return torrents, peers, skipped, errors.Wrapf(err, "Failed to add torrent: %s", ih.String())
+		}
+		torrents++
+		for _, peer := range swarm.Peers {
+			if maxAge > 0 && peer.AnnounceLast.Before(expired) {
+				skipped++
+				continue
+			}
+			if err := t.Peers.Add(ih, peer); err != nil {
+				return torrents, peers, skipped, errors.Wrapf(err, "Failed to add peer: %s", peer.PeerID.String())
+			}
+			peers++
+		}
+	}
+	return torrents, peers, skipped, nil
+}
@@ -0,0 +1,72 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/model"
+	"time"
+)
+
+// AnnounceSample is a single announce retained in the announce history of a peer
+type AnnounceSample struct {
+	Time       time.Time `json:"time"`
+	Uploaded   uint32    `json:"uploaded"`
+	Downloaded uint32    `json:"downloaded"`
+	Left       uint32    `json:"left"`
+	SpeedUP    uint32    `json:"speed_up"`
+	SpeedDN    uint32    `json:"speed_dn"`
+}
+
+type historyKey struct {
+	infoHash model.InfoHash
+	peerID   model.PeerID
+}
+
+// RecordAnnounce appends the current state of the peer to its announce history, keeping only
+// the most recent PeerHistorySize samples. This should be called once the peer has been
+// updated with the values of the announce. This is a no-op when PeerHistorySize is 0.
+func (t *Tracker) RecordAnnounce(ih model.InfoHash, peer *model.Peer) {
+	if t.PeerHistorySize <= 0 {
+		return
+	}
+	peer.RLock()
+	key := historyKey{ih, peer.PeerID}
+	sample := AnnounceSample{
+		Time:       peer.AnnounceLast,
+		Uploaded:   peer.Uploaded,
+		Downloaded: peer.Downloaded,
+		Left:       peer.Left,
+		SpeedUP:    peer.SpeedUP,
+		SpeedDN:    peer.SpeedDN,
+	}
+	peer.RUnlock()
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	if t.history == nil {
+		t.history = make(map[historyKey][]AnnounceSample)
+	}
+	samples := append(t.history[key], sample)
+	if len(samples) > t.PeerHistorySize {
+		samples = append(samples[:0:0], samples[len(samples)-t.PeerHistorySize:]...)
+	}
+	t.history[key] = samples
+}
+
+// PeerHistory returns a copy of the recorded announce history of the peer, oldest first
+func (t *Tracker) PeerHistory(ih model.InfoHash, peerID model.PeerID) []AnnounceSample {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	samples := t.history[historyKey{ih, peerID}]
+	history := make([]AnnounceSample, len(samples))
+	copy(history, samples)
+	return history
+}
+
+// expireHistory removes the histories of peers which have not announced since the time provided
+func (t *Tracker) expireHistory(expired time.Time) {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	for key, samples := range t.history {
+		if samples[len(samples)-1].Time.Before(expired) {
+			delete(t.history, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/model"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// AnnounceRequest holds the protocol independent values of an announce passed to hooks
+type AnnounceRequest struct {
+	InfoHash model.InfoHash
+	PeerID   model.PeerID
+	UserID   uint32
+	// Event is one of started, stopped or completed. Regular announces use an empty string
+	Event      string
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+	IP         net.IP
+	Port       uint16
+}
+
+// AnnounceHook is implemented by plugins wanting to be notified of every successful announce.
+//
+// Hooks are invoked by a pool of background workers once the peer has been updated, so they
+// never delay the response to the client. For a single announce the registered hooks are
+// called sequentially in the order they were registered. Announces are spread across the
+// workers however, so no ordering is guaranteed between announces, even those of the same
+// peer. The peer is shared with the swarm and may be modified by later announces, so
+// implementations must hold its read lock while accessing its fields.
+type AnnounceHook interface {
+	OnAnnounce(peer *model.Peer, req *AnnounceRequest, ulDiff, dlDiff uint64)
+}
+
+// NoopHook is an AnnounceHook which does nothing
+type NoopHook struct{}
+
+// OnAnnounce implements AnnounceHook
+func (NoopHook) OnAnnounce(_ *model.Peer, _ *AnnounceRequest, _, _ uint64) {}
+
+type hookEvent struct {
+	peer   *model.Peer
+	req    *AnnounceRequest
+	ulDiff uint64
+	dlDiff uint64
+}
+
+// RegisterHook adds a hook to be called for every announce. Hooks must be registered
+// before StartHooks is called.
+func (t *Tracker) RegisterHook(hook AnnounceHook) {
+	t.hooks = append(t.hooks, hook)
+}
+
+// RunHooks queues the announce for delivery to the registered hooks. If the queue is full
+// the announce is dropped rather than blocking the caller.
+func (t *Tracker) RunHooks(peer *model.Peer, req *AnnounceRequest, ulDiff, dlDiff uint64) {
+	if len(t.hooks) == 0 {
+		return
+	}
+	select {
+	case t.hookQueue <- hookEvent{peer: peer, req: req, ulDiff: ulDiff, dlDiff: dlDiff}:
+	default:
+		log.Warnf("Announce hook queue full, dropping event")
+	}
+}
+
+// StartHooks starts HookWorkers workers which deliver queued announces to the
+// registered hooks until the context is cancelled
+func (t *Tracker) StartHooks(ctx context.Context) {
+	workers := t.HookWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go t.hookWorker(ctx)
+	}
+}
+
+func (t *Tracker) hookWorker(ctx context.Context) {
+	for {
+		select {
+		case evt := <-t.hookQueue:
+			for _, hook := range t.hooks {
+				hook.OnAnnounce(evt.peer, evt.req, evt.ulDiff, evt.dlDiff)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// LoadRegistered adds the torrents and users known to the loader to the torrent and user stores.
+// Existing torrents have their size and freeleech status updated and existing users whose passkey
+// has changed are re-added under the new passkey. Entries missing from the loader are left as is,
+// removals must still be made through the admin api.
+func (t *Tracker) LoadRegistered(l store.Loader) error {
+	torrents, err := l.Torrents()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load torrents")
+	}
+	var addedTorrents, addedUsers int
+	for _, src := range torrents {
+		tor, err := t.Torrents.Get(src.InfoHash)
+		if err != nil {
+			if err := t.Torrents.Add(src); err != nil && err != consts.ErrDuplicate {
+				return errors.Wrapf(err, "Failed to add torrent: %s", src.InfoHash.String())
+			}
+			addedTorrents++
+			continue
+		}
+		if tor.Size == src.Size && tor.Freeleech == src.Freeleech {
+			continue
+		}
+		tor.Size = src.Size
+		tor.Freeleech = src.Freeleech
+		if err := t.Torrents.Update(tor); err != nil {
+			return errors.Wrapf(err, "Failed to update torrent: %s", src.InfoHash.String())
+		}
+	}
+	users, err := l.Users()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load users")
+	}
+	for _, src := range users {
+		usr, err := t.Users.GetByID(src.UserID)
+		if err == nil {
+			if usr.Passkey == src.Passkey {
+				continue
+			}
+			if err := t.Users.Delete(usr); err != nil {
+				return errors.Wrapf(err, "Failed to remove user for passkey change: %d", src.UserID)
+			}
+		}
+		if err := t.Users.Add(src); err != nil && err != consts.ErrDuplicate {
+			return errors.Wrapf(err, "Failed to add user: %d", src.UserID)
+		}
+		addedUsers++
+	}
+	log.Infof("Loaded %d torrents (%d new) and %d users (%d new or changed)",
+		len(torrents), addedTorrents, len(users), addedUsers)
+	return nil
+}
+
+// RegisteredLoader loads the registered torrents and users immediately and then again every
+// interval until the context is cancelled. An interval of 0 only loads once.
+func (t *Tracker) RegisteredLoader(ctx context.Context, l store.Loader, interval time.Duration) {
+	if err := t.LoadRegistered(l); err != nil {
+		log.Errorf("Failed to load registered torrents and users: %s", err.Error())
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.LoadRegistered(l); err != nil {
+				log.Errorf("Failed to load registered torrents and users: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FlushStats writes the user transfer and torrent snatch deltas accumulated by the user and
+// torrent stores to the writer. The store snapshots are only discarded once the writer has
+// persisted them so a failed flush is retried on the next call.
+func (t *Tracker) FlushStats(w store.StatWriter) error {
+	deltas := store.NewStatDeltas()
+	var sources []store.StatSource
+	for _, s := range []interface{}{t.Users, t.Torrents} {
+		source, ok := s.(store.StatSource)
+		if !ok {
+			continue
+		}
+		d, err := source.TakeStats()
+		if err != nil {
+			return errors.Wrap(err, "Failed to snapshot stats")
+		}
+		deltas.Merge(d)
+		sources = append(sources, source)
+	}
+	var rows int64
+	if !deltas.Empty() {
+		written, err := w.WriteStats(deltas)
+		if err != nil {
+			return errors.Wrap(err, "Failed to write stats")
+		}
+		rows = written
+	}
+	for _, source := range sources {
+		if err := source.CommitStats(); err != nil {
+			return errors.Wrap(err, "Failed to commit stats")
+		}
+	}
+	if deltas.Empty() {
+		return nil
+	}
+	users := len(deltas.Uploaded)
+	for userID := range deltas.Downloaded {
+		if _, found := deltas.Uploaded[userID]; !found {
+			users++
+		}
+	}
+	log.Infof("Flushed stats of %d users and %d torrents, %d rows written", users, len(deltas.Completed), rows)
+	return nil
+}
+
+// StatFlusher periodically flushes the accumulated stats to the writer until the context is
+// cancelled. Deltas which could not be flushed are kept by the stores and retried on the next
+// interval, or once the tracker is started again.
+func (t *Tracker) StatFlusher(ctx context.Context, w store.StatWriter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.FlushStats(w); err != nil {
+				log.Errorf("Failed to flush stats: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"time"
+)
+
+type peerListEntry struct {
+	peers    *model.CompactPeerList
+	seeders  uint
+	leechers uint
+	// Number of peers which joined, left or completed since the list was built
+	changes int
+	expires time.Time
+}
+
+// PeerCacheable checks if announces from the peer can be answered with a cached peer list.
+// Cached lists share one order for every announcing peer, so they are not used when the peers
+// returned depend on the announcing peer, which is the case with seeder bias, crypto matching
+// for peers requiring encryption and super seeding. Peers in the same country are not
+// preferred in cached lists.
+func (t *Tracker) PeerCacheable(peer *model.Peer) bool {
+	if t.PeerCacheTTL <= 0 || t.SeederBias > 0 {
+		return false
+	}
+	peer.RLock()
+	defer peer.RUnlock()
+	if t.CryptoMatching && peer.Crypto == model.CryptoRequired {
+		return false
+	}
+	return !(t.SuperSeeding && peer.SuperSeeding && peer.Seeding())
+}
+
+// CachedPeers returns the cached peer list of the torrent and the swarm counts at the time it
+// was built, or nil when there is no current list
+func (t *Tracker) CachedPeers(ih model.InfoHash) (*model.CompactPeerList, uint, uint) {
+	t.peerCacheMu.Lock()
+	entry, found := t.peerCache[ih]
+	if found && time.Now().After(entry.expires) {
+		delete(t.peerCache, ih)
+		found = false
+	}
+	t.peerCacheMu.Unlock()
+	if !found {
+		metrics.PeerCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, 0, 0
+	}
+	metrics.PeerCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return entry.peers, entry.seeders, entry.leechers
+}
+
+// CachePeers encodes the swarm in the order returned to all peers and caches it for
+// PeerCacheTTL. Swarms smaller than PeerCacheMinPeers are not cached and nil is returned.
+func (t *Tracker) CachePeers(ih model.InfoHash, peers model.Swarm) *model.CompactPeerList {
+	if t.PeerCacheTTL <= 0 || len(peers) < t.PeerCacheMinPeers {
+		return nil
+	}
+	seeders, leechers := peers.Counts()
+	list := model.NewCompactPeerList(t.OrderPeers(peers, ""))
+	t.peerCacheMu.Lock()
+	if t.peerCache == nil {
+		t.peerCache = make(map[model.InfoHash]*peerListEntry)
+	}
+	t.peerCache[ih] = &peerListEntry{
+		peers:    list,
+		seeders:  seeders,
+		leechers: leechers,
+		expires:  time.Now().Add(t.PeerCacheTTL),
+	}
+	t.peerCacheMu.Unlock()
+	return list
+}
+
+// PeerListChanged records that a peer joined, left or completed the swarm of the torrent. The
+// cached list is dropped once the changes exceed PeerCacheChurn of the cached peers.
+func (t *Tracker) PeerListChanged(ih model.InfoHash) {
+	t.peerCacheMu.Lock()
+	defer t.peerCacheMu.Unlock()
+	entry, found := t.peerCache[ih]
+	if !found {
+		return
+	}
+	entry.changes++
+	if float64(entry.changes) > t.PeerCacheChurn*float64(entry.peers.Len()) {
+		delete(t.peerCache, ih)
+	}
+}
+
+// DropPeerList removes the cached peer list of the torrent
+func (t *Tracker) DropPeerList(ih model.InfoHash) {
+	t.peerCacheMu.Lock()
+	delete(t.peerCache, ih)
+	t.peerCacheMu.Unlock()
+}
+
+// expirePeerCache removes any expired peer lists
+func (t *Tracker) expirePeerCache() {
+	now := time.Now()
+	t.peerCacheMu.Lock()
+	for ih, entry := range t.peerCache {
+		if now.After(entry.expires) {
+			delete(t.peerCache, ih)
+		}
+	}
+	t.peerCacheMu.Unlock()
+}
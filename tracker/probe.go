@@ -0,0 +1,130 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"time"
+)
+
+// probeQueueSize is the max number of peers waiting to be probed. Peers are skipped while the
+// queue is full so only a sample of the announcing peers is probed under load.
+const probeQueueSize = 1000
+
+// probeRequest is a peer waiting to have its reachability probed
+type probeRequest struct {
+	infoHash model.InfoHash
+	peerID   model.PeerID
+	addr     string
+}
+
+// key identifies the peer in the pending probes
+func (r probeRequest) key() string {
+	return r.infoHash.String() + r.peerID.String()
+}
+
+// probeAddr returns the address probed for the peer, preferring the IPv4 address. An empty
+// string is returned for peers without a usable address.
+func probeAddr(peer *model.Peer) string {
+	ip := peer.IP
+	if ip == nil {
+		ip = peer.IPv6
+	}
+	if ip == nil || peer.Port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(peer.Port)))
+}
+
+// probeChan returns the probe queue, creating it on first use. probeMu must be held.
+func (t *Tracker) probeChan() chan probeRequest {
+	if t.probeQueue == nil {
+		t.probeQueue = make(chan probeRequest, probeQueueSize)
+		t.probePending = make(map[string]struct{})
+	}
+	return t.probeQueue
+}
+
+// QueueProbe queues the peer to have its reachability probed by PeerProber when probing is
+// enabled and the peer has not been probed within ProbeInterval. This never blocks the
+// announce, the peer is skipped when the queue is full or it is already queued.
+func (t *Tracker) QueueProbe(ih model.InfoHash, peer *model.Peer) {
+	if !t.ProbePeers {
+		return
+	}
+	peer.RLock()
+	req := probeRequest{infoHash: ih, peerID: peer.PeerID, addr: probeAddr(peer)}
+	probedOn := peer.ProbedOn
+	peer.RUnlock()
+	if req.addr == "" || (!probedOn.IsZero() && time.Since(probedOn) < t.ProbeInterval) {
+		return
+	}
+	t.probeMu.Lock()
+	defer t.probeMu.Unlock()
+	queue := t.probeChan()
+	if _, queued := t.probePending[req.key()]; queued {
+		return
+	}
+	select {
+	case queue <- req:
+		t.probePending[req.key()] = struct{}{}
+	default:
+	}
+}
+
+// PeerProber probes the queued peers until the context is cancelled. At most ProbeRate probes
+// are started per second, each running in its own goroutine so slow peers do not hold up the
+// queue.
+func (t *Tracker) PeerProber(ctx context.Context) {
+	t.probeMu.Lock()
+	queue := t.probeChan()
+	t.probeMu.Unlock()
+	ticker := time.NewTicker(time.Second / time.Duration(t.ProbeRate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-queue:
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			go t.probe(req)
+		}
+	}
+}
+
+// probe attempts a tcp connection to the peer and records the result on the peer. Peers which
+// left the swarm while waiting are ignored.
+func (t *Tracker) probe(req probeRequest) {
+	connectable := false
+	conn, err := net.DialTimeout("tcp", req.addr, t.ProbeTimeout)
+	if err == nil {
+		connectable = true
+		_ = conn.Close()
+	}
+	result := "unreachable"
+	if connectable {
+		result = "connectable"
+	}
+	metrics.PeerProbesTotal.WithLabelValues(result).Inc()
+	t.probeMu.Lock()
+	delete(t.probePending, req.key())
+	t.probeMu.Unlock()
+	peer, err := t.Peers.Get(req.infoHash, req.peerID)
+	if err != nil {
+		return
+	}
+	peer.Lock()
+	peer.Connectable = connectable
+	peer.ProbedOn = time.Now()
+	peer.Unlock()
+	if err := t.Peers.Update(req.infoHash, peer); err != nil {
+		log.Errorf("Failed to save peer probe result: %s", err.Error())
+	}
+}
@@ -1,18 +1,67 @@
 package tracker
 
 import (
+	"context"
+	"encoding/hex"
+	"fmt"
 	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/model"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/leighmacdonald/mika/webhook"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	// Imported for side-effects for NewTestTracker
 	_ "github.com/leighmacdonald/mika/store/memory"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// uploadMultiplierLimit is the upper limit of the combined upload multiplier, regardless
+// of the configured max
+const uploadMultiplierLimit = 1000
+
+// Enforcement levels for the left value validation
+const (
+	LeftValidationOff    = "off"
+	LeftValidationWarn   = "warn"
+	LeftValidationReject = "reject"
+)
+
+// Handling modes of the corrupt bytes reported by clients
+const (
+	CorruptOff      = "off"
+	CorruptTrack    = "track"
+	CorruptPenalize = "penalize"
+)
+
+// CountryCounts is the number of seeders and leechers located in a single country
+type CountryCounts struct {
+	Seeders  uint `json:"seeders"`
+	Leechers uint `json:"leechers"`
+}
+
+type geoStatsEntry struct {
+	counts  map[string]CountryCounts
+	expires time.Time
+}
+
+type userCacheEntry struct {
+	user    *model.User
+	expires time.Time
+}
+
 // Tracker is the main application struct used to tie all the discreet components together
 type Tracker struct {
 	Torrents       store.TorrentStore
@@ -21,10 +70,238 @@ type Tracker struct {
 	Geodb          *geo.DB
 	AnnInterval    int
 	AnnIntervalMin int
-	MaxPeers       int
+	// AnnIntervalJitter is the +/- percentage of random jitter applied to AnnInterval
+	AnnIntervalJitter int
+	// EmptySwarmInterval is the interval returned to leechers alone in a swarm, 0 disables it
+	EmptySwarmInterval int
+	// SwarmIntervalSmall and SwarmIntervalLarge are the intervals returned for swarms of at most
+	// SwarmSizeSmall and at least SwarmSizeLarge peers, interpolated in between. 0 disables it
+	SwarmIntervalSmall int
+	SwarmIntervalLarge int
+	SwarmSizeSmall     int
+	SwarmSizeLarge     int
+	// RateLimitInterval is the minimum time between regular announces, 0 uses AnnIntervalMin
+	RateLimitInterval time.Duration
+	// RateLimitGrace is subtracted from the rate limit interval to allow for early announces
+	RateLimitGrace time.Duration
+	// MinIntervalEnforce answers regular announces sent before AnnIntervalMin without applying them
+	MinIntervalEnforce bool
+	// MinIntervalGrace is subtracted from AnnIntervalMin when checking for early announces
+	MinIntervalGrace time.Duration
+	// MaxIPConcurrency is the max number of in-flight announces per ip, 0 disables it
+	MaxIPConcurrency int
+	// IPConcurrencyCleanup is how often the counters of idle ips are removed
+	IPConcurrencyCleanup time.Duration
+	// AnnounceDedupWindow is how long announce responses are reused for identical announces,
+	// 0 disables it
+	AnnounceDedupWindow time.Duration
+	// AnnounceDedupSize is the max number of announce responses remembered
+	AnnounceDedupSize int
+	// PeerCacheTTL is how long the encoded peer lists of large swarms are reused, 0 disables it
+	PeerCacheTTL time.Duration
+	// PeerCacheMinPeers is the minimum swarm size for a peer list to be cached
+	PeerCacheMinPeers int
+	// PeerCacheChurn is the fraction of a cached peer list which may join, leave or complete
+	// before the list is dropped
+	PeerCacheChurn float64
+	// ActivityInterval is how often the counted announce and scrape requests are written to the
+	// torrent store activity rankings. 0 disables counting
+	ActivityInterval time.Duration
+	// ActivityHalfLife is the time it takes the recent activity counts to decay by half
+	ActivityHalfLife time.Duration
+	// PruneInactive is the default period without announces after which torrents are pruned
+	PruneInactive time.Duration
+	// ProbePeers enables probing the reachability of announcing peers in the background
+	ProbePeers bool
+	// ProbeInterval is how long a probe result is kept before the peer is probed again
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for the probe connection to be accepted
+	ProbeTimeout time.Duration
+	// ProbeRate is the maximum number of probes started per second
+	ProbeRate int
+	// MaxBelievableSpeed is the max upload speed in bytes/sec credited to users, 0 disables it
+	MaxBelievableSpeed uint32
+	// BonusRate is the number of bonus points credited per GB-hour seeded, 0 disables it
+	BonusRate float64
+	// BonusRequiresLeechers withholds bonus points from seeders of swarms without leechers
+	BonusRequiresLeechers bool
+	// RejectClientMsg is the failure reason returned to non-whitelisted clients
+	RejectClientMsg string
+	// UnregisteredMsg is the failure reason returned for unknown or deleted torrents
+	UnregisteredMsg string
+	// DeprecatedClients are peer_id prefixes of allowed clients which are sent DeprecatedClientMsg
+	DeprecatedClients   []string
+	DeprecatedClientMsg string
+	// ClientUserAgents are the User-Agent patterns required for peer_id prefixes
+	ClientUserAgents []UserAgentRule
+	// ClientUserAgentStrict rejects User-Agent mismatches instead of flagging them
+	ClientUserAgentStrict bool
+	// ShufflePeers randomizes the order of peers returned to clients
+	ShufflePeers bool
+	// SeederBias is the proportion of peers returned to leechers which should be seeders
+	SeederBias float64
+	// SuperSeeding hands super seeding peers a rotating subset of the leechers
+	SuperSeeding bool
+	// SuperSeedingPeers is the max number of leechers handed to a super seeding peer
+	SuperSeedingPeers int
+	// CryptoMatching returns peers supporting protocol encryption first to peers requiring it
+	CryptoMatching bool
+	// CryptoStrict drops peers without protocol encryption support instead of using them to
+	// fill the response
+	CryptoStrict bool
+	// PortMin and PortMax define the range of ports peers may announce
+	PortMin uint16
+	PortMax uint16
+	// MaxPeers is the upper limit of peers returned to a client
+	MaxPeers int
+	// ResetThreshold is the number of decreasing totals reported by a peer before it is
+	// flagged for review. 0 disables flagging
+	ResetThreshold uint32
+	// PeerHistorySize is the number of recent announces retained per peer, 0 disables it
+	PeerHistorySize int
+	// LeftValidation is one of the LeftValidation* levels applied by ValidLeft
+	LeftValidation string
+	// LeftGrace is the percentage of remaining data a new seeder may be missing
+	LeftGrace int
+	// CorruptMode is one of the Corrupt* modes applied by AccountCorrupt
+	CorruptMode string
+	// CorruptRatio is the fraction of a users downloads which may be corrupt before flagging them
+	CorruptRatio float64
+	// CorruptExclude subtracts the reported corrupt bytes from the credited downloads
+	CorruptExclude bool
+	// MaxPeersPerTorrent caps the size of a swarm, evicting the least recently announced
+	// peers to make room for new ones. 0 disables the limit
+	MaxPeersPerTorrent int
+	// MaxUserPeersPerTorrent caps the active peers a user may have in a swarm, 0 disables it
+	MaxUserPeersPerTorrent int
+	// MaxLeechers caps the leechers in a swarm for torrents without their own limit, 0 disables it
+	MaxLeechers int
+	// DownloadSlotsRetry is how long leechers rejected by the leecher limit should wait to retry
+	DownloadSlotsRetry time.Duration
+	// DefaultNumWant is the number of peers returned when numwant is not supplied
+	DefaultNumWant int
+	// ReapInterval is how often swarms are checked for stale peers
+	ReapInterval time.Duration
+	// ReapMultiplier * AnnInterval is how long a peer can go without announcing before being reaped
+	ReapMultiplier int
+	// HNRThreshold is the minimum participation time for a completed peer to not be a HNR
+	HNRThreshold time.Duration
+	// HNRWebhook delivers HNR events to a remote endpoint when configured
+	HNRWebhook *webhook.Dispatcher
+	// AuditLog records rejected requests when configured
+	AuditLog *AuditLog
+	// HookWorkers is the number of workers delivering announces to the registered hooks
+	HookWorkers int
+	// Freeleech enables freeleech for all torrents
+	Freeleech bool
+	// UploadMultiplier is applied to credited uploads on top of the per-torrent multiplier
+	UploadMultiplier float64
+	// MaxUploadMultiplier caps the combined upload multiplier
+	MaxUploadMultiplier float64
+	// TrackerID is returned to clients which should echo it back on their following announces
+	TrackerID string
+	// AllowNonCompact allows clients to request the non-compact peer list format
+	AllowNonCompact bool
+	// RequireCompact rejects announces requesting the non-compact peer list format
+	RequireCompact bool
+	// ReturnExternalIP adds the address the tracker sees the client as to announce responses
+	ReturnExternalIP bool
+	// ExternalIPString returns the external ip as a string instead of the compact form
+	ExternalIPString bool
+	// RequirePeerKey rejects announces where the key does not match the peers stored key
+	RequirePeerKey bool
+	// MinRatio is the minimum global ratio required to leech
+	MinRatio float64
+	// MinRatioGrace is the amount of bytes a user can download before MinRatio applies
+	MinRatioGrace uint64
+	// PublicAutoRegister registers unknown torrents as public on their first announce
+	PublicAutoRegister bool
+	// ScrapeAllowFull enables full scrapes when no info_hash is supplied
+	ScrapeAllowFull bool
+	// ScrapeFullLimit is the max number of torrents returned in a full scrape
+	ScrapeFullLimit int
+	// MaxURILength is the longest request URI accepted by the http tracker, 0 disables the limit
+	MaxURILength int
+	// ScrapeMaxHashes is the max number of info hashes accepted in a scrape request
+	ScrapeMaxHashes int
+	// ScrapeTruncate truncates requests over ScrapeMaxHashes instead of rejecting them
+	ScrapeTruncate bool
+	// ScrapeIncludeName adds the release name of the torrents to scrape entries
+	ScrapeIncludeName bool
+	// GeoStatsEnabled enables the per-torrent country breakdown
+	GeoStatsEnabled bool
+	// GeoStatsTTL is how long a country breakdown is cached
+	GeoStatsTTL time.Duration
+	// ASNdb resolves the autonomous system of peers, nil disables datacenter blocking
+	ASNdb *geo.ASNDB
+	// ASNBlockList contains the datacenter/hosting ASNs denied on torrents with BlockDatacenter set
+	ASNBlockList map[uint]bool
+	// ASNCacheTTL is how long the ASN of an ip is cached
+	ASNCacheTTL time.Duration
+	// UserCacheTTL is how long passkey lookups are cached, 0 disables caching
+	UserCacheTTL time.Duration
 	// Whitelist and whitelist lock
 	WhitelistMutex *sync.RWMutex
 	Whitelist      map[string]model.WhiteListClient
+	// TrustClientIP enables using the client supplied ip and ipv6 announce params
+	TrustClientIP bool
+	// TrustedProxies limits which request sources may supply their own address when not empty
+	TrustedProxies []*net.IPNet
+	// AllowPrivateIP allows peers to use private and loopback addresses
+	AllowPrivateIP bool
+	// IPOverrideAllowlist limits which clients may override their address when not empty,
+	// replacing the TrustClientIP and TrustedProxies rules
+	IPOverrideAllowlist []*net.IPNet
+	// IPOverrideReject rejects override attempts from clients outside of IPOverrideAllowlist
+	IPOverrideReject bool
+	// BanList contains the parsed IPs and CIDR ranges which are denied access and its lock
+	BanListMutex *sync.RWMutex
+	BanList      []*net.IPNet
+
+	geoStatsMu sync.Mutex
+	geoStats   map[model.InfoHash]geoStatsEntry
+
+	asnCacheMu sync.RWMutex
+	asnCache   map[string]asnCacheEntry
+
+	ipSlotsMu sync.Mutex
+	ipSlots   map[string]int
+
+	dedupMu sync.Mutex
+	dedup   map[string]dedupEntry
+
+	peerCacheMu sync.Mutex
+	peerCache   map[model.InfoHash]*peerListEntry
+
+	activityMu      sync.Mutex
+	activity        map[model.InfoHash]store.RequestCounts
+	activityFlushed time.Time
+
+	probeMu      sync.Mutex
+	probeQueue   chan probeRequest
+	probePending map[string]struct{}
+
+	userCacheMu sync.RWMutex
+	userCache   map[string]userCacheEntry
+
+	strikesMu sync.RWMutex
+	strikes   map[uint32]uint
+
+	historyMu sync.Mutex
+	history   map[historyKey][]AnnounceSample
+
+	hooks     []AnnounceHook
+	hookQueue chan hookEvent
+
+	// stateMu is held for reading by every in-flight announce so that Shutdown
+	// can wait for all in-flight announces to complete
+	stateMu  sync.RWMutex
+	closing  bool
+	inFlight int64
+
+	// livePeers is the number of peers counted across all swarms by the last reap or
+	// metrics update
+	livePeers int64
 }
 
 // New creates a new Tracker instance with configured backend stores
@@ -46,9 +323,48 @@ func New() (*Tracker, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to setup user store")
 	}
-	geodb := geo.New(viper.GetString(string(config.GeodbPath)))
+	var geodb *geo.DB
+	if geodbPath := viper.GetString(string(config.GeodbPath)); viper.GetBool(string(config.GeodbEnabled)) && geodbPath != "" {
+		geodb = geo.New(geodbPath)
+	}
+	var asndb *geo.ASNDB
+	if asnPath := viper.GetString(string(config.GeodbASNPath)); asnPath != "" {
+		asndb, err = geo.NewASN(asnPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var hnrWebhook *webhook.Dispatcher
+	if hookURL := viper.GetString(string(config.WebhookHNRURL)); hookURL != "" {
+		hnrWebhook = webhook.NewDispatcher(hookURL,
+			viper.GetString(string(config.WebhookSecret)),
+			viper.GetInt(string(config.WebhookRetries)),
+			viper.GetInt(string(config.WebhookQueueSize)))
+	}
+	var auditLog *AuditLog
+	if auditPath := viper.GetString(string(config.GeneralAuditLogPath)); auditPath != "" {
+		auditLog, err = NewAuditLog(auditPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tkr := newTracker(store.NewInstrumentedTorrentStore(s), store.NewInstrumentedPeerStore(p),
+		store.NewInstrumentedUserStore(u), geodb)
+	tkr.ASNdb = asndb
+	tkr.HNRWebhook = hnrWebhook
+	tkr.AuditLog = auditLog
+	if err := tkr.ReloadBanList(); err != nil {
+		log.Warnf("Failed to load ip ban list: %s", err.Error())
+	}
+	return tkr, nil
+}
+
+// newTracker creates a Tracker using the stores and geo database provided, with the rest of its
+// settings read from the current config. It is shared by New and NewTestTracker so both are
+// configured alike.
+func newTracker(ts store.TorrentStore, ps store.PeerStore, us store.UserStore, geodb *geo.DB) *Tracker {
 	whitelist := make(map[string]model.WhiteListClient)
-	wl, err := s.WhiteListGetAll()
+	wl, err := ts.WhiteListGetAll()
 	if err != nil {
 		log.Warnf("Whitelist empty, all clients are allowed")
 	} else {
@@ -57,16 +373,116 @@ func New() (*Tracker, error) {
 		}
 	}
 	return &Tracker{
-		Torrents:       s,
-		Peers:          p,
-		Users:          u,
-		Geodb:          geodb,
-		Whitelist:      whitelist,
-		WhitelistMutex: &sync.RWMutex{},
-		MaxPeers:       50,
-		AnnInterval:    viper.GetInt(string(config.TrackerAnnounceInterval)),
-		AnnIntervalMin: viper.GetInt(string(config.TrackerAnnounceIntervalMin)),
-	}, nil
+		Torrents:               ts,
+		Peers:                  ps,
+		Users:                  us,
+		Geodb:                  geodb,
+		Whitelist:              whitelist,
+		WhitelistMutex:         &sync.RWMutex{},
+		BanListMutex:           &sync.RWMutex{},
+		TrustClientIP:          viper.GetBool(string(config.TrackerTrustClientIP)),
+		TrustedProxies:         parseCIDRs(viper.GetStringSlice(string(config.TrackerTrustedProxies))),
+		IPOverrideAllowlist:    parseCIDRs(viper.GetStringSlice(string(config.TrackerIPOverrideAllowlist))),
+		IPOverrideReject:       viper.GetBool(string(config.TrackerIPOverrideReject)),
+		AllowPrivateIP:         viper.GetBool(string(config.TrackerAllowPrivateIP)),
+		MaxPeers:               viper.GetInt(string(config.TrackerMaxPeers)),
+		MaxPeersPerTorrent:     viper.GetInt(string(config.TrackerMaxPeersPerTorrent)),
+		MaxUserPeersPerTorrent: viper.GetInt(string(config.TrackerMaxUserPeersPerTorrent)),
+		MaxLeechers:            viper.GetInt(string(config.TrackerMaxLeechers)),
+		DownloadSlotsRetry:     viper.GetDuration(string(config.TrackerDownloadSlotsRetry)),
+		ResetThreshold:         viper.GetUint32(string(config.TrackerResetThreshold)),
+		PeerHistorySize:        viper.GetInt(string(config.TrackerPeerHistorySize)),
+		LeftValidation:         viper.GetString(string(config.TrackerLeftValidation)),
+		LeftGrace:              viper.GetInt(string(config.TrackerLeftGrace)),
+		CorruptMode:            viper.GetString(string(config.TrackerCorruptMode)),
+		CorruptRatio:           viper.GetFloat64(string(config.TrackerCorruptRatio)),
+		CorruptExclude:         viper.GetBool(string(config.TrackerCorruptExclude)),
+		DefaultNumWant:         viper.GetInt(string(config.TrackerDefaultNumWant)),
+		AnnInterval:            int(viper.GetDuration(string(config.TrackerAnnounceInterval)).Seconds()),
+		AnnIntervalMin:         int(viper.GetDuration(string(config.TrackerAnnounceIntervalMin)).Seconds()),
+		AnnIntervalJitter:      viper.GetInt(string(config.TrackerAnnounceIntervalJitter)),
+		EmptySwarmInterval:     int(viper.GetDuration(string(config.TrackerEmptySwarmInterval)).Seconds()),
+		SwarmIntervalSmall:     int(viper.GetDuration(string(config.TrackerSwarmIntervalSmall)).Seconds()),
+		SwarmIntervalLarge:     int(viper.GetDuration(string(config.TrackerSwarmIntervalLarge)).Seconds()),
+		SwarmSizeSmall:         viper.GetInt(string(config.TrackerSwarmSizeSmall)),
+		SwarmSizeLarge:         viper.GetInt(string(config.TrackerSwarmSizeLarge)),
+		RateLimitInterval:      viper.GetDuration(string(config.TrackerRateLimitInterval)),
+		RateLimitGrace:         viper.GetDuration(string(config.TrackerRateLimitGrace)),
+		MinIntervalEnforce:     viper.GetBool(string(config.TrackerMinIntervalEnforce)),
+		MinIntervalGrace:       viper.GetDuration(string(config.TrackerMinIntervalGrace)),
+		MaxIPConcurrency:       viper.GetInt(string(config.TrackerMaxIPConcurrency)),
+		AnnounceDedupWindow:    viper.GetDuration(string(config.TrackerAnnounceDedupWindow)),
+		AnnounceDedupSize:      viper.GetInt(string(config.TrackerAnnounceDedupSize)),
+		PeerCacheTTL:           viper.GetDuration(string(config.TrackerPeerCacheTTL)),
+		PeerCacheMinPeers:      viper.GetInt(string(config.TrackerPeerCacheMinPeers)),
+		PeerCacheChurn:         viper.GetFloat64(string(config.TrackerPeerCacheChurn)),
+		ActivityInterval:       viper.GetDuration(string(config.TrackerActivityInterval)),
+		ActivityHalfLife:       viper.GetDuration(string(config.TrackerActivityHalfLife)),
+		PruneInactive:          viper.GetDuration(string(config.TrackerPruneInactive)),
+		ProbePeers:             viper.GetBool(string(config.TrackerProbePeers)),
+		ProbeInterval:          viper.GetDuration(string(config.TrackerProbeInterval)),
+		ProbeTimeout:           viper.GetDuration(string(config.TrackerProbeTimeout)),
+		ProbeRate:              viper.GetInt(string(config.TrackerProbeRate)),
+		IPConcurrencyCleanup:   viper.GetDuration(string(config.TrackerIPConcurrencyCleanup)),
+		MaxBelievableSpeed:     viper.GetUint32(string(config.TrackerMaxBelievableSpeed)),
+		BonusRate:              viper.GetFloat64(string(config.TrackerBonusRate)),
+		BonusRequiresLeechers:  viper.GetBool(string(config.TrackerBonusRequiresLeechers)),
+		RejectClientMsg:        viper.GetString(string(config.TrackerRejectClientMsg)),
+		UnregisteredMsg:        viper.GetString(string(config.TrackerUnregisteredMsg)),
+		DeprecatedClients:      viper.GetStringSlice(string(config.TrackerDeprecatedClients)),
+		ClientUserAgents:       ParseUserAgentRules(viper.GetStringSlice(string(config.TrackerClientUserAgents))),
+		ClientUserAgentStrict:  viper.GetBool(string(config.TrackerClientUserAgentStrict)),
+		DeprecatedClientMsg:    viper.GetString(string(config.TrackerDeprecatedClientMsg)),
+		ShufflePeers:           viper.GetBool(string(config.TrackerShufflePeers)),
+		SeederBias:             viper.GetFloat64(string(config.TrackerSeederBias)),
+		SuperSeeding:           viper.GetBool(string(config.TrackerSuperSeeding)),
+		SuperSeedingPeers:      viper.GetInt(string(config.TrackerSuperSeedingPeers)),
+		CryptoMatching:         viper.GetBool(string(config.TrackerCryptoMatching)),
+		CryptoStrict:           viper.GetBool(string(config.TrackerCryptoStrict)),
+		HookWorkers:            viper.GetInt(string(config.TrackerHookWorkers)),
+		hookQueue:              make(chan hookEvent, viper.GetInt(string(config.TrackerHookQueueSize))),
+		PortMin:                uint16(viper.GetUint32(string(config.TrackerPortMin))),
+		PortMax:                uint16(viper.GetUint32(string(config.TrackerPortMax))),
+		HNRThreshold:           viper.GetDuration(string(config.TrackerHNRThreshold)),
+		Freeleech:              viper.GetBool(string(config.TrackerFreeleech)),
+		UploadMultiplier:       viper.GetFloat64(string(config.TrackerUploadMultiplier)),
+		MaxUploadMultiplier:    viper.GetFloat64(string(config.TrackerMaxUploadMultiplier)),
+		RequirePeerKey:         viper.GetBool(string(config.TrackerRequirePeerKey)),
+		AllowNonCompact:        viper.GetBool(string(config.TrackerAllowNonCompact)),
+		ReturnExternalIP:       viper.GetBool(string(config.TrackerReturnExternalIP)),
+		ExternalIPString:       viper.GetBool(string(config.TrackerExternalIPString)),
+		TrackerID:              trackerID(),
+		RequireCompact:         viper.GetBool(string(config.TrackerRequireCompact)),
+		ReapInterval:           viper.GetDuration(string(config.TrackerReapInterval)),
+		GeoStatsEnabled:        viper.GetBool(string(config.GeodbStatsEnabled)),
+		GeoStatsTTL:            viper.GetDuration(string(config.GeodbStatsTTL)),
+		ASNBlockList:           parseASNs(viper.GetIntSlice(string(config.GeodbASNBlockList))),
+		ASNCacheTTL:            viper.GetDuration(string(config.GeodbASNCacheTTL)),
+		UserCacheTTL:           viper.GetDuration(string(config.TrackerUserCacheTTL)),
+		ReapMultiplier:         viper.GetInt(string(config.TrackerReapMultiplier)),
+		MinRatio:               viper.GetFloat64(string(config.TrackerMinRatio)),
+		MinRatioGrace:          uint64(viper.GetInt64(string(config.TrackerMinRatioGrace))),
+		PublicAutoRegister:     viper.GetBool(string(config.TrackerPublicAutoRegister)),
+		ScrapeAllowFull:        viper.GetBool(string(config.TrackerScrapeAllowFull)),
+		ScrapeFullLimit:        viper.GetInt(string(config.TrackerScrapeFullLimit)),
+		MaxURILength:           viper.GetInt(string(config.TrackerMaxURILength)),
+		ScrapeMaxHashes:        viper.GetInt(string(config.TrackerScrapeMaxHashes)),
+		ScrapeTruncate:         viper.GetBool(string(config.TrackerScrapeTruncate)),
+		ScrapeIncludeName:      viper.GetBool(string(config.TrackerScrapeIncludeName)),
+	}
+}
+
+// trackerID returns the configured tracker id, or a random one when not configured
+func trackerID() string {
+	if id := viper.GetString(string(config.TrackerID)); id != "" {
+		return id
+	}
+	b, err := util.GenRandomBytes(8)
+	if err != nil {
+		log.Errorf("Failed to generate tracker id: %s", err.Error())
+		return ""
+	}
+	return hex.EncodeToString(b)
 }
 
 // NewTestTracker sets up a tracker with fake data for testing
@@ -109,14 +525,6 @@ func NewTestTracker() (*Tracker, []*model.Torrent, []*model.User, []*model.Peer)
 		}
 		torrents = append(torrents, t)
 	}
-	wl, err := ts.WhiteListGetAll()
-	if err != nil {
-		log.Warnf("Failed to read any client whitelists, all clients allowed")
-	}
-	wlm := make(map[string]model.WhiteListClient)
-	for _, cw := range wl {
-		wlm[cw.ClientPrefix] = cw
-	}
 	var peers []*model.Peer
 	for _, t := range torrents {
 		for i := 0; i < swarmSize; i++ {
@@ -127,15 +535,1107 @@ func NewTestTracker() (*Tracker, []*model.Torrent, []*model.User, []*model.Peer)
 			peers = append(peers, p)
 		}
 	}
-	return &Tracker{
-		Torrents:       ts,
-		Peers:          ps,
-		Users:          us,
-		Geodb:          geo.New(viper.GetString(string(config.GeodbPath))),
-		WhitelistMutex: &sync.RWMutex{},
-		Whitelist:      wlm,
-		MaxPeers:       50,
-		AnnInterval:    viper.GetInt(string(config.TrackerAnnounceInterval)),
-		AnnIntervalMin: viper.GetInt(string(config.TrackerAnnounceIntervalMin)),
-	}, torrents, users, peers
+	// The geo database is optional so tests can run without having downloaded it
+	var geodb *geo.DB
+	if geodbPath := viper.GetString(string(config.GeodbPath)); viper.GetBool(string(config.GeodbEnabled)) && geodbPath != "" {
+		if _, err := os.Stat(geodbPath); err == nil {
+			geodb = geo.New(geodbPath)
+		}
+	}
+	return newTracker(ts, ps, us, geodb), torrents, users, peers
+}
+
+// StartAnnounce registers a new in-flight announce. It returns false once Shutdown
+// has been called, in which case the announce must be rejected. FinishAnnounce must be
+// called once the announce has completed when true is returned.
+func (t *Tracker) StartAnnounce() bool {
+	t.stateMu.RLock()
+	if t.closing {
+		t.stateMu.RUnlock()
+		return false
+	}
+	atomic.AddInt64(&t.inFlight, 1)
+	return true
+}
+
+// FinishAnnounce marks a in-flight announce as completed
+func (t *Tracker) FinishAnnounce() {
+	atomic.AddInt64(&t.inFlight, -1)
+	t.stateMu.RUnlock()
+}
+
+// Shutdown stops accepting new announces and waits for any in-flight announces to finish
+// writing their peer state. Queued peer updates are then flushed before the backing stores are
+// closed. If the context expires before the in-flight announces finish the stores are left open
+// and the context error is returned.
+func (t *Tracker) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		t.stateMu.Lock()
+		t.closing = true
+		t.stateMu.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Timed out waiting for in-flight announces")
+	}
+	var closeErr error
+	flushed := 0
+	if syncer, ok := t.Peers.(store.Syncer); ok {
+		n, err := syncer.Flush()
+		if err != nil {
+			log.Errorf("Failed to flush queued peer updates: %s", err.Error())
+			closeErr = err
+		}
+		flushed = n
+	}
+	for _, s := range []interface{ Close() error }{t.Peers, t.Torrents, t.Users} {
+		if err := s.Close(); err != nil {
+			log.Errorf("Failed to close store: %s", err.Error())
+			closeErr = err
+		}
+	}
+	if t.AuditLog != nil {
+		if err := t.AuditLog.Close(); err != nil {
+			log.Errorf("Failed to close audit log: %s", err.Error())
+		}
+	}
+	log.Infof("Tracker shutdown complete, flushed %d peers", flushed)
+	return closeErr
+}
+
+// Intervals returns the announce interval with jitter applied along with the minimum interval
+// which is guaranteed to never exceed the returned interval
+func (t *Tracker) Intervals() (interval int, minInterval int) {
+	return t.intervals(t.AnnInterval)
+}
+
+// SwarmIntervals returns the announce intervals for a peer given how many other peers are
+// in its swarm. Leechers with nobody to download from are told to back off using
+// EmptySwarmInterval, seeders and peers in populated swarms receive the regular intervals,
+// scaled by the swarm size when enabled.
+func (t *Tracker) SwarmIntervals(left uint32, otherPeers int) (interval int, minInterval int) {
+	if t.EmptySwarmInterval > t.AnnInterval && left > 0 && otherPeers == 0 {
+		metrics.AnnounceEmptySwarmTotal.Inc()
+		return t.intervals(t.EmptySwarmInterval)
+	}
+	return t.intervals(t.swarmInterval(otherPeers + 1))
+}
+
+// swarmInterval returns the base announce interval for a swarm of the size. The interval is
+// linearly interpolated between SwarmIntervalSmall and SwarmIntervalLarge for swarms sized
+// between SwarmSizeSmall and SwarmSizeLarge and is never below AnnIntervalMin.
+func (t *Tracker) swarmInterval(size int) int {
+	if t.SwarmIntervalSmall <= 0 || t.SwarmIntervalLarge <= 0 || t.SwarmSizeLarge <= t.SwarmSizeSmall {
+		return t.AnnInterval
+	}
+	var interval int
+	switch {
+	case size <= t.SwarmSizeSmall:
+		interval = t.SwarmIntervalSmall
+	case size >= t.SwarmSizeLarge:
+		interval = t.SwarmIntervalLarge
+	default:
+		interval = t.SwarmIntervalSmall + (t.SwarmIntervalLarge-t.SwarmIntervalSmall)*
+			(size-t.SwarmSizeSmall)/(t.SwarmSizeLarge-t.SwarmSizeSmall)
+	}
+	if interval < t.AnnIntervalMin {
+		interval = t.AnnIntervalMin
+	}
+	return interval
+}
+
+func (t *Tracker) intervals(base int) (interval int, minInterval int) {
+	interval = base
+	if t.AnnIntervalJitter > 0 {
+		maxJitter := interval * t.AnnIntervalJitter / 100
+		if maxJitter > 0 {
+			interval += rand.Intn(maxJitter*2+1) - maxJitter
+		}
+	}
+	minInterval = t.AnnIntervalMin
+	if minInterval > interval {
+		minInterval = interval
+	}
+	return interval, minInterval
+}
+
+// LocatePeer resolves and caches the location and country of the peer using the geo database.
+// This is a no-op when the geo database is not enabled.
+func (t *Tracker) LocatePeer(peer *model.Peer) {
+	if t.Geodb == nil {
+		return
+	}
+	city, err := t.Geodb.Lookup(peer.IP)
+	if err != nil {
+		log.Debugf("Failed to locate peer: %s", err.Error())
+		return
+	}
+	peer.Lock()
+	peer.Location = city.Location
+	peer.CountryCode = city.Country.ISOCode
+	peer.Unlock()
+}
+
+// VerifyPeerKey checks the key sent with an announce against the key stored for the peer. Peers
+// without a stored key adopt the first key they send. Mismatches are only rejected when
+// RequirePeerKey is enabled since not all clients send a key.
+func (t *Tracker) VerifyPeerKey(peer *model.Peer, key string) bool {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.Key == "" {
+		peer.Key = key
+		return true
+	}
+	if !t.RequirePeerKey || peer.Key == key {
+		return true
+	}
+	log.Warnf("Rejected announce with mismatched key for peer: %s", peer.PeerID.String())
+	return false
+}
+
+// GeoStats returns the number of seeders and leechers per country for the torrent. Peers
+// without a known country are counted under "unknown". Results are cached for GeoStatsTTL.
+func (t *Tracker) GeoStats(ih model.InfoHash) (map[string]CountryCounts, error) {
+	if !t.GeoStatsEnabled {
+		return nil, consts.ErrInvalidConfig
+	}
+	t.geoStatsMu.Lock()
+	defer t.geoStatsMu.Unlock()
+	if entry, found := t.geoStats[ih]; found && time.Now().Before(entry.expires) {
+		return entry.counts, nil
+	}
+	peers, err := t.Peers.GetN(ih, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]CountryCounts)
+	for _, p := range peers {
+		p.RLock()
+		country, left := p.CountryCode, p.Left
+		p.RUnlock()
+		if country == "" {
+			country = "unknown"
+		}
+		cc := counts[country]
+		if left == 0 {
+			cc.Seeders++
+		} else {
+			cc.Leechers++
+		}
+		counts[country] = cc
+	}
+	if t.geoStats == nil {
+		t.geoStats = make(map[model.InfoHash]geoStatsEntry)
+	}
+	t.geoStats[ih] = geoStatsEntry{counts: counts, expires: time.Now().Add(t.GeoStatsTTL)}
+	return counts, nil
+}
+
+// UserByPasskey returns the valid user matching the passkey. Successful lookups are cached
+// for UserCacheTTL so changes to a user in the backing store, including deleting them, can
+// take up to UserCacheTTL to be seen by the tracker.
+func (t *Tracker) UserByPasskey(passkey string) (*model.User, error) {
+	if t.UserCacheTTL > 0 {
+		t.userCacheMu.RLock()
+		entry, found := t.userCache[passkey]
+		t.userCacheMu.RUnlock()
+		if found && time.Now().Before(entry.expires) {
+			return entry.user, nil
+		}
+	}
+	usr, err := t.Users.GetByPasskey(passkey)
+	if err != nil || !usr.Valid() {
+		if t.UserCacheTTL > 0 {
+			t.userCacheMu.Lock()
+			delete(t.userCache, passkey)
+			t.userCacheMu.Unlock()
+		}
+		return nil, consts.ErrUnauthorized
+	}
+	if t.UserCacheTTL > 0 {
+		t.userCacheMu.Lock()
+		if t.userCache == nil {
+			t.userCache = make(map[string]userCacheEntry)
+		}
+		t.userCache[passkey] = userCacheEntry{user: usr, expires: time.Now().Add(t.UserCacheTTL)}
+		t.userCacheMu.Unlock()
+	}
+	return usr, nil
+}
+
+// RateLimitWindow returns the minimum time required between regular announces of a peer, 0 or
+// less when rate limiting is disabled
+func (t *Tracker) RateLimitWindow() time.Duration {
+	minGap := t.RateLimitInterval
+	if minGap == 0 {
+		minGap = time.Duration(t.AnnIntervalMin) * time.Second
+	}
+	return minGap - t.RateLimitGrace
+}
+
+// IsRateLimited checks if the peer has announced again sooner than the rate limit interval
+// allows. This must be checked before the peer is updated as it relies on AnnounceLast. Only
+// regular and paused announces are checked, event announces and stopped announces in
+// particular must always be processed so peers leaving the swarm are removed immediately.
+// The first announce of a peer is never limited as AnnounceLast is only its creation time.
+func (t *Tracker) IsRateLimited(peer *model.Peer) bool {
+	minGap := t.RateLimitWindow()
+	if minGap <= 0 {
+		return false
+	}
+	peer.RLock()
+	last := peer.AnnounceLast
+	isNew := peer.IsNew()
+	peer.RUnlock()
+	if isNew || last.IsZero() || time.Since(last) >= minGap {
+		return false
+	}
+	metrics.AnnounceRateLimitedTotal.Inc()
+	return true
+}
+
+// IsEarlyAnnounce checks if the peer has announced again before the minimum announce interval
+// has passed when MinIntervalEnforce is enabled. Early announces should be answered with the
+// current swarm without updating the peer so they do not inflate its stats. Like
+// IsRateLimited, this must be checked before the peer is updated and never for event announces.
+func (t *Tracker) IsEarlyAnnounce(peer *model.Peer) bool {
+	if !t.MinIntervalEnforce {
+		return false
+	}
+	minGap := time.Duration(t.AnnIntervalMin)*time.Second - t.MinIntervalGrace
+	if minGap <= 0 {
+		return false
+	}
+	peer.RLock()
+	last := peer.AnnounceLast
+	peer.RUnlock()
+	if last.IsZero() || time.Since(last) >= minGap {
+		return false
+	}
+	metrics.AnnounceEarlyTotal.Inc()
+	return true
+}
+
+// AccountTransfer credits the users global transfer totals with the amounts transferred since
+// their last announce. Downloads are not counted for freeleech torrents or when global
+// freeleech is enabled, uploads always count and are multiplied by the torrent and global
+// upload multipliers.
+func (t *Tracker) AccountTransfer(usr *model.User, tor *model.Torrent, uploaded uint32, downloaded uint32) error {
+	if usr.IsAnonymous() {
+		return nil
+	}
+	tor.RLock()
+	freeleech := tor.Freeleech
+	multiUp := tor.MultiUp
+	tor.RUnlock()
+	if t.Freeleech || freeleech {
+		downloaded = 0
+	}
+	if uploaded == 0 && downloaded == 0 {
+		return nil
+	}
+	credited := uint64(uploaded)
+	if multiplier := t.UploadMultiplierFor(multiUp); multiplier != 1 {
+		credited = uint64(float64(uploaded) * multiplier)
+		log.Debugf("Applied %.2fx upload multiplier for user %d on torrent %s: %d -> %d",
+			multiplier, usr.UserID, tor.InfoHash.String(), uploaded, credited)
+	}
+	return t.Users.AddTransfer(usr, credited, uint64(downloaded))
+}
+
+// AccountSpeed updates the users speed totals with the change of a peers speeds from prevUp and
+// prevDn to up and dn. Peers leaving the swarm are passed zero speeds so their contribution is
+// removed. The totals expire once none of the users peers announce before they would be reaped.
+func (t *Tracker) AccountSpeed(userID uint32, prevUp uint32, prevDn uint32, up uint32, dn uint32) error {
+	if userID == 0 || (prevUp == up && prevDn == dn) {
+		return nil
+	}
+	ss, ok := t.Users.(store.SpeedStore)
+	if !ok {
+		return nil
+	}
+	ttl := time.Duration(t.AnnInterval*t.ReapMultiplier) * time.Second
+	return ss.AddSpeed(userID, int64(up)-int64(prevUp), int64(dn)-int64(prevDn), ttl)
+}
+
+// UserSpeed returns the users current total upload and download speeds across all of their
+// active peers
+func (t *Tracker) UserSpeed(userID uint32) (up uint64, dn uint64, err error) {
+	ss, ok := t.Users.(store.SpeedStore)
+	if !ok {
+		return 0, 0, nil
+	}
+	return ss.GetSpeed(userID)
+}
+
+// UploadMultiplierFor returns the combined global and per-torrent upload multiplier, capped at
+// MaxUploadMultiplier. Unset (zero) multipliers count as 1 and negative values are ignored.
+// Uploads are at most a uint32 per announce, so the hard upper limit of uploadMultiplierLimit
+// ensures a misconfigured multiplier can never overflow the users uint64 totals.
+func (t *Tracker) UploadMultiplierFor(torrentMultiplier float64) float64 {
+	multiplier := 1.0
+	for _, m := range []float64{t.UploadMultiplier, torrentMultiplier} {
+		if m > 0 {
+			multiplier *= m
+		}
+	}
+	if t.MaxUploadMultiplier > 0 && multiplier > t.MaxUploadMultiplier {
+		multiplier = t.MaxUploadMultiplier
+	}
+	if multiplier > uploadMultiplierLimit {
+		multiplier = uploadMultiplierLimit
+	}
+	return multiplier
+}
+
+// OrderPeers sorts the swarm into the order peers should be returned to a client located in
+// the country provided. When ShufflePeers is enabled the swarm is shuffled first, so peers
+// in the same country are still preferred but are shuffled within their group, followed by
+// the shuffled remaining peers.
+func (t *Tracker) OrderPeers(peers model.Swarm, countryCode string) model.Swarm {
+	if t.ShufflePeers {
+		peers = peers.Shuffle(rand.New(rand.NewSource(time.Now().UnixNano())))
+	}
+	// Paused peers are not actively transferring so they are only used to fill the response,
+	// followed by the peers which failed their reachability probe
+	return peers.PreferCountry(countryCode).PausedLast().UnreachableLast()
+}
+
+// BiasPeers reorders the swarm so that the first numWant peers favour the peers most useful
+// to the requesting peer. Leechers receive up to SeederBias * numWant seeders with the rest
+// filled by leechers, while seeders receive leechers first. The existing order is kept within
+// each group and either group fills in when the other runs short.
+func (t *Tracker) BiasPeers(peers model.Swarm, seeder bool, numWant int) model.Swarm {
+	if t.SeederBias <= 0 {
+		return peers
+	}
+	seeders := 0
+	if !seeder {
+		seeders = int(math.Ceil(math.Min(t.SeederBias, 1) * float64(numWant)))
+	}
+	return peers.Mix(numWant, seeders)
+}
+
+// SuperSeedPeers returns the next rotating subset of the leechers for super seeding peers
+// and advances the cursor of the peer, the cursor must be stored with the peer afterwards.
+// ok is false when the peer is not super seeding and the swarm is returned unchanged.
+func (t *Tracker) SuperSeedPeers(peers model.Swarm, peer *model.Peer, numWant int) (model.Swarm, bool) {
+	if !t.SuperSeeding {
+		return peers, false
+	}
+	peer.Lock()
+	defer peer.Unlock()
+	if !peer.SuperSeeding || !peer.Seeding() {
+		return peers, false
+	}
+	n := numWant
+	if t.SuperSeedingPeers > 0 && n > t.SuperSeedingPeers {
+		n = t.SuperSeedingPeers
+	}
+	var rotated model.Swarm
+	rotated, peer.SuperSeedCursor = peers.RotateLeechers(peer.SuperSeedCursor, n)
+	return rotated, true
+}
+
+// MatchCrypto reorders the swarm returned to peers requiring protocol encryption so peers
+// supporting it come first, falling back to the other peers when there are not enough of them.
+// With CryptoStrict set the other peers are never returned.
+func (t *Tracker) MatchCrypto(peers model.Swarm, peer *model.Peer) model.Swarm {
+	if !t.CryptoMatching || peer.Crypto != model.CryptoRequired {
+		return peers
+	}
+	return peers.CryptoFirst(t.CryptoStrict)
+}
+
+// IsValidPort checks that the port is within the allowed range. Port 0 is never valid.
+func (t *Tracker) IsValidPort(port uint16) bool {
+	return port > 0 && port >= t.PortMin && (t.PortMax == 0 || port <= t.PortMax)
+}
+
+// LimitUpload caps the upload credited for an announce when the peers upload speed exceeds
+// MaxBelievableSpeed. The raw speed is still recorded on the peer for diagnostics, but only
+// the amount which could have been uploaded at MaxBelievableSpeed is credited and a strike
+// is recorded against the user.
+func (t *Tracker) LimitUpload(usr *model.User, peer *model.Peer, ulDiff uint32) uint32 {
+	if t.MaxBelievableSpeed == 0 || ulDiff == 0 {
+		return ulDiff
+	}
+	peer.RLock()
+	speed := peer.SpeedUP
+	peer.RUnlock()
+	if speed <= t.MaxBelievableSpeed {
+		return ulDiff
+	}
+	credited := uint32(uint64(ulDiff) * uint64(t.MaxBelievableSpeed) / uint64(speed))
+	t.strikesMu.Lock()
+	if t.strikes == nil {
+		t.strikes = make(map[uint32]uint)
+	}
+	t.strikes[usr.UserID]++
+	strikes := t.strikes[usr.UserID]
+	t.strikesMu.Unlock()
+	metrics.AnnounceSpeedCappedTotal.Inc()
+	log.Warnf("Impossible upload speed from user %d: %d B/s, credited %d/%d bytes (strikes: %d)",
+		usr.UserID, speed, credited, ulDiff, strikes)
+	return credited
+}
+
+// ValidLeft sanity checks the left value of a announce against the size of the torrent. A peer
+// can never have more left than the size of the torrent, and a known leecher reporting that it
+// has become a seeder must have downloaded what it previously had left, less LeftGrace
+// percent. Seeders are not otherwise checked, as the peer which created the torrent never
+// downloads it. The peer is nil for peers new to the swarm. Returns false when the announce
+// should be rejected.
+func (t *Tracker) ValidLeft(tor *model.Torrent, peer *model.Peer, downloaded uint32, left uint32) bool {
+	if t.LeftValidation == "" || t.LeftValidation == LeftValidationOff {
+		return true
+	}
+	tor.RLock()
+	size := tor.Size
+	tor.RUnlock()
+	var reason string
+	if size > 0 && uint64(left) > size {
+		reason = fmt.Sprintf("left %d exceeds torrent size %d", left, size)
+	} else if peer != nil && left == 0 {
+		peer.RLock()
+		prevLeft, prevDownloaded := peer.Left, peer.Downloaded
+		peer.RUnlock()
+		var dlDiff uint32
+		if downloaded > prevDownloaded {
+			dlDiff = downloaded - prevDownloaded
+		}
+		required := uint64(prevLeft) * uint64(100-t.LeftGrace) / 100
+		if uint64(dlDiff) < required {
+			reason = fmt.Sprintf("seeding after downloading %d of %d bytes left", dlDiff, prevLeft)
+		}
+	}
+	if reason == "" {
+		return true
+	}
+	metrics.AnnounceInvalidLeftTotal.Inc()
+	log.Warnf("Invalid left for torrent %s: %s", tor.InfoHash.String(), reason)
+	return t.LeftValidation != LeftValidationReject
+}
+
+// FlagResets flags the peer for review once it has reported decreasing totals more than
+// ResetThreshold times. The peer is only flagged once.
+func (t *Tracker) FlagResets(peer *model.Peer) {
+	if t.ResetThreshold == 0 {
+		return
+	}
+	peer.Lock()
+	flag := !peer.Flagged && peer.Resets > t.ResetThreshold
+	if flag {
+		peer.Flagged = true
+	}
+	resets, userID := peer.Resets, peer.UserID
+	peer.Unlock()
+	if !flag {
+		return
+	}
+	metrics.PeersFlaggedTotal.Inc()
+	log.Warnf("Flagged peer %s of user %d for review after %d counter resets",
+		peer.PeerID.String(), userID, resets)
+}
+
+// tracksCorrupt returns true when the corrupt bytes reported by clients are added to the users
+// corrupt totals
+func (t *Tracker) tracksCorrupt() bool {
+	return t.CorruptMode == CorruptTrack || t.CorruptMode == CorruptPenalize
+}
+
+// ExcludeCorrupt returns the download to credit for an announce, less the corrupt bytes
+// reported since the peers previous announce when CorruptExclude is set
+func (t *Tracker) ExcludeCorrupt(dlDiff uint32, corrupt uint32) uint32 {
+	if !t.CorruptExclude {
+		return dlDiff
+	}
+	if corrupt >= dlDiff {
+		return 0
+	}
+	return dlDiff - corrupt
+}
+
+// AccountCorrupt adds the corrupt bytes reported since the peers previous announce to the
+// users corrupt total when CorruptMode is track or penalize. This must be called after the
+// download has been credited, so the user is flagged only once their total exceeds
+// CorruptRatio of their downloads.
+func (t *Tracker) AccountCorrupt(usr *model.User, corrupt uint32) error {
+	if corrupt == 0 || usr.IsAnonymous() || !t.tracksCorrupt() {
+		return nil
+	}
+	cs, ok := t.Users.(store.CorruptStore)
+	if !ok {
+		return nil
+	}
+	flagged := usr.CorruptExceeds(t.CorruptRatio)
+	if err := cs.AddCorrupt(usr, uint64(corrupt)); err != nil {
+		return err
+	}
+	if !flagged && usr.CorruptExceeds(t.CorruptRatio) {
+		metrics.UsersCorruptFlaggedTotal.Inc()
+		log.Warnf("Flagged user %d for review after reporting %d corrupt of %d downloaded bytes",
+			usr.UserID, usr.Corrupt, usr.Downloaded)
+	}
+	return nil
+}
+
+// CorruptFlagged returns true when corrupt data is tracked and the user has reported more than
+// CorruptRatio of their downloads as corrupt
+func (t *Tracker) CorruptFlagged(usr *model.User) bool {
+	return t.tracksCorrupt() && usr.CorruptExceeds(t.CorruptRatio)
+}
+
+// CorruptAllowed returns false for users flagged for corrupt data when CorruptMode is penalize.
+// Flagged users may still seed.
+func (t *Tracker) CorruptAllowed(usr *model.User) bool {
+	return t.CorruptMode != CorruptPenalize || !t.CorruptFlagged(usr)
+}
+
+// AccrueBonus credits the user with bonus points for the time the peer spent seeding since
+// its last announce, at BonusRate points per GB-hour of the torrents size. This must be called
+// before the announce is applied to the peer. The elapsed time is capped at the announce
+// interval so only the time between regular announces is credited, regardless of how
+// often or rarely the peer announces. With BonusRequiresLeechers set no points are credited
+// while the swarm has no leechers to seed to.
+func (t *Tracker) AccrueBonus(usr *model.User, tor *model.Torrent, peer *model.Peer) error {
+	if t.BonusRate <= 0 || usr.IsAnonymous() {
+		return nil
+	}
+	peer.RLock()
+	seeding := peer.Left == 0 && !peer.IsNew() && !peer.Paused
+	elapsed := time.Since(peer.AnnounceLast)
+	peer.RUnlock()
+	if !seeding || elapsed <= 0 {
+		return nil
+	}
+	if maxElapsed := time.Duration(t.AnnInterval) * time.Second; maxElapsed > 0 && elapsed > maxElapsed {
+		elapsed = maxElapsed
+	}
+	if t.BonusRequiresLeechers {
+		_, leechers, err := t.Peers.CountsOnly(tor.InfoHash)
+		if err != nil {
+			return errors.Wrap(err, "Failed to count leechers")
+		}
+		if leechers == 0 {
+			log.Debugf("Withheld bonus points from user %d, no leechers in swarm %s",
+				usr.UserID, tor.InfoHash.String())
+			return nil
+		}
+	}
+	tor.RLock()
+	size := tor.Size
+	tor.RUnlock()
+	points := t.BonusRate * float64(size) / (1 << 30) * elapsed.Hours()
+	if points <= 0 {
+		return nil
+	}
+	return t.Users.AddPoints(usr, points)
+}
+
+// Strikes returns the number of times the user has reported an impossible upload speed
+func (t *Tracker) Strikes(userID uint32) uint {
+	t.strikesMu.RLock()
+	defer t.strikesMu.RUnlock()
+	return t.strikes[userID]
+}
+
+// HNRThresholdFor returns the HNR threshold of the torrent, using HNRThreshold unless the
+// torrent overrides it
+func (t *Tracker) HNRThresholdFor(tor *model.Torrent) time.Duration {
+	if tor.HNRThreshold > 0 {
+		return time.Duration(tor.HNRThreshold) * time.Second
+	}
+	return t.HNRThreshold
+}
+
+// AddHNR records a Hit-N-Run for the peer and notifies the configured webhook if enabled
+func (t *Tracker) AddHNR(tor *model.Torrent, peer *model.Peer) {
+	peer.RLock()
+	hnr := model.HNR{
+		UserID:     peer.UserID,
+		TorrentID:  tor.TorrentID,
+		Downloaded: peer.Downloaded,
+		TotalTime:  peer.TotalTime,
+		CreatedOn:  time.Now(),
+	}
+	peer.RUnlock()
+	if hnr.UserID == 0 {
+		// Anonymous peers of public torrents can't be held accountable
+		return
+	}
+	log.Infof("HNR detected for user %d on torrent %d", hnr.UserID, hnr.TorrentID)
+	if t.HNRWebhook != nil {
+		t.HNRWebhook.Send(hnr)
+	}
+}
+
+// ReloadWhitelist re-reads the client whitelist from the torrent store and swaps it
+// in atomically so announces never see a partially loaded whitelist
+func (t *Tracker) ReloadWhitelist() error {
+	wl, err := t.Torrents.WhiteListGetAll()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read client whitelist")
+	}
+	whitelist := make(map[string]model.WhiteListClient, len(wl))
+	for _, cw := range wl {
+		whitelist[cw.ClientPrefix] = cw
+	}
+	t.WhitelistMutex.Lock()
+	t.Whitelist = whitelist
+	t.WhitelistMutex.Unlock()
+	log.Infof("Loaded %d whitelisted clients", len(whitelist))
+	return nil
+}
+
+// ReloadBanList re-reads the banned IPs and CIDR ranges from both the config and torrent store
+// and swaps in the newly parsed list. The config bans are still applied if the store fails.
+func (t *Tracker) ReloadBanList() error {
+	entries := viper.GetStringSlice(string(config.TrackerBanList))
+	stored, err := t.Torrents.BanListGetAll()
+	if err == nil {
+		entries = append(entries, stored...)
+	}
+	banList := parseCIDRs(entries)
+	t.BanListMutex.Lock()
+	t.BanList = banList
+	t.BanListMutex.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read ip ban list")
+	}
+	log.Infof("Loaded %d banned ip ranges", len(banList))
+	return nil
+}
+
+// parseCIDRs converts the single IPs and CIDR ranges into networks. Single IPs
+// are treated as a /32 or /128 network. Invalid entries are logged and skipped.
+func parseCIDRs(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Warnf("Skipping invalid ip: %s", entry)
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warnf("Skipping invalid ip range: %s", entry)
+			continue
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks
+}
+
+// IsTrustedProxy checks if the ip is within one of the trusted proxy ranges
+func (t *Tracker) IsTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range t.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptDeclaredIP checks if the address declared by a client can be used instead of the
+// address the request was received from. Declared addresses are only used when TrustClientIP
+// is enabled and, if any trusted proxies are configured, the request came from one of them.
+// Private and loopback addresses are rejected unless AllowPrivateIP is enabled.
+func (t *Tracker) AcceptDeclaredIP(remote net.IP, declared net.IP) bool {
+	if declared == nil || !t.TrustClientIP {
+		return false
+	}
+	if len(t.TrustedProxies) > 0 && !t.IsTrustedProxy(remote) {
+		return false
+	}
+	if !t.AllowPrivateIP && util.IsPrivateIP(declared) {
+		log.Warnf("Ignoring non-routable declared ip: %s", declared.String())
+		return false
+	}
+	return true
+}
+
+// AcceptIPOverride checks if the client at source may announce the declared address instead.
+// Without a IPOverrideAllowlist this applies the AcceptDeclaredIP rules to the connecting
+// address conn. Otherwise only clients within the allowlist may override their address and
+// attempts from other clients are ignored, or rejected with consts.ErrIPOverrideDenied when
+// IPOverrideReject is enabled. Declaring the source address itself is not an override.
+func (t *Tracker) AcceptIPOverride(conn net.IP, source net.IP, declared net.IP) (bool, error) {
+	if len(t.IPOverrideAllowlist) == 0 {
+		return t.AcceptDeclaredIP(conn, declared), nil
+	}
+	if declared == nil || declared.Equal(source) {
+		return false, nil
+	}
+	allowed := false
+	for _, ipNet := range t.IPOverrideAllowlist {
+		if ipNet.Contains(source) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		if t.IPOverrideReject {
+			return false, consts.ErrIPOverrideDenied
+		}
+		return false, nil
+	}
+	if !t.AllowPrivateIP && util.IsPrivateIP(declared) {
+		log.Warnf("Ignoring non-routable declared ip: %s", declared.String())
+		return false, nil
+	}
+	return true, nil
+}
+
+// IsBanned checks if the ip falls within any of the banned ranges. Rejections
+// are logged with the offending ip for auditing purposes.
+func (t *Tracker) IsBanned(ip net.IP) bool {
+	t.BanListMutex.RLock()
+	defer t.BanListMutex.RUnlock()
+	for _, ipNet := range t.BanList {
+		if ipNet.Contains(ip) {
+			log.Warnf("Rejected request from banned ip: %s", ip.String())
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidClient checks the peer_id prefix against the client whitelist, returning the name
+// of the matched client. When the whitelist is empty all clients are allowed and the
+// name is always empty.
+func (t *Tracker) IsValidClient(peerID model.PeerID) (string, bool) {
+	t.WhitelistMutex.RLock()
+	defer t.WhitelistMutex.RUnlock()
+	if len(t.Whitelist) == 0 {
+		return "", true
+	}
+	client := peerID.RawString()
+	for _, wl := range t.Whitelist {
+		if wl.Match(client) {
+			return wl.ClientName, true
+		}
+	}
+	// Only the client prefix is logged, the remainder of the peer_id is random
+	log.Debugf("Rejected non-whitelisted client prefix: %q", client[:8])
+	metrics.ClientRejectedTotal.Inc()
+	return "", false
+}
+
+// ClientWarning returns the warning message to send along with the announce response when
+// the peer_id prefix matches a deprecated client, or an empty string otherwise
+func (t *Tracker) ClientWarning(peerID model.PeerID) string {
+	client := peerID.RawString()
+	for _, prefix := range t.DeprecatedClients {
+		if prefix != "" && strings.HasPrefix(client, prefix) {
+			return t.DeprecatedClientMsg
+		}
+	}
+	return ""
+}
+
+// Ping checks that the backing stores can be reached. Stores which do not implement
+// store.Pinger are assumed to always be reachable.
+func (t *Tracker) Ping() error {
+	stores := []struct {
+		name  string
+		store interface{}
+	}{
+		{"torrent", t.Torrents},
+		{"peer", t.Peers},
+		{"user", t.Users},
+	}
+	for _, s := range stores {
+		if pinger, ok := s.store.(store.Pinger); ok {
+			if err := pinger.Ping(); err != nil {
+				return errors.Wrapf(err, "%s store unreachable", s.name)
+			}
+		}
+	}
+	return nil
+}
+
+// LastSync returns when the peer store last wrote its queued peer updates. The zero time is
+// returned when the peer store writes updates immediately.
+func (t *Tracker) LastSync() time.Time {
+	if syncer, ok := t.Peers.(store.Syncer); ok {
+		return syncer.LastSync()
+	}
+	return time.Time{}
+}
+
+// LivePeers returns the estimated number of peers across all swarms as of the last peer
+// reap or metrics update
+func (t *Tracker) LivePeers() int64 {
+	return atomic.LoadInt64(&t.livePeers)
+}
+
+// MetricsUpdater periodically recalculates the swarm wide seeder and leecher gauges
+// until the context is cancelled
+func (t *Tracker) MetricsUpdater(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.updateSwarmMetrics()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) updateSwarmMetrics() {
+	torrents, err := t.Torrents.GetN(math.MaxInt32)
+	if err != nil {
+		log.Errorf("Failed to fetch torrents for metrics: %s", err.Error())
+		return
+	}
+	var seeders, leechers uint
+	for _, torrent := range torrents {
+		peers, err := t.Peers.GetN(torrent.InfoHash, math.MaxInt32)
+		if err != nil {
+			continue
+		}
+		s, l := peers.Counts()
+		seeders += s
+		leechers += l
+	}
+	metrics.Seeders.Set(float64(seeders))
+	metrics.Leechers.Set(float64(leechers))
+	atomic.StoreInt64(&t.livePeers, int64(seeders+leechers))
+}
+
+// PeerReaper periodically removes peers from swarms which have not announced within
+// AnnInterval * ReapMultiplier. It runs until the context is cancelled.
+func (t *Tracker) PeerReaper(ctx context.Context) {
+	ticker := time.NewTicker(t.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.reapPeers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) reapPeers() {
+	maxAge := time.Duration(t.AnnInterval*t.ReapMultiplier) * time.Second
+	if maxAge <= 0 {
+		log.Warnf("Invalid peer reap age, skipping reap")
+		return
+	}
+	torrents, err := t.Torrents.GetN(math.MaxInt32)
+	if err != nil {
+		log.Errorf("Failed to fetch torrents for peer reaping: %s", err.Error())
+		return
+	}
+	expired := time.Now().Add(-maxAge)
+	reaped := 0
+	live := 0
+	for _, torrent := range torrents {
+		peers, err := t.Peers.GetN(torrent.InfoHash, math.MaxInt32)
+		if err != nil {
+			continue
+		}
+		live += len(peers)
+		// Collect first so we are not deleting from the slice we are iterating
+		var stale []*model.Peer
+		for _, peer := range peers {
+			peer.RLock()
+			lastAnnounce := peer.AnnounceLast
+			peer.RUnlock()
+			if lastAnnounce.Before(expired) {
+				stale = append(stale, peer)
+			}
+		}
+		// Deleting the peer also prunes it from the per-user peer index
+		for _, peer := range stale {
+			if err := t.Peers.Delete(torrent.InfoHash, peer); err != nil {
+				log.Errorf("Failed to reap peer: %s", err.Error())
+				continue
+			}
+			t.PeerListChanged(torrent.InfoHash)
+			if peer.IsHNR(t.HNRThresholdFor(torrent)) {
+				t.AddHNR(torrent, peer)
+			}
+			up, dn := peer.Speed()
+			if err := t.AccountSpeed(peer.UserID, up, dn, 0, 0); err != nil {
+				log.Errorf("Failed to remove reaped peer speed: %s", err.Error())
+			}
+			reaped++
+		}
+	}
+	atomic.StoreInt64(&t.livePeers, int64(live-reaped))
+	t.expireHistory(expired)
+	t.expireASNCache()
+	t.expireDedup()
+	t.expirePeerCache()
+	log.Debugf("Reaped %d stale peers", reaped)
+}
+
+// EvictPeers makes room in the swarm for a new peer when it has reached MaxPeersPerTorrent.
+// The least recently announced peers are removed first, with leechers evicted before seeders
+// which announced at the same time.
+func (t *Tracker) EvictPeers(tor *model.Torrent) {
+	if t.MaxPeersPerTorrent <= 0 {
+		return
+	}
+	seeders, leechers, err := t.Peers.CountsOnly(tor.InfoHash)
+	if err != nil || int(seeders+leechers) < t.MaxPeersPerTorrent {
+		return
+	}
+	peers, err := t.Peers.GetN(tor.InfoHash, math.MaxInt32)
+	if err != nil {
+		log.Errorf("Failed to fetch peers for eviction: %s", err.Error())
+		return
+	}
+	// The counts can include peers which are already gone from the swarm, such as peers
+	// deleted concurrently, so the number to evict is taken from the peers actually fetched
+	toEvict := len(peers) - t.MaxPeersPerTorrent + 1
+	if toEvict <= 0 {
+		return
+	}
+	type candidate struct {
+		peer         *model.Peer
+		announceLast time.Time
+		seeder       bool
+	}
+	candidates := make([]candidate, len(peers))
+	for i, peer := range peers {
+		peer.RLock()
+		candidates[i] = candidate{peer, peer.AnnounceLast, peer.Left == 0}
+		peer.RUnlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].announceLast.Equal(candidates[j].announceLast) {
+			return !candidates[i].seeder && candidates[j].seeder
+		}
+		return candidates[i].announceLast.Before(candidates[j].announceLast)
+	})
+	evicted := 0
+	for _, c := range candidates[:toEvict] {
+		if err := t.Peers.Delete(tor.InfoHash, c.peer); err != nil {
+			log.Errorf("Failed to evict peer: %s", err.Error())
+			continue
+		}
+		t.PeerListChanged(tor.InfoHash)
+		evicted++
+	}
+	metrics.PeersEvictedTotal.Add(float64(evicted))
+	log.Warnf("Swarm for %s reached max peers (%d), evicted %d peers",
+		tor.InfoHash.String(), t.MaxPeersPerTorrent, evicted)
+}
+
+// UserPeersAllowed checks if the user may add another peer to the swarm without exceeding
+// MaxUserPeersPerTorrent. The count comes from the per-user peer index of the store, and peers
+// which have gone longer than the reap age without announcing are not counted so the count
+// stays accurate between reaps. Anonymous peers of public torrents are not limited as they
+// all share the same user id.
+func (t *Tracker) UserPeersAllowed(tor *model.Torrent, userID uint32) bool {
+	if t.MaxUserPeersPerTorrent <= 0 || userID == 0 {
+		return true
+	}
+	var since time.Time
+	if maxAge := time.Duration(t.AnnInterval*t.ReapMultiplier) * time.Second; maxAge > 0 {
+		since = time.Now().Add(-maxAge)
+	}
+	active, err := t.Peers.UserPeers(tor.InfoHash, userID, since)
+	if err != nil {
+		log.Errorf("Failed to fetch peers of user %d: %s", userID, err.Error())
+		return true
+	}
+	if active < t.MaxUserPeersPerTorrent {
+		return true
+	}
+	log.Warnf("Rejected peer from user %d, already has %d active peers in swarm %s",
+		userID, active, tor.InfoHash.String())
+	metrics.AnnounceUserPeerLimitTotal.Inc()
+	return false
+}
+
+// DownloadSlotAvailable checks if a new peer may join the swarm without exceeding the leecher
+// limit of the torrent, or MaxLeechers when the torrent has no limit of its own. Seeders are
+// always allowed. The peer counts of the store are used so the check stays cheap.
+func (t *Tracker) DownloadSlotAvailable(tor *model.Torrent, left uint32) bool {
+	limit := t.MaxLeechers
+	if tor.MaxLeechers > 0 {
+		limit = int(tor.MaxLeechers)
+	}
+	if limit <= 0 || left == 0 {
+		return true
+	}
+	_, leechers, err := t.Peers.CountsOnly(tor.InfoHash)
+	if err != nil || int(leechers) < limit {
+		return true
+	}
+	log.Debugf("Rejected leecher, download slots full for swarm %s (%d/%d)",
+		tor.InfoHash.String(), leechers, limit)
+	metrics.AnnounceSlotsFullTotal.Inc()
+	return false
+}
+
+// TorrentForAnnounce returns the torrent matching the info hash. When PublicAutoRegister is
+// enabled unknown torrents are registered as public torrents instead of returning an error.
+func (t *Tracker) TorrentForAnnounce(ih model.InfoHash) (*model.Torrent, error) {
+	tor, err := t.Torrents.Get(ih)
+	if err == nil || !t.PublicAutoRegister {
+		return tor, err
+	}
+	tor = model.NewTorrent(ih, ih.String(), 0)
+	tor.Visibility = model.Public
+	if err := t.Torrents.Add(tor); err != nil {
+		if err != consts.ErrDuplicate {
+			return nil, errors.Wrap(err, "Failed to auto register public torrent")
+		}
+		// Registered by a concurrent announce, or a known deleted torrent
+		return t.Torrents.Get(ih)
+	}
+	log.Infof("Auto registered public torrent: %s", ih.String())
+	return tor, nil
+}
+
+// PeerCompleted handles a completed event for the peer. The peer is marked as a seeder and the
+// torrents snatch count is incremented. The snatch is only ever counted once per peer so clients
+// re-sending the completed event on reconnect are not double counted. The count is stored as a
+// durable counter so it is unaffected by peers leaving the swarm.
+func (t *Tracker) PeerCompleted(tor *model.Torrent, peer *model.Peer) error {
+	peer.Lock()
+	alreadyCompleted := peer.Completed
+	peer.Completed = true
+	peer.Left = 0
+	peer.Unlock()
+	if alreadyCompleted {
+		return nil
+	}
+	t.PeerListChanged(tor.InfoHash)
+	total, err := t.Torrents.IncrementCompleted(tor.InfoHash)
+	if err != nil {
+		return err
+	}
+	tor.Lock()
+	tor.TotalCompleted = total
+	tor.Unlock()
+	if peer.UserID == 0 {
+		// Anonymous peers of public torrents have no snatch list
+		return nil
+	}
+	return t.Users.AddSnatch(model.Snatch{
+		UserID:    peer.UserID,
+		InfoHash:  tor.InfoHash,
+		CreatedOn: time.Now(),
+	})
 }
@@ -1 +1,1211 @@
 package tracker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/store"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTracker_IsValidClient(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	tkr.Whitelist = map[string]model.WhiteListClient{}
+	name, valid := tkr.IsValidClient(model.PeerIDFromString("-qB4220-xxxxxxxxxxxx"))
+	require.True(t, valid)
+	require.Equal(t, "", name)
+	tkr.Whitelist["-qB"] = model.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	name, valid = tkr.IsValidClient(model.PeerIDFromString("-qB4220-xxxxxxxxxxxx"))
+	require.True(t, valid)
+	require.Equal(t, "qBittorrent", name)
+	_, valid = tkr.IsValidClient(model.PeerIDFromString("-XX0001-xxxxxxxxxxxx"))
+	require.False(t, valid)
+}
+
+func TestTracker_ReapPeers(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, peers := NewTestTracker()
+	tkr.AnnInterval = 60
+	tkr.ReapMultiplier = 2
+	stale := peers[0]
+	stale.AnnounceLast = time.Now().Add(-time.Minute * 3)
+	var total int64
+	for _, tor := range torrents {
+		swarm, err := tkr.Peers.GetN(tor.InfoHash, 1000)
+		require.NoError(t, err)
+		total += int64(len(swarm))
+	}
+	tkr.reapPeers()
+	_, err := tkr.Peers.Get(torrents[0].InfoHash, stale.PeerID)
+	require.Error(t, err)
+	_, err = tkr.Peers.Get(torrents[0].InfoHash, peers[1].PeerID)
+	require.NoError(t, err)
+	require.Equal(t, total-1, tkr.LivePeers())
+}
+
+func TestTracker_PeerCompleted(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, peers := NewTestTracker()
+	tor := torrents[0]
+	peer := peers[0]
+	peer.Left = 1000
+	completed := tor.TotalCompleted
+	require.NoError(t, tkr.PeerCompleted(tor, peer))
+	require.True(t, peer.Completed)
+	require.Equal(t, uint32(0), peer.Left)
+	require.Equal(t, completed+1, tor.TotalCompleted)
+	// Re-sending the completed event should not count twice
+	require.NoError(t, tkr.PeerCompleted(tor, peer))
+	require.Equal(t, completed+1, tor.TotalCompleted)
+	snatches, err := tkr.Users.GetSnatches(peer.UserID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(snatches))
+	require.Equal(t, tor.InfoHash, snatches[0].InfoHash)
+}
+
+func TestTracker_Intervals(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	tkr.AnnInterval = 300
+	tkr.AnnIntervalMin = 295
+	tkr.AnnIntervalJitter = 10
+	for i := 0; i < 100; i++ {
+		interval, minInterval := tkr.Intervals()
+		require.True(t, interval >= 270 && interval <= 330, "interval out of range: %d", interval)
+		require.True(t, minInterval <= interval)
+	}
+	tkr.AnnIntervalJitter = 0
+	interval, minInterval := tkr.Intervals()
+	require.Equal(t, 300, interval)
+	require.Equal(t, 295, minInterval)
+}
+
+func TestTracker_SwarmIntervals(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	tkr.AnnInterval = 300
+	tkr.AnnIntervalMin = 60
+	tkr.AnnIntervalJitter = 0
+	// Disabled by default
+	interval, minInterval := tkr.SwarmIntervals(100, 0)
+	require.Equal(t, 300, interval)
+	require.Equal(t, 60, minInterval)
+	tkr.EmptySwarmInterval = 1800
+	interval, minInterval = tkr.SwarmIntervals(100, 0)
+	require.Equal(t, 1800, interval)
+	require.Equal(t, 60, minInterval)
+	// Seeders and leechers with peers available use the regular interval
+	interval, _ = tkr.SwarmIntervals(0, 0)
+	require.Equal(t, 300, interval)
+	interval, _ = tkr.SwarmIntervals(100, 1)
+	require.Equal(t, 300, interval)
+	// The min interval never exceeds the interval returned
+	tkr.AnnIntervalMin = 3600
+	interval, minInterval = tkr.SwarmIntervals(100, 0)
+	require.Equal(t, 1800, interval)
+	require.Equal(t, 1800, minInterval)
+}
+
+func TestTracker_BiasPeers(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	var swarm model.Swarm
+	for i := 0; i < 10; i++ {
+		swarm = append(swarm, &model.Peer{Left: uint32(i % 2)})
+	}
+	require.Equal(t, swarm, tkr.BiasPeers(swarm, false, 4), "Disabled by default")
+	tkr.SeederBias = 0.75
+	seeders, leechers := tkr.BiasPeers(swarm, false, 4)[:4].Counts()
+	require.Equal(t, uint(3), seeders)
+	require.Equal(t, uint(1), leechers)
+	seeders, leechers = tkr.BiasPeers(swarm, true, 4)[:4].Counts()
+	require.Equal(t, uint(0), seeders)
+	require.Equal(t, uint(4), leechers)
+	tkr.SeederBias = 2
+	seeders, _ = tkr.BiasPeers(swarm, false, 4)[:4].Counts()
+	require.Equal(t, uint(4), seeders)
+}
+
+func TestTracker_SuperSeedPeers(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	var swarm model.Swarm
+	for i := 0; i < 10; i++ {
+		swarm = append(swarm, &model.Peer{
+			PeerID: model.PeerIDFromString(fmt.Sprintf("-XX0001-%012d", i)),
+			Left:   uint32(i % 2),
+		})
+	}
+	seeder := &model.Peer{SuperSeeding: true}
+	peers, ok := tkr.SuperSeedPeers(swarm, seeder, 50)
+	require.False(t, ok, "Disabled by default")
+	require.Equal(t, swarm, peers)
+	tkr.SuperSeeding = true
+	tkr.SuperSeedingPeers = 2
+	seen := make(map[model.PeerID]int)
+	for i := 0; i < 5; i++ {
+		peers, ok = tkr.SuperSeedPeers(swarm, seeder, 50)
+		require.True(t, ok)
+		require.Len(t, peers, 2)
+		for _, p := range peers {
+			require.False(t, p.Seeding())
+			seen[p.PeerID]++
+		}
+	}
+	// Every leecher is handed out once before any is repeated
+	require.Len(t, seen, 5)
+	for _, n := range seen {
+		require.Equal(t, 2, n)
+	}
+	// Leechers are not super seeding even when they announce it
+	leecher := &model.Peer{SuperSeeding: true, Left: 1}
+	_, ok = tkr.SuperSeedPeers(swarm, leecher, 50)
+	require.False(t, ok)
+}
+
+func TestTracker_ReloadWhitelist(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	client := model.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	require.NoError(t, tkr.Torrents.WhiteListAdd(client))
+	// Not visible until reloaded
+	_, valid := tkr.IsValidClient(peerID)
+	require.True(t, valid)
+	require.NoError(t, tkr.ReloadWhitelist())
+	_, valid = tkr.IsValidClient(peerID)
+	require.False(t, valid)
+	_, valid = tkr.IsValidClient(model.PeerIDFromString("-qB4220-123456789012"))
+	require.True(t, valid)
+}
+
+func TestTracker_ReloadBanList(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	require.False(t, tkr.IsBanned(net.ParseIP("10.1.2.3")))
+	require.NoError(t, tkr.Torrents.BanListAdd("10.0.0.0/8"))
+	require.NoError(t, tkr.Torrents.BanListAdd("192.168.1.10"))
+	require.NoError(t, tkr.Torrents.BanListAdd("2001:db8::/32"))
+	require.NoError(t, tkr.Torrents.BanListAdd("invalid"))
+	require.NoError(t, tkr.ReloadBanList())
+	require.Len(t, tkr.BanList, 3)
+	require.True(t, tkr.IsBanned(net.ParseIP("10.1.2.3")))
+	require.True(t, tkr.IsBanned(net.ParseIP("192.168.1.10")))
+	require.False(t, tkr.IsBanned(net.ParseIP("192.168.1.11")))
+	require.True(t, tkr.IsBanned(net.ParseIP("2001:db8::1")))
+	require.False(t, tkr.IsBanned(net.ParseIP("2001:db9::1")))
+}
+
+func TestTracker_Shutdown(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	require.True(t, tkr.StartAnnounce())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	// Times out while the announce is still in-flight
+	require.Error(t, tkr.Shutdown(ctx))
+	tkr.FinishAnnounce()
+	require.NoError(t, tkr.Shutdown(context.Background()))
+	require.False(t, tkr.StartAnnounce())
+}
+
+func TestTracker_AcquireIP(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	ip := net.ParseIP("12.34.56.78")
+	require.True(t, tkr.AcquireIP(ip), "Disabled by default")
+	tkr.ReleaseIP(ip)
+	tkr.MaxIPConcurrency = 2
+	require.True(t, tkr.AcquireIP(ip))
+	require.True(t, tkr.AcquireIP(ip))
+	require.False(t, tkr.AcquireIP(ip))
+	require.True(t, tkr.AcquireIP(net.ParseIP("12.34.56.79")), "Other ips are unaffected")
+	tkr.ReleaseIP(ip)
+	require.True(t, tkr.AcquireIP(ip))
+	tkr.ReleaseIP(ip)
+	tkr.ReleaseIP(ip)
+	tkr.cleanupIPSlots()
+	require.Len(t, tkr.ipSlots, 1, "Idle ips are removed")
+}
+
+func TestTracker_IsRateLimited(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	tkr.AnnIntervalMin = 60
+	tkr.RateLimitInterval = 0
+	tkr.RateLimitGrace = time.Second * 5
+	peer := peers[0]
+	peer.AnnounceLast = time.Now().Add(-time.Second * 30)
+	require.False(t, tkr.IsRateLimited(peer), "First announce")
+	peer.Announces = 1
+	peer.AnnounceLast = time.Time{}
+	require.False(t, tkr.IsRateLimited(peer))
+	peer.AnnounceLast = time.Now().Add(-time.Second * 30)
+	require.True(t, tkr.IsRateLimited(peer))
+	// Within the grace window
+	peer.AnnounceLast = time.Now().Add(-time.Second * 57)
+	require.False(t, tkr.IsRateLimited(peer))
+	tkr.RateLimitInterval = time.Second * 20
+	peer.AnnounceLast = time.Now().Add(-time.Second * 30)
+	require.False(t, tkr.IsRateLimited(peer))
+}
+
+func TestTracker_IsEarlyAnnounce(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	tkr.AnnIntervalMin = 60
+	tkr.MinIntervalGrace = time.Second * 5
+	peer := peers[0]
+	peer.AnnounceLast = time.Now().Add(-time.Second * 30)
+	require.False(t, tkr.IsEarlyAnnounce(peer), "Disabled")
+	tkr.MinIntervalEnforce = true
+	require.True(t, tkr.IsEarlyAnnounce(peer))
+	peer.AnnounceLast = time.Time{}
+	require.False(t, tkr.IsEarlyAnnounce(peer))
+	// Within the grace window
+	peer.AnnounceLast = time.Now().Add(-time.Second * 57)
+	require.False(t, tkr.IsEarlyAnnounce(peer))
+}
+
+func TestTracker_AccountTransfer(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := NewTestTracker()
+	usr := users[0]
+	tor := torrents[0]
+	require.NoError(t, tkr.AccountTransfer(usr, tor, 100, 200))
+	require.Equal(t, uint64(100), usr.Uploaded)
+	require.Equal(t, uint64(200), usr.Downloaded)
+	tor.Freeleech = true
+	require.NoError(t, tkr.AccountTransfer(usr, tor, 100, 200))
+	require.Equal(t, uint64(200), usr.Uploaded)
+	require.Equal(t, uint64(200), usr.Downloaded)
+	tor.Freeleech = false
+	tkr.Freeleech = true
+	require.NoError(t, tkr.AccountTransfer(usr, tor, 100, 200))
+	require.Equal(t, uint64(300), usr.Uploaded)
+	require.Equal(t, uint64(200), usr.Downloaded)
+}
+
+func TestTracker_AccountSpeed(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := NewTestTracker()
+	tkr.AnnInterval = 60
+	tkr.ReapMultiplier = 2
+	usr := users[0]
+	require.NoError(t, tkr.AccountSpeed(usr.UserID, 0, 0, 100, 200))
+	require.NoError(t, tkr.AccountSpeed(usr.UserID, 0, 0, 50, 0))
+	require.NoError(t, tkr.AccountSpeed(usr.UserID, 100, 200, 300, 100))
+	up, dn, err := tkr.UserSpeed(usr.UserID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(350), up)
+	require.Equal(t, uint64(100), dn)
+	// Reaped peers no longer count towards the users speed
+	stale := peers[0]
+	stale.UserID = usr.UserID
+	stale.SpeedUP = 50
+	stale.AnnounceLast = time.Now().Add(-time.Minute * 3)
+	tkr.reapPeers()
+	_, err = tkr.Peers.Get(torrents[0].InfoHash, stale.PeerID)
+	require.Error(t, err)
+	up, _, err = tkr.UserSpeed(usr.UserID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), up)
+}
+
+func TestTracker_AccountCorrupt(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := NewTestTracker()
+	tkr.CorruptRatio = 0.1
+	usr := users[0]
+	usr.Downloaded = 1000
+	usr.Corrupt = 0
+	tkr.CorruptMode = CorruptOff
+	require.NoError(t, tkr.AccountCorrupt(usr, 500))
+	require.Equal(t, uint64(0), usr.Corrupt)
+	tkr.CorruptMode = CorruptTrack
+	require.NoError(t, tkr.AccountCorrupt(usr, 100))
+	require.Equal(t, uint64(100), usr.Corrupt)
+	require.False(t, tkr.CorruptFlagged(usr))
+	require.NoError(t, tkr.AccountCorrupt(usr, 1))
+	require.True(t, tkr.CorruptFlagged(usr))
+	// Flagged users may only keep downloading when they are not penalized
+	require.True(t, tkr.CorruptAllowed(usr))
+	tkr.CorruptMode = CorruptPenalize
+	require.False(t, tkr.CorruptAllowed(usr))
+
+	require.Equal(t, uint32(100), tkr.ExcludeCorrupt(100, 10))
+	tkr.CorruptExclude = true
+	require.Equal(t, uint32(90), tkr.ExcludeCorrupt(100, 10))
+	require.Equal(t, uint32(0), tkr.ExcludeCorrupt(10, 100))
+}
+
+func TestTracker_VerifyPeerKey(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	peer := peers[0]
+	peer.Key = ""
+	require.True(t, tkr.VerifyPeerKey(peer, "ABCD1234"))
+	require.Equal(t, "ABCD1234", peer.Key)
+	// Mismatches are allowed unless enforcement is enabled
+	require.True(t, tkr.VerifyPeerKey(peer, "FFFFFFFF"))
+	tkr.RequirePeerKey = true
+	require.False(t, tkr.VerifyPeerKey(peer, "FFFFFFFF"))
+	require.False(t, tkr.VerifyPeerKey(peer, ""))
+	require.True(t, tkr.VerifyPeerKey(peer, "ABCD1234"))
+}
+
+func TestTracker_GeoStats(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	ih := torrents[0].InfoHash
+	_, err := tkr.GeoStats(ih)
+	require.Error(t, err)
+	tkr.GeoStatsEnabled = true
+	tkr.GeoStatsTTL = time.Minute
+	peers, err := tkr.Peers.GetN(ih, 100)
+	require.NoError(t, err)
+	for i, p := range peers {
+		p.Left = uint32(i % 2)
+		p.CountryCode = ""
+	}
+	peers[0].CountryCode = "CA"
+	counts, err := tkr.GeoStats(ih)
+	require.NoError(t, err)
+	require.Equal(t, CountryCounts{Seeders: 1}, counts["CA"])
+	require.Equal(t, uint(len(peers)-1), counts["unknown"].Seeders+counts["unknown"].Leechers)
+	// Cached results are returned until the ttl expires
+	peers[1].CountryCode = "US"
+	counts, err = tkr.GeoStats(ih)
+	require.NoError(t, err)
+	require.NotContains(t, counts, "US")
+	tkr.GeoStatsTTL = 0
+	tkr.geoStats = nil
+	counts, err = tkr.GeoStats(ih)
+	require.NoError(t, err)
+	require.Contains(t, counts, "US")
+}
+
+func TestTracker_AcceptDeclaredIP(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	remote := net.ParseIP("1.2.3.4")
+	declared := net.ParseIP("5.6.7.8")
+	require.False(t, tkr.AcceptDeclaredIP(remote, declared), "Untrusted by default")
+	tkr.TrustClientIP = true
+	require.True(t, tkr.AcceptDeclaredIP(remote, declared))
+	require.False(t, tkr.AcceptDeclaredIP(remote, nil))
+	require.False(t, tkr.AcceptDeclaredIP(remote, net.ParseIP("192.168.1.10")))
+	tkr.AllowPrivateIP = true
+	require.True(t, tkr.AcceptDeclaredIP(remote, net.ParseIP("192.168.1.10")))
+	tkr.TrustedProxies = parseCIDRs([]string{"10.0.0.0/8"})
+	require.False(t, tkr.AcceptDeclaredIP(remote, declared), "Remote is not a trusted proxy")
+	require.True(t, tkr.AcceptDeclaredIP(net.ParseIP("10.1.1.1"), declared))
+}
+
+func TestTracker_AcceptIPOverride(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	seedbox := net.ParseIP("203.0.113.10")
+	other := net.ParseIP("1.2.3.4")
+	declared := net.ParseIP("5.6.7.8")
+	tkr.TrustClientIP = true
+	accept, err := tkr.AcceptIPOverride(other, other, declared)
+	require.NoError(t, err)
+	require.True(t, accept, "Uses the trust rules without a allowlist")
+	tkr.IPOverrideAllowlist = parseCIDRs([]string{"203.0.113.0/24"})
+	accept, err = tkr.AcceptIPOverride(other, other, declared)
+	require.NoError(t, err)
+	require.False(t, accept, "Ignored outside of the allowlist")
+	accept, err = tkr.AcceptIPOverride(other, seedbox, declared)
+	require.NoError(t, err)
+	require.True(t, accept, "Allowlisted client behind a proxy")
+	tkr.TrustClientIP = false
+	accept, err = tkr.AcceptIPOverride(seedbox, seedbox, declared)
+	require.NoError(t, err)
+	require.True(t, accept, "Independent of TrustClientIP")
+	tkr.IPOverrideReject = true
+	_, err = tkr.AcceptIPOverride(other, other, declared)
+	require.Equal(t, consts.ErrIPOverrideDenied, err)
+	accept, err = tkr.AcceptIPOverride(other, other, other)
+	require.NoError(t, err, "Declaring the real address is not an override")
+	require.False(t, accept)
+}
+
+func TestTracker_LimitUpload(t *testing.T) {
+	config.Read("")
+	tkr, _, users, peers := NewTestTracker()
+	peer := peers[0]
+	peer.AnnounceLast = time.Now().Add(-time.Second * 10)
+	ulDiff, _ := peer.Update(peer.Uploaded+10000, peer.Downloaded, peer.Left)
+	require.Equal(t, ulDiff, tkr.LimitUpload(users[0], peer, ulDiff), "Disabled by default")
+	tkr.MaxBelievableSpeed = 500
+	require.Equal(t, uint32(5000), tkr.LimitUpload(users[0], peer, ulDiff))
+	require.Equal(t, uint32(1000), peer.SpeedUP, "Raw speed is kept")
+	require.Equal(t, uint(1), tkr.Strikes(users[0].UserID))
+	require.Equal(t, uint(0), tkr.Strikes(users[1].UserID))
+	tkr.MaxBelievableSpeed = 1000
+	require.Equal(t, ulDiff, tkr.LimitUpload(users[0], peer, ulDiff))
+	require.Equal(t, uint(1), tkr.Strikes(users[0].UserID))
+}
+
+func TestTracker_AccrueBonus(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := NewTestTracker()
+	usr := users[0]
+	tor := torrents[0]
+	tor.Size = 2 << 30
+	tkr.AnnInterval = 3600
+	peer := model.NewPeer(usr.UserID, model.PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	peer.AnnounceLast = time.Now().Add(-time.Minute * 30)
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.Equal(t, 0.0, usr.Points, "Disabled by default")
+	tkr.BonusRate = 2
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.Equal(t, 0.0, usr.Points, "New peers have not seeded yet")
+	peer.Announces = 1
+	peer.Left = 100
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.Equal(t, 0.0, usr.Points, "Leechers do not accrue points")
+	peer.Left = 0
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.InDelta(t, 2.0, usr.Points, 0.01)
+	// Time between announces beyond the announce interval is not credited
+	peer.AnnounceLast = time.Now().Add(-time.Hour * 10)
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.InDelta(t, 6.0, usr.Points, 0.01)
+	// Seeding a swarm without leechers is not rewarded when leechers are required
+	tkr.BonusRequiresLeechers = true
+	swarm, err := tkr.Peers.GetN(tor.InfoHash, 1000)
+	require.NoError(t, err)
+	for _, p := range swarm {
+		if p.Left > 0 {
+			require.NoError(t, tkr.Peers.Delete(tor.InfoHash, p))
+		}
+	}
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.InDelta(t, 6.0, usr.Points, 0.01, "No leechers")
+	leecher := model.NewPeer(users[1].UserID, model.PeerIDFromString("-XX0001-210987654321"), net.ParseIP("1.2.3.5"), 6881)
+	leecher.Left = 100
+	require.NoError(t, tkr.Peers.Add(tor.InfoHash, leecher))
+	require.NoError(t, tkr.AccrueBonus(usr, tor, peer))
+	require.InDelta(t, 10.0, usr.Points, 0.01)
+}
+
+func TestTracker_IsValidPort(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	require.False(t, tkr.IsValidPort(0))
+	require.False(t, tkr.IsValidPort(80))
+	require.True(t, tkr.IsValidPort(1024))
+	require.True(t, tkr.IsValidPort(65535))
+	tkr.PortMin = 6881
+	tkr.PortMax = 6889
+	require.False(t, tkr.IsValidPort(6880))
+	require.True(t, tkr.IsValidPort(6885))
+	require.False(t, tkr.IsValidPort(6890))
+}
+
+func TestTracker_OrderPeers(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	var swarm model.Swarm
+	for i := 0; i < 50; i++ {
+		p := &model.Peer{Port: uint16(i)}
+		if i%2 == 0 {
+			p.CountryCode = "CA"
+		}
+		swarm = append(swarm, p)
+	}
+	require.Equal(t, swarm, tkr.OrderPeers(swarm, ""), "Order is kept when disabled")
+	tkr.ShufflePeers = true
+	ordered := tkr.OrderPeers(swarm, "CA")
+	require.Equal(t, len(swarm), len(ordered))
+	require.NotEqual(t, swarm.PreferCountry("CA"), ordered)
+	for i, p := range ordered {
+		if i < 25 {
+			require.Equal(t, "CA", p.CountryCode, "Preferred country peers come first")
+		} else {
+			require.Equal(t, "", p.CountryCode)
+		}
+	}
+}
+
+type recordingHook struct {
+	name   string
+	events chan string
+}
+
+func (h recordingHook) OnAnnounce(_ *model.Peer, req *AnnounceRequest, _, _ uint64) {
+	h.events <- h.name + ":" + req.Event
+}
+
+func TestTracker_RunHooks(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	tkr.HookWorkers = 1
+	events := make(chan string, 10)
+	tkr.RegisterHook(recordingHook{"a", events})
+	tkr.RegisterHook(NoopHook{})
+	tkr.RegisterHook(recordingHook{"b", events})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tkr.StartHooks(ctx)
+	tkr.RunHooks(peers[0], &AnnounceRequest{Event: "started"}, 10, 0)
+	for _, expected := range []string{"a:started", "b:started"} {
+		select {
+		case evt := <-events:
+			require.Equal(t, expected, evt, "Hooks are called in registration order")
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for hook")
+		}
+	}
+}
+
+func TestTracker_UserByPasskey(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := NewTestTracker()
+	tkr.UserCacheTTL = time.Minute
+	usr, err := tkr.UserByPasskey(users[0].Passkey)
+	require.NoError(t, err)
+	require.Equal(t, users[0].UserID, usr.UserID)
+	_, err = tkr.UserByPasskey("xxxxxxxxxxxxxxxxxxxx")
+	require.Error(t, err)
+	require.NoError(t, tkr.Users.Delete(users[0]))
+	_, err = tkr.UserByPasskey(users[0].Passkey)
+	require.NoError(t, err, "Cached users are returned until they expire")
+	tkr.UserCacheTTL = 0
+	_, err = tkr.UserByPasskey(users[0].Passkey)
+	require.Error(t, err)
+}
+
+func TestTracker_EvictPeers(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tor := torrents[0]
+	swarm, err := tkr.Peers.GetN(tor.InfoHash, 100)
+	require.NoError(t, err)
+	now := time.Now()
+	for i, p := range swarm {
+		p.AnnounceLast = now.Add(-time.Duration(len(swarm)-i) * time.Minute)
+		p.Left = 1
+	}
+	// Tied with the leecher announcing at the same time, the seeder should be kept
+	swarm[1].AnnounceLast = swarm[2].AnnounceLast
+	swarm[1].Left = 0
+	tkr.EvictPeers(tor)
+	peers, _ := tkr.Peers.GetN(tor.InfoHash, 100)
+	require.Equal(t, len(swarm), len(peers), "Disabled by default")
+	tkr.MaxPeersPerTorrent = len(swarm) - 1
+	tkr.EvictPeers(tor)
+	remaining, err := tkr.Peers.GetN(tor.InfoHash, 100)
+	require.NoError(t, err)
+	require.Equal(t, len(swarm)-2, len(remaining), "Room is made for one new peer")
+	for _, p := range remaining {
+		require.NotEqual(t, swarm[0].PeerID, p.PeerID)
+		require.NotEqual(t, swarm[2].PeerID, p.PeerID)
+	}
+}
+
+// testStaleCountsPeerStore reports counts including peers which are no longer in the swarm, the
+// same way the redis count sets can before the stale members are removed
+type testStaleCountsPeerStore struct {
+	store.PeerStore
+	stale uint
+}
+
+func (s *testStaleCountsPeerStore) CountsOnly(ih model.InfoHash) (uint, uint, error) {
+	seeders, leechers, err := s.PeerStore.CountsOnly(ih)
+	return seeders, leechers + s.stale, err
+}
+
+func TestTracker_EvictPeersStaleCounts(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tor := torrents[0]
+	swarm, err := tkr.Peers.GetN(tor.InfoHash, 100)
+	require.NoError(t, err)
+	tkr.Peers = &testStaleCountsPeerStore{PeerStore: tkr.Peers, stale: 10}
+	tkr.MaxPeersPerTorrent = len(swarm) + 5
+	require.NotPanics(t, func() { tkr.EvictPeers(tor) })
+	peers, err := tkr.Peers.GetN(tor.InfoHash, 100)
+	require.NoError(t, err)
+	require.Equal(t, len(swarm), len(peers), "Nothing is evicted when the fetched swarm has room")
+}
+
+func TestTracker_UserPeersAllowed(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tkr.AnnInterval = 60
+	tkr.ReapMultiplier = 2
+	tor := torrents[0]
+	const userID = 9999
+	require.True(t, tkr.UserPeersAllowed(tor, userID), "Disabled by default")
+	tkr.MaxUserPeersPerTorrent = 2
+	for i := 0; i < 2; i++ {
+		p := model.NewPeer(userID, model.PeerIDFromString(fmt.Sprintf("-XX0001-00000000000%d", i)),
+			net.ParseIP("1.2.3.4"), uint16(6881+i))
+		require.True(t, tkr.UserPeersAllowed(tor, userID))
+		require.NoError(t, tkr.Peers.Add(tor.InfoHash, p))
+	}
+	require.False(t, tkr.UserPeersAllowed(tor, userID))
+	require.True(t, tkr.UserPeersAllowed(tor, userID+1), "Other users are unaffected")
+	// Peers due to be reaped no longer count
+	stale, err := tkr.Peers.Get(tor.InfoHash, model.PeerIDFromString("-XX0001-000000000000"))
+	require.NoError(t, err)
+	stale.AnnounceLast = time.Now().Add(-time.Minute * 3)
+	require.True(t, tkr.UserPeersAllowed(tor, userID))
+}
+
+func TestTracker_DatacenterAllowed(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := NewTestTracker()
+	tkr.ASNCacheTTL = time.Minute
+	tor := torrents[0]
+	usr := users[0]
+	dc := net.ParseIP("12.34.56.78")
+	home := net.ParseIP("23.45.67.89")
+	tkr.asnCache = map[string]asnCacheEntry{
+		dc.String():   {asn: 16509, expires: time.Now().Add(time.Minute)},
+		home.String(): {asn: 7922, expires: time.Now().Add(time.Minute)},
+	}
+	require.Equal(t, uint(16509), tkr.LookupASN(dc))
+	require.True(t, tkr.DatacenterAllowed(tor, usr, dc), "Disabled without a block list")
+	tkr.ASNBlockList = parseASNs([]int{16509, 0})
+	require.Len(t, tkr.ASNBlockList, 1)
+	require.True(t, tkr.DatacenterAllowed(tor, usr, dc), "Torrents allow datacenters by default")
+	tor.BlockDatacenter = true
+	require.False(t, tkr.DatacenterAllowed(tor, usr, dc))
+	require.True(t, tkr.DatacenterAllowed(tor, usr, home))
+	require.True(t, tkr.DatacenterAllowed(tor, usr, net.ParseIP("1.1.1.1")), "Unknown asn allowed")
+	usr.Seedbox = true
+	require.True(t, tkr.DatacenterAllowed(tor, usr, dc), "Seedbox users are exempt")
+	tkr.asnCache[dc.String()] = asnCacheEntry{asn: 16509, expires: time.Now().Add(-time.Second)}
+	tkr.expireASNCache()
+	require.Len(t, tkr.asnCache, 1)
+}
+
+func TestTracker_FlagResets(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	peer := peers[0]
+	peer.Resets = 3
+	tkr.FlagResets(peer)
+	require.False(t, peer.Flagged, "Disabled by default")
+	tkr.ResetThreshold = 3
+	tkr.FlagResets(peer)
+	require.False(t, peer.Flagged)
+	peer.Update(peer.Uploaded+1000, peer.Downloaded, peer.Left)
+	peer.Update(0, 0, peer.Left)
+	require.Equal(t, uint32(4), peer.Resets)
+	tkr.FlagResets(peer)
+	require.True(t, peer.Flagged)
+}
+
+func TestTracker_ValidLeft(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tor := torrents[0]
+	tor.Size = 10000
+	require.True(t, tkr.ValidLeft(tor, nil, 0, 20000), "Disabled by default")
+	tkr.LeftValidation = LeftValidationWarn
+	require.True(t, tkr.ValidLeft(tor, nil, 0, 20000), "Only logged")
+	tkr.LeftValidation = LeftValidationReject
+	require.False(t, tkr.ValidLeft(tor, nil, 0, 20000))
+	require.True(t, tkr.ValidLeft(tor, nil, 0, 10000))
+	// New seeders are not checked as the torrent creator never downloads it
+	require.True(t, tkr.ValidLeft(tor, nil, 0, 0))
+
+	peer := model.NewPeer(1, model.PeerIDFromString("-XX0001-123456789012"), nil, 6881)
+	peer.Update(0, 2000, 8000)
+	tkr.LeftGrace = 5
+	require.False(t, tkr.ValidLeft(tor, peer, 2000, 0), "Seeding without downloading")
+	require.False(t, tkr.ValidLeft(tor, peer, 9000, 0))
+	require.True(t, tkr.ValidLeft(tor, peer, 9600, 0), "Within the grace")
+	require.True(t, tkr.ValidLeft(tor, peer, 3000, 7000), "Leechers are not checked")
+}
+
+func TestTracker_AccountTransferMultiplier(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := NewTestTracker()
+	usr := users[0]
+	tor := torrents[0]
+	uploaded, downloaded := usr.Uploaded, usr.Downloaded
+	require.NoError(t, tkr.AccountTransfer(usr, tor, 1000, 500))
+	require.Equal(t, uploaded+1000, usr.Uploaded)
+	require.Equal(t, downloaded+500, usr.Downloaded)
+
+	// Multipliers stack and only apply to uploads
+	tor.MultiUp = 2
+	tkr.UploadMultiplier = 1.5
+	require.NoError(t, tkr.AccountTransfer(usr, tor, 1000, 500))
+	require.Equal(t, uploaded+4000, usr.Uploaded)
+	require.Equal(t, downloaded+1000, usr.Downloaded)
+
+	tkr.MaxUploadMultiplier = 2
+	require.Equal(t, 2.0, tkr.UploadMultiplierFor(tor.MultiUp))
+	tkr.MaxUploadMultiplier = 0
+	require.Equal(t, float64(uploadMultiplierLimit), tkr.UploadMultiplierFor(1e30))
+	tkr.UploadMultiplier = 0
+	require.Equal(t, 1.0, tkr.UploadMultiplierFor(0), "Unset multipliers are ignored")
+	require.Equal(t, 1.0, tkr.UploadMultiplierFor(-5))
+}
+
+func TestTracker_RecordAnnounce(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, peers := NewTestTracker()
+	ih := torrents[0].InfoHash
+	peer := peers[0]
+	tkr.RecordAnnounce(ih, peer)
+	require.Empty(t, tkr.PeerHistory(ih, peer.PeerID), "Disabled by default")
+	tkr.PeerHistorySize = 3
+	for i := 1; i <= 5; i++ {
+		peer.Update(uint32(i*1000), 0, 0)
+		tkr.RecordAnnounce(ih, peer)
+	}
+	history := tkr.PeerHistory(ih, peer.PeerID)
+	require.Equal(t, 3, len(history))
+	require.Equal(t, uint32(3000), history[0].Uploaded)
+	require.Equal(t, uint32(5000), history[2].Uploaded)
+	require.Empty(t, tkr.PeerHistory(torrents[1].InfoHash, peer.PeerID))
+	tkr.expireHistory(time.Now().Add(time.Minute))
+	require.Empty(t, tkr.PeerHistory(ih, peer.PeerID))
+}
+
+type testLoader struct {
+	torrents []*model.Torrent
+	users    []*model.User
+}
+
+func (l *testLoader) Torrents() ([]*model.Torrent, error) { return l.torrents, nil }
+func (l *testLoader) Users() ([]*model.User, error)       { return l.users, nil }
+func (l *testLoader) Close() error                        { return nil }
+
+func TestTracker_LoadRegistered(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := NewTestTracker()
+	existing := model.NewTorrent(torrents[0].InfoHash, "", 0)
+	existing.Size = torrents[0].Size + 1000
+	existing.Freeleech = !torrents[0].Freeleech
+	newTorrent := model.NewTorrent(model.InfoHashFromString("loader-new-torrent-1"), "", 0)
+	changedUser := &model.User{UserID: users[0].UserID, Passkey: "loaderpasskey1234567", DownloadEnabled: true}
+	newUser := &model.User{UserID: 9999, Passkey: "loaderpasskey7654321", DownloadEnabled: true}
+	l := &testLoader{
+		torrents: []*model.Torrent{existing, newTorrent},
+		users:    []*model.User{changedUser, newUser},
+	}
+	require.NoError(t, tkr.LoadRegistered(l))
+	tor, err := tkr.Torrents.Get(existing.InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, existing.Size, tor.Size)
+	require.Equal(t, existing.Freeleech, tor.Freeleech)
+	_, err = tkr.Torrents.Get(newTorrent.InfoHash)
+	require.NoError(t, err)
+	_, err = tkr.Users.GetByPasskey(changedUser.Passkey)
+	require.NoError(t, err)
+	_, err = tkr.Users.GetByPasskey(users[0].Passkey)
+	require.Error(t, err, "Old passkey should be removed")
+	_, err = tkr.Users.GetByID(newUser.UserID)
+	require.NoError(t, err)
+	// Loading again is a no-op
+	require.NoError(t, tkr.LoadRegistered(l))
+}
+
+// testStatUserStore records transfers as stat deltas the same way the redis store does
+type testStatUserStore struct {
+	store.UserStore
+	live    *store.StatDeltas
+	pending *store.StatDeltas
+}
+
+func (s *testStatUserStore) AddTransfer(u *model.User, uploaded uint64, downloaded uint64) error {
+	s.live.Uploaded[u.UserID] += uploaded
+	s.live.Downloaded[u.UserID] += downloaded
+	return s.UserStore.AddTransfer(u, uploaded, downloaded)
+}
+
+func (s *testStatUserStore) TakeStats() (*store.StatDeltas, error) {
+	if s.pending == nil {
+		s.pending, s.live = s.live, store.NewStatDeltas()
+	}
+	return s.pending, nil
+}
+
+func (s *testStatUserStore) CommitStats() error {
+	s.pending = nil
+	return nil
+}
+
+type testStatWriter struct {
+	fail    bool
+	written []*store.StatDeltas
+}
+
+func (w *testStatWriter) WriteStats(d *store.StatDeltas) (int64, error) {
+	if w.fail {
+		return 0, fmt.Errorf("write failed")
+	}
+	w.written = append(w.written, d)
+	return int64(len(d.Uploaded)), nil
+}
+
+func TestTracker_FlushStats(t *testing.T) {
+	config.Read("")
+	tkr, _, users, _ := NewTestTracker()
+	us := &testStatUserStore{UserStore: tkr.Users, live: store.NewStatDeltas()}
+	tkr.Users = us
+	w := &testStatWriter{}
+	require.NoError(t, tkr.FlushStats(w))
+	require.Len(t, w.written, 0, "Nothing to flush")
+	require.NoError(t, tkr.Users.AddTransfer(users[0], 1000, 500))
+	w.fail = true
+	require.Error(t, tkr.FlushStats(w))
+	// Transfers made while the snapshot is pending are kept for the next flush
+	require.NoError(t, tkr.Users.AddTransfer(users[0], 50, 0))
+	w.fail = false
+	require.NoError(t, tkr.FlushStats(w))
+	require.Len(t, w.written, 1)
+	require.Equal(t, uint64(1000), w.written[0].Uploaded[users[0].UserID])
+	require.Equal(t, uint64(500), w.written[0].Downloaded[users[0].UserID])
+	require.NoError(t, tkr.FlushStats(w))
+	require.Len(t, w.written, 2)
+	require.Equal(t, uint64(50), w.written[1].Uploaded[users[0].UserID])
+}
+
+func TestTracker_AnnounceDedup(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, peers := NewTestTracker()
+	key := DedupKey(1, torrents[0].InfoHash, peers[0].PeerID, "", 1000, 0)
+	tkr.RememberAnnounce(key, []byte("resp"))
+	_, found := tkr.DuplicateAnnounce(key)
+	require.False(t, found, "Disabled by default")
+	tkr.AnnounceDedupWindow = time.Minute
+	tkr.AnnounceDedupSize = 2
+	tkr.RememberAnnounce(key, []byte("resp"))
+	resp, found := tkr.DuplicateAnnounce(key)
+	require.True(t, found)
+	require.Equal(t, []byte("resp"), resp)
+	stopped := DedupKey(1, torrents[0].InfoHash, peers[0].PeerID, "stopped", 1000, 0)
+	_, found = tkr.DuplicateAnnounce(stopped)
+	require.False(t, found, "Events are part of the key")
+	tkr.RememberAnnounce(stopped, []byte("stopped"))
+	other := DedupKey(2, torrents[0].InfoHash, peers[0].PeerID, "", 1000, 0)
+	tkr.RememberAnnounce(other, []byte("other"))
+	_, found = tkr.DuplicateAnnounce(other)
+	require.False(t, found, "Not remembered when full")
+	tkr.dedup[key] = dedupEntry{response: []byte("resp"), expires: time.Now().Add(-time.Second)}
+	_, found = tkr.DuplicateAnnounce(key)
+	require.False(t, found, "Expired")
+	tkr.RememberAnnounce(other, []byte("other"))
+	_, found = tkr.DuplicateAnnounce(other)
+	require.True(t, found, "Expired entries are removed to make space")
+	tkr.expireDedup()
+	require.Len(t, tkr.dedup, 2)
+}
+
+func TestTracker_PeerCache(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	ih := torrents[0].InfoHash
+	swarm, err := tkr.Peers.GetN(ih, 1000)
+	require.NoError(t, err)
+	require.False(t, tkr.PeerCacheable(swarm[0]), "Disabled by default")
+	require.Nil(t, tkr.CachePeers(ih, swarm))
+	tkr.PeerCacheTTL = time.Minute
+	tkr.PeerCacheMinPeers = len(swarm) + 1
+	tkr.PeerCacheChurn = 0.2
+	require.True(t, tkr.PeerCacheable(swarm[0]))
+	require.Nil(t, tkr.CachePeers(ih, swarm), "Swarm too small")
+	tkr.PeerCacheMinPeers = len(swarm)
+	list := tkr.CachePeers(ih, swarm)
+	require.NotNil(t, list)
+	require.Equal(t, len(swarm), list.Len())
+	cached, seeders, leechers := tkr.CachedPeers(ih)
+	require.Equal(t, list, cached)
+	expSeeders, expLeechers := swarm.Counts()
+	require.Equal(t, expSeeders, seeders)
+	require.Equal(t, expLeechers, leechers)
+	cached, _, _ = tkr.CachedPeers(torrents[1].InfoHash)
+	require.Nil(t, cached)
+	// Up to 20% of the 10 peers may change before the list is dropped
+	tkr.PeerListChanged(ih)
+	tkr.PeerListChanged(ih)
+	cached, _, _ = tkr.CachedPeers(ih)
+	require.NotNil(t, cached)
+	tkr.PeerListChanged(ih)
+	cached, _, _ = tkr.CachedPeers(ih)
+	require.Nil(t, cached, "Too many changes")
+	tkr.CachePeers(ih, swarm)
+	tkr.peerCache[ih].expires = time.Now().Add(-time.Second)
+	cached, _, _ = tkr.CachedPeers(ih)
+	require.Nil(t, cached, "Expired")
+	tkr.CachePeers(ih, swarm)
+	tkr.CachePeers(torrents[1].InfoHash, swarm)
+	tkr.peerCache[ih].expires = time.Now().Add(-time.Second)
+	tkr.expirePeerCache()
+	require.Len(t, tkr.peerCache, 1)
+	tkr.DropPeerList(torrents[1].InfoHash)
+	require.Empty(t, tkr.peerCache)
+	tkr.SeederBias = 0.5
+	require.False(t, tkr.PeerCacheable(swarm[0]), "Seeder bias depends on the peer")
+}
+
+func TestTracker_UserAgentMatches(t *testing.T) {
+	config.Read("")
+	tkr, _, _, peers := NewTestTracker()
+	qb := model.PeerIDFromString("-qB4500-123456789012")
+	qbOld := model.PeerIDFromString("-qB3010-123456789012")
+	require.True(t, tkr.UserAgentMatches(qb, "curl/7.0"), "No rules configured")
+	tkr.ClientUserAgents = ParseUserAgentRules([]string{
+		"-qB ^qBittorrent/",
+		"-qB3 ^qBittorrent/v?3\\.",
+		"invalid",
+		"-TR [",
+	})
+	require.Len(t, tkr.ClientUserAgents, 2, "Invalid rules are skipped")
+	require.True(t, tkr.UserAgentMatches(qb, "qBittorrent/4.5.0"))
+	require.False(t, tkr.UserAgentMatches(qb, "Transmission/3.00"))
+	require.False(t, tkr.UserAgentMatches(qbOld, "qBittorrent/4.5.0"), "Longest prefix is used")
+	require.True(t, tkr.UserAgentMatches(qbOld, "qBittorrent/v3.1.0"))
+	require.True(t, tkr.UserAgentMatches(model.PeerIDFromString("-TR3000-123456789012"), "anything"))
+	peer := peers[0]
+	peer.Flagged = false
+	tkr.FlagUserAgent(peer)
+	require.True(t, peer.Flagged)
+}
+
+func TestTracker_SwarmIntervalScaling(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	tkr.AnnInterval = 300
+	tkr.AnnIntervalMin = 60
+	tkr.AnnIntervalJitter = 0
+	interval, _ := tkr.SwarmIntervals(0, 5000)
+	require.Equal(t, 300, interval, "Disabled by default")
+	tkr.SwarmIntervalSmall = 120
+	tkr.SwarmIntervalLarge = 900
+	tkr.SwarmSizeSmall = 10
+	tkr.SwarmSizeLarge = 1010
+	for _, tc := range []struct {
+		others   int
+		expected int
+	}{{0, 120}, {9, 120}, {509, 510}, {1009, 900}, {50000, 900}} {
+		interval, minInterval := tkr.SwarmIntervals(0, tc.others)
+		require.Equal(t, tc.expected, interval, tc.others)
+		require.Equal(t, 60, minInterval)
+	}
+	// Never below the min interval
+	tkr.AnnIntervalMin = 200
+	interval, minInterval := tkr.SwarmIntervals(0, 1)
+	require.Equal(t, 200, interval)
+	require.Equal(t, 200, minInterval)
+	// Leechers alone in a swarm still back off
+	tkr.EmptySwarmInterval = 1800
+	interval, _ = tkr.SwarmIntervals(100, 0)
+	require.Equal(t, 1800, interval)
+}
+
+func TestTracker_DumpRestoreState(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, peers := NewTestTracker()
+	tkr.AnnInterval = 60
+	tkr.ReapMultiplier = 3
+	stale, err := tkr.Peers.GetN(torrents[0].InfoHash, 1)
+	require.NoError(t, err)
+	require.Len(t, stale, 1)
+	stale[0].AnnounceLast = time.Now().Add(-time.Hour)
+	require.NoError(t, tkr.Peers.Update(torrents[0].InfoHash, stale[0]))
+	var buf bytes.Buffer
+	dumpedTorrents, dumpedPeers, err := tkr.DumpState(&buf)
+	require.NoError(t, err)
+	require.Equal(t, len(torrents), dumpedTorrents)
+	require.Equal(t, len(peers), dumpedPeers)
+
+	ts, err := store.NewTorrentStore("memory", config.StoreConfig{})
+	require.NoError(t, err)
+	ps, err := store.NewPeerStore("memory", config.StoreConfig{})
+	require.NoError(t, err)
+	tkr.Torrents = ts
+	tkr.Peers = ps
+	restoredTorrents, restoredPeers, skipped, err := tkr.RestoreState(&buf)
+	require.NoError(t, err)
+	require.Equal(t, len(torrents), restoredTorrents)
+	require.Equal(t, len(peers)-1, restoredPeers)
+	require.Equal(t, 1, skipped)
+	tor, err := tkr.Torrents.Get(torrents[1].InfoHash)
+	require.NoError(t, err)
+	require.Equal(t, torrents[1].ReleaseName, tor.ReleaseName)
+	_, err = tkr.Peers.Get(torrents[0].InfoHash, stale[0].PeerID)
+	require.Error(t, err, "Stale peers are not restored")
+}
+
+func TestTracker_MatchCrypto(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := NewTestTracker()
+	plain := &model.Peer{}
+	supported := &model.Peer{Crypto: model.CryptoSupported}
+	requester := &model.Peer{Crypto: model.CryptoRequired}
+	swarm := model.Swarm{plain, supported}
+	require.Equal(t, swarm, tkr.MatchCrypto(swarm, requester), "Disabled by default")
+	tkr.CryptoMatching = true
+	require.Equal(t, swarm, tkr.MatchCrypto(swarm, supported), "Only applies to peers requiring crypto")
+	require.Equal(t, model.Swarm{supported, plain}, tkr.MatchCrypto(swarm, requester))
+	tkr.CryptoStrict = true
+	require.Equal(t, model.Swarm{supported}, tkr.MatchCrypto(swarm, requester))
+}
+
+func TestTracker_Activity(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tkr.CountAnnounce(torrents[0].InfoHash)
+	require.NoError(t, tkr.FlushActivity())
+	top, err := tkr.TopTorrents(10)
+	require.NoError(t, err)
+	require.Empty(t, top, "Disabled by default")
+
+	tkr.ActivityInterval = time.Second
+	tkr.ActivityHalfLife = time.Hour
+	for i := 0; i < 4; i++ {
+		tkr.CountAnnounce(torrents[1].InfoHash)
+	}
+	tkr.CountAnnounce(torrents[2].InfoHash)
+	tkr.CountScrape(torrents[2].InfoHash)
+	tkr.CountScrape(torrents[3].InfoHash)
+	require.NoError(t, tkr.FlushActivity())
+	top, err = tkr.TopTorrents(2)
+	require.NoError(t, err)
+	require.Len(t, top, 2)
+	require.Equal(t, torrents[1].InfoHash, top[0].InfoHash)
+	require.Equal(t, int64(4), top[0].Announces)
+	require.Equal(t, torrents[2].InfoHash, top[1].InfoHash)
+	require.Equal(t, int64(1), top[1].Scrapes)
+
+	// An hour later the recent counts are halved while the totals are kept
+	tkr.activityFlushed = time.Now().Add(-time.Hour)
+	tkr.CountAnnounce(torrents[2].InfoHash)
+	require.NoError(t, tkr.FlushActivity())
+	top, err = tkr.TopTorrents(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), top[0].Announces)
+	require.InDelta(t, 2, top[0].RecentAnnounces, 0.01)
+	top, err = tkr.TopTorrents(2)
+	require.NoError(t, err)
+	require.Equal(t, torrents[2].InfoHash, top[1].InfoHash)
+	require.Equal(t, int64(2), top[1].Announces)
+	require.InDelta(t, 1.5, top[1].RecentAnnounces, 0.01)
+}
+
+func TestTracker_HNRThresholdFor(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tkr.HNRThreshold = time.Hour * 24
+	tor := torrents[0]
+	require.Equal(t, time.Hour*24, tkr.HNRThresholdFor(tor))
+	tor.HNRThreshold = 3600 * 72
+	require.Equal(t, time.Hour*72, tkr.HNRThresholdFor(tor))
+	peer := model.NewPeer(1, model.PeerIDFromString("-XX0001-123456789012"), net.ParseIP("1.2.3.4"), 6881)
+	peer.Completed = true
+	peer.TotalTime = 3600 * 48
+	require.True(t, peer.IsHNR(tkr.HNRThresholdFor(tor)), "Large torrents need more seed time")
+}
+
+func TestTracker_DownloadSlotAvailable(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tor := torrents[0]
+	leecher := model.NewPeer(1, model.PeerIDFromString("-XX0001-000000000001"), net.ParseIP("1.2.3.4"), 6881)
+	leecher.Left = 1000
+	require.NoError(t, tkr.Peers.Add(tor.InfoHash, leecher))
+	_, leechers, err := tkr.Peers.CountsOnly(tor.InfoHash)
+	require.NoError(t, err)
+	require.True(t, tkr.DownloadSlotAvailable(tor, 1000), "Disabled by default")
+	tkr.MaxLeechers = int(leechers)
+	require.False(t, tkr.DownloadSlotAvailable(tor, 1000))
+	require.True(t, tkr.DownloadSlotAvailable(tor, 0), "Seeders are never limited")
+	tor.MaxLeechers = uint32(leechers + 1)
+	require.True(t, tkr.DownloadSlotAvailable(tor, 1000), "Torrent limit overrides the global limit")
+}
+
+func TestTracker_PeerProber(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := NewTestTracker()
+	tkr.ProbePeers = true
+	tkr.ProbeInterval = time.Hour
+	tkr.ProbeTimeout = time.Second
+	tkr.ProbeRate = 1000
+	tor := torrents[0]
+	open, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = open.Close() }()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	require.NoError(t, closed.Close())
+	reachable := model.NewPeer(1, model.PeerIDFromString("-XX0001-000000000001"), net.ParseIP("127.0.0.1"),
+		uint16(open.Addr().(*net.TCPAddr).Port))
+	unreachable := model.NewPeer(1, model.PeerIDFromString("-XX0001-000000000002"), net.ParseIP("127.0.0.1"),
+		uint16(closedPort))
+	require.NoError(t, tkr.Peers.Add(tor.InfoHash, reachable))
+	require.NoError(t, tkr.Peers.Add(tor.InfoHash, unreachable))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tkr.PeerProber(ctx)
+	probed := func(peerID model.PeerID) *model.Peer {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			p, err := tkr.Peers.Get(tor.InfoHash, peerID)
+			require.NoError(t, err)
+			p.RLock()
+			done := !p.ProbedOn.IsZero()
+			p.RUnlock()
+			if done {
+				return p
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("Peer was not probed: %s", peerID.String())
+		return nil
+	}
+	tkr.QueueProbe(tor.InfoHash, reachable)
+	tkr.QueueProbe(tor.InfoHash, unreachable)
+	require.False(t, probed(reachable.PeerID).Unreachable())
+	require.True(t, probed(unreachable.PeerID).Unreachable())
+	// Recently probed peers are not queued again
+	tkr.QueueProbe(tor.InfoHash, reachable)
+	tkr.probeMu.Lock()
+	require.Empty(t, tkr.probePending)
+	tkr.probeMu.Unlock()
+}
+
+func TestAuditLog_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-audit")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "audit.log")
+	a, err := NewAuditLog(path)
+	require.NoError(t, err)
+	a.Write(AuditEntry{Reason: "Banned", Code: 492, IP: net.ParseIP("1.2.3.4")})
+	// Rotated logs are released and writing continues at the original path
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, a.Reopen())
+	a.Write(AuditEntry{Reason: "Ratio too low", Code: 491, UserID: 10})
+	require.NoError(t, a.Close())
+	rotated, err := ioutil.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(rotated, []byte("\n")))
+	require.Contains(t, string(rotated), `"ip":"1.2.3.4"`)
+	current, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(current, []byte("\n")))
+	require.Contains(t, string(current), `"user_id":10`)
+	require.NotContains(t, string(current), `"ip"`)
+}
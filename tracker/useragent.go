@@ -0,0 +1,73 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// UserAgentRule is the User-Agent pattern clients using the peer_id prefix must match
+type UserAgentRule struct {
+	Prefix  string
+	Pattern *regexp.Regexp
+}
+
+// ParseUserAgentRules parses the "<prefix> <pattern>" config entries, ordered by the longest
+// prefix first so the most specific rule is matched. Invalid entries are logged and skipped.
+func ParseUserAgentRules(entries []string) []UserAgentRule {
+	var rules []UserAgentRule
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), " ", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Errorf("Ignoring invalid client user agent rule: %q", entry)
+			continue
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Errorf("Ignoring invalid client user agent pattern %q: %s", entry, err.Error())
+			continue
+		}
+		rules = append(rules, UserAgentRule{Prefix: parts[0], Pattern: pattern})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	return rules
+}
+
+// UserAgentMatches checks the User-Agent sent by the client against the pattern of its peer_id
+// prefix. Clients without a rule always match. Mismatches are logged and counted.
+func (t *Tracker) UserAgentMatches(peerID model.PeerID, userAgent string) bool {
+	client := peerID.RawString()
+	for _, rule := range t.ClientUserAgents {
+		if !strings.HasPrefix(client, rule.Prefix) {
+			continue
+		}
+		if rule.Pattern.MatchString(userAgent) {
+			return true
+		}
+		// Only the client prefix is logged, the remainder of the peer_id is random
+		log.Warnf("User-Agent mismatch for client prefix %q: %q", client[:8], userAgent)
+		metrics.ClientUserAgentMismatchTotal.Inc()
+		return false
+	}
+	return true
+}
+
+// FlagUserAgent flags the peer for review after it announced with a User-Agent not matching
+// its peer_id. The peer is only flagged once.
+func (t *Tracker) FlagUserAgent(peer *model.Peer) {
+	peer.Lock()
+	flag := !peer.Flagged
+	peer.Flagged = true
+	userID := peer.UserID
+	peer.Unlock()
+	if !flag {
+		return
+	}
+	metrics.PeersFlaggedTotal.Inc()
+	log.Warnf("Flagged peer %s of user %d for review after a User-Agent mismatch", peer.PeerID.String(), userID)
+}
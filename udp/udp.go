@@ -0,0 +1,609 @@
+// Package udp implements the UDP tracker protocol as defined in BEP 15
+//
+// http://bittorrent.org/beps/bep_0015.html
+//
+// Authentication is handled using the URL data extension defined in BEP 41 where the
+// passkey is sent as the first path element, eg: udp://tracker:34000/<passkey>/announce
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/leighmacdonald/mika/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// protocolID is the magic constant sent with every connect request
+	protocolID uint64 = 0x41727101980
+
+	// connectionTTL is how long a issued connection id is valid for
+	connectionTTL = time.Minute * 2
+
+	// maxPacketSize is the largest datagram we will read
+	maxPacketSize = 2048
+
+	infoHashSize = 20
+)
+
+type action uint32
+
+const (
+	actionConnect action = iota
+	actionAnnounce
+	actionScrape
+	actionError
+)
+
+type event uint32
+
+const (
+	eventNone event = iota
+	eventCompleted
+	eventStarted
+	eventStopped
+	// eventPaused is defined by BEP 21 for partial seeds
+	eventPaused
+)
+
+// label returns the name used for the event in metrics
+func (e event) label() string {
+	switch e {
+	case eventCompleted:
+		return "completed"
+	case eventStarted:
+		return "started"
+	case eventStopped:
+		return "stopped"
+	case eventPaused:
+		return "paused"
+	default:
+		return "regular"
+	}
+}
+
+// BEP 41 option types
+const (
+	optionEndOfOptions byte = 0x0
+	optionNOP          byte = 0x1
+	optionURLData      byte = 0x2
+)
+
+const (
+	msgInvalidConnID    = "Invalid connection id"
+	msgInvalidAction    = "Invalid action"
+	msgMalformedRequest = "Malformed request"
+	msgInvalidAuth      = "Invalid passkey supplied"
+	msgInvalidInfoHash  = "Invalid info hash"
+	msgInvalidPort      = "Invalid port"
+	msgInvalidClient    = "Client not allowed"
+	msgRatioTooLow      = "Ratio too low"
+	msgCorruptTooHigh   = "Too much corrupt data reported"
+	msgBanned           = "Banned"
+	msgShuttingDown     = "Tracker shutting down"
+	msgRateLimited      = "Rate limited"
+	msgInvalidKey       = "Invalid key"
+	msgTorrentDisabled  = "Torrent has been disabled"
+	msgInvalidLeft      = "Invalid left"
+	msgTooManyPeers     = "Too many active peers for this torrent"
+	msgSlotsFull        = "Download slots full, retry later"
+	msgDatacenter       = "Datacenter peers are not allowed on this torrent"
+	msgAddressFamily    = "Address family not allowed on this torrent"
+	msgIPOverride       = "Not allowed to set the ip field"
+	msgGenericError     = "Internal tracker error"
+)
+
+// ErrServerClosed is returned from ListenAndServe after Shutdown has been called
+var ErrServerClosed = errors.New("udp: Server closed")
+
+// Server is the UDP interface for the tracker handling announces and scrape requests
+type Server struct {
+	t    *tracker.Tracker
+	addr string
+
+	conn    *net.UDPConn
+	closing chan struct{}
+
+	connIDsMu *sync.Mutex
+	connIDs   map[uint64]time.Time
+}
+
+// NewServer creates a new UDP tracker server which will listen on the addr supplied
+func NewServer(t *tracker.Tracker, addr string) *Server {
+	return &Server{
+		t:         t,
+		addr:      addr,
+		closing:   make(chan struct{}),
+		connIDsMu: &sync.Mutex{},
+		connIDs:   make(map[uint64]time.Time),
+	}
+}
+
+// ListenAndServe listens on the configured UDP address and handles incoming requests
+// until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to resolve udp listen address")
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen on udp address")
+	}
+	s.conn = conn
+	go s.expireConnIDs()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closing:
+				return ErrServerClosed
+			default:
+			}
+			log.Errorf("Failed to read udp packet: %s", err.Error())
+			continue
+		}
+		resp := s.handle(remote, buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(resp, remote); err != nil {
+			log.Debugf("Failed to write udp response: %s", err.Error())
+		}
+	}
+}
+
+// Shutdown stops the server from handling any further requests
+func (s *Server) Shutdown(_ context.Context) error {
+	close(s.closing)
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// expireConnIDs periodically removes any expired connection ids
+func (s *Server) expireConnIDs() {
+	t := time.NewTicker(connectionTTL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			now := time.Now()
+			s.connIDsMu.Lock()
+			for id, expires := range s.connIDs {
+				if now.After(expires) {
+					delete(s.connIDs, id)
+				}
+			}
+			s.connIDsMu.Unlock()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// newConnID generates and registers a new random connection id
+func (s *Server) newConnID() (uint64, error) {
+	b, err := util.GenRandomBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint64(b)
+	s.connIDsMu.Lock()
+	s.connIDs[id] = time.Now().Add(connectionTTL)
+	s.connIDsMu.Unlock()
+	return id, nil
+}
+
+// validConnID checks that the connection id was issued by us and has not expired
+func (s *Server) validConnID(id uint64) bool {
+	s.connIDsMu.Lock()
+	defer s.connIDsMu.Unlock()
+	expires, found := s.connIDs[id]
+	return found && time.Now().Before(expires)
+}
+
+// handle processes a single request packet and returns the response packet. A nil
+// response means that nothing should be sent back to the client.
+func (s *Server) handle(addr *net.UDPAddr, packet []byte) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(packet[0:8])
+	act := action(binary.BigEndian.Uint32(packet[8:12]))
+	txID := binary.BigEndian.Uint32(packet[12:16])
+	if s.t.IsBanned(addr.IP) {
+		return errorResponse(txID, msgBanned)
+	}
+	if act == actionConnect {
+		if connID != protocolID {
+			return nil
+		}
+		return s.connect(txID)
+	}
+	if !s.validConnID(connID) {
+		return errorResponse(txID, msgInvalidConnID)
+	}
+	switch act {
+	case actionAnnounce:
+		if !s.t.StartAnnounce() {
+			return errorResponse(txID, msgShuttingDown)
+		}
+		resp := s.announce(addr, txID, packet)
+		s.t.FinishAnnounce()
+		if action(binary.BigEndian.Uint32(resp[0:4])) == actionError {
+			metrics.AnnounceRejectedTotal.Inc()
+		} else {
+			evt := event(binary.BigEndian.Uint32(packet[80:84]))
+			metrics.AnnounceTotal.WithLabelValues(evt.label()).Inc()
+		}
+		return resp
+	case actionScrape:
+		resp := s.scrape(txID, packet)
+		if action(binary.BigEndian.Uint32(resp[0:4])) == actionScrape {
+			metrics.ScrapeTotal.Inc()
+		}
+		return resp
+	default:
+		return errorResponse(txID, msgInvalidAction)
+	}
+}
+
+func (s *Server) connect(txID uint32) []byte {
+	connID, err := s.newConnID()
+	if err != nil {
+		log.Errorf("Failed to generate connection id: %s", err.Error())
+		return errorResponse(txID, msgGenericError)
+	}
+	resp := make([]byte, 16)
+	binary.BigEndian.PutUint32(resp[0:4], uint32(actionConnect))
+	binary.BigEndian.PutUint32(resp[4:8], txID)
+	binary.BigEndian.PutUint64(resp[8:16], connID)
+	return resp
+}
+
+func (s *Server) announce(addr *net.UDPAddr, txID uint32, packet []byte) []byte {
+	if len(packet) < 98 {
+		return errorResponse(txID, msgMalformedRequest)
+	}
+	// Check that the user is valid before parsing anything else
+	passkey := parsePasskey(packet[98:])
+	if passkey == "" {
+		return errorResponse(txID, msgInvalidAuth)
+	}
+	usr, err := s.t.UserByPasskey(passkey)
+	if err != nil {
+		return errorResponse(txID, msgInvalidAuth)
+	}
+	var ih model.InfoHash
+	copy(ih[:], packet[16:36])
+	var peerID model.PeerID
+	copy(peerID[:], packet[36:56])
+	clientName, validClient := s.t.IsValidClient(peerID)
+	if !validClient {
+		if s.t.RejectClientMsg != "" {
+			return errorResponse(txID, s.t.RejectClientMsg)
+		}
+		return errorResponse(txID, msgInvalidClient)
+	}
+	downloaded := binary.BigEndian.Uint64(packet[56:64])
+	left := binary.BigEndian.Uint64(packet[64:72])
+	uploaded := binary.BigEndian.Uint64(packet[72:80])
+	evt := event(binary.BigEndian.Uint32(packet[80:84]))
+	// The 32bit key is formatted the same way most clients send it over http
+	key := fmt.Sprintf("%08X", binary.BigEndian.Uint32(packet[88:92]))
+	numWant := int32(binary.BigEndian.Uint32(packet[92:96]))
+	port := binary.BigEndian.Uint16(packet[96:98])
+	// The client supplied IP field is only used when the tracker is configured to trust it,
+	// otherwise the source address is used. A zero value means the field was not set.
+	ip := addr.IP
+	if declared := net.IP(packet[84:88]); !declared.Equal(net.IPv4zero) {
+		declared = net.IPv4(declared[0], declared[1], declared[2], declared[3])
+		accept, err := s.t.AcceptIPOverride(addr.IP, addr.IP, declared)
+		if err != nil {
+			return errorResponse(txID, msgIPOverride)
+		}
+		if accept {
+			ip = declared
+		}
+	}
+	var ipv6 net.IP
+	if ip.To4() == nil {
+		ipv6 = ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if !s.t.AllowPrivateIP && util.IsPrivateIP(ip) {
+		log.Warnf("Attempt to use non-routable IP value: %s", ip.String())
+		return errorResponse(txID, msgMalformedRequest)
+	}
+	if left > 0 && !usr.RatioAllowed(s.t.MinRatio, s.t.MinRatioGrace) {
+		return errorResponse(txID, msgRatioTooLow)
+	}
+	if left > 0 && !s.t.CorruptAllowed(usr) {
+		return errorResponse(txID, msgCorruptTooHigh)
+	}
+	if !s.t.IsValidPort(port) {
+		return errorResponse(txID, msgInvalidPort)
+	}
+	tor, err := s.t.TorrentForAnnounce(ih)
+	if err != nil || tor.IsDeleted {
+		if s.t.UnregisteredMsg != "" {
+			return errorResponse(txID, s.t.UnregisteredMsg)
+		}
+		return errorResponse(txID, msgInvalidInfoHash)
+	}
+	if !tor.IsEnabled {
+		if tor.Reason != "" {
+			return errorResponse(txID, tor.Reason)
+		}
+		return errorResponse(txID, msgTorrentDisabled)
+	}
+	if !s.t.DatacenterAllowed(tor, usr, ip) {
+		return errorResponse(txID, msgDatacenter)
+	}
+	if !tor.AddressFamily.Allows(ip, ipv6) {
+		return errorResponse(txID, msgAddressFamily)
+	}
+	// Rejected announces are not counted as activity of the torrent
+	s.t.CountAnnounce(tor.InfoHash)
+	s.t.TouchTorrent(tor)
+	peer, err := s.t.Peers.Get(tor.InfoHash, peerID)
+	if !s.t.ValidLeft(tor, peer, uint32(downloaded), uint32(left)) {
+		return errorResponse(txID, msgInvalidLeft)
+	}
+	if err != nil {
+		if !s.t.UserPeersAllowed(tor, usr.UserID) {
+			return errorResponse(txID, msgTooManyPeers)
+		}
+		if !s.t.DownloadSlotAvailable(tor, uint32(left)) {
+			return errorResponse(txID, msgSlotsFull)
+		}
+		// Create a new peer for the swarm
+		peer = model.NewPeer(usr.UserID, peerID, ip, port)
+		s.t.LocatePeer(peer)
+		peer.IPv6 = ipv6
+		peer.Key = key
+		peer.Client = clientName
+		s.t.EvictPeers(tor)
+		if err := s.t.Peers.Add(tor.InfoHash, peer); err != nil {
+			log.Errorf("Failed to insert peer into swarm: %s", err.Error())
+			return errorResponse(txID, msgGenericError)
+		}
+		s.t.PeerListChanged(tor.InfoHash)
+	} else if !s.t.VerifyPeerKey(peer, key) {
+		return errorResponse(txID, msgInvalidKey)
+	} else if (evt == eventNone || evt == eventPaused) && s.t.IsRateLimited(peer) {
+		// Only regular announces are limited, event announces are always accepted
+		return errorResponse(txID, msgRateLimited)
+	}
+	// Regular announces sent before the min interval are answered with the current swarm but
+	// not applied, so clients ignoring the min interval can not inflate their stats
+	early := err == nil && (evt == eventNone || evt == eventPaused) && s.t.IsEarlyAnnounce(peer)
+	if !early {
+		peer.UpdateAddr(ip, ipv6)
+		if err := s.t.AccrueBonus(usr, tor, peer); err != nil {
+			log.Errorf("Failed to update user bonus points: %s", err.Error())
+		}
+		prevUp, prevDn := peer.Speed()
+		ulDiff, dlDiff := peer.Update(uint32(uploaded), uint32(downloaded), uint32(left))
+		peer.UpdateHNRExempt(s.t.HNRThresholdFor(tor))
+		peer.SetPaused(evt == eventPaused)
+		s.t.FlagResets(peer)
+		s.t.RecordAnnounce(tor.InfoHash, peer)
+		ulDiff = s.t.LimitUpload(usr, peer, ulDiff)
+		if err := s.t.AccountTransfer(usr, tor, ulDiff, dlDiff); err != nil {
+			log.Errorf("Failed to update user transfer totals: %s", err.Error())
+		}
+		hookReq := &tracker.AnnounceRequest{
+			InfoHash:   tor.InfoHash,
+			PeerID:     peerID,
+			UserID:     usr.UserID,
+			Uploaded:   uploaded,
+			Downloaded: downloaded,
+			Left:       left,
+			IP:         ip,
+			Port:       port,
+		}
+		if evt != eventNone {
+			hookReq.Event = evt.label()
+		}
+		s.t.RunHooks(peer, hookReq, uint64(ulDiff), uint64(dlDiff))
+		switch evt {
+		case eventCompleted:
+			if err := s.t.PeerCompleted(tor, peer); err != nil {
+				log.Errorf("Failed to update torrent completed count: %s", err.Error())
+			}
+		case eventStopped:
+			if err := s.t.Peers.Delete(tor.InfoHash, peer); err != nil {
+				log.Errorf("Could not remove peer from swarm: %s", err.Error())
+				return errorResponse(txID, msgGenericError)
+			}
+			s.t.PeerListChanged(tor.InfoHash)
+			if peer.IsHNR(s.t.HNRThresholdFor(tor)) {
+				s.t.AddHNR(tor, peer)
+			}
+		}
+		up, dn := peer.Speed()
+		if evt == eventStopped {
+			up, dn = 0, 0
+		}
+		if err := s.t.AccountSpeed(usr.UserID, prevUp, prevDn, up, dn); err != nil {
+			log.Errorf("Failed to update user speed: %s", err.Error())
+		}
+		if evt != eventStopped {
+			if err := s.t.Peers.Update(tor.InfoHash, peer); err != nil {
+				log.Errorf("Failed to sync peer: %s", err.Error())
+			}
+			s.t.QueueProbe(tor.InfoHash, peer)
+		}
+	}
+	// A negative numwant means the client wants the default amount
+	limit := s.t.DefaultNumWant
+	if numWant >= 0 {
+		limit = int(numWant)
+	}
+	// Large swarms are answered from a shared compact peer list when the response does not
+	// depend on the announcing peer
+	cacheable := s.t.PeerCacheable(peer)
+	var (
+		peers             model.Swarm
+		cached            *model.CompactPeerList
+		seeders, leechers uint
+	)
+	if cacheable {
+		cached, seeders, leechers = s.t.CachedPeers(tor.InfoHash)
+	}
+	if cached == nil {
+		peers, err = s.t.Peers.GetN(tor.InfoHash, s.t.MaxPeers)
+		if err != nil {
+			log.Errorf("Could not read peers from swarm: %s", err.Error())
+			return errorResponse(txID, msgGenericError)
+		}
+		seeders, leechers = peers.Counts()
+		if cacheable {
+			cached = s.t.CachePeers(tor.InfoHash, peers)
+		}
+	}
+	var interval int
+	var peers4, peers6 []byte
+	if cached != nil {
+		others := cached.Len()
+		if cached.Contains(peerID) {
+			others--
+		}
+		interval, _ = s.t.SwarmIntervals(peer.Left, others)
+		peers4, peers6 = tor.AddressFamily.Filter(cached.Peers(limit, peerID))
+	} else {
+		interval, _ = s.t.SwarmIntervals(peer.Left, peers.Others(peerID))
+		// Prefer peers in the same country when the swarm is larger than what we return
+		peers = s.t.OrderPeers(peers, peer.CountryCode)
+		peers = s.t.BiasPeers(peers, peer.Seeding(), limit)
+		if limit < len(peers) {
+			peers = peers[:limit]
+		}
+		// Only the peers matching the address family of the request are returned
+		peers4, peers6 = tor.AddressFamily.Filter(model.MakeCompactPeers(peers, peerID))
+	}
+	compact := peers4
+	if addr.IP.To4() == nil {
+		compact = peers6
+	}
+	resp := make([]byte, 20, 20+len(compact))
+	binary.BigEndian.PutUint32(resp[0:4], uint32(actionAnnounce))
+	binary.BigEndian.PutUint32(resp[4:8], txID)
+	binary.BigEndian.PutUint32(resp[8:12], uint32(interval))
+	binary.BigEndian.PutUint32(resp[12:16], uint32(leechers))
+	binary.BigEndian.PutUint32(resp[16:20], uint32(seeders))
+	return append(resp, compact...)
+}
+
+func (s *Server) scrape(txID uint32, packet []byte) []byte {
+	hashes := (len(packet) - 16) / infoHashSize
+	if hashes == 0 {
+		return errorResponse(txID, msgMalformedRequest)
+	}
+	log.Debugf("Scrape request with %d/%d info hashes", hashes, s.t.ScrapeMaxHashes)
+	if hashes > s.t.ScrapeMaxHashes {
+		if !s.t.ScrapeTruncate {
+			return errorResponse(txID, msgMalformedRequest)
+		}
+		hashes = s.t.ScrapeMaxHashes
+	}
+	infoHashes := make([]model.InfoHash, hashes)
+	for i := range infoHashes {
+		offset := 16 + i*infoHashSize
+		copy(infoHashes[i][:], packet[offset:offset+infoHashSize])
+	}
+	torrents, err := s.t.Torrents.GetMulti(infoHashes)
+	if err != nil {
+		log.Errorf("Failed to fetch torrents for scrape: %s", err.Error())
+		return errorResponse(txID, msgGenericError)
+	}
+	known := make(map[model.InfoHash]*model.Torrent, len(torrents))
+	for _, torrent := range torrents {
+		known[torrent.InfoHash] = torrent
+		if torrent.IsEnabled {
+			s.t.CountScrape(torrent.InfoHash)
+		}
+	}
+	resp := make([]byte, 8, 8+hashes*12)
+	binary.BigEndian.PutUint32(resp[0:4], uint32(actionScrape))
+	binary.BigEndian.PutUint32(resp[4:8], txID)
+	for _, ih := range infoHashes {
+		// Results are positional so unknown and disabled torrents are returned as empty
+		var seeders, completed, leechers uint
+		torrent, found := known[ih]
+		if !found {
+			log.Debugf("Scrape request for invalid torrent: %s", ih)
+		} else if !torrent.IsEnabled {
+			log.Debugf("Scrape request for disabled torrent: %s", ih)
+		} else if seeders, leechers, err = s.t.Peers.CountsOnly(torrent.InfoHash); err != nil {
+			log.Debugf("Failed to get peer counts for scrape: %s", torrent.InfoHash)
+		} else {
+			completed = uint(torrent.TotalCompleted)
+		}
+		var row [12]byte
+		binary.BigEndian.PutUint32(row[0:4], uint32(seeders))
+		binary.BigEndian.PutUint32(row[4:8], uint32(completed))
+		binary.BigEndian.PutUint32(row[8:12], uint32(leechers))
+		resp = append(resp, row[:]...)
+	}
+	return resp
+}
+
+// errorResponse builds a error response packet with the message supplied
+func errorResponse(txID uint32, msg string) []byte {
+	resp := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint32(resp[0:4], uint32(actionError))
+	binary.BigEndian.PutUint32(resp[4:8], txID)
+	return append(resp, msg...)
+}
+
+// parsePasskey reads the BEP 41 options appended to a announce request and returns
+// the first path element of the URL data, which is the users passkey
+func parsePasskey(options []byte) string {
+	var urlData []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case optionEndOfOptions:
+			i = len(options)
+		case optionNOP:
+			i++
+		case optionURLData:
+			if i+1 >= len(options) {
+				return ""
+			}
+			size := int(options[i+1])
+			end := i + 2 + size
+			if end > len(options) {
+				return ""
+			}
+			urlData = append(urlData, options[i+2:end]...)
+			i = end
+		default:
+			// Unknown options are length prefixed so we can skip them
+			if i+1 >= len(options) {
+				return ""
+			}
+			i += 2 + int(options[i+1])
+		}
+	}
+	path := string(urlData)
+	if idx := strings.IndexByte(path, '?'); idx >= 0 {
+		path = path[:idx]
+	}
+	return strings.Split(strings.Trim(path, "/"), "/")[0]
+}
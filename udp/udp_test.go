@@ -0,0 +1,143 @@
+package udp
+
+import (
+	"encoding/binary"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func connect(t *testing.T, s *Server) uint64 {
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], protocolID)
+	binary.BigEndian.PutUint32(req[8:12], uint32(actionConnect))
+	binary.BigEndian.PutUint32(req[12:16], 1)
+	resp := s.handle(&net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 6881}, req)
+	require.Len(t, resp, 16)
+	require.Equal(t, uint32(actionConnect), binary.BigEndian.Uint32(resp[0:4]))
+	require.Equal(t, uint32(1), binary.BigEndian.Uint32(resp[4:8]))
+	return binary.BigEndian.Uint64(resp[8:16])
+}
+
+func TestServer_Connect(t *testing.T) {
+	config.Read("")
+	tkr, _, _, _ := tracker.NewTestTracker()
+	s := NewServer(tkr, "")
+	connID := connect(t, s)
+	require.True(t, s.validConnID(connID))
+	require.False(t, s.validConnID(connID+1))
+
+	// Bad magic value is silently dropped
+	req := make([]byte, 16)
+	require.Nil(t, s.handle(&net.UDPAddr{IP: net.ParseIP("1.1.1.1")}, req))
+}
+
+func TestServer_Announce(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, peers := tracker.NewTestTracker()
+	s := NewServer(tkr, "")
+	addr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 6881}
+	connID := connect(t, s)
+	newReq := func(passkey string) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], uint32(actionAnnounce))
+		binary.BigEndian.PutUint32(req[12:16], 2)
+		copy(req[16:36], torrents[0].InfoHash[:])
+		copy(req[36:56], peers[0].PeerID[:])
+		binary.BigEndian.PutUint64(req[64:72], 1000)
+		binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+		binary.BigEndian.PutUint16(req[96:98], 6881)
+		path := "/" + passkey + "/announce"
+		req = append(req, optionURLData, byte(len(path)))
+		return append(req, path...)
+	}
+	resp := s.handle(addr, newReq(users[0].Passkey))
+	require.True(t, len(resp) >= 20)
+	require.Equal(t, uint32(actionAnnounce), binary.BigEndian.Uint32(resp[0:4]), string(resp[8:]))
+	require.Equal(t, uint32(2), binary.BigEndian.Uint32(resp[4:8]))
+	require.Equal(t, 0, (len(resp)-20)%6)
+
+	resp = s.handle(addr, newReq("invalid"))
+	require.Equal(t, uint32(actionError), binary.BigEndian.Uint32(resp[0:4]))
+	require.Equal(t, msgInvalidAuth, string(resp[8:]))
+}
+
+func TestServer_AnnounceStoppedInWindow(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 60
+	tkr.RateLimitInterval = time.Minute
+	tkr.MinIntervalEnforce = true
+	s := NewServer(tkr, "")
+	addr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 6881}
+	connID := connect(t, s)
+	peerID := model.PeerIDFromString("-XX0001-123456789012")
+	newReq := func(evt event) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], uint32(actionAnnounce))
+		binary.BigEndian.PutUint32(req[12:16], 2)
+		copy(req[16:36], torrents[0].InfoHash[:])
+		copy(req[36:56], peerID[:])
+		binary.BigEndian.PutUint32(req[80:84], uint32(evt))
+		binary.BigEndian.PutUint32(req[92:96], 0xffffffff)
+		binary.BigEndian.PutUint16(req[96:98], 6881)
+		path := "/" + users[0].Passkey + "/announce"
+		req = append(req, optionURLData, byte(len(path)))
+		return append(req, path...)
+	}
+	resp := s.handle(addr, newReq(eventStarted))
+	require.Equal(t, uint32(actionAnnounce), binary.BigEndian.Uint32(resp[0:4]), string(resp[8:]))
+	resp = s.handle(addr, newReq(eventNone))
+	require.Equal(t, msgRateLimited, string(resp[8:]))
+	resp = s.handle(addr, newReq(eventStopped))
+	require.Equal(t, uint32(actionAnnounce), binary.BigEndian.Uint32(resp[0:4]), string(resp[8:]))
+	_, err := tkr.Peers.Get(torrents[0].InfoHash, peerID)
+	require.Error(t, err, "Stopped peer should have left the swarm")
+}
+
+func TestServer_Scrape(t *testing.T) {
+	config.Read("")
+	tkr, torrents, _, _ := tracker.NewTestTracker()
+	tkr.ScrapeMaxHashes = 2
+	s := NewServer(tkr, "")
+	addr := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 6881}
+	connID := connect(t, s)
+	newReq := func(count int) []byte {
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], uint32(actionScrape))
+		binary.BigEndian.PutUint32(req[12:16], 3)
+		for i := 0; i < count; i++ {
+			req = append(req, torrents[i].InfoHash[:]...)
+		}
+		return req
+	}
+	resp := s.handle(addr, newReq(2))
+	require.Len(t, resp, 8+2*12)
+	require.Equal(t, uint32(actionScrape), binary.BigEndian.Uint32(resp[0:4]))
+	require.Equal(t, uint32(3), binary.BigEndian.Uint32(resp[4:8]))
+
+	resp = s.handle(addr, newReq(3))
+	require.Equal(t, uint32(actionError), binary.BigEndian.Uint32(resp[0:4]))
+
+	tkr.ScrapeTruncate = true
+	resp = s.handle(addr, newReq(3))
+	require.Len(t, resp, 8+2*12)
+}
+
+func TestParsePasskey(t *testing.T) {
+	opts := []byte{optionNOP, optionURLData, 4}
+	opts = append(opts, "/abc"...)
+	opts = append(opts, optionURLData, 9)
+	opts = append(opts, "/announce"...)
+	opts = append(opts, optionEndOfOptions)
+	require.Equal(t, "abc", parsePasskey(opts))
+	require.Equal(t, "", parsePasskey(nil))
+	require.Equal(t, "", parsePasskey([]byte{optionURLData, 10, 'a'}))
+}
@@ -18,7 +18,7 @@ func StringToInt16(s string, def int16) int16 {
 
 // StringToUInt16 converts a string to a uint16 returning a default value on failure
 func StringToUInt16(s string, def uint16) uint16 {
-	v, err := strconv.ParseInt(s, 10, 16)
+	v, err := strconv.ParseUint(s, 10, 16)
 	if err != nil {
 		log.Warnf("failed to parse uint16 value from redis: %s", s)
 		return def
@@ -28,7 +28,7 @@ func StringToUInt16(s string, def uint16) uint16 {
 
 // StringToUInt32 converts a string to a uint32 returning a default value on failure
 func StringToUInt32(s string, def uint32) uint32 {
-	v, err := strconv.ParseInt(s, 10, 32)
+	v, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
 		log.Warnf("failed to parse uint32 value from redis: %s", s)
 		return def
@@ -36,6 +36,16 @@ func StringToUInt32(s string, def uint32) uint32 {
 	return uint32(v)
 }
 
+// StringToUInt64 converts a string to a uint64 returning a default value on failure
+func StringToUInt64(s string, def uint64) uint64 {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		log.Warnf("failed to parse uint64 value from redis: %s", s)
+		return def
+	}
+	return v
+}
+
 // StringToFloat64 converts a string to a float64 returning a default value on failure
 func StringToFloat64(s string, def float64) float64 {
 	v, err := strconv.ParseFloat(s, 64)
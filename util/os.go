@@ -13,12 +13,31 @@ import (
 // This is mostly designed to shutdown & cleanup services
 func WaitForSignal(ctx context.Context, f func(ctx context.Context) error) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	select {
 	case <-sigChan:
-		c, _ := context.WithDeadline(ctx, time.Now().Add(time.Second*5))
+		c, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*5))
+		defer cancel()
 		if err := f(c); err != nil {
 			log.Fatalf("Error closing servers gracefully; %s", err)
 		}
 	}
 }
+
+// ReloadOnSignal will execute a function every time a SIGHUP is received until the
+// context is cancelled. This is used to reload data without restarting.
+func ReloadOnSignal(ctx context.Context, f func() error) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			if err := f(); err != nil {
+				log.Errorf("Failed to reload: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
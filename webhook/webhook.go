@@ -0,0 +1,117 @@
+// Package webhook provides a async dispatcher used to POST json encoded events to a
+// remote http endpoint without blocking the caller.
+//
+// Each request is signed using a HMAC-SHA256 of the request body using a shared secret. The
+// hex encoded signature is sent in the SignatureHeader header so receivers can verify the origin.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/leighmacdonald/mika/consts"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader is the header containing the HMAC signature of the body
+const SignatureHeader = "X-Mika-Signature"
+
+// Dispatcher queues and delivers webhook payloads in the background
+type Dispatcher struct {
+	url     string
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan []byte
+}
+
+// NewDispatcher creates a new dispatcher which will deliver payloads to the url provided.
+// Failed deliveries are retried up to retries times with a exponential backoff.
+func NewDispatcher(url string, secret string, retries int, queueSize int) *Dispatcher {
+	return &Dispatcher{
+		url:     url,
+		secret:  []byte(secret),
+		retries: retries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan []byte, queueSize),
+	}
+}
+
+// Send encodes and queues the payload for delivery. If the queue is full the payload
+// is dropped so that the caller is never blocked.
+func (d *Dispatcher) Send(payload interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("Failed to encode webhook payload: %s", err.Error())
+		return
+	}
+	select {
+	case d.queue <- b:
+	default:
+		log.Warnf("Webhook queue full, dropping payload")
+	}
+}
+
+// Start will deliver queued payloads until the context is cancelled
+func (d *Dispatcher) Start(ctx context.Context) {
+	for {
+		select {
+		case body := <-d.queue:
+			d.deliver(ctx, body)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, body []byte) {
+	backoff := d.backoff
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return
+			}
+		}
+		err := d.post(body)
+		if err == nil {
+			return
+		}
+		log.Debugf("Webhook delivery attempt %d failed: %s", attempt+1, err.Error())
+	}
+	log.Warnf("Dropping webhook payload after %d failed attempts", d.retries+1)
+}
+
+func (d *Dispatcher) post(body []byte) error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(d.secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return consts.ErrInvalidResponseCode
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of the body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
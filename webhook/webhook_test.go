@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	secret := "secret"
+	received := make(chan map[string]interface{}, 1)
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// Fail the first attempt to exercise the retry path
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		require.Equal(t, Sign([]byte(secret), body), r.Header.Get(SignatureHeader))
+		var v map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &v))
+		received <- v
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewDispatcher(ts.URL, secret, 2, 10)
+	d.backoff = time.Millisecond
+	go d.Start(ctx)
+	d.Send(map[string]interface{}{"user_id": 10})
+	select {
+	case v := <-received:
+		require.Equal(t, float64(10), v["user_id"])
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for webhook delivery")
+	}
+	require.Equal(t, 2, attempts)
+}
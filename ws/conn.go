@@ -0,0 +1,214 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opText  byte = 0x1
+	opClose byte = 0x8
+	opPing  byte = 0x9
+	opPong  byte = 0xa
+
+	// handshakeGUID is appended to the client key to calculate the accept header (RFC 6455 1.3)
+	handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxMessageSize is the largest message accepted from a client. SDP offers are
+	// usually only a few KB, even when a client sends several at once.
+	maxMessageSize = 64 << 10
+
+	// writeTimeout limits how long a slow client can block writers relaying messages to it
+	writeTimeout = 5 * time.Second
+)
+
+var (
+	errNotWebsocket    = errors.New("ws: not a websocket handshake")
+	errUnmasked        = errors.New("ws: client frames must be masked")
+	errMessageTooLarge = errors.New("ws: message too large")
+)
+
+// conn is a minimal server side RFC 6455 websocket connection supporting the text messages
+// used by WebTorrent clients. Reads must only be done from a single goroutine, writes are
+// safe for concurrent use.
+type conn struct {
+	nc      net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// headerContains checks for a token in a comma separated header value, ignoring case
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptKey calculates the Sec-WebSocket-Accept value for the client key
+func acceptKey(key string) string {
+	h := sha1.New()
+	_, _ = h.Write([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// upgrade performs the opening handshake and takes over the underlying connection. An error
+// response has already been sent to the client when an error is returned.
+func upgrade(w http.ResponseWriter, r *http.Request) (*conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Websocket upgrade required", http.StatusBadRequest)
+		return nil, errNotWebsocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errNotWebsocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websocket upgrade unavailable", http.StatusInternalServerError)
+		return nil, errors.New("ws: connection does not support hijacking")
+	}
+	nc, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "ws: failed to hijack connection")
+	}
+	// Clear any deadlines set by the http server, they are managed per message from here on
+	_ = nc.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := nc.Write([]byte(resp)); err != nil {
+		_ = nc.Close()
+		return nil, errors.Wrap(err, "ws: failed to write handshake")
+	}
+	return &conn{nc: nc, br: rw.Reader}, nil
+}
+
+// readFrame reads and unmasks a single frame
+func (c *conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0f
+	if hdr[1]&0x80 == 0 {
+		err = errUnmasked
+		return
+	}
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxMessageSize {
+		err = errMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next complete data message, answering any pings received while
+// waiting for it. io.EOF is returned once the client closes the connection.
+func (c *conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			_ = c.writeFrame(opClose, nil)
+			return nil, io.EOF
+		}
+		msg = append(msg, payload...)
+		if len(msg) > maxMessageSize {
+			return nil, errMessageTooLarge
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// writeFrame sends a single unfragmented, unmasked frame
+func (c *conn) writeFrame(op byte, payload []byte) error {
+	buf := make([]byte, 0, len(payload)+10)
+	buf = append(buf, 0x80|op)
+	switch size := len(payload); {
+	case size < 126:
+		buf = append(buf, byte(size))
+	case size <= 0xffff:
+		buf = append(buf, 126, byte(size>>8), byte(size))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		buf = append(append(buf, 127), ext[:]...)
+	}
+	buf = append(buf, payload...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write(buf)
+	return err
+}
+
+// WriteJSON encodes v and sends it as a text message
+func (c *conn) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(opText, b)
+}
+
+// Close closes the underlying connection without sending a close frame
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,536 @@
+// Package ws implements the WebTorrent websocket tracker protocol used by browser clients
+//
+// https://github.com/webtorrent/bittorrent-tracker
+//
+// Browser peers are unable to accept incoming connections so instead of returning a list
+// of peers the tracker relays WebRTC offers and answers between the peers connected to it.
+// The peers are still stored in the swarm so they count towards the scrape totals, but with
+// a port of 0 so they are never returned to regular http or udp clients.
+//
+// Authentication uses the same passkey path as the http tracker, eg:
+// wss://tracker:34003/<passkey>/announce
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/tracker"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	msgMalformedRequest = "Malformed request"
+	msgInvalidAction    = "Invalid action"
+	msgInvalidAuth      = "Invalid passkey supplied"
+	msgInvalidInfoHash  = "Invalid info hash"
+	msgInvalidClient    = "Client not allowed"
+	msgRatioTooLow      = "Ratio too low"
+	msgCorruptTooHigh   = "Too much corrupt data reported"
+	msgBanned           = "Banned"
+	msgShuttingDown     = "Tracker shutting down"
+	msgRateLimited      = "Rate limited"
+	msgTorrentDisabled  = "Torrent has been disabled"
+	msgInvalidLeft      = "Invalid left"
+	msgTooManyPeers     = "Too many active peers for this torrent"
+	msgSlotsFull        = "Download slots full, retry later"
+	msgDatacenter       = "Datacenter peers are not allowed on this torrent"
+	msgGenericError     = "Internal tracker error"
+
+	actionAnnounce = "announce"
+)
+
+type offer struct {
+	OfferID string          `json:"offer_id"`
+	Offer   json.RawMessage `json:"offer"`
+}
+
+type announceRequest struct {
+	Action     string          `json:"action"`
+	InfoHash   string          `json:"info_hash"`
+	PeerID     string          `json:"peer_id"`
+	NumWant    int             `json:"numwant"`
+	Uploaded   uint64          `json:"uploaded"`
+	Downloaded uint64          `json:"downloaded"`
+	Left       uint64          `json:"left"`
+	Event      string          `json:"event"`
+	Offers     []offer         `json:"offers"`
+	Answer     json.RawMessage `json:"answer"`
+	OfferID    string          `json:"offer_id"`
+	ToPeerID   string          `json:"to_peer_id"`
+}
+
+type announceResponse struct {
+	Action     string `json:"action"`
+	InfoHash   string `json:"info_hash"`
+	Interval   int    `json:"interval"`
+	Complete   uint   `json:"complete"`
+	Incomplete uint   `json:"incomplete"`
+	Warning    string `json:"warning message,omitempty"`
+}
+
+type failureResponse struct {
+	Action        string `json:"action,omitempty"`
+	InfoHash      string `json:"info_hash,omitempty"`
+	FailureReason string `json:"failure reason"`
+}
+
+// relayMessage delivers an offer or answer from one peer to another
+type relayMessage struct {
+	Action   string          `json:"action"`
+	InfoHash string          `json:"info_hash"`
+	PeerID   string          `json:"peer_id"`
+	OfferID  string          `json:"offer_id"`
+	Offer    json.RawMessage `json:"offer,omitempty"`
+	Answer   json.RawMessage `json:"answer,omitempty"`
+}
+
+// decodeID converts the "binary string" encoding used by WebTorrent clients, where each
+// byte is sent as a single code point, back to the raw 20 byte info hash or peer id
+func decodeID(s string) ([20]byte, bool) {
+	var id [20]byte
+	i := 0
+	for _, r := range s {
+		if i == len(id) || r > 0xff {
+			return id, false
+		}
+		id[i] = byte(r)
+		i++
+	}
+	return id, i == len(id)
+}
+
+// encodeID is the inverse of decodeID
+func encodeID(id [20]byte) string {
+	r := make([]rune, len(id))
+	for i, b := range id {
+		r[i] = rune(b)
+	}
+	return string(r)
+}
+
+// eventLabel returns the name used for the event in metrics
+func eventLabel(event string) string {
+	if event == "" {
+		return "regular"
+	}
+	return event
+}
+
+// Server is the websocket interface for the tracker handling WebTorrent announces
+type Server struct {
+	t   *tracker.Tracker
+	srv *http.Server
+
+	mu      sync.RWMutex
+	closing bool
+	conns   map[*conn]struct{}
+	// swarms maps the peers in each swarm to their connection so offers can be relayed
+	swarms map[model.InfoHash]map[model.PeerID]*conn
+}
+
+// NewServer creates a new websocket tracker server which will listen on the addr supplied
+func NewServer(t *tracker.Tracker, addr string) *Server {
+	s := &Server{
+		t:      t,
+		conns:  make(map[*conn]struct{}),
+		swarms: make(map[model.InfoHash]map[model.PeerID]*conn),
+	}
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+	}
+	return s
+}
+
+// ListenAndServe listens for plain websocket connections until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	return s.srv.ListenAndServe()
+}
+
+// ListenAndServeTLS listens for secure websocket connections until Shutdown is called.
+// Browsers only allow pages served over https to connect to wss:// trackers.
+func (s *Server) ListenAndServeTLS(certFile string, keyFile string) error {
+	return s.srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Shutdown stops accepting new connections and closes all connected clients
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	return s.srv.Shutdown(ctx)
+}
+
+// ServeHTTP authenticates and upgrades new connections
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "announce" {
+		http.NotFound(w, r)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, msgMalformedRequest, http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || s.t.IsBanned(ip) {
+		http.Error(w, msgBanned, http.StatusForbidden)
+		return
+	}
+	usr, err := s.t.UserByPasskey(parts[0])
+	if err != nil {
+		http.Error(w, msgInvalidAuth, http.StatusForbidden)
+		return
+	}
+	c, err := upgrade(w, r)
+	if err != nil {
+		log.Debugf("Failed to upgrade websocket connection: %s", err.Error())
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	s.serve(c, usr, ip)
+}
+
+// serve reads announces from the client until it disconnects
+func (s *Server) serve(c *conn, usr *model.User, ip net.IP) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	// The swarms joined over this connection, the peers are removed once it closes
+	joined := make(map[model.InfoHash]model.PeerID)
+	defer s.disconnect(c, joined)
+	idleTimeout := time.Duration(s.t.AnnInterval*2) * time.Second
+	for {
+		if idleTimeout > 0 {
+			_ = c.nc.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		msg, err := c.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("Closing websocket connection: %s", err.Error())
+			}
+			return
+		}
+		var req announceRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			_ = c.WriteJSON(failureResponse{FailureReason: msgMalformedRequest})
+			continue
+		}
+		if req.Action != actionAnnounce {
+			_ = c.WriteJSON(failureResponse{Action: req.Action, FailureReason: msgInvalidAction})
+			continue
+		}
+		if !s.t.StartAnnounce() {
+			_ = c.WriteJSON(failureResponse{Action: req.Action, FailureReason: msgShuttingDown})
+			return
+		}
+		resp := s.announce(c, usr, ip, &req, joined)
+		s.t.FinishAnnounce()
+		if resp == nil {
+			continue
+		}
+		if _, failed := resp.(failureResponse); failed {
+			metrics.AnnounceRejectedTotal.Inc()
+		} else {
+			metrics.AnnounceTotal.WithLabelValues(eventLabel(req.Event)).Inc()
+		}
+		if err := c.WriteJSON(resp); err != nil {
+			log.Debugf("Failed to write websocket response: %s", err.Error())
+			return
+		}
+	}
+}
+
+// announce handles a single announce message. Answers to a previously relayed offer are only
+// forwarded to the peer which made the offer and do not update the swarm, in which case nil
+// is returned as there is no response.
+func (s *Server) announce(c *conn, usr *model.User, ip net.IP, req *announceRequest,
+	joined map[model.InfoHash]model.PeerID) interface{} {
+	fail := func(reason string) failureResponse {
+		return failureResponse{Action: actionAnnounce, InfoHash: req.InfoHash, FailureReason: reason}
+	}
+	ih, ok := decodeID(req.InfoHash)
+	if !ok {
+		return fail(msgInvalidInfoHash)
+	}
+	pid, ok := decodeID(req.PeerID)
+	if !ok {
+		return fail(msgMalformedRequest)
+	}
+	peerID := model.PeerID(pid)
+	clientName, validClient := s.t.IsValidClient(peerID)
+	if !validClient {
+		if s.t.RejectClientMsg != "" {
+			return fail(s.t.RejectClientMsg)
+		}
+		return fail(msgInvalidClient)
+	}
+	if req.Answer != nil {
+		s.relayAnswer(ih, peerID, req)
+		return nil
+	}
+	if req.Left > 0 && !usr.RatioAllowed(s.t.MinRatio, s.t.MinRatioGrace) {
+		return fail(msgRatioTooLow)
+	}
+	if req.Left > 0 && !s.t.CorruptAllowed(usr) {
+		return fail(msgCorruptTooHigh)
+	}
+	tor, err := s.t.TorrentForAnnounce(ih)
+	if err != nil || tor.IsDeleted {
+		if s.t.UnregisteredMsg != "" {
+			return fail(s.t.UnregisteredMsg)
+		}
+		return fail(msgInvalidInfoHash)
+	}
+	if !tor.IsEnabled {
+		if tor.Reason != "" {
+			return fail(tor.Reason)
+		}
+		return fail(msgTorrentDisabled)
+	}
+	if !s.t.DatacenterAllowed(tor, usr, ip) {
+		return fail(msgDatacenter)
+	}
+	// Rejected announces are not counted as activity of the torrent
+	s.t.CountAnnounce(tor.InfoHash)
+	s.t.TouchTorrent(tor)
+	var ipv6 net.IP
+	if ip.To4() == nil {
+		ipv6 = ip
+	}
+	peer, err := s.t.Peers.Get(tor.InfoHash, peerID)
+	if !s.t.ValidLeft(tor, peer, uint32(req.Downloaded), uint32(req.Left)) {
+		return fail(msgInvalidLeft)
+	}
+	if err != nil {
+		if !s.t.UserPeersAllowed(tor, usr.UserID) {
+			return fail(msgTooManyPeers)
+		}
+		if !s.t.DownloadSlotAvailable(tor, uint32(req.Left)) {
+			return fail(msgSlotsFull)
+		}
+		// Websocket peers are stored without a port so they are never handed out to
+		// regular clients which would be unable to connect to them
+		peer = model.NewPeer(usr.UserID, peerID, ip, 0)
+		s.t.LocatePeer(peer)
+		peer.IPv6 = ipv6
+		peer.Client = clientName
+		s.t.EvictPeers(tor)
+		if err := s.t.Peers.Add(tor.InfoHash, peer); err != nil {
+			log.Errorf("Failed to insert peer into swarm: %s", err.Error())
+			return fail(msgGenericError)
+		}
+		s.t.PeerListChanged(tor.InfoHash)
+	} else if (req.Event == "" || req.Event == "paused") && s.t.IsRateLimited(peer) {
+		// Only regular announces are limited, event announces are always accepted
+		return fail(msgRateLimited)
+	}
+	peer.UpdateAddr(ip, ipv6)
+	if err := s.t.AccrueBonus(usr, tor, peer); err != nil {
+		log.Errorf("Failed to update user bonus points: %s", err.Error())
+	}
+	prevUp, prevDn := peer.Speed()
+	ulDiff, dlDiff := peer.Update(uint32(req.Uploaded), uint32(req.Downloaded), uint32(req.Left))
+	peer.SetPaused(req.Event == "paused")
+	peer.UpdateHNRExempt(s.t.HNRThresholdFor(tor))
+	s.t.FlagResets(peer)
+	s.t.RecordAnnounce(tor.InfoHash, peer)
+	ulDiff = s.t.LimitUpload(usr, peer, ulDiff)
+	if err := s.t.AccountTransfer(usr, tor, ulDiff, dlDiff); err != nil {
+		log.Errorf("Failed to update user transfer totals: %s", err.Error())
+	}
+	s.t.RunHooks(peer, &tracker.AnnounceRequest{
+		InfoHash:   tor.InfoHash,
+		PeerID:     peerID,
+		UserID:     usr.UserID,
+		Event:      req.Event,
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		IP:         ip,
+	}, uint64(ulDiff), uint64(dlDiff))
+	switch req.Event {
+	case "completed":
+		if err := s.t.PeerCompleted(tor, peer); err != nil {
+			log.Errorf("Failed to update torrent completed count: %s", err.Error())
+		}
+	case "stopped":
+		s.untrack(tor.InfoHash, peerID, c)
+		delete(joined, tor.InfoHash)
+		if err := s.t.Peers.Delete(tor.InfoHash, peer); err != nil {
+			log.Errorf("Could not remove peer from swarm: %s", err.Error())
+			return fail(msgGenericError)
+		}
+		s.t.PeerListChanged(tor.InfoHash)
+		if peer.IsHNR(s.t.HNRThresholdFor(tor)) {
+			s.t.AddHNR(tor, peer)
+		}
+	}
+	up, dn := peer.Speed()
+	if req.Event == "stopped" {
+		up, dn = 0, 0
+	}
+	if err := s.t.AccountSpeed(usr.UserID, prevUp, prevDn, up, dn); err != nil {
+		log.Errorf("Failed to update user speed: %s", err.Error())
+	}
+	if req.Event != "stopped" {
+		if err := s.t.Peers.Update(tor.InfoHash, peer); err != nil {
+			log.Errorf("Failed to sync peer: %s", err.Error())
+		}
+		s.track(tor.InfoHash, peerID, c)
+		joined[tor.InfoHash] = peerID
+		s.relayOffers(tor.InfoHash, peerID, req)
+	}
+	seeders, leechers, err := s.t.Peers.CountsOnly(tor.InfoHash)
+	if err != nil {
+		log.Errorf("Could not read swarm counts: %s", err.Error())
+	}
+	// The counts include the announcing peer unless it just left the swarm
+	others := int(seeders + leechers)
+	if req.Event != "stopped" && others > 0 {
+		others--
+	}
+	interval, _ := s.t.SwarmIntervals(peer.Left, others)
+	return announceResponse{
+		Action:     actionAnnounce,
+		InfoHash:   req.InfoHash,
+		Interval:   interval,
+		Complete:   seeders,
+		Incomplete: leechers,
+		Warning:    s.t.ClientWarning(peerID),
+	}
+}
+
+// relayOffers sends each offer to a different peer connected to the swarm
+func (s *Server) relayOffers(ih model.InfoHash, from model.PeerID, req *announceRequest) {
+	offers := req.Offers
+	if req.NumWant >= 0 && req.NumWant < len(offers) {
+		offers = offers[:req.NumWant]
+	}
+	if s.t.MaxPeers > 0 && len(offers) > s.t.MaxPeers {
+		offers = offers[:s.t.MaxPeers]
+	}
+	if len(offers) == 0 {
+		return
+	}
+	// Map iteration order is random, so the offers are spread across the swarm
+	var targets []*conn
+	s.mu.RLock()
+	for peerID, target := range s.swarms[ih] {
+		if len(targets) == len(offers) {
+			break
+		}
+		if peerID != from {
+			targets = append(targets, target)
+		}
+	}
+	s.mu.RUnlock()
+	for i, target := range targets {
+		err := target.WriteJSON(relayMessage{
+			Action:   actionAnnounce,
+			InfoHash: encodeID(ih),
+			PeerID:   encodeID(from),
+			OfferID:  offers[i].OfferID,
+			Offer:    offers[i].Offer,
+		})
+		if err != nil {
+			log.Debugf("Failed to relay offer: %s", err.Error())
+		}
+	}
+}
+
+// relayAnswer sends the answer back to the peer which made the offer
+func (s *Server) relayAnswer(ih model.InfoHash, from model.PeerID, req *announceRequest) {
+	to, ok := decodeID(req.ToPeerID)
+	if !ok {
+		return
+	}
+	s.mu.RLock()
+	target, found := s.swarms[ih][model.PeerID(to)]
+	s.mu.RUnlock()
+	if !found {
+		return
+	}
+	err := target.WriteJSON(relayMessage{
+		Action:   actionAnnounce,
+		InfoHash: encodeID(ih),
+		PeerID:   encodeID(from),
+		OfferID:  req.OfferID,
+		Answer:   req.Answer,
+	})
+	if err != nil {
+		log.Debugf("Failed to relay answer: %s", err.Error())
+	}
+}
+
+func (s *Server) track(ih model.InfoHash, peerID model.PeerID, c *conn) {
+	s.mu.Lock()
+	if s.swarms[ih] == nil {
+		s.swarms[ih] = make(map[model.PeerID]*conn)
+	}
+	s.swarms[ih][peerID] = c
+	s.mu.Unlock()
+}
+
+// untrack removes the peers connection from the swarm, returning false if the peer has
+// since reconnected using another connection
+func (s *Server) untrack(ih model.InfoHash, peerID model.PeerID, c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.swarms[ih][peerID] != c {
+		return false
+	}
+	delete(s.swarms[ih], peerID)
+	if len(s.swarms[ih]) == 0 {
+		delete(s.swarms, ih)
+	}
+	return true
+}
+
+// disconnect closes the connection and removes its peers from the swarms they joined, as
+// they can no longer receive offers
+func (s *Server) disconnect(c *conn, joined map[model.InfoHash]model.PeerID) {
+	_ = c.Close()
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	for ih, peerID := range joined {
+		if !s.untrack(ih, peerID, c) {
+			continue
+		}
+		peer, err := s.t.Peers.Get(ih, peerID)
+		if err != nil {
+			continue
+		}
+		if err := s.t.Peers.Delete(ih, peer); err != nil {
+			log.Errorf("Could not remove peer from swarm: %s", err.Error())
+			continue
+		}
+		s.t.PeerListChanged(ih)
+		up, dn := peer.Speed()
+		if err := s.t.AccountSpeed(peer.UserID, up, dn, 0, 0); err != nil {
+			log.Errorf("Failed to remove peer speed: %s", err.Error())
+		}
+	}
+}
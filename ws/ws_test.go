@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/model"
+	"github.com/leighmacdonald/mika/tracker"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+func dial(t *testing.T, srv *httptest.Server, path string) (*testClient, *http.Response) {
+	nc, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	_, err = nc.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		require.Equal(t, acceptKey(key), resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &testClient{t: t, nc: nc, br: br}, resp
+}
+
+func (c *testClient) send(v interface{}) {
+	payload, err := json.Marshal(v)
+	require.NoError(c.t, err)
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opText}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err = c.nc.Write(frame)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) read() map[string]interface{} {
+	require.NoError(c.t, c.nc.SetReadDeadline(time.Now().Add(time.Second)))
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(c.br, hdr)
+	require.NoError(c.t, err)
+	size := int(hdr[1] & 0x7f)
+	if size == 126 {
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.br, ext)
+		require.NoError(c.t, err)
+		size = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	var msg map[string]interface{}
+	require.NoError(c.t, json.Unmarshal(payload, &msg))
+	return msg
+}
+
+func TestDecodeID(t *testing.T) {
+	var ih model.InfoHash
+	for i := range ih {
+		ih[i] = byte(i * 13)
+	}
+	decoded, ok := decodeID(encodeID(ih))
+	require.True(t, ok)
+	require.Equal(t, ih, model.InfoHash(decoded))
+	_, ok = decodeID("too short")
+	require.False(t, ok)
+	_, ok = decodeID(strings.Repeat("Ā", 20))
+	require.False(t, ok)
+}
+
+func TestServer_Announce(t *testing.T) {
+	config.Read("")
+	tkr, torrents, users, _ := tracker.NewTestTracker()
+	tkr.AnnIntervalMin = 0
+	s := NewServer(tkr, "")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	_, resp := dial(t, srv, "/xxxxxxxxxxxxxxxxxxxx/announce")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ih := encodeID(torrents[0].InfoHash)
+	seeder, resp := dial(t, srv, "/"+users[0].Passkey+"/announce")
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	seederID := encodeID(model.PeerIDFromString("-WW0001-aaaaaaaaaaaa"))
+	seeder.send(map[string]interface{}{
+		"action": "announce", "info_hash": ih, "peer_id": seederID, "left": 0, "event": "started",
+	})
+	msg := seeder.read()
+	require.Equal(t, ih, msg["info_hash"], msg)
+	_, found := msg["failure reason"]
+	require.False(t, found, msg)
+
+	leecher, resp := dial(t, srv, "/"+users[0].Passkey+"/announce")
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	leecherID := encodeID(model.PeerIDFromString("-WW0001-bbbbbbbbbbbb"))
+	leecher.send(map[string]interface{}{
+		"action": "announce", "info_hash": ih, "peer_id": leecherID, "left": 100, "event": "started",
+		"numwant": 5, "offers": []map[string]interface{}{
+			{"offer_id": "offer1", "offer": map[string]string{"type": "offer", "sdp": "v=0"}},
+		},
+	})
+	require.Equal(t, ih, leecher.read()["info_hash"])
+
+	// The offer is relayed to the other websocket peer in the swarm
+	relayed := seeder.read()
+	require.Equal(t, "offer1", relayed["offer_id"])
+	require.Equal(t, leecherID, relayed["peer_id"])
+	require.Equal(t, "v=0", relayed["offer"].(map[string]interface{})["sdp"])
+
+	// And the answer is relayed back to the peer which made the offer
+	seeder.send(map[string]interface{}{
+		"action": "announce", "info_hash": ih, "peer_id": seederID, "to_peer_id": leecherID,
+		"offer_id": "offer1", "answer": map[string]string{"type": "answer", "sdp": "v=0"},
+	})
+	answer := leecher.read()
+	require.Equal(t, "offer1", answer["offer_id"])
+	require.Equal(t, seederID, answer["peer_id"])
+
+	peer, err := tkr.Peers.Get(torrents[0].InfoHash, model.PeerIDFromString("-WW0001-aaaaaaaaaaaa"))
+	require.NoError(t, err, "Websocket peers are part of the swarm")
+	require.Equal(t, uint16(0), peer.Port)
+
+	// Disconnected peers are removed from the swarm
+	require.NoError(t, seeder.nc.Close())
+	for i := 0; i < 100; i++ {
+		if _, err = tkr.Peers.Get(torrents[0].InfoHash, peer.PeerID); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Error(t, err)
+}